@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
@@ -26,6 +27,8 @@ import (
 type ContainerAPI interface {
 	CreateExecInPodgRPC(context.Context, string, *config.KubeExecConfig) error
 	WriteFileInPodgRPC(context.Context, string, *config.KubeFileWriteConfig) error
+	CreateSocketForwardInPodgRPC(context.Context, string, *config.KubeSocketForwardConfig) error
+	ServeSFTPInPodgRPC(context.Context, string, *config.KubeSFTPConfig) error
 }
 
 // API is the API.
@@ -99,15 +102,19 @@ func (a *API) CreateExecInPodgRPC(ctx context.Context, endpoint string, conf *co
 	}
 	defer conn.Close()
 	client := manageproto.NewAPIClient(conn)
-	resp, err := client.ExecCommandStream(ctx)
+	stream, err := client.ExecCommandStream(ctx)
 	if err != nil {
 		return err
 	}
+	// the sender and the terminal size handler share the stream
+	resp := &lockedExecStream{API_ExecCommandStreamClient: stream}
 	err = resp.Send(&manageproto.ExecCommandStreamRequest{
 		Content: &manageproto.ExecCommandStreamRequest_Command{
 			Command: &manageproto.ExecCommandRequest{
 				Command: conf.Command,
+				Args:    conf.Args,
 				Tty:     conf.Tty,
+				Env:     conf.Env,
 			},
 		},
 	})
@@ -117,8 +124,13 @@ func (a *API) CreateExecInPodgRPC(ctx context.Context, endpoint string, conf *co
 
 	ctx, cancel := context.WithCancel(ctx)
 	g, ctx := errgroup.WithContext(ctx)
+	// the exit code wins over the errors the other goroutines return after the receiver cancelled them
+	var exitErr syscall.Errno
+	exited := false
 	g.Go(func() error {
-		return a.receiver(ctx, cancel, resp, conf.Communication, conf.Communication)
+		err := a.receiver(ctx, cancel, resp, conf.Communication, conf.Communication)
+		exited = errors.As(err, &exitErr)
+		return err
 	})
 	g.Go(func() error {
 		return a.sender(ctx, resp, conf.Communication)
@@ -129,9 +141,32 @@ func (a *API) CreateExecInPodgRPC(ctx context.Context, endpoint string, conf *co
 	a.logger.Debug("waiting for exec to finish")
 	err = g.Wait()
 	a.logger.Debug("g wait returned")
+	if exited {
+		return exitErr
+	}
 	return err
 }
 
+// lockedExecStream serializes the sends on the stream, gRPC does not allow concurrent sends.
+type lockedExecStream struct {
+	manageproto.API_ExecCommandStreamClient
+	mut sync.Mutex
+}
+
+// Send sends the request.
+func (s *lockedExecStream) Send(req *manageproto.ExecCommandStreamRequest) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.API_ExecCommandStreamClient.Send(req)
+}
+
+// CloseSend closes the sending direction of the stream.
+func (s *lockedExecStream) CloseSend() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.API_ExecCommandStreamClient.CloseSend()
+}
+
 func (a *API) termSizeHandler(ctx context.Context, resp manageproto.API_ExecCommandStreamClient, resizeData remotecommand.TerminalSizeQueue) error {
 	queue := make(chan *remotecommand.TerminalSize, 1)
 	go func() {
@@ -218,8 +253,11 @@ func (a *API) sender(ctx context.Context, resp manageproto.API_ExecCommandStream
 		for {
 			n, err := stdin.Read(copier)
 			if err == io.EOF {
+				// the command reads EOF as well and keeps running, the receiver ends the exec with its exit code
 				a.logger.Info("received EOF from stdin")
-				errChan <- err
+				if err := resp.CloseSend(); err != nil {
+					errChan <- err
+				}
 				return
 			}
 			if err != nil {
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package containerapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/benschlueter/delegatio/agent/manageapi"
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestCreateExecInPodgRPC(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		args             []string
+		stdin            string
+		expectOutput     string
+		expectExitStatus syscall.Errno
+	}{
+		"stdin closed": {
+			args:         []string{"-c", "cat"},
+			stdin:        "input",
+			expectOutput: "input",
+		},
+		"no stdin": {
+			args:         []string{"-c", "echo done"},
+			expectOutput: "done\n",
+		},
+		"exit code": {
+			args:             []string{"-c", "exit 3"},
+			expectExitStatus: 3,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			listener := bufconn.Listen(1024 * 1024)
+			server := grpc.NewServer()
+			manageproto.RegisterAPIServer(server, manageapi.New(zap.NewNop(), nil, nil))
+			go server.Serve(listener)
+			defer server.GracefulStop()
+
+			api := New(zap.NewNop(), nil, &bufconnDialer{listener: listener})
+			channel := &bufferChannel{stdin: strings.NewReader(tc.stdin)}
+			sizes := &closingSizeQueue{done: make(chan struct{})}
+			defer close(sizes.done)
+			err := api.CreateExecInPodgRPC(context.Background(), "bufconn", &config.KubeExecConfig{
+				Command:       "sh",
+				Args:          tc.args,
+				Communication: channel,
+				WinQueue:      sizes,
+			})
+			var exitStatus syscall.Errno
+			require.True(errors.As(err, &exitStatus), "error %v is no exit status", err)
+			assert.Equal(tc.expectExitStatus, exitStatus)
+			assert.Equal(tc.expectOutput, channel.String())
+		})
+	}
+}
+
+// bufferChannel is a ssh.Channel reading the input from a reader and writing the output to a buffer.
+type bufferChannel struct {
+	ssh.Channel
+	stdin  io.Reader
+	mut    sync.Mutex
+	output bytes.Buffer
+}
+
+func (c *bufferChannel) Read(data []byte) (int, error) {
+	return c.stdin.Read(data)
+}
+
+func (c *bufferChannel) Write(data []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.output.Write(data)
+}
+
+func (c *bufferChannel) String() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.output.String()
+}
+
+// closingSizeQueue reports no terminal size until it is done.
+type closingSizeQueue struct {
+	done chan struct{}
+}
+
+func (q *closingSizeQueue) Next() *remotecommand.TerminalSize {
+	<-q.done
+	return nil
+}
@@ -0,0 +1,394 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package containerapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrQuotaExceeded is returned when a write would exceed the disk quota of the user.
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// quotaRestatBytes is the number of bytes a session may reserve before the disk usage of the home directory is read
+// again. Concurrent sessions of the user and changes made in a shell are thereby taken into account.
+const quotaRestatBytes = 8 << 20
+
+// ServeSFTPInPodgRPC serves the SFTP protocol on conf.Communication. All file operations are executed by the
+// agent in the pod. It blocks until the client closes the session or the context is cancelled.
+func (a *API) ServeSFTPInPodgRPC(ctx context.Context, endpoint string, conf *config.KubeSFTPConfig) error {
+	conn, err := a.dialInsecure(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client := manageproto.NewAPIClient(conn)
+	fs := &sftpFileSystem{
+		ctx:    ctx,
+		logger: a.logger,
+		client: client,
+		quota: &sftpQuota{
+			limit: conf.Quota,
+			diskUsage: func() (int64, error) {
+				usage, err := client.DiskUsage(ctx, &manageproto.DiskUsageRequest{Path: conf.HomeDirectory})
+				if err != nil {
+					return 0, err
+				}
+				return usage.Bytes, nil
+			},
+		},
+	}
+	if conf.Quota > 0 {
+		if err := fs.quota.refresh(); err != nil {
+			a.logger.Error("failed to get disk usage", zap.Error(err))
+			return err
+		}
+	}
+
+	server := sftp.NewRequestServer(conf.Communication, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}, sftp.WithStartDirectory(conf.HomeDirectory))
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// sftpFileSystem implements the sftp request handlers using the file API of the agent.
+type sftpFileSystem struct {
+	ctx    context.Context
+	logger *zap.Logger
+	client manageproto.APIClient
+	quota  *sftpQuota
+}
+
+// Fileread checks that the file exists and returns a reader for it.
+func (f *sftpFileSystem) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	info, err := f.stat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", r.Filepath)
+	}
+	return &sftpFileReader{fs: f, path: r.Filepath}, nil
+}
+
+// Filewrite opens a file for writing in the pod.
+func (f *sftpFileSystem) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+	var size int64
+	if info, err := f.stat(r.Filepath); err == nil {
+		size = info.Size()
+	}
+	ctx, cancel := context.WithCancel(f.ctx)
+	stream, err := f.client.WriteFileRange(ctx)
+	if err != nil {
+		cancel()
+		return nil, sftpError(err)
+	}
+	if err := stream.Send(&manageproto.WriteFileRangeRequest{
+		Content: &manageproto.WriteFileRangeRequest_Header{
+			Header: &manageproto.WriteFileRangeHeader{
+				Path:      r.Filepath,
+				Create:    flags.Creat,
+				Truncate:  flags.Trunc,
+				Exclusive: flags.Excl,
+			},
+		},
+	}); err != nil {
+		cancel()
+		return nil, sftpError(err)
+	}
+	// the agent acknowledges the header once the file is opened
+	if _, err := stream.Recv(); err != nil {
+		cancel()
+		return nil, sftpError(err)
+	}
+	if flags.Trunc {
+		f.quota.release(size)
+		size = 0
+	}
+	return &sftpFileWriter{fs: f, stream: stream, cancel: cancel, size: size}, nil
+}
+
+// Filecmd executes file commands in the pod.
+func (f *sftpFileSystem) Filecmd(r *sftp.Request) error {
+	f.logger.Debug("sftp command", zap.String("method", r.Method), zap.String("path", r.Filepath))
+	var err error
+	switch r.Method {
+	case "Rename":
+		// an overwritten target no longer counts towards the quota
+		var size int64
+		if info, statErr := f.stat(r.Target); statErr == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		if _, err = f.client.RenameFile(f.ctx, &manageproto.RenameFileRequest{OldPath: r.Filepath, NewPath: r.Target}); err == nil {
+			f.quota.release(size)
+		}
+	case "Rmdir", "Remove":
+		var size int64
+		if info, statErr := f.stat(r.Filepath); statErr == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		if _, err = f.client.RemoveFile(f.ctx, &manageproto.RemoveFileRequest{Path: r.Filepath}); err == nil {
+			f.quota.release(size)
+		}
+	case "Mkdir":
+		_, err = f.client.MakeDirectory(f.ctx, &manageproto.MakeDirectoryRequest{Path: r.Filepath})
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return sftpError(err)
+}
+
+// Filelist lists directories and stats files in the pod.
+func (f *sftpFileSystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		stream, err := f.client.ListDirectory(f.ctx, &manageproto.ListDirectoryRequest{Path: r.Filepath})
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		var entries sftpListerAt
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				return nil, sftpError(err)
+			}
+			for _, entry := range resp.Entries {
+				entries = append(entries, &sftpFileInfo{entry})
+			}
+		}
+	case "Stat":
+		info, err := f.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// stat returns the file information of the file at path.
+func (f *sftpFileSystem) stat(path string) (os.FileInfo, error) {
+	resp, err := f.client.StatFile(f.ctx, &manageproto.StatFileRequest{Path: path})
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpFileInfo{resp.Info}, nil
+}
+
+// sftpFileReader reads a file in the pod, every ReadAt is a separate request to the agent.
+type sftpFileReader struct {
+	fs   *sftpFileSystem
+	path string
+}
+
+// ReadAt reads len(p) bytes starting at off. It returns io.EOF if the file ends before p is filled.
+func (r *sftpFileReader) ReadAt(p []byte, off int64) (int, error) {
+	stream, err := r.fs.client.ReadFileRange(r.fs.ctx, &manageproto.ReadFileRangeRequest{
+		Path:   r.path,
+		Offset: off,
+		Length: int64(len(p)),
+	})
+	if err != nil {
+		return 0, sftpError(err)
+	}
+	n := 0
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, sftpError(err)
+		}
+		n += copy(p[n:], resp.Data)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpFileWriter writes to a file in the pod over a single stream, which is kept open until the file is closed.
+type sftpFileWriter struct {
+	fs     *sftpFileSystem
+	stream manageproto.API_WriteFileRangeClient
+	cancel context.CancelFunc
+	mux    sync.Mutex
+	// size is the known size of the file, writes beyond it are counted towards the quota.
+	size int64
+}
+
+// WriteAt sends the data to the agent. Errors of the agent are reported with the next call.
+func (w *sftpFileWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	size := w.size
+	if end := off + int64(len(p)); end > w.size {
+		if err := w.fs.quota.reserve(end - w.size); err != nil {
+			return 0, err
+		}
+		w.size = end
+	}
+	if err := w.stream.Send(&manageproto.WriteFileRangeRequest{
+		Content: &manageproto.WriteFileRangeRequest_Chunk{
+			Chunk: &manageproto.FileChunk{Offset: off, Data: p},
+		},
+	}); err != nil {
+		// the bytes were not written, so they are no longer reserved
+		w.fs.quota.release(w.size - size)
+		w.size = size
+		// the actual error of the agent is returned by Recv
+		_, err = w.stream.Recv()
+		return 0, sftpError(err)
+	}
+	return len(p), nil
+}
+
+// Close finishes the stream and waits until the agent has closed the file.
+func (w *sftpFileWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	defer w.cancel()
+	if err := w.stream.CloseSend(); err != nil {
+		return sftpError(err)
+	}
+	if _, err := w.stream.Recv(); err != io.EOF {
+		return sftpError(err)
+	}
+	return nil
+}
+
+// sftpQuota tracks the disk usage of the home directory during a SFTP session. The usage is read from the disk
+// when the session starts, after quotaRestatBytes were reserved and before a write is rejected.
+type sftpQuota struct {
+	mux   sync.Mutex
+	used  int64
+	limit int64
+	// unstated are the bytes reserved since the disk usage was read.
+	unstated  int64
+	diskUsage func() (int64, error)
+}
+
+// reserve adds n bytes to the usage, unless the limit would be exceeded.
+func (q *sftpQuota) reserve(n int64) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.limit <= 0 {
+		return nil
+	}
+	if q.unstated+n > quotaRestatBytes || q.used+n > q.limit {
+		if err := q.refreshLocked(); err != nil {
+			return err
+		}
+	}
+	if q.used+n > q.limit {
+		return ErrQuotaExceeded
+	}
+	q.used += n
+	q.unstated += n
+	return nil
+}
+
+// refresh reads the disk usage of the home directory.
+func (q *sftpQuota) refresh() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.refreshLocked()
+}
+
+func (q *sftpQuota) refreshLocked() error {
+	used, err := q.diskUsage()
+	if err != nil {
+		return err
+	}
+	q.used = used
+	q.unstated = 0
+	return nil
+}
+
+// release removes n bytes from the usage.
+func (q *sftpQuota) release(n int64) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.used = max(q.used-n, 0)
+}
+
+// sftpListerAt is a static list of file information.
+type sftpListerAt []os.FileInfo
+
+// ListAt copies the entries starting at offset into ls.
+func (l sftpListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpFileInfo implements os.FileInfo for the file information returned by the agent.
+type sftpFileInfo struct {
+	info *manageproto.FileInfo
+}
+
+func (i *sftpFileInfo) Name() string       { return i.info.GetName() }
+func (i *sftpFileInfo) Size() int64        { return i.info.GetSize() }
+func (i *sftpFileInfo) Mode() os.FileMode  { return os.FileMode(i.info.GetMode()) }
+func (i *sftpFileInfo) ModTime() time.Time { return time.Unix(i.info.GetModificationTime(), 0) }
+func (i *sftpFileInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *sftpFileInfo) Sys() any           { return nil }
+func (i *sftpFileInfo) Uid() uint32        { return i.info.GetUid() }
+func (i *sftpFileInfo) Gid() uint32        { return i.info.GetGid() }
+
+// sftpError converts a gRPC status error of the agent to an error the sftp server reports to the client.
+func sftpError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		return sftp.ErrSSHFxNoSuchFile
+	case codes.PermissionDenied:
+		return sftp.ErrSSHFxPermissionDenied
+	case codes.Unimplemented:
+		return sftp.ErrSSHFxOpUnsupported
+	default:
+		if s, ok := status.FromError(err); ok {
+			return errors.New(s.Message())
+		}
+		return err
+	}
+}
@@ -0,0 +1,246 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package containerapi
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benschlueter/delegatio/agent/manageapi"
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServeSFTPInPodgRPC(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		quota     int64
+		existing  map[string]string
+		action    func(*sftp.Client, string) error
+		expectErr bool
+		expect    map[string]string
+	}{
+		"write file": {
+			action: func(client *sftp.Client, home string) error {
+				return writeSFTPFile(client, filepath.Join(home, "file"), "content")
+			},
+			expect: map[string]string{"file": "content"},
+		},
+		"read file": {
+			existing: map[string]string{"file": "content"},
+			action: func(client *sftp.Client, home string) error {
+				file, err := client.Open(filepath.Join(home, "file"))
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				data, err := io.ReadAll(file)
+				if err != nil {
+					return err
+				}
+				if string(data) != "content" {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			},
+			expect: map[string]string{"file": "content"},
+		},
+		"read missing file": {
+			action: func(client *sftp.Client, home string) error {
+				_, err := client.Open(filepath.Join(home, "file"))
+				if !os.IsNotExist(err) {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			},
+			expectErr: true,
+		},
+		"list directory": {
+			existing: map[string]string{"a": "1", "b": "2"},
+			action: func(client *sftp.Client, home string) error {
+				entries, err := client.ReadDir(home)
+				if err != nil {
+					return err
+				}
+				if len(entries) != 2 {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			},
+			expect: map[string]string{"a": "1", "b": "2"},
+		},
+		"rename and remove": {
+			existing: map[string]string{"a": "1", "b": "2"},
+			action: func(client *sftp.Client, home string) error {
+				if err := client.Rename(filepath.Join(home, "a"), filepath.Join(home, "c")); err != nil {
+					return err
+				}
+				return client.Remove(filepath.Join(home, "b"))
+			},
+			expect: map[string]string{"c": "1"},
+		},
+		"make directory": {
+			action: func(client *sftp.Client, home string) error {
+				if err := client.Mkdir(filepath.Join(home, "dir")); err != nil {
+					return err
+				}
+				return writeSFTPFile(client, filepath.Join(home, "dir", "file"), "content")
+			},
+			expect: map[string]string{"dir/file": "content"},
+		},
+		"write within quota": {
+			quota:    10,
+			existing: map[string]string{"file": "12345"},
+			action: func(client *sftp.Client, home string) error {
+				return writeSFTPFile(client, filepath.Join(home, "other"), "12345")
+			},
+			expect: map[string]string{"file": "12345", "other": "12345"},
+		},
+		"write exceeds quota": {
+			quota:    10,
+			existing: map[string]string{"file": "12345"},
+			action: func(client *sftp.Client, home string) error {
+				return writeSFTPFile(client, filepath.Join(home, "other"), "123456")
+			},
+			expectErr: true,
+		},
+		"rename over existing file": {
+			quota:    10,
+			existing: map[string]string{"a": "12345", "b": "12345"},
+			action: func(client *sftp.Client, home string) error {
+				if err := client.PosixRename(filepath.Join(home, "a"), filepath.Join(home, "b")); err != nil {
+					return err
+				}
+				return writeSFTPFile(client, filepath.Join(home, "c"), "12345")
+			},
+			expect: map[string]string{"b": "12345", "c": "12345"},
+		},
+		"write after removal outside of the session": {
+			quota:    10,
+			existing: map[string]string{"file": "1234567890"},
+			action: func(client *sftp.Client, home string) error {
+				if err := os.Remove(filepath.Join(home, "file")); err != nil {
+					return err
+				}
+				return writeSFTPFile(client, filepath.Join(home, "other"), "12345")
+			},
+			expect: map[string]string{"other": "12345"},
+		},
+		"overwrite within quota": {
+			quota:    10,
+			existing: map[string]string{"file": "12345678"},
+			action: func(client *sftp.Client, home string) error {
+				return writeSFTPFile(client, filepath.Join(home, "file"), "1234567890")
+			},
+			expect: map[string]string{"file": "1234567890"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			home := t.TempDir()
+			for name, content := range tc.existing {
+				require.NoError(os.WriteFile(filepath.Join(home, name), []byte(content), 0o644))
+			}
+
+			listener := bufconn.Listen(1024 * 1024)
+			server := grpc.NewServer()
+			manageproto.RegisterAPIServer(server, manageapi.New(zap.NewNop(), nil, nil))
+			go server.Serve(listener)
+			defer server.GracefulStop()
+
+			api := New(zap.NewNop(), nil, &bufconnDialer{listener: listener})
+			serverConn, clientConn := net.Pipe()
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- api.ServeSFTPInPodgRPC(context.Background(), "bufconn", &config.KubeSFTPConfig{
+					Communication: &pipeChannel{Conn: serverConn},
+					HomeDirectory: home,
+					Quota:         tc.quota,
+				})
+			}()
+
+			client, err := sftp.NewClientPipe(clientConn, clientConn)
+			require.NoError(err)
+			err = tc.action(client, home)
+			client.Close()
+			require.NoError(<-serveErr)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			files := map[string]string{}
+			require.NoError(filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(home, path)
+				files[rel] = string(content)
+				return err
+			}))
+			assert.Equal(tc.expect, files)
+		})
+	}
+}
+
+// writeSFTPFile creates or truncates the file and writes the content to it.
+func writeSFTPFile(client *sftp.Client, path, content string) error {
+	file, err := client.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(content)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type bufconnDialer struct {
+	listener *bufconn.Listener
+}
+
+func (d *bufconnDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return d.listener.DialContext(ctx)
+}
+
+// pipeChannel is a ssh.Channel backed by a net.Conn.
+type pipeChannel struct {
+	net.Conn
+}
+
+func (c *pipeChannel) CloseWrite() error {
+	return c.Conn.Close()
+}
+
+func (c *pipeChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *pipeChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+var _ ssh.Channel = &pipeChannel{}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package containerapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"github.com/benschlueter/delegatio/internal/config"
+	"go.uber.org/zap"
+)
+
+// CreateSocketForwardInPodgRPC lets the agent listen on a socket inside the pod and relays every accepted
+// connection to the connection returned by conf.Connect. It blocks until the context is cancelled or the agent
+// closes the listener.
+func (a *API) CreateSocketForwardInPodgRPC(ctx context.Context, endpoint string, conf *config.KubeSocketForwardConfig) error {
+	conn, err := a.dialInsecure(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := manageproto.NewAPIClient(conn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := client.ListenSocket(ctx, &manageproto.ListenSocketRequest{
+		Network: conf.Network,
+		Address: conf.Address,
+	})
+	if err != nil {
+		return err
+	}
+	ready, err := resp.Recv()
+	if err != nil {
+		return err
+	}
+	if ready.GetAddress() == "" {
+		return errors.New("agent did not report the socket address")
+	}
+	a.logger.Debug("socket in pod ready", zap.String("address", ready.GetAddress()))
+	conf.Ready(ready.GetAddress())
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		data, err := resp.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func(connectionID string) {
+			defer wg.Done()
+			if err := a.relaySocketConnection(ctx, client, connectionID, conf.Connect); err != nil {
+				a.logger.Info("socket relay stopped", zap.String("connection", connectionID), zap.Error(err))
+			}
+		}(data.GetConnectionId())
+	}
+}
+
+// relaySocketConnection claims the connection with the given id from the agent and copies data in both directions.
+func (a *API) relaySocketConnection(ctx context.Context, client manageproto.APIClient, connectionID string, connect func() (io.ReadWriteCloser, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConnectSocket(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&manageproto.ConnectSocketRequest{
+		Content: &manageproto.ConnectSocketRequest_ConnectionId{ConnectionId: connectionID},
+	}); err != nil {
+		return err
+	}
+	remote, err := connect()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	// Errors on the client side cancel the stream, which in turn stops the receiving loop below.
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := remote.Read(buf)
+			if n > 0 {
+				if err := stream.Send(&manageproto.ConnectSocketRequest{
+					Content: &manageproto.ConnectSocketRequest_Data{Data: buf[:n]},
+				}); err != nil {
+					cancel()
+					return
+				}
+			}
+			if err == io.EOF {
+				_ = stream.CloseSend()
+				return
+			}
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+	// The agent finishes the stream once both directions of the connection inside the pod are closed.
+	for {
+		data, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := remote.Write(data.GetData()); err != nil {
+			return err
+		}
+	}
+}
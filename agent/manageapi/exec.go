@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 
 	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
@@ -81,6 +82,9 @@ func (a *ManageAPI) ExecCommandStream(srv manageproto.API_ExecCommandStreamServe
 		return status.Error(codes.InvalidArgument, "no command received")
 	}
 	execCommand := exec.Command(command.Command, command.Args...)
+	if len(command.Env) > 0 {
+		execCommand.Env = append(os.Environ(), command.Env...)
+	}
 
 	errorStreamWriter := &streamWriterWrapper{
 		forwardFunc: func(b []byte) error {
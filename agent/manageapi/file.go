@@ -15,7 +15,8 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// WriteFile creates a file and writes output to it.
+// WriteFile creates a file and writes output to it. The files contain secrets like keys and X11 cookies, so the
+// file and a created directory are only accessible by the user of the agent, which runs the commands of the sessions.
 func (a *ManageAPI) WriteFile(_ context.Context, in *manageproto.WriteFileRequest) (*manageproto.WriteFileResponse, error) {
 	a.logger.Info("request to write file", zap.String("path", in.Filepath), zap.String("name", in.Filename))
 	if _, err := os.Stat(in.Filepath); os.IsNotExist(err) {
@@ -25,10 +26,16 @@ func (a *ManageAPI) WriteFile(_ context.Context, in *manageproto.WriteFileReques
 		}
 	}
 	a.logger.Debug("about to write file to disk", zap.String("path", in.Filepath), zap.String("name", in.Filename))
-	if err := os.WriteFile(filepath.Join(in.Filepath, in.Filename), in.Content, os.ModeAppend); err != nil {
+	path := filepath.Join(in.Filepath, in.Filename)
+	if err := os.WriteFile(path, in.Content, 0o600); err != nil {
 		a.logger.Error("failed to write file", zap.String("path", in.Filepath), zap.String("name", in.Filename), zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "file write failed exited with error code: %v", err)
 	}
+	// the mode of an existing file is not changed by WriteFile
+	if err := os.Chmod(path, 0o600); err != nil {
+		a.logger.Error("failed to change file mode", zap.String("path", in.Filepath), zap.String("name", in.Filename), zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "file mode change failed exited with error code: %v", err)
+	}
 	a.logger.Debug("wrote content to disk", zap.String("path", in.Filepath), zap.String("name", in.Filename))
 	return &manageproto.WriteFileResponse{}, nil
 }
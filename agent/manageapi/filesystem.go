@@ -0,0 +1,223 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package manageapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// fileChunkSize is the maximum amount of file data sent in a single message.
+	fileChunkSize = 32 * 1024
+	// listBatchSize is the maximum number of directory entries sent in a single message.
+	listBatchSize = 128
+)
+
+// StatFile returns information about a file. Symbolic links are followed.
+func (a *ManageAPI) StatFile(_ context.Context, in *manageproto.StatFileRequest) (*manageproto.StatFileResponse, error) {
+	a.logger.Debug("request to stat file", zap.String("path", in.Path))
+	info, err := os.Stat(in.Path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return &manageproto.StatFileResponse{Info: fileInfoToProto(info)}, nil
+}
+
+// ListDirectory streams the entries of a directory in batches.
+func (a *ManageAPI) ListDirectory(in *manageproto.ListDirectoryRequest, srv manageproto.API_ListDirectoryServer) error {
+	a.logger.Debug("request to list directory", zap.String("path", in.Path))
+	dir, err := os.Open(in.Path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer dir.Close()
+	for {
+		entries, err := dir.Readdir(listBatchSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fileError(err)
+		}
+		resp := &manageproto.ListDirectoryResponse{}
+		for _, entry := range entries {
+			resp.Entries = append(resp.Entries, fileInfoToProto(entry))
+		}
+		if err := srv.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadFileRange streams up to length bytes of a file starting at offset.
+// The stream ends early if the end of the file is reached.
+func (a *ManageAPI) ReadFileRange(in *manageproto.ReadFileRangeRequest, srv manageproto.API_ReadFileRangeServer) error {
+	a.logger.Debug("request to read file range", zap.String("path", in.Path), zap.Int64("offset", in.Offset), zap.Int64("length", in.Length))
+	file, err := os.Open(in.Path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer file.Close()
+	buf := make([]byte, fileChunkSize)
+	for offset, end := in.Offset, in.Offset+in.Length; offset < end; {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), end-offset)], offset)
+		if n > 0 {
+			if err := srv.Send(&manageproto.ReadFileRangeResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fileError(err)
+		}
+	}
+	return nil
+}
+
+// WriteFileRange opens the file given in the header of the first message and writes the chunks of all following
+// messages to it. An empty response is sent once the file is opened, so the caller learns about failures early.
+func (a *ManageAPI) WriteFileRange(srv manageproto.API_WriteFileRangeServer) error {
+	in, err := srv.Recv()
+	if err != nil {
+		a.logger.Error("error receiving file header", zap.Error(err))
+		return status.Error(codes.InvalidArgument, "error receiving input")
+	}
+	header := in.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "first message must contain the file header")
+	}
+	a.logger.Debug("request to write file range", zap.String("path", header.Path))
+	flags := os.O_WRONLY
+	if header.Create {
+		flags |= os.O_CREATE
+	}
+	if header.Truncate {
+		flags |= os.O_TRUNC
+	}
+	if header.Exclusive {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(header.Path, flags, 0o644)
+	if err != nil {
+		return fileError(err)
+	}
+	defer file.Close()
+	if err := srv.Send(&manageproto.WriteFileRangeResponse{}); err != nil {
+		return err
+	}
+	for {
+		in, err := srv.Recv()
+		if err == io.EOF {
+			return fileError(file.Close())
+		}
+		if err != nil {
+			return err
+		}
+		chunk := in.GetChunk()
+		if chunk == nil {
+			return status.Error(codes.InvalidArgument, "expected a file chunk")
+		}
+		if _, err := file.WriteAt(chunk.Data, chunk.Offset); err != nil {
+			a.logger.Error("failed to write file range", zap.String("path", header.Path), zap.Error(err))
+			return fileError(err)
+		}
+	}
+}
+
+// RenameFile renames a file or directory.
+func (a *ManageAPI) RenameFile(_ context.Context, in *manageproto.RenameFileRequest) (*manageproto.RenameFileResponse, error) {
+	a.logger.Info("request to rename file", zap.String("old", in.OldPath), zap.String("new", in.NewPath))
+	if err := os.Rename(in.OldPath, in.NewPath); err != nil {
+		return nil, fileError(err)
+	}
+	return &manageproto.RenameFileResponse{}, nil
+}
+
+// RemoveFile removes a file or an empty directory.
+func (a *ManageAPI) RemoveFile(_ context.Context, in *manageproto.RemoveFileRequest) (*manageproto.RemoveFileResponse, error) {
+	a.logger.Info("request to remove file", zap.String("path", in.Path))
+	if err := os.Remove(in.Path); err != nil {
+		return nil, fileError(err)
+	}
+	return &manageproto.RemoveFileResponse{}, nil
+}
+
+// MakeDirectory creates a directory.
+func (a *ManageAPI) MakeDirectory(_ context.Context, in *manageproto.MakeDirectoryRequest) (*manageproto.MakeDirectoryResponse, error) {
+	a.logger.Info("request to create directory", zap.String("path", in.Path))
+	if err := os.Mkdir(in.Path, 0o755); err != nil {
+		return nil, fileError(err)
+	}
+	return &manageproto.MakeDirectoryResponse{}, nil
+}
+
+// DiskUsage returns the size of all regular files below a directory.
+func (a *ManageAPI) DiskUsage(_ context.Context, in *manageproto.DiskUsageRequest) (*manageproto.DiskUsageResponse, error) {
+	a.logger.Debug("request to calculate disk usage", zap.String("path", in.Path))
+	var usage int64
+	err := filepath.WalkDir(in.Path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		usage += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return &manageproto.DiskUsageResponse{Bytes: usage}, nil
+}
+
+// fileInfoToProto converts the file information to its protobuf representation.
+func fileInfoToProto(info fs.FileInfo) *manageproto.FileInfo {
+	protoInfo := &manageproto.FileInfo{
+		Name:             info.Name(),
+		Size:             info.Size(),
+		Mode:             uint32(info.Mode()),
+		ModificationTime: info.ModTime().Unix(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		protoInfo.Uid = stat.Uid
+		protoInfo.Gid = stat.Gid
+	}
+	return protoInfo
+}
+
+// fileError converts a file system error to a gRPC status error.
+func fileError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, fs.ErrExist):
+		return status.Error(codes.AlreadyExists, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
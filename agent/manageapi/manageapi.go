@@ -7,6 +7,7 @@ package manageapi
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
 	"go.uber.org/zap"
@@ -19,15 +20,19 @@ type ManageAPI struct {
 	logger *zap.Logger
 	core   Core
 	dialer Dialer
+	// pendingConns holds connections accepted by ListenSocket until they are claimed by ConnectSocket.
+	pendingConns map[string]net.Conn
+	pendingMux   sync.Mutex
 	manageproto.UnimplementedAPIServer
 }
 
 // New creates a new API.
 func New(logger *zap.Logger, core Core, dialer Dialer) *ManageAPI {
 	return &ManageAPI{
-		logger: logger,
-		core:   core,
-		dialer: dialer,
+		logger:       logger,
+		core:         core,
+		dialer:       dialer,
+		pendingConns: make(map[string]net.Conn),
 	}
 }
 
@@ -24,6 +24,16 @@ const (
 	API_ExecCommand_FullMethodName             = "/manageapi.API/ExecCommand"
 	API_WriteFile_FullMethodName               = "/manageapi.API/WriteFile"
 	API_ReadFile_FullMethodName                = "/manageapi.API/ReadFile"
+	API_ListenSocket_FullMethodName            = "/manageapi.API/ListenSocket"
+	API_ConnectSocket_FullMethodName           = "/manageapi.API/ConnectSocket"
+	API_StatFile_FullMethodName                = "/manageapi.API/StatFile"
+	API_ListDirectory_FullMethodName           = "/manageapi.API/ListDirectory"
+	API_ReadFileRange_FullMethodName           = "/manageapi.API/ReadFileRange"
+	API_WriteFileRange_FullMethodName          = "/manageapi.API/WriteFileRange"
+	API_RenameFile_FullMethodName              = "/manageapi.API/RenameFile"
+	API_RemoveFile_FullMethodName              = "/manageapi.API/RemoveFile"
+	API_MakeDirectory_FullMethodName           = "/manageapi.API/MakeDirectory"
+	API_DiskUsage_FullMethodName               = "/manageapi.API/DiskUsage"
 )
 
 // APIClient is the client API for API service.
@@ -35,6 +45,16 @@ type APIClient interface {
 	ExecCommand(ctx context.Context, in *ExecCommandRequest, opts ...grpc.CallOption) (*ExecCommandResponse, error)
 	WriteFile(ctx context.Context, in *WriteFileRequest, opts ...grpc.CallOption) (*WriteFileResponse, error)
 	ReadFile(ctx context.Context, in *ReadFileRequest, opts ...grpc.CallOption) (*ReadFileResponse, error)
+	ListenSocket(ctx context.Context, in *ListenSocketRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListenSocketResponse], error)
+	ConnectSocket(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ConnectSocketRequest, ConnectSocketResponse], error)
+	StatFile(ctx context.Context, in *StatFileRequest, opts ...grpc.CallOption) (*StatFileResponse, error)
+	ListDirectory(ctx context.Context, in *ListDirectoryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListDirectoryResponse], error)
+	ReadFileRange(ctx context.Context, in *ReadFileRangeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadFileRangeResponse], error)
+	WriteFileRange(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WriteFileRangeRequest, WriteFileRangeResponse], error)
+	RenameFile(ctx context.Context, in *RenameFileRequest, opts ...grpc.CallOption) (*RenameFileResponse, error)
+	RemoveFile(ctx context.Context, in *RemoveFileRequest, opts ...grpc.CallOption) (*RemoveFileResponse, error)
+	MakeDirectory(ctx context.Context, in *MakeDirectoryRequest, opts ...grpc.CallOption) (*MakeDirectoryResponse, error)
+	DiskUsage(ctx context.Context, in *DiskUsageRequest, opts ...grpc.CallOption) (*DiskUsageResponse, error)
 }
 
 type aPIClient struct {
@@ -107,6 +127,139 @@ func (c *aPIClient) ReadFile(ctx context.Context, in *ReadFileRequest, opts ...g
 	return out, nil
 }
 
+func (c *aPIClient) ListenSocket(ctx context.Context, in *ListenSocketRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListenSocketResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[2], API_ListenSocket_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListenSocketRequest, ListenSocketResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ListenSocketClient = grpc.ServerStreamingClient[ListenSocketResponse]
+
+func (c *aPIClient) ConnectSocket(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ConnectSocketRequest, ConnectSocketResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[3], API_ConnectSocket_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ConnectSocketRequest, ConnectSocketResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ConnectSocketClient = grpc.BidiStreamingClient[ConnectSocketRequest, ConnectSocketResponse]
+
+func (c *aPIClient) StatFile(ctx context.Context, in *StatFileRequest, opts ...grpc.CallOption) (*StatFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatFileResponse)
+	err := c.cc.Invoke(ctx, API_StatFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) ListDirectory(ctx context.Context, in *ListDirectoryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListDirectoryResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[4], API_ListDirectory_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListDirectoryRequest, ListDirectoryResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ListDirectoryClient = grpc.ServerStreamingClient[ListDirectoryResponse]
+
+func (c *aPIClient) ReadFileRange(ctx context.Context, in *ReadFileRangeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadFileRangeResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[5], API_ReadFileRange_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadFileRangeRequest, ReadFileRangeResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ReadFileRangeClient = grpc.ServerStreamingClient[ReadFileRangeResponse]
+
+func (c *aPIClient) WriteFileRange(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WriteFileRangeRequest, WriteFileRangeResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[6], API_WriteFileRange_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WriteFileRangeRequest, WriteFileRangeResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_WriteFileRangeClient = grpc.BidiStreamingClient[WriteFileRangeRequest, WriteFileRangeResponse]
+
+func (c *aPIClient) RenameFile(ctx context.Context, in *RenameFileRequest, opts ...grpc.CallOption) (*RenameFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RenameFileResponse)
+	err := c.cc.Invoke(ctx, API_RenameFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) RemoveFile(ctx context.Context, in *RemoveFileRequest, opts ...grpc.CallOption) (*RemoveFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveFileResponse)
+	err := c.cc.Invoke(ctx, API_RemoveFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) MakeDirectory(ctx context.Context, in *MakeDirectoryRequest, opts ...grpc.CallOption) (*MakeDirectoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MakeDirectoryResponse)
+	err := c.cc.Invoke(ctx, API_MakeDirectory_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) DiskUsage(ctx context.Context, in *DiskUsageRequest, opts ...grpc.CallOption) (*DiskUsageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DiskUsageResponse)
+	err := c.cc.Invoke(ctx, API_DiskUsage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // APIServer is the server API for API service.
 // All implementations must embed UnimplementedAPIServer
 // for forward compatibility.
@@ -116,6 +269,16 @@ type APIServer interface {
 	ExecCommand(context.Context, *ExecCommandRequest) (*ExecCommandResponse, error)
 	WriteFile(context.Context, *WriteFileRequest) (*WriteFileResponse, error)
 	ReadFile(context.Context, *ReadFileRequest) (*ReadFileResponse, error)
+	ListenSocket(*ListenSocketRequest, grpc.ServerStreamingServer[ListenSocketResponse]) error
+	ConnectSocket(grpc.BidiStreamingServer[ConnectSocketRequest, ConnectSocketResponse]) error
+	StatFile(context.Context, *StatFileRequest) (*StatFileResponse, error)
+	ListDirectory(*ListDirectoryRequest, grpc.ServerStreamingServer[ListDirectoryResponse]) error
+	ReadFileRange(*ReadFileRangeRequest, grpc.ServerStreamingServer[ReadFileRangeResponse]) error
+	WriteFileRange(grpc.BidiStreamingServer[WriteFileRangeRequest, WriteFileRangeResponse]) error
+	RenameFile(context.Context, *RenameFileRequest) (*RenameFileResponse, error)
+	RemoveFile(context.Context, *RemoveFileRequest) (*RemoveFileResponse, error)
+	MakeDirectory(context.Context, *MakeDirectoryRequest) (*MakeDirectoryResponse, error)
+	DiskUsage(context.Context, *DiskUsageRequest) (*DiskUsageResponse, error)
 	mustEmbedUnimplementedAPIServer()
 }
 
@@ -141,6 +304,36 @@ func (UnimplementedAPIServer) WriteFile(context.Context, *WriteFileRequest) (*Wr
 func (UnimplementedAPIServer) ReadFile(context.Context, *ReadFileRequest) (*ReadFileResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ReadFile not implemented")
 }
+func (UnimplementedAPIServer) ListenSocket(*ListenSocketRequest, grpc.ServerStreamingServer[ListenSocketResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ListenSocket not implemented")
+}
+func (UnimplementedAPIServer) ConnectSocket(grpc.BidiStreamingServer[ConnectSocketRequest, ConnectSocketResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ConnectSocket not implemented")
+}
+func (UnimplementedAPIServer) StatFile(context.Context, *StatFileRequest) (*StatFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StatFile not implemented")
+}
+func (UnimplementedAPIServer) ListDirectory(*ListDirectoryRequest, grpc.ServerStreamingServer[ListDirectoryResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ListDirectory not implemented")
+}
+func (UnimplementedAPIServer) ReadFileRange(*ReadFileRangeRequest, grpc.ServerStreamingServer[ReadFileRangeResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ReadFileRange not implemented")
+}
+func (UnimplementedAPIServer) WriteFileRange(grpc.BidiStreamingServer[WriteFileRangeRequest, WriteFileRangeResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WriteFileRange not implemented")
+}
+func (UnimplementedAPIServer) RenameFile(context.Context, *RenameFileRequest) (*RenameFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedAPIServer) RemoveFile(context.Context, *RemoveFileRequest) (*RemoveFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveFile not implemented")
+}
+func (UnimplementedAPIServer) MakeDirectory(context.Context, *MakeDirectoryRequest) (*MakeDirectoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MakeDirectory not implemented")
+}
+func (UnimplementedAPIServer) DiskUsage(context.Context, *DiskUsageRequest) (*DiskUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiskUsage not implemented")
+}
 func (UnimplementedAPIServer) mustEmbedUnimplementedAPIServer() {}
 func (UnimplementedAPIServer) testEmbeddedByValue()             {}
 
@@ -234,6 +427,143 @@ func _API_ReadFile_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _API_ListenSocket_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListenSocketRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(APIServer).ListenSocket(m, &grpc.GenericServerStream[ListenSocketRequest, ListenSocketResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ListenSocketServer = grpc.ServerStreamingServer[ListenSocketResponse]
+
+func _API_ConnectSocket_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(APIServer).ConnectSocket(&grpc.GenericServerStream[ConnectSocketRequest, ConnectSocketResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ConnectSocketServer = grpc.BidiStreamingServer[ConnectSocketRequest, ConnectSocketResponse]
+
+func _API_StatFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).StatFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: API_StatFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).StatFile(ctx, req.(*StatFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_ListDirectory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListDirectoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(APIServer).ListDirectory(m, &grpc.GenericServerStream[ListDirectoryRequest, ListDirectoryResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ListDirectoryServer = grpc.ServerStreamingServer[ListDirectoryResponse]
+
+func _API_ReadFileRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadFileRangeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(APIServer).ReadFileRange(m, &grpc.GenericServerStream[ReadFileRangeRequest, ReadFileRangeResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_ReadFileRangeServer = grpc.ServerStreamingServer[ReadFileRangeResponse]
+
+func _API_WriteFileRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(APIServer).WriteFileRange(&grpc.GenericServerStream[WriteFileRangeRequest, WriteFileRangeResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type API_WriteFileRangeServer = grpc.BidiStreamingServer[WriteFileRangeRequest, WriteFileRangeResponse]
+
+func _API_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: API_RenameFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).RenameFile(ctx, req.(*RenameFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_RemoveFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).RemoveFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: API_RemoveFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).RemoveFile(ctx, req.(*RemoveFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_MakeDirectory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MakeDirectoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).MakeDirectory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: API_MakeDirectory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).MakeDirectory(ctx, req.(*MakeDirectoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_DiskUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiskUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).DiskUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: API_DiskUsage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).DiskUsage(ctx, req.(*DiskUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // API_ServiceDesc is the grpc.ServiceDesc for API service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -253,6 +583,26 @@ var API_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ReadFile",
 			Handler:    _API_ReadFile_Handler,
 		},
+		{
+			MethodName: "StatFile",
+			Handler:    _API_StatFile_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _API_RenameFile_Handler,
+		},
+		{
+			MethodName: "RemoveFile",
+			Handler:    _API_RemoveFile_Handler,
+		},
+		{
+			MethodName: "MakeDirectory",
+			Handler:    _API_MakeDirectory_Handler,
+		},
+		{
+			MethodName: "DiskUsage",
+			Handler:    _API_DiskUsage_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -266,6 +616,33 @@ var API_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _API_ExecCommandReturnStream_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "ListenSocket",
+			Handler:       _API_ListenSocket_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ConnectSocket",
+			Handler:       _API_ConnectSocket_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ListDirectory",
+			Handler:       _API_ListDirectory_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ReadFileRange",
+			Handler:       _API_ReadFileRange_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WriteFileRange",
+			Handler:       _API_WriteFileRange_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "managei.proto",
 }
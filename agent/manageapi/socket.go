@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package manageapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/benschlueter/delegatio/agent/manageapi/manageproto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pendingConnTimeout is the time a connection accepted by ListenSocket waits for its ConnectSocket stream.
+const pendingConnTimeout = 30 * time.Second
+
+// ListenSocket creates a listener inside the container and announces every accepted connection to the caller.
+// The caller is expected to claim the connection with ConnectSocket. The listener is closed when the stream ends.
+// Only unix and tcp sockets are supported. If no address is given for an unix socket, the socket is created in a new private temporary directory.
+func (a *ManageAPI) ListenSocket(in *manageproto.ListenSocketRequest, srv manageproto.API_ListenSocketServer) error {
+	a.logger.Info("request to listen on socket", zap.String("network", in.Network), zap.String("address", in.Address))
+	if in.Network != "unix" && in.Network != "tcp" {
+		return status.Errorf(codes.InvalidArgument, "unsupported network %q", in.Network)
+	}
+	address := in.Address
+	if in.Network == "unix" && address == "" {
+		dir, err := os.MkdirTemp("", "delegatio-")
+		if err != nil {
+			a.logger.Error("failed to create socket directory", zap.Error(err))
+			return status.Errorf(codes.Internal, "socket directory creation failed: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		address = filepath.Join(dir, "agent.sock")
+	} else if in.Network == "unix" {
+		if err := createSocketDir(filepath.Dir(address)); err != nil {
+			a.logger.Error("failed to create socket directory", zap.Error(err))
+			return status.Errorf(codes.Internal, "socket directory creation failed: %v", err)
+		}
+	}
+	listener, err := net.Listen(in.Network, address)
+	if err != nil {
+		a.logger.Error("failed to listen on socket", zap.String("address", address), zap.Error(err))
+		return status.Errorf(codes.Internal, "listen on socket failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		<-srv.Context().Done()
+		listener.Close()
+	}()
+
+	if err := srv.Send(&manageproto.ListenSocketResponse{
+		Content: &manageproto.ListenSocketResponse_Address{Address: listener.Addr().String()},
+	}); err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			a.logger.Debug("socket listener closed", zap.String("address", address))
+			return nil
+		}
+		if err != nil {
+			a.logger.Error("failed to accept connection on socket", zap.Error(err))
+			return status.Errorf(codes.Internal, "accept on socket failed: %v", err)
+		}
+		id, err := a.addPendingConn(conn)
+		if err != nil {
+			conn.Close()
+			return status.Errorf(codes.Internal, "generating connection id failed: %v", err)
+		}
+		if err := srv.Send(&manageproto.ListenSocketResponse{
+			Content: &manageproto.ListenSocketResponse_ConnectionId{ConnectionId: id},
+		}); err != nil {
+			a.takePendingConn(id)
+			conn.Close()
+			return err
+		}
+	}
+}
+
+// createSocketDir creates the directory of a socket like /tmp/.X11-unix, sticky and writable by every user,
+// so clients running as any user can use it. Existing directories are not changed.
+func createSocketDir(dir string) error {
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.Chmod(dir, os.ModeSticky|0o777)
+}
+
+// ConnectSocket relays the data of a connection accepted by ListenSocket.
+// The first message must contain the connection id, all following messages carry data.
+func (a *ManageAPI) ConnectSocket(srv manageproto.API_ConnectSocketServer) error {
+	in, err := srv.Recv()
+	if err != nil {
+		a.logger.Error("error receiving connection id", zap.Error(err))
+		return status.Error(codes.InvalidArgument, "error receiving input")
+	}
+	conn := a.takePendingConn(in.GetConnectionId())
+	if conn == nil {
+		return status.Errorf(codes.NotFound, "no pending connection with id %q", in.GetConnectionId())
+	}
+	defer conn.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := srv.Send(&manageproto.ConnectSocketResponse{Data: buf[:n]}); err != nil {
+					errChan <- err
+					return
+				}
+			}
+			if err == io.EOF {
+				errChan <- nil
+				return
+			}
+			if err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+	for {
+		in, err := srv.Recv()
+		if err == io.EOF {
+			if unixConn, ok := conn.(interface{ CloseWrite() error }); ok {
+				_ = unixConn.CloseWrite()
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(in.GetData()); err != nil {
+			a.logger.Error("writing to socket connection", zap.Error(err))
+			return status.Errorf(codes.Internal, "writing to socket failed: %v", err)
+		}
+	}
+	return <-errChan
+}
+
+// addPendingConn stores the connection under a random id. The connection is closed if it is
+// not claimed within pendingConnTimeout.
+func (a *ManageAPI) addPendingConn(conn net.Conn) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	a.pendingMux.Lock()
+	a.pendingConns[id] = conn
+	a.pendingMux.Unlock()
+	time.AfterFunc(pendingConnTimeout, func() {
+		if conn := a.takePendingConn(id); conn != nil {
+			a.logger.Info("pending socket connection was never claimed", zap.String("id", id))
+			conn.Close()
+		}
+	})
+	return id, nil
+}
+
+// takePendingConn removes the connection from the pending connections and returns it.
+func (a *ManageAPI) takePendingConn(id string) net.Conn {
+	a.pendingMux.Lock()
+	defer a.pendingMux.Unlock()
+	conn, ok := a.pendingConns[id]
+	if !ok {
+		return nil
+	}
+	delete(a.pendingConns, id)
+	return conn
+}
@@ -6,9 +6,9 @@ package installer
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/url"
-	"os"
 
 	"github.com/benschlueter/delegatio/cli/installer/helm"
 	"github.com/benschlueter/delegatio/internal/config"
@@ -131,24 +131,27 @@ func (k *installer) initalizeChallenges(ctx context.Context, userConfig *config.
 	if err := k.client.CreateNamespace(ctx, config.UserNamespace); err != nil {
 		return err
 	}
-	stWrapper := storewrapper.StoreWrapper{Store: k.client.SharedStore}
+	stWrapper := storewrapper.StoreWrapper{Store: k.client.SharedStore, Keys: k.client.Keys}
 
-	for namespace := range userConfig.Containers {
-		if err := stWrapper.PutChallengeData(namespace, nil); err != nil {
+	for namespace, challenge := range userConfig.Containers {
+		if err := stWrapper.PutChallenge(namespace, challenge); err != nil {
 			return err
 		}
 		k.logger.Info("added challenge to store", zap.String("challenge", namespace))
 	}
 
 	for uuid, userData := range userConfig.UUIDToUser {
-		if err := stWrapper.PutDataIdxByUUID(uuid, userData); err != nil {
+		userData.UUID = uuid
+		if err := stWrapper.PutUser(userData); err != nil {
 			return err
 		}
 		k.logger.Info("added user to store", zap.String("uuid", uuid), zap.Any("userinfo", userData))
 	}
+	// users indexed by their public key are stored under their uuid as well, the public key is indexed
 	for pubkey, userData := range userConfig.PubKeyToUser {
-		if err := stWrapper.PutDataIdxByPubKey(pubkey, userData); err != nil {
-			return err
+		userData.PubKey = []byte(pubkey)
+		if err := stWrapper.PutUser(userData); err != nil {
+			return fmt.Errorf("adding user with public key %s: %w", pubkey, err)
 		}
 		k.logger.Info("added user to store", zap.String("pubkey", pubkey), zap.Any("userinfo", userData))
 	}
@@ -165,14 +168,14 @@ func (k *installer) initializeSSH(ctx context.Context) error {
 		k.logger.With(zap.Error(err)).Error("failed to createConfigMapAndPutData")
 		return err
 	}
-	privateBytes, err := os.ReadFile("./server_test")
-	if err != nil {
+	if err := k.client.UploadSSHHostKeys(); err != nil {
 		return err
 	}
-	if err := k.client.UploadSSHServerPrivKey(privateBytes); err != nil {
+	k.logger.Info("uploaded ssh host keys")
+	if err := k.client.UploadSSHCAKey(); err != nil {
 		return err
 	}
-	k.logger.Info("uploaded ssh server private key")
+	k.logger.Info("uploaded ssh certificate authority key")
 	if err := k.client.CreateServiceAccount(ctx, config.SSHNamespaceName, config.SSHServiceAccountName); err != nil {
 		return err
 	}
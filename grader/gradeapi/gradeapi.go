@@ -11,9 +11,12 @@ import (
 
 	"github.com/benschlueter/delegatio/grader/gradeapi/gradeproto"
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/file"
 	"github.com/benschlueter/delegatio/internal/k8sapi"
 	"github.com/benschlueter/delegatio/internal/store"
 	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -25,20 +28,36 @@ type API struct {
 	dialer       Dialer
 	client       *k8sapi.Client
 	backingStore store.Store
+	// keys encrypt the secrets in the store, they are stored in plaintext if it is nil.
+	keys *envelope.KeyRing
 
 	gradeproto.UnimplementedAPIServer
 }
 
-// New creates a new API.
-func New(logger *zap.Logger, dialer Dialer, initStore bool) (*API, error) {
+// New creates a new API. The API has no store if storeConf is nil, the secrets in the store are stored in plaintext
+// if encryption is nil.
+func New(logger *zap.Logger, dialer Dialer, storeConf *store.Config, encryption *envelope.Config) (*API, error) {
 	// use the current context in kubeconfig
 	client, err := k8sapi.NewClient(logger)
 	if err != nil {
 		return nil, err
 	}
-	var store store.Store
-	if initStore {
-		store, err = client.GetStore()
+	var backingStore store.Store
+	if storeConf != nil {
+		openedStore, err := store.Open(*storeConf, client.GetStore)
+		if err != nil {
+			return nil, err
+		}
+		// users and teams are read for every grading request, the cache lives as long as the grader
+		backingStore = store.NewCache(logger.Named("cache"), openedStore, storewrapper.CachedPrefixes()...)
+	}
+	var keys *envelope.KeyRing
+	if encryption != nil {
+		keys, err = envelope.Load(*encryption, file.NewHandler(afero.NewOsFs()), func(name string) (map[string][]byte, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), config.DefaultTimeout)
+			defer cancel()
+			return client.GetSecretData(ctx, config.GraderNamespaceName, name)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -48,7 +67,8 @@ func New(logger *zap.Logger, dialer Dialer, initStore bool) (*API, error) {
 		logger:       logger,
 		dialer:       dialer,
 		client:       client,
-		backingStore: store,
+		backingStore: backingStore,
+		keys:         keys,
 	}, nil
 }
 
@@ -72,7 +92,7 @@ func (a *API) grpcWithDialer() grpc.DialOption {
 }
 
 func (a *API) data() storewrapper.StoreWrapper {
-	return storewrapper.StoreWrapper{Store: a.backingStore}
+	return storewrapper.StoreWrapper{Store: a.backingStore, Keys: a.keys}
 }
 
 // SendGradingRequest sends a grading request to the grader service.
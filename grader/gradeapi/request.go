@@ -9,20 +9,38 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strconv"
 
 	"github.com/benschlueter/delegatio/grader/gradeapi/gradeproto"
 	"github.com/benschlueter/delegatio/grader/gradeapi/graders"
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/team"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func (a *API) updatePointsUser(_ context.Context, points int, uuid string, exerciseID int) error {
+// updatePointsUser records the points of the exercise. Requests from team workspaces carry the workspace identifier
+// instead of a uuid, the points are recorded for the team.
+func (a *API) updatePointsUser(ctx context.Context, points int, uuid string, exerciseID int) error {
 	a.logger.Info("updating points", zap.String("uuid", uuid), zap.Int("points", points), zap.Int("exercise", exerciseID))
-	// ToDO: Update points for user and add database connection / container
-	return nil
+	exercise := strconv.Itoa(exerciseID)
+	data := a.data().WithContext(ctx)
+	if name, ok := team.FromWorkspace(uuid); ok {
+		return team.RecordPoints(data, name, exercise, points)
+	}
+	exists, err := data.UUIDExists(uuid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s does not exist", uuid)
+	}
+	return data.PutGrade(config.Grade{Workspace: uuid, Exercise: exercise, Points: points})
 }
 
 // RequestGrading is the gRPC endpoint for requesting grading.
@@ -60,33 +78,65 @@ func (a *API) RequestGrading(ctx context.Context, in *gradeproto.RequestGradingR
 	}
 
 	if err := a.updatePointsUser(ctx, points, uuid, int(exerciseID)); err != nil {
+		if errors.Is(err, store.ErrUnavailable) {
+			return nil, status.Error(codes.Unavailable, "store unavailable")
+		}
 		return nil, status.Error(codes.Internal, "failed to update points")
 	}
 
 	return &gradeproto.RequestGradingResponse{Points: int32(points), Log: log}, nil
 }
 
-func (a *API) checkSignature(_ context.Context, uuid string, signature, solution []byte) error {
+// checkSignature verifies the signature of the solution. Solutions of team workspaces are signed with the key of
+// the team, since all members share the container.
+func (a *API) checkSignature(ctx context.Context, uuid string, signature, solution []byte) error {
 	a.logger.Info("checking signature", zap.String("studentID", uuid))
-	exists, err := a.data().UUIDExists(uuid)
+	data := a.data().WithContext(ctx)
+	if name, ok := team.FromWorkspace(uuid); ok {
+		teamData, err := data.GetTeamData(name)
+		if errors.Is(err, store.ErrUnavailable) {
+			return status.Error(codes.Unavailable, "store unavailable")
+		}
+		if err != nil {
+			return status.Error(codes.NotFound, "team not found")
+		}
+		if teamData.PubKey == nil {
+			return status.Error(codes.FailedPrecondition, "team has no key")
+		}
+		return verifySignature(teamData.PubKey, signature, solution)
+	}
+	exists, err := data.UUIDExists(uuid)
+	if errors.Is(err, store.ErrUnavailable) {
+		return status.Error(codes.Unavailable, "store unavailable")
+	}
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return status.Error(codes.NotFound, "user not found")
 	}
-	var userData config.UserInformation
-	if err := a.data().GetUUIDData(uuid, &userData); err != nil {
+	userData, err := data.GetUser(uuid)
+	if err != nil {
 		return status.Error(codes.FailedPrecondition, "failed to get user data")
 	}
 	a.logger.Info("got user data", zap.String("publicKey", string(userData.PubKey)))
-	sshPubKey, err := ssh.ParsePublicKey(userData.PubKey)
+	return verifySignature(userData.PubKey, signature, solution)
+}
+
+// verifySignature verifies the PKCS1v15 signature of the solution with the rsa public key.
+func verifySignature(pubKey, signature, solution []byte) error {
+	sshPubKey, err := ssh.ParsePublicKey(pubKey)
 	if err != nil {
 		return status.Error(codes.Internal, "failed to unmarshal public key")
 	}
-	pubKeyNewIface := sshPubKey.(ssh.CryptoPublicKey)
-	pubKewNewIfaceTwo := pubKeyNewIface.CryptoPublicKey()
-	rsaPubKey := pubKewNewIfaceTwo.(*rsa.PublicKey)
+	cryptoPubKey, ok := sshPubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return status.Error(codes.Internal, "unsupported public key")
+	}
+	rsaPubKey, ok := cryptoPubKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return status.Error(codes.Internal, "unsupported public key")
+	}
 	hashSolution := sha512.Sum512(solution)
 	if err := rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA512, hashSolution[:], signature); err != nil {
 		return status.Error(codes.Unauthenticated, "signature check")
@@ -11,6 +11,8 @@ import (
 	"net"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"go.uber.org/zap"
 )
@@ -20,6 +22,10 @@ var userID = 555
 func main() {
 	logLevelUser := flag.Bool("debug", false, "enables gRPC debug output")
 	selfExec := flag.Bool("self", false, "enables self-execution in sandbox environment")
+	storeBackend := flag.String("store-backend", store.BackendEtcd, "store backend, etcd or bolt")
+	storePath := flag.String("store-path", "", "database file of the bolt store backend")
+	keyRingFile := flag.String("keyring-file", "", "file of the key ring which encrypts the secrets in the store")
+	keyRingSecret := flag.String("keyring-secret", "", "secret of the key ring which encrypts the secrets in the store")
 	flag.Parse()
 	args := flag.Args()
 
@@ -41,6 +47,10 @@ func main() {
 		bindIP := config.DefaultIP
 		bindPort := fmt.Sprint(config.GradeAPIport)
 		dialer := &net.Dialer{}
-		run(dialer, bindIP, bindPort, zapLoggerCore)
+		var encryption *envelope.Config
+		if *keyRingFile != "" || *keyRingSecret != "" {
+			encryption = &envelope.Config{File: *keyRingFile, Secret: *keyRingSecret}
+		}
+		run(dialer, bindIP, bindPort, store.Config{Backend: *storeBackend, Path: *storePath}, encryption, zapLoggerCore)
 	}
 }
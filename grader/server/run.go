@@ -19,6 +19,8 @@ import (
 	"github.com/benschlueter/delegatio/grader/gradeapi"
 	"github.com/benschlueter/delegatio/grader/gradeapi/gradeproto"
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
@@ -30,10 +32,10 @@ import (
 
 var version = "0.0.0"
 
-func run(dialer gradeapi.Dialer, bindIP, bindPort string, zapLoggerCore *zap.Logger) {
+func run(dialer gradeapi.Dialer, bindIP, bindPort string, storeConf store.Config, encryption *envelope.Config, zapLoggerCore *zap.Logger) {
 	defer func() { _ = zapLoggerCore.Sync() }()
 	zapLoggerCore.Info("starting delegatio grader", zap.String("version", version), zap.String("commit", config.Commit))
-	gapi, err := gradeapi.New(zapLoggerCore.Named("gradeapi"), dialer, true)
+	gapi, err := gradeapi.New(zapLoggerCore.Named("gradeapi"), dialer, &storeConf, encryption)
 	if err != nil {
 		zapLoggerCore.Fatal("create gradeapi", zap.Error(err))
 	}
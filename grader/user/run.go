@@ -52,7 +52,7 @@ func run(dialer gradeapi.Dialer, zapLoggerCore *zap.Logger) {
 		zapLoggerCore.Fatal("signing solution", zap.Error(err))
 	}
 
-	api, err := gradeapi.New(zapLoggerCore, dialer, false)
+	api, err := gradeapi.New(zapLoggerCore, dialer, nil, nil)
 	if err != nil {
 		zapLoggerCore.Fatal("create gradeapi", zap.Error(err))
 	}
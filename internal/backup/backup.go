@@ -0,0 +1,258 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package backup takes snapshots of the store and restores them. A snapshot is a consistent copy of all entries,
+// compressed with gzip and protected by the checksum of the entries, see store.Checksum.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"go.uber.org/zap"
+)
+
+const (
+	// snapshotVersion is the version of the snapshot format.
+	snapshotVersion = 1
+	snapshotPrefix  = "snapshot-"
+	snapshotSuffix  = ".json.gz"
+	// snapshotTimeFormat is part of the name, so the names sort by the time the snapshots were taken.
+	snapshotTimeFormat = "20060102T150405Z"
+	// maxCheckInterval is the longest time between two checks of the scheduler whether a snapshot is due.
+	maxCheckInterval = time.Minute
+)
+
+// snapshot is the content of a snapshot before compression. The entries have the same encoding as the backups
+// of the admin tool.
+type snapshot struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Checksum string            `json:"checksum"`
+	Entries  map[string][]byte `json:"entries"`
+}
+
+// Info describes a snapshot.
+type Info struct {
+	Name    string
+	Created time.Time
+	Entries int
+	// Checksum is the SHA-256 checksum of the entries, it equals the checksum of the store at the time of the snapshot.
+	Checksum string
+	// Size is the compressed size.
+	Size int
+}
+
+// Create takes a consistent snapshot of the store and saves it at the destination.
+func Create(ctx context.Context, src store.Store, destination Destination, now time.Time) (Info, error) {
+	// Transfer reads all entries of one revision, the copy in memory is consistent
+	memory := store.NewStdStore()
+	if err := src.Transfer(memory); err != nil {
+		return Info{}, fmt.Errorf("copying the store: %w", err)
+	}
+	count, checksum, err := store.Checksum(memory)
+	if err != nil {
+		return Info{}, err
+	}
+	content := snapshot{Version: snapshotVersion, Created: now.UTC(), Checksum: checksum, Entries: make(map[string][]byte, count)}
+	err = store.Scan(ctx, memory, "", func(entry store.KeyValue) error {
+		content.Entries[entry.Key] = entry.Value
+		return nil
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(writer).Encode(content); err != nil {
+		return Info{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return Info{}, err
+	}
+	info := Info{Name: snapshotName(now), Created: content.Created, Entries: count, Checksum: checksum, Size: compressed.Len()}
+	if err := destination.Put(ctx, info.Name, compressed.Bytes()); err != nil {
+		return Info{}, fmt.Errorf("saving snapshot %s: %w", info.Name, err)
+	}
+	return info, nil
+}
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	// DryRun only reads and verifies the snapshot, nothing is written.
+	DryRun bool
+	// Force writes the snapshot to a store which is not empty, the entries of the snapshot replace existing entries.
+	Force bool
+	// Progress is called with the number of entries written so far, it may be nil.
+	Progress func(written int)
+}
+
+// Restore verifies the checksum of the snapshot and writes its entries to the store, which must be empty unless
+// forced. The checksum of the written entries is verified as well.
+func Restore(ctx context.Context, destination Destination, name string, dst store.Store, opts RestoreOptions) (Info, error) {
+	data, err := destination.Get(ctx, name)
+	if err != nil {
+		return Info{}, fmt.Errorf("reading snapshot %s: %w", name, err)
+	}
+	memory, info, err := load(name, data)
+	if err != nil {
+		return Info{}, err
+	}
+	if opts.DryRun {
+		return info, nil
+	}
+	result, err := store.Migrate(memory, dst, store.MigrateOptions{Force: opts.Force, Progress: opts.Progress})
+	if err != nil {
+		return info, err
+	}
+	if result.Checksum != info.Checksum {
+		return info, fmt.Errorf("checksum mismatch: snapshot %s, written %s", info.Checksum, result.Checksum)
+	}
+	return info, nil
+}
+
+// load decompresses the snapshot into memory and verifies its checksum.
+func load(name string, data []byte) (*store.StdStore, Info, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("decompressing snapshot %s: %w", name, err)
+	}
+	defer reader.Close()
+	var content snapshot
+	if err := json.NewDecoder(reader).Decode(&content); err != nil {
+		return nil, Info{}, fmt.Errorf("decoding snapshot %s: %w", name, err)
+	}
+	// the gzip checksum is verified at the end of the stream
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, Info{}, fmt.Errorf("decompressing snapshot %s: %w", name, err)
+	}
+	if content.Version != snapshotVersion {
+		return nil, Info{}, fmt.Errorf("snapshot %s has version %d, supported is %d", name, content.Version, snapshotVersion)
+	}
+	memory := store.NewStdStore()
+	for key, value := range content.Entries {
+		if err := memory.Put(key, value); err != nil {
+			return nil, Info{}, err
+		}
+	}
+	count, checksum, err := store.Checksum(memory)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if checksum != content.Checksum {
+		return nil, Info{}, fmt.Errorf("snapshot %s is corrupted: checksum %s, expected %s", name, checksum, content.Checksum)
+	}
+	return memory, Info{Name: name, Created: content.Created, Entries: count, Checksum: checksum, Size: len(data)}, nil
+}
+
+// Prune deletes the snapshots which are not retained, the newest snapshot is always kept. It returns the names of
+// the deleted snapshots.
+func Prune(ctx context.Context, destination Destination, retention Retention, now time.Time) ([]string, error) {
+	objects, err := destination.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	// the newest snapshot is the last one
+	for i, object := range objects[:max(len(objects)-1, 0)] {
+		newer := len(objects) - 1 - i
+		created, err := snapshotTime(object.Name)
+		if err != nil {
+			continue
+		}
+		expired := retention.MaxAge > 0 && now.Sub(created) > retention.MaxAge
+		if !expired && (retention.Keep == 0 || newer < retention.Keep) {
+			continue
+		}
+		if err := destination.Delete(ctx, object.Name); err != nil {
+			return deleted, fmt.Errorf("deleting snapshot %s: %w", object.Name, err)
+		}
+		deleted = append(deleted, object.Name)
+	}
+	return deleted, nil
+}
+
+// Scheduler takes snapshots of the store in the interval of the configuration and prunes the old snapshots. Several
+// ssh servers run a scheduler on the same store, the time of the last snapshot is recorded in the store, so only
+// one of them takes a snapshot per interval.
+type Scheduler struct {
+	log          *zap.Logger
+	backingStore store.Store
+	destination  Destination
+	conf         Config
+	now          func() time.Time
+}
+
+// NewScheduler creates a new Scheduler.
+func NewScheduler(log *zap.Logger, backingStore store.Store, destination Destination, conf Config) *Scheduler {
+	return &Scheduler{log: log, backingStore: backingStore, destination: destination, conf: conf, now: time.Now}
+}
+
+// Run takes the snapshots until ctx is done, nothing is scheduled without interval.
+func (s *Scheduler) Run(ctx context.Context) {
+	if s.conf.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(s.conf.Interval, maxCheckInterval))
+	defer ticker.Stop()
+	for {
+		if err := s.runOnce(ctx); err != nil {
+			s.log.Error("taking scheduled snapshot", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runOnce takes a snapshot if none was taken within the interval. The claim of a failed snapshot is released, so it
+// is retried at the next check of any scheduler.
+func (s *Scheduler) runOnce(ctx context.Context) error {
+	now := s.now()
+	claimed, err := storewrapper.StoreWrapper{Store: s.backingStore}.WithContext(ctx).ClaimBackup(now, s.conf.Interval)
+	if err != nil || !claimed {
+		return err
+	}
+	info, err := Create(ctx, s.backingStore, s.destination, now)
+	if err != nil {
+		// the claim is released even if the snapshot failed because the server stops
+		data := storewrapper.StoreWrapper{Store: s.backingStore}.WithContext(context.WithoutCancel(ctx))
+		if releaseErr := data.ReleaseBackup(now); releaseErr != nil {
+			return errors.Join(err, fmt.Errorf("releasing the claim: %w", releaseErr))
+		}
+		return err
+	}
+	s.log.Info("took snapshot", zap.String("name", info.Name), zap.Int("entries", info.Entries), zap.Int("size", info.Size), zap.String("checksum", info.Checksum))
+	deleted, err := Prune(ctx, s.destination, s.conf.Retention, now)
+	if len(deleted) > 0 {
+		s.log.Info("pruned snapshots", zap.Strings("names", deleted))
+	}
+	return err
+}
+
+// snapshotName returns the name of the snapshot taken at the time.
+func snapshotName(created time.Time) string {
+	return snapshotPrefix + created.UTC().Format(snapshotTimeFormat) + snapshotSuffix
+}
+
+// snapshotTime returns the time encoded in the name of the snapshot.
+func snapshotTime(name string) (time.Time, error) {
+	return time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+}
+
+// isSnapshot reports whether the name is the name of a snapshot.
+func isSnapshot(name string) bool {
+	return strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix)
+}
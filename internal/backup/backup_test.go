@@ -0,0 +1,290 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func newStore(t *testing.T, entries map[string]string) store.Store {
+	s := store.NewStdStore()
+	for key, value := range entries {
+		require.NoError(t, s.Put(key, []byte(value)))
+	}
+	return s
+}
+
+func TestCreateRestore(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	entries := map[string]string{"uuid-alice": `{"version":1}`, "grade-alice/1": `{"Points":5}`, "privkey-ssh": "\x00binary"}
+	testCases := map[string]struct {
+		dst          map[string]string
+		corrupt      func([]byte) []byte
+		opts         RestoreOptions
+		expectErr    bool
+		expectStored map[string]string
+	}{
+		"empty store": {
+			expectStored: entries,
+		},
+		"store not empty": {
+			dst:          map[string]string{"uuid-bob": "bob"},
+			expectErr:    true,
+			expectStored: map[string]string{"uuid-bob": "bob"},
+		},
+		"forced": {
+			dst:          map[string]string{"uuid-bob": "bob", "uuid-alice": "old"},
+			opts:         RestoreOptions{Force: true},
+			expectStored: map[string]string{"uuid-bob": "bob", "uuid-alice": `{"version":1}`, "grade-alice/1": `{"Points":5}`, "privkey-ssh": "\x00binary"},
+		},
+		"dry run": {
+			opts:         RestoreOptions{DryRun: true},
+			expectStored: map[string]string{},
+		},
+		"changed entry": {
+			corrupt: func(data []byte) []byte {
+				return recompress(t, data, func(content []byte) []byte {
+					return bytes.Replace(content, []byte(`"uuid-alice"`), []byte(`"uuid-mallory"`), 1)
+				})
+			},
+			expectErr:    true,
+			expectStored: map[string]string{},
+		},
+		"truncated": {
+			corrupt:      func(data []byte) []byte { return data[:len(data)/2] },
+			expectErr:    true,
+			expectStored: map[string]string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			ctx := context.Background()
+
+			src := newStore(t, entries)
+			destination := NewDirectoryDestination(afero.NewMemMapFs(), "/backup")
+			info, err := Create(ctx, src, destination, now)
+			require.NoError(err)
+			assert.Equal("snapshot-20261018T120000Z.json.gz", info.Name)
+			assert.Equal(len(entries), info.Entries)
+			_, checksum, err := store.Checksum(src)
+			require.NoError(err)
+			assert.Equal(checksum, info.Checksum)
+			if tc.corrupt != nil {
+				data, err := destination.Get(ctx, info.Name)
+				require.NoError(err)
+				require.NoError(destination.Put(ctx, info.Name, tc.corrupt(data)))
+			}
+
+			dst := newStore(t, tc.dst)
+			restored, err := Restore(ctx, destination, info.Name, dst, tc.opts)
+			if tc.expectErr {
+				assert.Error(err)
+			} else {
+				require.NoError(err)
+				assert.Equal(info.Checksum, restored.Checksum)
+				assert.True(now.Equal(restored.Created))
+			}
+			stored := map[string]string{}
+			require.NoError(store.Scan(ctx, dst, "", func(entry store.KeyValue) error {
+				stored[entry.Key] = string(entry.Value)
+				return nil
+			}))
+			assert.Equal(tc.expectStored, stored)
+		})
+	}
+}
+
+// recompress decompresses the snapshot, changes the content and compresses it again.
+func recompress(t *testing.T, data []byte, change func([]byte) []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	var content bytes.Buffer
+	_, err = content.ReadFrom(reader)
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write(change(content.Bytes()))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return compressed.Bytes()
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		retention  Retention
+		snapshots  []time.Duration
+		expectKept []time.Duration
+	}{
+		"keep all": {
+			snapshots:  []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+			expectKept: []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+		},
+		"keep count": {
+			retention:  Retention{Keep: 2},
+			snapshots:  []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+			expectKept: []time.Duration{48 * time.Hour, 24 * time.Hour},
+		},
+		"max age": {
+			retention:  Retention{MaxAge: 50 * time.Hour},
+			snapshots:  []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+			expectKept: []time.Duration{48 * time.Hour, 24 * time.Hour},
+		},
+		"count and max age": {
+			retention:  Retention{Keep: 1, MaxAge: 50 * time.Hour},
+			snapshots:  []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+			expectKept: []time.Duration{24 * time.Hour},
+		},
+		"newest is kept": {
+			retention:  Retention{MaxAge: time.Hour},
+			snapshots:  []time.Duration{72 * time.Hour, 48 * time.Hour},
+			expectKept: []time.Duration{48 * time.Hour},
+		},
+		"no snapshots": {
+			retention: Retention{Keep: 1},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			ctx := context.Background()
+
+			destination := NewDirectoryDestination(afero.NewMemMapFs(), "/backup")
+			for _, age := range tc.snapshots {
+				require.NoError(destination.Put(ctx, snapshotName(now.Add(-age)), []byte{}))
+			}
+			_, err := Prune(ctx, destination, tc.retention, now)
+			require.NoError(err)
+
+			objects, err := destination.List(ctx)
+			require.NoError(err)
+			var kept []string
+			for _, object := range objects {
+				kept = append(kept, object.Name)
+			}
+			var expected []string
+			for _, age := range tc.expectKept {
+				expected = append(expected, snapshotName(now.Add(-age)))
+			}
+			assert.Equal(expected, kept)
+		})
+	}
+}
+
+func TestSchedulerClaim(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+
+	backingStore := newStore(t, map[string]string{"uuid-alice": "alice"})
+	destination := NewDirectoryDestination(afero.NewMemMapFs(), "/backup")
+	conf := Config{Interval: time.Hour, Directory: "/backup", Retention: Retention{Keep: 2}}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	// two servers share the store
+	schedulers := []*Scheduler{
+		NewScheduler(zap.NewNop(), backingStore, destination, conf),
+		NewScheduler(zap.NewNop(), backingStore, destination, conf),
+	}
+	for _, scheduler := range schedulers {
+		scheduler.now = func() time.Time { return now }
+	}
+
+	for minute := 0; minute < 150; minute++ {
+		for _, scheduler := range schedulers {
+			require.NoError(scheduler.runOnce(ctx))
+		}
+		now = now.Add(time.Minute)
+	}
+	objects, err := destination.List(ctx)
+	require.NoError(err)
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	// snapshots at 12:00, 13:00 and 14:00, the first is pruned
+	assert.Equal([]string{"snapshot-20261018T130000Z.json.gz", "snapshot-20261018T140000Z.json.gz"}, names)
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+
+	backingStore := newStore(t, map[string]string{"uuid-alice": "alice"})
+	destination := NewDirectoryDestination(afero.NewMemMapFs(), "/backup")
+	conf := Config{Interval: time.Hour, Directory: "/backup"}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	failing := NewScheduler(zap.NewNop(), backingStore, failingDestination{destination}, conf)
+	working := NewScheduler(zap.NewNop(), backingStore, destination, conf)
+	failing.now = func() time.Time { return now }
+	working.now = func() time.Time { return now }
+
+	// the failed snapshot does not keep the other server from taking it
+	assert.Error(failing.runOnce(ctx))
+	require.NoError(working.runOnce(ctx))
+	objects, err := destination.List(ctx)
+	require.NoError(err)
+	require.Len(objects, 1)
+	assert.Equal(snapshotName(now), objects[0].Name)
+}
+
+// failingDestination fails to save snapshots.
+type failingDestination struct {
+	Destination
+}
+
+func (failingDestination) Put(context.Context, string, []byte) error {
+	return errors.New("destination unavailable")
+}
+
+func TestConfigValidate(t *testing.T) {
+	s3 := &S3Config{Endpoint: "https://s3.example.com", Bucket: "backup", AccessKeyID: "id", SecretAccessKeyFile: "/secret"}
+	testCases := map[string]struct {
+		conf      Config
+		expectErr bool
+	}{
+		"directory":            {conf: Config{Directory: "/backup", Interval: time.Hour}},
+		"s3":                   {conf: Config{S3: s3}},
+		"no destination":       {conf: Config{}, expectErr: true},
+		"two destinations":     {conf: Config{Directory: "/backup", S3: s3}, expectErr: true},
+		"incomplete s3":        {conf: Config{S3: &S3Config{Endpoint: "https://s3.example.com"}}, expectErr: true},
+		"negative interval":    {conf: Config{Directory: "/backup", Interval: -time.Hour}, expectErr: true},
+		"negative retention":   {conf: Config{Directory: "/backup", Retention: Retention{Keep: -1}}, expectErr: true},
+		"negative maximum age": {conf: Config{Directory: "/backup", Retention: Retention{MaxAge: -time.Hour}}, expectErr: true},
+		"s3 with retention":    {conf: Config{S3: s3, Retention: Retention{Keep: 7, MaxAge: 30 * 24 * time.Hour}}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.conf.Validate()
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Config configures the snapshots of the store, exactly one of Directory and S3 must be set.
+type Config struct {
+	// Interval is the time between two scheduled snapshots, snapshots are only taken manually if it is zero.
+	Interval time.Duration `yaml:"interval"`
+	// Directory stores the snapshots as files, usually on a persistent volume.
+	Directory string `yaml:"directory"`
+	// S3 stores the snapshots in a bucket of an S3-compatible endpoint.
+	S3 *S3Config `yaml:"s3,omitempty"`
+	// Retention decides which snapshots are deleted after a scheduled snapshot.
+	Retention Retention `yaml:"retention"`
+}
+
+// S3Config is the bucket of an S3-compatible endpoint, the objects are addressed path-style.
+type S3Config struct {
+	// Endpoint is the URL of the endpoint, e.g. https://s3.eu-central-1.amazonaws.com.
+	Endpoint string `yaml:"endpoint"`
+	// Region is used to sign the requests. Defaults to us-east-1.
+	Region string `yaml:"region"`
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the names of the snapshots, e.g. delegatio/.
+	Prefix      string `yaml:"prefix"`
+	AccessKeyID string `yaml:"accessKeyID"`
+	// SecretAccessKeyFile contains the secret access key, so it is not part of the configuration.
+	SecretAccessKeyFile string `yaml:"secretAccessKeyFile"`
+}
+
+// Retention decides which snapshots are kept, the newest snapshot is never deleted. Zero values keep all snapshots.
+type Retention struct {
+	// Keep is the number of snapshots which are kept.
+	Keep int `yaml:"keep"`
+	// MaxAge is the age after which snapshots are deleted.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Validate checks that the destination is complete and the durations are not negative.
+func (c Config) Validate() error {
+	var errs []error
+	if (c.Directory == "") == (c.S3 == nil) {
+		errs = append(errs, errors.New("backup: exactly one of directory and s3 is required"))
+	}
+	if c.S3 != nil {
+		for name, value := range map[string]string{
+			"endpoint": c.S3.Endpoint, "bucket": c.S3.Bucket, "accessKeyID": c.S3.AccessKeyID, "secretAccessKeyFile": c.S3.SecretAccessKeyFile,
+		} {
+			if value == "" {
+				errs = append(errs, fmt.Errorf("backup: s3 %s is required", name))
+			}
+		}
+	}
+	if c.Interval < 0 {
+		errs = append(errs, errors.New("backup: interval must not be negative"))
+	}
+	if c.Retention.Keep < 0 || c.Retention.MaxAge < 0 {
+		errs = append(errs, errors.New("backup: retention must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Open returns the destination of the configuration, the secret access key of S3 is read from the file system.
+func Open(conf Config, fs afero.Fs) (Destination, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.Directory != "" {
+		return NewDirectoryDestination(fs, conf.Directory), nil
+	}
+	secret, err := afero.ReadFile(fs, conf.S3.SecretAccessKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading s3 secret access key: %w", err)
+	}
+	return NewS3Destination(*conf.S3, strings.TrimSpace(string(secret)))
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Destination stores the snapshots by their name.
+type Destination interface {
+	// Put saves the snapshot, an existing snapshot with the name is replaced.
+	Put(ctx context.Context, name string, data []byte) error
+	// Get reads the snapshot, it returns an error wrapping os.ErrNotExist if it does not exist.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// List returns the snapshots sorted by name, i.e. by the time they were taken.
+	List(ctx context.Context) ([]Object, error)
+	// Delete removes the snapshot.
+	Delete(ctx context.Context, name string) error
+}
+
+// Object describes a stored snapshot.
+type Object struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// DirectoryDestination stores the snapshots as files in a directory.
+type DirectoryDestination struct {
+	fs  afero.Fs
+	dir string
+}
+
+// NewDirectoryDestination creates a new DirectoryDestination.
+func NewDirectoryDestination(fs afero.Fs, dir string) *DirectoryDestination {
+	return &DirectoryDestination{fs: fs, dir: dir}
+}
+
+// Put writes the snapshot to a temporary file and renames it, so a partial snapshot is never listed.
+func (d *DirectoryDestination) Put(_ context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := d.fs.MkdirAll(d.dir, 0o700); err != nil {
+		return err
+	}
+	// the snapshots contain the private keys of the users
+	tmp := filepath.Join(d.dir, "."+name+".tmp")
+	if err := afero.WriteFile(d.fs, tmp, data, 0o600); err != nil {
+		return err
+	}
+	return d.fs.Rename(tmp, filepath.Join(d.dir, name))
+}
+
+// Get reads the file of the snapshot.
+func (d *DirectoryDestination) Get(_ context.Context, name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	return afero.ReadFile(d.fs, filepath.Join(d.dir, name))
+}
+
+// List returns the snapshot files of the directory.
+func (d *DirectoryDestination) List(_ context.Context) ([]Object, error) {
+	infos, err := afero.ReadDir(d.fs, d.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var objects []Object
+	for _, info := range infos {
+		if info.IsDir() || !isSnapshot(info.Name()) {
+			continue
+		}
+		objects = append(objects, Object{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// Delete removes the file of the snapshot.
+func (d *DirectoryDestination) Delete(_ context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return d.fs.Remove(filepath.Join(d.dir, name))
+}
+
+// checkName rejects names which are no snapshots, i.e. paths.
+func checkName(name string) error {
+	if !isSnapshot(name) || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3DefaultRegion is the region used to sign requests if none is configured, most S3-compatible stores ignore it.
+	s3DefaultRegion = "us-east-1"
+	// s3Timeout bounds each request, a snapshot is uploaded in a single request.
+	s3Timeout = 10 * time.Minute
+)
+
+// S3Destination stores the snapshots in a bucket of an S3-compatible endpoint. The requests are signed with AWS
+// Signature Version 4.
+type S3Destination struct {
+	client   *http.Client
+	endpoint *url.URL
+	conf     S3Config
+	secret   string
+	now      func() time.Time
+}
+
+// NewS3Destination creates a new S3Destination.
+func NewS3Destination(conf S3Config, secretAccessKey string) (*S3Destination, error) {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "https" && endpoint.Scheme != "http" {
+		return nil, fmt.Errorf("s3 endpoint %q is no http or https URL", conf.Endpoint)
+	}
+	if conf.Region == "" {
+		conf.Region = s3DefaultRegion
+	}
+	return &S3Destination{client: &http.Client{Timeout: s3Timeout}, endpoint: endpoint, conf: conf, secret: secretAccessKey, now: time.Now}, nil
+}
+
+// Put uploads the snapshot.
+func (d *S3Destination) Put(ctx context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, err := d.do(ctx, http.MethodPut, d.conf.Prefix+name, nil, data)
+	return err
+}
+
+// Get downloads the snapshot.
+func (d *S3Destination) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	return d.do(ctx, http.MethodGet, d.conf.Prefix+name, nil, nil)
+}
+
+// List lists the snapshots under the prefix with ListObjectsV2.
+func (d *S3Destination) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {d.conf.Prefix + snapshotPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := d.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("decoding s3 object list: %w", err)
+		}
+		for _, content := range result.Contents {
+			name := strings.TrimPrefix(content.Key, d.conf.Prefix)
+			if isSnapshot(name) && !strings.Contains(name, "/") {
+				objects = append(objects, Object{Name: name, Size: content.Size, ModTime: content.LastModified})
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// Delete deletes the snapshot.
+func (d *S3Destination) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, err := d.do(ctx, http.MethodDelete, d.conf.Prefix+name, nil, nil)
+	return err
+}
+
+// listBucketResult is the response of ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// do sends the signed request for the object key of the bucket and returns the body of the response.
+func (d *S3Destination) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	target := *d.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + d.conf.Bucket + "/" + key
+	target.RawPath = s3EscapePath(target.Path)
+	target.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	signV4(req, d.conf.AccessKeyID, d.secret, d.conf.Region, sha256Hex(body), d.now())
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, fmt.Errorf("s3 object %s: %w", key, os.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(data[:min(len(data), 512)]))
+	}
+	return data, nil
+}
+
+// signV4 adds the headers of AWS Signature Version 4 to the request. The host and all headers of the request are signed.
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery encodes the query sorted by name, as required by the signature.
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3EscapePath escapes the segments of the path.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes all bytes except the unreserved characters of RFC 3986, slashes are kept unless escapeSlash.
+func s3Escape(value string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
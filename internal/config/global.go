@@ -46,6 +46,8 @@ const (
 	AuthenticationType = "authType"
 	// AuthenticatedPrivKey is the private key used for authentication.
 	AuthenticatedPrivKey = "privateKey"
+	// AuthenticatedPubKey is the public key in the ssh wire format used for public key authentication.
+	AuthenticatedPubKey = "publicKey"
 	// UserContainerImage is the image used for the challenge containers.
 	UserContainerImage = "ghcr.io/benschlueter/delegatio/archimage:0.1"
 	// SSHContainerImage is the image used for the ssh containers.
@@ -62,16 +64,42 @@ const (
 	SSHServiceAccountName = "development-ssh"
 	// SSHPort is the port where the ssh server is listening.
 	SSHPort = 2200
+	// SSHHealthPort is the port of the liveness and readiness endpoints of the ssh server.
+	SSHHealthPort = 2201
+	// SSHReadinessPath is the path of the readiness endpoint of the ssh server.
+	SSHReadinessPath = "/readyz"
+	// SSHDrainGracePeriod is the default duration open sessions are kept when the ssh server is stopped.
+	SSHDrainGracePeriod = 10 * time.Minute
+	// SSHPreStopDelay is the delay before the ssh server is stopped, so the load balancer removes the pod first.
+	SSHPreStopDelay = 10 * time.Second
+	// SSHCertificateUser is the ssh user name used to request a certificate for the public key of the user.
+	SSHCertificateUser = "certificate"
+	// SSHKeysUser is the ssh user name used to list, add and remove the public keys of the user. Password logins name
+	// the user after a plus, i.e. keys+<user>.
+	SSHKeysUser = "keys"
+	// SSHCertificateValidity is the duration for which issued ssh user certificates are valid.
+	SSHCertificateValidity = 12 * time.Hour
 	// SSHNamespaceName is the namespace where the ssh containers are running.
 	SSHNamespaceName = "ssh"
+	// SSHConfigMapName is the name of the optional ConfigMap in the ssh namespace containing the ssh server configuration.
+	SSHConfigMapName = "ssh-config"
+	// SSHConfigMapKey is the key of the ssh server configuration in the ConfigMap.
+	SSHConfigMapKey = "config.yaml"
 	// GraderNamespaceName is the namespace where the grader containers are running.
 	GraderNamespaceName = "grader"
 	// GraderServiceAccountName is the name of the Kubernetes grader service account with cluster access.
 	GraderServiceAccountName = "development-grader"
 	// NameSpaceFilePath is the path to the file where the namespace is stored.
 	NameSpaceFilePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	// UserHomeDirectory is the home directory of the user in the challenge containers, it is backed by a persistent volume.
+	UserHomeDirectory = "/root"
+	// SFTPQuota is the maximum number of bytes a user may store in the home directory using SFTP.
+	SFTPQuota = 1 << 30
 	// SandboxPath is the path to the sandbox directory.
 	SandboxPath = "/sandbox"
+	// TeamWorkspacePrefix prefixes the workspace identifier of a team. The uuids of users start with the name of their
+	// authentication backend and a single dash, team is no valid backend name, so uuids never start with it.
+	TeamWorkspacePrefix = "team--"
 	// UUIDEnvVariable is the environment variable name of the uuid of the user.
 	UUIDEnvVariable = "GraderUUID"
 	// TerraformLogFile is the file name of the Terraform log file.
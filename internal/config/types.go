@@ -5,6 +5,9 @@
 package config
 
 import (
+	"io"
+	"time"
+
 	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/tools/remotecommand"
 )
@@ -22,6 +25,14 @@ type UserConfiguration struct {
 	Containers   map[string]ContainerInformation `yaml:"challenges" json:"challenges"`
 }
 
+// HostKey holds the host key of one key type of the ssh server.
+type HostKey struct {
+	// PrivateKey is used for the handshake.
+	PrivateKey []byte
+	// NextPrivateKey is advertised to the clients during a rotation and replaces PrivateKey once the rotation is completed.
+	NextPrivateKey []byte `json:",omitempty"`
+}
+
 // UserInformation holds the data for a user.
 type UserInformation struct {
 	Username   string
@@ -32,12 +43,79 @@ type UserInformation struct {
 	Gender     string
 	PrivKey    []byte
 	PubKey     []byte
-	Points     map[string]int
+	// Points are only set in records written before schema version 1, the grades are stored as separate records.
+	Points map[string]int
+}
+
+// PublicKey is a public key a user logs in with.
+type PublicKey struct {
+	// Key is the public key in the ssh wire format.
+	Key         []byte
+	Fingerprint string
+	Label       string
+	Added       time.Time
+	// LastUsed is updated on logins with the key, at most once per interval to limit the writes to the store.
+	LastUsed time.Time
+	// Primary marks the public key of the user record, it verifies the signatures of solutions and can only be
+	// revoked by an admin.
+	Primary bool
+}
+
+// MFAData is the second factor of a user.
+type MFAData struct {
+	// Secret is the TOTP secret, it is encrypted with the key ring in the store.
+	Secret []byte
+	// LastStep is the last accepted TOTP period, codes of this or earlier periods are rejected.
+	LastStep int64
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string
+}
+
+// RateLimitState counts the handshakes or the failed logins of a source IP or a username.
+type RateLimitState struct {
+	// Start is the beginning of the window in which the handshakes are counted.
+	Start time.Time
+	// Count is the number of handshakes in the window or the number of failed logins.
+	Count int
+	// LastFailure is the time of the last failed login.
+	LastFailure time.Time
+	// LockedUntil is the end of the lockout after too many failed logins.
+	LockedUntil time.Time
+	// Expires is the time after which the state is reset, expired states are removed from the store.
+	Expires time.Time
+}
+
+// SessionLease marks an active ssh connection of a user, it is renewed while the connection is open.
+type SessionLease struct {
+	Expires time.Time
 }
 
 // ContainerInformation holds the data for a challenge.
 type ContainerInformation struct {
 	ContainerName string
+	// Teams enables the team workspace, the members of a team share one container of the challenge.
+	Teams bool
+}
+
+// TeamInformation holds the data for a team. The members share one container and one grade.
+type TeamInformation struct {
+	Name string
+	// Members are the uuids of the members, a user is member of at most one team.
+	Members []string
+	// PrivKey signs the solutions submitted from the workspace of the team, it is created on the first connection to
+	// the workspace. The members share the container, so it holds this key instead of the private keys of the members.
+	PrivKey []byte
+	// PubKey verifies the signatures of the solutions of the team.
+	PubKey []byte
+	// Points are only set in records written before schema version 1, the grades are stored as separate records.
+	Points map[string]int
+}
+
+// Grade holds the points of a workspace, i.e. of a user or a team, for one exercise.
+type Grade struct {
+	Workspace string
+	Exercise  string
+	Points    int
 }
 
 // KubeExecConfig holds the configuration parsed to the execCommand function.
@@ -45,9 +123,11 @@ type KubeExecConfig struct {
 	Namespace      string
 	UserIdentifier string
 	Command        string
+	Args           []string
 	Communication  ssh.Channel
 	WinQueue       remotecommand.TerminalSizeQueue
 	Tty            bool
+	Env            []string
 }
 
 // KubeFileWriteConfig holds the data to write a file using the VMAPI.
@@ -67,6 +147,29 @@ type KubeForwardConfig struct {
 	Communication ssh.Channel
 }
 
+// KubeSocketForwardConfig holds the configuration to forward connections to a socket inside a pod.
+type KubeSocketForwardConfig struct {
+	Namespace      string
+	UserIdentifier string
+	Network        string
+	Address        string
+	// Ready is called with the address the socket is listening on inside the pod.
+	Ready func(address string)
+	// Connect is called for every connection accepted inside the pod and returns the other end of the relay.
+	Connect func() (io.ReadWriteCloser, error)
+}
+
+// KubeSFTPConfig holds the configuration to serve SFTP backed by the file system of a pod.
+type KubeSFTPConfig struct {
+	Namespace      string
+	UserIdentifier string
+	Communication  ssh.Channel
+	// HomeDirectory is the start directory of the session. Its disk usage counts towards the quota.
+	HomeDirectory string
+	// Quota is the maximum number of bytes the user may store, zero or a negative value disables the limit.
+	Quota int64
+}
+
 // KubeRessourceIdentifier holds the information to identify a kubernetes ressource.
 type KubeRessourceIdentifier struct {
 	UserIdentifier      string
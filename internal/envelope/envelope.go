@@ -0,0 +1,272 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package envelope encrypts secrets with envelope encryption. Every secret is encrypted with its own AES-GCM data
+// key, the data key is wrapped by a key-encryption key of a key ring. Rotating the key-encryption key only requires
+// the data keys to be wrapped again with Rewrap, the encrypted secrets are unchanged. The key ring keeps the previous
+// keys to read secrets sealed before a rotation.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/benschlueter/delegatio/internal/file"
+	"gopkg.in/yaml.v3"
+)
+
+// SecretKey is the key of the key ring in the data of a Kubernetes Secret.
+const SecretKey = "keyring"
+
+// keySize is the size of the key-encryption and the data keys, i.e. AES-256.
+const keySize = 32
+
+// sealedPrefix marks sealed values, values without it are plaintext written before encryption was enabled.
+var sealedPrefix = []byte("envelope:v1:")
+
+// Config selects the source of the key ring, exactly one of File and Secret must be set.
+type Config struct {
+	// File contains the key ring.
+	File string `yaml:"file"`
+	// Secret is the name of a Kubernetes Secret in the namespace of the server, it contains the key ring under the key "keyring".
+	Secret string `yaml:"secret"`
+}
+
+// Validate checks that exactly one source is set.
+func (c Config) Validate() error {
+	if (c.File == "") == (c.Secret == "") {
+		return errors.New("encryption: exactly one of file and secret is required")
+	}
+	return nil
+}
+
+// Load reads the key ring from the file or the secret of the configuration, secretData returns the data of the
+// Kubernetes Secret with the name.
+func Load(conf Config, fileHandler file.Handler, secretData func(name string) (map[string][]byte, error)) (*KeyRing, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.File != "" {
+		data, err := fileHandler.Read(conf.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading key ring: %w", err)
+		}
+		return Parse(data)
+	}
+	data, err := secretData(conf.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("reading key ring secret %s: %w", conf.Secret, err)
+	}
+	keyRing, ok := data[SecretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s contains no key %q", conf.Secret, SecretKey)
+	}
+	return Parse(keyRing)
+}
+
+// keyRingFile is the YAML encoding of a key ring, the keys are base64 encoded.
+type keyRingFile struct {
+	Current string            `yaml:"current"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// Parse decodes a key ring of the form
+//
+//	current: "2"
+//	keys:
+//	  "1": <base64 encoded 32 byte key>
+//	  "2": <base64 encoded 32 byte key>
+func Parse(data []byte) (*KeyRing, error) {
+	var encoded keyRingFile
+	if err := yaml.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("decoding key ring: %w", err)
+	}
+	keys := make(map[string][]byte, len(encoded.Keys))
+	for id, key := range encoded.Keys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %s: %w", id, err)
+		}
+		keys[id] = decoded
+	}
+	return NewKeyRing(encoded.Current, keys)
+}
+
+// KeyRing holds the key-encryption keys indexed by their ID. Secrets are sealed with the current key.
+type KeyRing struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyRing creates a key ring of the 32 byte keys, current is the ID of the key new secrets are sealed with.
+func NewKeyRing(current string, keys map[string][]byte) (*KeyRing, error) {
+	if current == "" {
+		return nil, errors.New("key ring has no current key")
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the key ring", current)
+	}
+	ring := &KeyRing{current: current, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		ring.keys[id] = aead
+	}
+	return ring, nil
+}
+
+// sealed is the encoding of a sealed value after the prefix.
+type sealed struct {
+	// KeyID is the ID of the key-encryption key which wraps the data key.
+	KeyID string `json:"kek"`
+	// DataKey is the nonce and the wrapped data key.
+	DataKey []byte `json:"dek"`
+	// Ciphertext is the nonce and the encrypted secret.
+	Ciphertext []byte `json:"data"`
+}
+
+// Seal encrypts the secret with a new data key, which is wrapped with the current key. The additional data, e.g. the
+// key of the record in the store, must be passed to Open again.
+func (r *KeyRing) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(aead, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(r.keys[r.current], dataKey, []byte(r.current))
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(sealed{KeyID: r.current, DataKey: wrapped, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(sealedPrefix), encoded...), nil
+}
+
+// Open decrypts a sealed value, values which are not sealed are returned unchanged.
+func (r *KeyRing) Open(value, additionalData []byte) ([]byte, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	envelope, err := decode(value)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := r.keys[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q of the sealed value is not in the key ring", envelope.KeyID)
+	}
+	dataKey, err := open(kek, envelope.DataKey, []byte(envelope.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(aead, envelope.Ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the sealed value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rewrap wraps the data key of a sealed value with the current key, the encrypted secret is not changed.
+func (r *KeyRing) Rewrap(value []byte) ([]byte, error) {
+	if !IsSealed(value) {
+		return nil, errors.New("the value is not sealed")
+	}
+	envelope, err := decode(value)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := r.keys[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q of the sealed value is not in the key ring", envelope.KeyID)
+	}
+	dataKey, err := open(kek, envelope.DataKey, []byte(envelope.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the data key: %w", err)
+	}
+	wrapped, err := seal(r.keys[r.current], dataKey, []byte(r.current))
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(sealed{KeyID: r.current, DataKey: wrapped, Ciphertext: envelope.Ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(sealedPrefix), encoded...), nil
+}
+
+// CurrentID returns the ID of the key new secrets are sealed with.
+func (r *KeyRing) CurrentID() string {
+	return r.current
+}
+
+// Current reports whether the value is sealed with the current key. Plaintext values and values sealed with an older
+// key must be sealed again.
+func (r *KeyRing) Current(value []byte) bool {
+	if !IsSealed(value) {
+		return false
+	}
+	envelope, err := decode(value)
+	return err == nil && envelope.KeyID == r.current
+}
+
+// IsSealed reports whether the value was sealed by a key ring.
+func IsSealed(value []byte) bool {
+	return bytes.HasPrefix(value, sealedPrefix)
+}
+
+func decode(value []byte) (sealed, error) {
+	var envelope sealed
+	if err := json.Unmarshal(bytes.TrimPrefix(value, sealedPrefix), &envelope); err != nil {
+		return envelope, fmt.Errorf("decoding the sealed value: %w", err)
+	}
+	return envelope, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestSealOpen(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ring, err := NewKeyRing("1", map[string][]byte{"1": testKey(1)})
+	require.NoError(err)
+	sealedValue, err := ring.Seal([]byte("secret"), []byte("uuid-alice"))
+	require.NoError(err)
+	assert.True(IsSealed(sealedValue))
+	assert.NotContains(string(sealedValue), "secret")
+	assert.True(ring.Current(sealedValue))
+
+	plaintext, err := ring.Open(sealedValue, []byte("uuid-alice"))
+	require.NoError(err)
+	assert.Equal([]byte("secret"), plaintext)
+
+	// the additional data binds the secret to its record
+	_, err = ring.Open(sealedValue, []byte("uuid-bob"))
+	assert.Error(err)
+
+	// plaintext written before encryption was enabled is returned unchanged
+	plaintext, err = ring.Open([]byte("legacy"), nil)
+	require.NoError(err)
+	assert.Equal([]byte("legacy"), plaintext)
+	assert.False(ring.Current([]byte("legacy")))
+}
+
+func TestRotation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	old, err := NewKeyRing("1", map[string][]byte{"1": testKey(1)})
+	require.NoError(err)
+	sealedValue, err := old.Seal([]byte("secret"), nil)
+	require.NoError(err)
+
+	rotated, err := NewKeyRing("2", map[string][]byte{"1": testKey(1), "2": testKey(2)})
+	require.NoError(err)
+	assert.False(rotated.Current(sealedValue))
+	plaintext, err := rotated.Open(sealedValue, nil)
+	require.NoError(err)
+	assert.Equal([]byte("secret"), plaintext)
+
+	resealed, err := rotated.Rewrap(sealedValue)
+	require.NoError(err)
+	assert.True(rotated.Current(resealed))
+	_, err = rotated.Rewrap([]byte("secret"))
+	assert.Error(err)
+
+	// once the old key is removed, only values sealed with the new key can be opened
+	retired, err := NewKeyRing("2", map[string][]byte{"2": testKey(2)})
+	require.NoError(err)
+	_, err = retired.Open(sealedValue, nil)
+	assert.Error(err)
+	_, err = retired.Open(resealed, nil)
+	assert.NoError(err)
+}
+
+func TestNewKeyRing(t *testing.T) {
+	testCases := map[string]struct {
+		current   string
+		keys      map[string][]byte
+		expectErr bool
+	}{
+		"valid": {
+			current: "1",
+			keys:    map[string][]byte{"1": testKey(1), "0": testKey(0)},
+		},
+		"missing current key": {
+			current:   "2",
+			keys:      map[string][]byte{"1": testKey(1)},
+			expectErr: true,
+		},
+		"no current key": {
+			keys:      map[string][]byte{"1": testKey(1)},
+			expectErr: true,
+		},
+		"short key": {
+			current:   "1",
+			keys:      map[string][]byte{"1": []byte("short")},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewKeyRing(tc.current, tc.keys)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	keyRing := fmt.Sprintf("current: \"2\"\nkeys:\n  \"1\": %s\n  \"2\": %s\n",
+		base64.StdEncoding.EncodeToString(testKey(1)), base64.StdEncoding.EncodeToString(testKey(2)))
+	secrets := map[string]map[string][]byte{
+		"keyring": {SecretKey: []byte(keyRing)},
+		"empty":   {},
+	}
+	secretData := func(name string) (map[string][]byte, error) {
+		data, ok := secrets[name]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return data, nil
+	}
+
+	testCases := map[string]struct {
+		conf      Config
+		expectErr bool
+	}{
+		"file":           {conf: Config{File: "keyring.yaml"}},
+		"secret":         {conf: Config{Secret: "keyring"}},
+		"missing file":   {conf: Config{File: "missing.yaml"}, expectErr: true},
+		"missing secret": {conf: Config{Secret: "missing"}, expectErr: true},
+		"secret without key ring": {
+			conf:      Config{Secret: "empty"},
+			expectErr: true,
+		},
+		"no source":   {expectErr: true},
+		"two sources": {conf: Config{File: "keyring.yaml", Secret: "keyring"}, expectErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fileHandler := file.NewHandler(afero.NewMemMapFs())
+			require.NoError(fileHandler.Write("keyring.yaml", []byte(keyRing)))
+			ring, err := Load(tc.conf, fileHandler, secretData)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			sealedValue, err := ring.Seal([]byte("secret"), nil)
+			require.NoError(err)
+			assert.Contains(string(sealedValue), `"kek":"2"`)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package hostkey manages the host keys of the ssh server in the store.
+//
+// The server uses one host key per key type for the handshake. A key is rotated in two steps: Rotate generates the
+// next key, which the server advertises to the clients with the hostkeys-00@openssh.com extension. Once the clients
+// had the chance to learn it, Complete replaces the current key with the next key and the old key is retired.
+// Running servers do not watch the store, they load the changed keys when they receive SIGHUP.
+package hostkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TypeRSA is a 4096 bit RSA key.
+	TypeRSA = "rsa"
+	// TypeECDSA is an ECDSA key on the P-256 curve.
+	TypeECDSA = "ecdsa"
+	// TypeEd25519 is an Ed25519 key.
+	TypeEd25519 = "ed25519"
+)
+
+// Types are the key types of the host keys, Ensure generates a key of each type.
+var Types = []string{TypeRSA, TypeECDSA, TypeEd25519}
+
+// sshTypes maps the ssh public key types to the key types.
+var sshTypes = map[string]string{
+	ssh.KeyAlgoRSA:      TypeRSA,
+	ssh.KeyAlgoECDSA256: TypeECDSA,
+	ssh.KeyAlgoED25519:  TypeEd25519,
+}
+
+// Set are the host keys of the ssh server.
+type Set struct {
+	// Current are the keys used for the handshake, there is at most one per key type.
+	Current []ssh.Signer
+	// Next are the keys of ongoing rotations, they are only advertised to the clients.
+	Next []ssh.Signer
+}
+
+// All returns the current and the next keys, all of them are advertised to the clients.
+func (s Set) All() []ssh.Signer {
+	return append(append([]ssh.Signer{}, s.Current...), s.Next...)
+}
+
+// Generate generates a PEM encoded private key of the key type.
+func Generate(keyType string) ([]byte, error) {
+	var privateKey any
+	var err error
+	switch keyType {
+	case TypeRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	case TypeECDSA:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case TypeEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown host key type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, "delegatio ssh host key")
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(pemBlock), nil
+}
+
+// Ensure generates the host keys missing in the store and returns their key types. The single host key of older
+// installations is imported first, so clients keep trusting the server.
+func Ensure(data storewrapper.StoreWrapper) ([]string, error) {
+	hostKeys, err := data.GetHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	var unsetErr *store.ValueUnsetError
+	legacyKey, err := data.GetPrivKey()
+	if err != nil && !errors.As(err, &unsetErr) {
+		return nil, err
+	}
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(legacyKey)
+		if err != nil {
+			return nil, fmt.Errorf("parsing legacy host key: %w", err)
+		}
+		if keyType, ok := sshTypes[signer.PublicKey().Type()]; ok {
+			if _, ok := hostKeys[keyType]; !ok {
+				if err := data.PutHostKey(keyType, config.HostKey{PrivateKey: legacyKey}); err != nil {
+					return nil, err
+				}
+				hostKeys[keyType] = config.HostKey{PrivateKey: legacyKey}
+			}
+		}
+	}
+	var generated []string
+	for _, keyType := range Types {
+		if _, ok := hostKeys[keyType]; ok {
+			continue
+		}
+		privateKey, err := Generate(keyType)
+		if err != nil {
+			return nil, err
+		}
+		if err := data.PutHostKey(keyType, config.HostKey{PrivateKey: privateKey}); err != nil {
+			return nil, err
+		}
+		generated = append(generated, keyType)
+	}
+	return generated, nil
+}
+
+// Load parses the host keys in the store. The keys are sorted by key type.
+func Load(data storewrapper.StoreWrapper) (Set, error) {
+	hostKeys, err := data.GetHostKeys()
+	if err != nil {
+		return Set{}, err
+	}
+	keyTypes := make([]string, 0, len(hostKeys))
+	for keyType := range hostKeys {
+		keyTypes = append(keyTypes, keyType)
+	}
+	sort.Strings(keyTypes)
+	var set Set
+	for _, keyType := range keyTypes {
+		signer, err := ssh.ParsePrivateKey(hostKeys[keyType].PrivateKey)
+		if err != nil {
+			return Set{}, fmt.Errorf("parsing %s host key: %w", keyType, err)
+		}
+		set.Current = append(set.Current, signer)
+		if hostKeys[keyType].NextPrivateKey == nil {
+			continue
+		}
+		next, err := ssh.ParsePrivateKey(hostKeys[keyType].NextPrivateKey)
+		if err != nil {
+			return Set{}, fmt.Errorf("parsing next %s host key: %w", keyType, err)
+		}
+		set.Next = append(set.Next, next)
+	}
+	return set, nil
+}
+
+// Rotate generates the next key of the key type and returns its public key.
+// The rotation is completed with Complete after the ssh servers advertised the key long enough.
+func Rotate(data storewrapper.StoreWrapper, keyType string) (ssh.PublicKey, error) {
+	next, err := Generate(keyType)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(next)
+	if err != nil {
+		return nil, err
+	}
+	err = update(data, keyType, func(hostKey *config.HostKey) error {
+		if hostKey.NextPrivateKey != nil {
+			return fmt.Errorf("rotation of the %s host key is already in progress", keyType)
+		}
+		hostKey.NextPrivateKey = next
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+// Complete replaces the key of the key type with its next key and returns the public key of the retired key.
+func Complete(data storewrapper.StoreWrapper, keyType string) (ssh.PublicKey, error) {
+	var retired ssh.Signer
+	err := update(data, keyType, func(hostKey *config.HostKey) error {
+		if hostKey.NextPrivateKey == nil {
+			return fmt.Errorf("no rotation of the %s host key in progress", keyType)
+		}
+		var err error
+		if retired, err = ssh.ParsePrivateKey(hostKey.PrivateKey); err != nil {
+			return err
+		}
+		*hostKey = config.HostKey{PrivateKey: hostKey.NextPrivateKey}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retired.PublicKey(), nil
+}
+
+// update changes the host key of the key type in one transaction.
+func update(data storewrapper.StoreWrapper, keyType string, fn func(*config.HostKey) error) error {
+	err := data.UpdateHostKey(keyType, fn)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("no %s host key in the store", keyType)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package hostkey
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestEnsure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := storewrapper.StoreWrapper{Store: store.NewStdStore()}
+	legacyKey, err := Generate(TypeEd25519)
+	require.NoError(err)
+	require.NoError(data.PutPrivKey(legacyKey))
+
+	generated, err := Ensure(data)
+	require.NoError(err)
+	assert.Equal([]string{TypeRSA, TypeECDSA}, generated)
+	generated, err = Ensure(data)
+	require.NoError(err)
+	assert.Empty(generated)
+
+	set, err := Load(data)
+	require.NoError(err)
+	assert.Empty(set.Next)
+	var keyTypes []string
+	for _, signer := range set.Current {
+		keyTypes = append(keyTypes, signer.PublicKey().Type())
+	}
+	assert.Equal([]string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}, keyTypes)
+	legacySigner, err := ssh.ParsePrivateKey(legacyKey)
+	require.NoError(err)
+	assert.Equal(legacySigner.PublicKey().Marshal(), set.Current[1].PublicKey().Marshal())
+}
+
+func TestRotation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := storewrapper.StoreWrapper{Store: store.NewStdStore()}
+	_, err := Rotate(data, TypeEd25519)
+	assert.Error(err)
+
+	privateKey, err := Generate(TypeEd25519)
+	require.NoError(err)
+	require.NoError(data.PutPrivKey(privateKey))
+	_, err = Ensure(data)
+	require.NoError(err)
+	_, err = Complete(data, TypeEd25519)
+	assert.Error(err)
+
+	next, err := Rotate(data, TypeEd25519)
+	require.NoError(err)
+	_, err = Rotate(data, TypeEd25519)
+	assert.Error(err)
+	set, err := Load(data)
+	require.NoError(err)
+	assert.Len(set.Current, len(Types))
+	require.Len(set.Next, 1)
+	assert.Equal(next.Marshal(), set.Next[0].PublicKey().Marshal())
+	assert.Len(set.All(), len(Types)+1)
+
+	retired, err := Complete(data, TypeEd25519)
+	require.NoError(err)
+	current, err := ssh.ParsePrivateKey(privateKey)
+	require.NoError(err)
+	assert.Equal(current.PublicKey().Marshal(), retired.Marshal())
+	set, err = Load(data)
+	require.NoError(err)
+	assert.Empty(set.Next)
+	assert.Contains(publicKeys(set.Current), string(next.Marshal()))
+	assert.NotContains(publicKeys(set.Current), string(retired.Marshal()))
+}
+
+func TestConcurrentRotation(t *testing.T) {
+	require := require.New(t)
+
+	data := storewrapper.StoreWrapper{Store: store.NewStdStore()}
+	_, err := Ensure(data)
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = Rotate(data, TypeEd25519)
+		}()
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestGenerate(t *testing.T) {
+	_, err := Generate("dsa")
+	assert.Error(t, err)
+}
+
+func publicKeys(signers []ssh.Signer) []string {
+	var keys []string
+	for _, signer := range signers {
+		keys = append(keys, string(signer.PublicKey().Marshal()))
+	}
+	return keys
+}
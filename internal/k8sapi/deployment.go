@@ -6,14 +6,21 @@ package k8sapi
 
 import (
 	"context"
+	"strconv"
+	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
 	appsAPI "k8s.io/api/apps/v1"
 	coreAPI "k8s.io/api/core/v1"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-var automountServiceAccountToken = true
+var (
+	automountServiceAccountToken = true
+	// sshTerminationGracePeriod leaves some time to close the connections after the drain grace period.
+	sshTerminationGracePeriod = int64((config.SSHPreStopDelay + config.SSHDrainGracePeriod + 30*time.Second).Seconds())
+)
 
 // CreateSSHDeployment creates a SSH Server deployment.
 func (k *Client) CreateSSHDeployment(ctx context.Context, namespace, deploymentName string, replicas int32) error {
@@ -47,6 +54,8 @@ func (k *Client) CreateSSHDeployment(ctx context.Context, namespace, deploymentN
 				Spec: coreAPI.PodSpec{
 					ServiceAccountName:           config.SSHServiceAccountName,
 					AutomountServiceAccountToken: &automountServiceAccountToken,
+					// The server drains open sessions for SSHDrainGracePeriod after the preStop hook before it is killed.
+					TerminationGracePeriodSeconds: &sshTerminationGracePeriod,
 					// Somehow needed, otherwise nginx wont connect to the pods.
 					HostNetwork: true,
 					Containers: []coreAPI.Container{
@@ -61,6 +70,25 @@ func (k *Client) CreateSSHDeployment(ctx context.Context, namespace, deploymentN
 									},
 								},
 							},
+							// The pod is unready while the server drains, so the load balancer stops sending new connections.
+							ReadinessProbe: &coreAPI.Probe{
+								ProbeHandler: coreAPI.ProbeHandler{
+									HTTPGet: &coreAPI.HTTPGetAction{
+										Path: config.SSHReadinessPath,
+										Port: intstr.FromInt32(config.SSHHealthPort),
+									},
+								},
+								PeriodSeconds:    2,
+								FailureThreshold: 1,
+							},
+							// The endpoints are removed while the hook runs, afterwards the server stops accepting connections.
+							Lifecycle: &coreAPI.Lifecycle{
+								PreStop: &coreAPI.LifecycleHandler{
+									Exec: &coreAPI.ExecAction{
+										Command: []string{"sleep", strconv.Itoa(int(config.SSHPreStopDelay.Seconds()))},
+									},
+								},
+							},
 							ImagePullPolicy: coreAPI.PullAlways,
 							SecurityContext: &coreAPI.SecurityContext{
 								Capabilities: &coreAPI.Capabilities{
@@ -75,6 +103,11 @@ func (k *Client) CreateSSHDeployment(ctx context.Context, namespace, deploymentN
 									ContainerPort: 2200,
 									Protocol:      coreAPI.ProtocolTCP,
 								},
+								{
+									Name:          "health",
+									ContainerPort: config.SSHHealthPort,
+									Protocol:      coreAPI.ProtocolTCP,
+								},
 							},
 						},
 					},
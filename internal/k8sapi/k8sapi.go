@@ -6,6 +6,9 @@ package k8sapi
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"errors"
 	"net"
 	"os"
@@ -14,9 +17,12 @@ import (
 	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/hostkey"
 	"github.com/benschlueter/delegatio/internal/store"
 	"github.com/benschlueter/delegatio/internal/storewrapper"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -32,6 +38,8 @@ type Client struct {
 	requestID   int
 	mux         sync.Mutex
 	SharedStore store.Store
+	// Keys encrypt the secrets in the shared store, they are stored in plaintext if it is nil.
+	Keys *envelope.KeyRing
 }
 
 // NewClient returns a new kuberenetes client-go wrapper.
@@ -86,12 +94,12 @@ func (k *Client) GetStoreUserData() (data *config.UserConfiguration, err error)
 		k.logger.Info("client is not connected to etcd")
 		return nil, ErrNotConnected
 	}
-	stWrapper := storewrapper.StoreWrapper{Store: k.SharedStore}
+	stWrapper := k.data()
 	challenges, err := stWrapper.GetAllChallenges()
 	if err != nil {
 		return nil, err
 	}
-	userData, err := stWrapper.GetAllPublicKeys()
+	userData, err := stWrapper.GetAllUsers()
 	if err != nil {
 		return nil, err
 	}
@@ -99,14 +107,42 @@ func (k *Client) GetStoreUserData() (data *config.UserConfiguration, err error)
 	return data, nil
 }
 
-// UploadSSHServerPrivKey uploads the ssh server private key to the store.
-func (k *Client) UploadSSHServerPrivKey(privKey []byte) (err error) {
+// UploadSSHHostKeys generates the missing host keys of the ssh server and uploads them to the store.
+// Existing keys are kept, so clients keep trusting the server.
+func (k *Client) UploadSSHHostKeys() (err error) {
 	if k.SharedStore == nil {
 		k.logger.Info("client is not connected to etcd")
 		return ErrNotConnected
 	}
-	stWrapper := storewrapper.StoreWrapper{Store: k.SharedStore}
-	return stWrapper.PutPrivKey(privKey)
+	generated, err := hostkey.Ensure(k.data())
+	if err != nil {
+		return err
+	}
+	k.logger.Info("generated ssh host keys", zap.Strings("types", generated))
+	return nil
+}
+
+// UploadSSHCAKey generates the private key of the ssh certificate authority and uploads it to the store.
+// An existing key is kept, so certificates issued before stay valid.
+func (k *Client) UploadSSHCAKey() (err error) {
+	if k.SharedStore == nil {
+		k.logger.Info("client is not connected to etcd")
+		return ErrNotConnected
+	}
+	stWrapper := k.data()
+	var unsetErr *store.ValueUnsetError
+	if _, err := stWrapper.GetCAKey(); !errors.As(err, &unsetErr) {
+		return err
+	}
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(privKey, "delegatio ssh ca")
+	if err != nil {
+		return err
+	}
+	return stWrapper.PutCAKey(pem.EncodeToMemory(pemBlock))
 }
 
 // DownloadSSHServerPrivKey downloads the ssh server private key from the store.
@@ -115,8 +151,12 @@ func (k *Client) DownloadSSHServerPrivKey(privKey []byte) (err error) {
 		k.logger.Info("client is not connected to etcd")
 		return ErrNotConnected
 	}
-	stWrapper := storewrapper.StoreWrapper{Store: k.SharedStore}
-	return stWrapper.PutPrivKey(privKey)
+	return k.data().PutPrivKey(privKey)
+}
+
+// data returns the wrapper of the shared store.
+func (k *Client) data() storewrapper.StoreWrapper {
+	return storewrapper.StoreWrapper{Store: k.SharedStore, Keys: k.Keys}
 }
 
 // GetKubeConfigPath returns the path to the kubeconfig file.
@@ -20,3 +20,12 @@ func (k *Client) CreateSecret(ctx context.Context, name string) error {
 	}
 	return nil
 }
+
+// GetSecretData gets the data of a given secret.
+func (k *Client) GetSecretData(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret, err := k.Client.CoreV1().Secrets(namespace).Get(ctx, name, metaAPI.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
@@ -5,13 +5,21 @@
 package templates
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/benschlueter/delegatio/internal/config"
 	appsAPI "k8s.io/api/apps/v1"
 	coreAPI "k8s.io/api/core/v1"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-var automountServiceAccountToken = true
+var (
+	automountServiceAccountToken = true
+	// sshTerminationGracePeriod leaves some time to close the connections after the drain grace period.
+	sshTerminationGracePeriod = int64((config.SSHPreStopDelay + config.SSHDrainGracePeriod + 30*time.Second).Seconds())
+)
 
 // Deployment creates a deployment template.
 func Deployment(namespace, deploymentName string, replicas int32) *appsAPI.Deployment {
@@ -45,6 +53,8 @@ func Deployment(namespace, deploymentName string, replicas int32) *appsAPI.Deplo
 				Spec: coreAPI.PodSpec{
 					ServiceAccountName:           "development",
 					AutomountServiceAccountToken: &automountServiceAccountToken,
+					// The server drains open sessions for SSHDrainGracePeriod after the preStop hook before it is killed.
+					TerminationGracePeriodSeconds: &sshTerminationGracePeriod,
 					// Somehow needed, otherwise nginx wont connect to the pods.
 					HostNetwork: true,
 					Containers: []coreAPI.Container{
@@ -59,6 +69,25 @@ func Deployment(namespace, deploymentName string, replicas int32) *appsAPI.Deplo
 									},
 								},
 							},
+							// The pod is unready while the server drains, so the load balancer stops sending new connections.
+							ReadinessProbe: &coreAPI.Probe{
+								ProbeHandler: coreAPI.ProbeHandler{
+									HTTPGet: &coreAPI.HTTPGetAction{
+										Path: config.SSHReadinessPath,
+										Port: intstr.FromInt32(config.SSHHealthPort),
+									},
+								},
+								PeriodSeconds:    2,
+								FailureThreshold: 1,
+							},
+							// The endpoints are removed while the hook runs, afterwards the server stops accepting connections.
+							Lifecycle: &coreAPI.Lifecycle{
+								PreStop: &coreAPI.LifecycleHandler{
+									Exec: &coreAPI.ExecAction{
+										Command: []string{"sleep", strconv.Itoa(int(config.SSHPreStopDelay.Seconds()))},
+									},
+								},
+							},
 							ImagePullPolicy: coreAPI.PullAlways,
 							SecurityContext: &coreAPI.SecurityContext{
 								Capabilities: &coreAPI.Capabilities{
@@ -73,6 +102,11 @@ func Deployment(namespace, deploymentName string, replicas int32) *appsAPI.Deplo
 									ContainerPort: 2200,
 									Protocol:      coreAPI.ProtocolTCP,
 								},
+								{
+									Name:          "health",
+									ContainerPort: config.SSHHealthPort,
+									Protocol:      coreAPI.ProtocolTCP,
+								},
 							},
 						},
 					},
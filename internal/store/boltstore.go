@@ -0,0 +1,333 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds all entries of the store.
+var boltBucket = []byte("delegatio")
+
+// BoltStore is a store that uses an embedded bbolt database on disk as a backend.
+// It is meant for single node and development setups, the database can only be opened by one process.
+type BoltStore struct {
+	db *bolt.DB
+	// writeMut serializes the writes, so the changes are published in the order they are committed.
+	writeMut txLock
+	notifier notifier
+}
+
+// NewBoltStore opens or creates the database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt database %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return &BoltStore{db: db, writeMut: newTxLock()}, nil
+}
+
+// Get retrieves a value from BoltStore by Type and Name.
+func (s *BoltStore) Get(request string) ([]byte, error) {
+	return s.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value from BoltStore by Type and Name.
+func (s *BoltStore) GetContext(ctx context.Context, request string) ([]byte, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value = boltGet(tx, request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, &ValueUnsetError{requestedValue: request}
+	}
+	return value, nil
+}
+
+// Put saves a value in BoltStore by Type and Name.
+func (s *BoltStore) Put(request string, requestData []byte) error {
+	return s.PutContext(context.Background(), request, requestData)
+}
+
+// PutContext saves a value in BoltStore by Type and Name.
+func (s *BoltStore) PutContext(ctx context.Context, request string, requestData []byte) error {
+	tx, err := s.BeginTransactionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Put(request, requestData); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete deletes the store entry with the given key.
+func (s *BoltStore) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the store entry with the given key.
+func (s *BoltStore) DeleteContext(ctx context.Context, key string) error {
+	tx, err := s.BeginTransactionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Delete(key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Iterator returns an Iterator for a given prefix.
+func (s *BoltStore) Iterator(prefix string) (Iterator, error) {
+	return s.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an Iterator for a given prefix.
+func (s *BoltStore) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		keys = boltKeys(tx, prefix)
+		return nil
+	})
+	return &StdIterator{0, keys}, err
+}
+
+// Range returns a page of the entries with the prefix, starting after the continuation token.
+func (s *BoltStore) Range(prefix, token string, limit int) (Page, error) {
+	return s.RangeContext(context.Background(), prefix, token, limit)
+}
+
+// RangeContext returns a page of the entries with the prefix, starting after the continuation token.
+func (s *BoltStore) RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error) {
+	if err := contextError(ctx); err != nil {
+		return Page{}, err
+	}
+	if err := checkRange(prefix, token, limit); err != nil {
+		return Page{}, err
+	}
+	var page Page
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		key, value := cursor.Seek([]byte(prefix))
+		if token != "" {
+			key, value = cursor.Seek([]byte(token))
+			if string(key) == token {
+				key, value = cursor.Next()
+			}
+		}
+		for ; key != nil && bytes.HasPrefix(key, []byte(prefix)); key, value = cursor.Next() {
+			if len(page.Entries) == limit {
+				page.Next = page.Entries[limit-1].Key
+				break
+			}
+			page.Entries = append(page.Entries, KeyValue{Key: string(key), Value: bytes.Clone(value)})
+		}
+		return nil
+	})
+	return page, err
+}
+
+// Transfer transfers all entries from this store to the given store in batches of transactions.
+func (s *BoltStore) Transfer(newstore Store) error {
+	var keys []string
+	var values [][]byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, value []byte) error {
+			keys = append(keys, string(key))
+			values = append(values, bytes.Clone(value))
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += transferBatchSize {
+		end := min(start+transferBatchSize, len(keys))
+		if err := putBatch(newstore, keys[start:end], values[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch returns the changes of the keys with the given prefix until cancel is called.
+func (s *BoltStore) Watch(prefix string) (<-chan Event, func()) {
+	return s.notifier.watch(prefix)
+}
+
+// BeginTransaction starts a new transaction.
+func (s *BoltStore) BeginTransaction() (Transaction, error) {
+	return s.BeginTransactionContext(context.Background())
+}
+
+// BeginTransactionContext starts a new transaction, it waits until other transactions are committed or rolled back.
+func (s *BoltStore) BeginTransactionContext(ctx context.Context) (Transaction, error) {
+	if err := s.writeMut.lock(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		s.writeMut.unlock()
+		return nil, err
+	}
+	return &boltTransaction{store: s, tx: tx}, nil
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTransaction is a writable bolt transaction, it sees its own changes.
+type boltTransaction struct {
+	store  *BoltStore
+	tx     *bolt.Tx
+	events []Event
+}
+
+// Get retrieves a value.
+func (t *boltTransaction) Get(request string) ([]byte, error) {
+	return t.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value.
+func (t *boltTransaction) GetContext(ctx context.Context, request string) ([]byte, error) {
+	if t.tx == nil {
+		return nil, errors.New("no ongoing transaction")
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	value := boltGet(t.tx, request)
+	if value == nil {
+		return nil, &ValueUnsetError{requestedValue: request}
+	}
+	return value, nil
+}
+
+// Put saves a value.
+func (t *boltTransaction) Put(request string, requestData []byte) error {
+	if t.tx == nil {
+		return errors.New("no ongoing transaction")
+	}
+	// bolt references the value until the commit
+	value := bytes.Clone(requestData)
+	if value == nil {
+		value = []byte{}
+	}
+	if err := t.tx.Bucket(boltBucket).Put([]byte(request), value); err != nil {
+		return err
+	}
+	t.events = append(t.events, Event{Type: EventPut, Key: request, Value: value})
+	return nil
+}
+
+// Delete deletes the key if it exists.
+func (t *boltTransaction) Delete(key string) error {
+	if t.tx == nil {
+		return errors.New("no ongoing transaction")
+	}
+	bucket := t.tx.Bucket(boltBucket)
+	if bucket.Get([]byte(key)) == nil {
+		return nil
+	}
+	if err := bucket.Delete([]byte(key)); err != nil {
+		return err
+	}
+	t.events = append(t.events, Event{Type: EventDelete, Key: key})
+	return nil
+}
+
+// Iterator returns an iterator for all keys in the transaction with a given prefix.
+func (t *boltTransaction) Iterator(prefix string) (Iterator, error) {
+	return t.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an iterator for all keys in the transaction with a given prefix.
+func (t *boltTransaction) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	if t.tx == nil {
+		return nil, errors.New("no ongoing transaction")
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	return &StdIterator{0, boltKeys(t.tx, prefix)}, nil
+}
+
+// Commit ends a transaction and persists the changes.
+func (t *boltTransaction) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext ends a transaction and persists the changes, nothing is written if the context is done.
+func (t *boltTransaction) CommitContext(ctx context.Context) error {
+	if t.tx == nil {
+		return errors.New("no ongoing transaction")
+	}
+	if err := contextError(ctx); err != nil {
+		t.Rollback()
+		return err
+	}
+	err := t.tx.Commit()
+	t.tx = nil
+	if err == nil {
+		t.store.notifier.publish(t.events)
+	}
+	t.store.writeMut.unlock()
+	return err
+}
+
+// Rollback aborts a transaction. Noop if already committed.
+func (t *boltTransaction) Rollback() {
+	if t.tx == nil {
+		return
+	}
+	_ = t.tx.Rollback()
+	t.tx = nil
+	t.store.writeMut.unlock()
+}
+
+// boltGet returns a copy of the value, it is nil if the key does not exist.
+func boltGet(tx *bolt.Tx, key string) []byte {
+	value := tx.Bucket(boltBucket).Get([]byte(key))
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+// boltKeys returns the keys with the prefix in ascending order.
+func boltKeys(tx *bolt.Tx, prefix string) []string {
+	keys := make([]string, 0)
+	cursor := tx.Bucket(boltBucket).Cursor()
+	for key, _ := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = cursor.Next() {
+		keys = append(keys, string(key))
+	}
+	return keys
+}
@@ -0,0 +1,45 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltStore(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	testStore(t, func() (Store, error) {
+		return store, nil
+	})
+}
+
+func TestBoltStorePersistence(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "store.db")
+	store, err := NewBoltStore(path)
+	require.NoError(err)
+	require.NoError(store.Put("key", []byte("value")))
+	require.NoError(store.Put("empty", nil))
+	require.NoError(store.Close())
+
+	store, err = NewBoltStore(path)
+	require.NoError(err)
+	defer store.Close()
+	value, err := store.Get("key")
+	require.NoError(err)
+	assert.Equal([]byte("value"), value)
+	value, err = store.Get("empty")
+	require.NoError(err)
+	assert.Empty(value)
+}
@@ -0,0 +1,275 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cacheRetryInterval is the pause before a failed watch is restarted.
+const cacheRetryInterval = time.Second
+
+// Cache is a Store which serves the keys with the cached prefixes from memory. The memory is loaded once and kept up
+// to date by watching the store, keys are read from the store until their prefix is loaded and while a watch is
+// restarted. Puts, deletes and the changes of committed transactions are written through, so they are visible to the
+// next read of the same cache before they are watched.
+type Cache struct {
+	Store
+	log *zap.Logger
+
+	mut     sync.RWMutex
+	entries map[string][]byte
+	// loaded contains the prefixes which are served from memory.
+	loaded map[string]bool
+
+	cancel chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewCache creates a cache of the prefixes of the store, Close stops watching the store.
+func NewCache(log *zap.Logger, backingStore Store, prefixes ...string) *Cache {
+	c := &Cache{
+		Store:   backingStore,
+		log:     log,
+		entries: make(map[string][]byte),
+		loaded:  make(map[string]bool),
+		cancel:  make(chan struct{}),
+	}
+	for _, prefix := range prefixes {
+		c.wg.Add(1)
+		go c.watch(prefix)
+	}
+	return c
+}
+
+// Get returns the value of the key, from memory if its prefix is loaded.
+func (c *Cache) Get(key string) ([]byte, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value of the key, from memory if its prefix is loaded.
+func (c *Cache) GetContext(ctx context.Context, key string) ([]byte, error) {
+	c.mut.RLock()
+	if c.cached(key) {
+		value, ok := c.entries[key]
+		c.mut.RUnlock()
+		if !ok {
+			return nil, &ValueUnsetError{requestedValue: key}
+		}
+		return bytes.Clone(value), nil
+	}
+	c.mut.RUnlock()
+	return c.Store.GetContext(ctx, key)
+}
+
+// Range returns a page of the entries with the prefix, from memory if the prefix is loaded.
+func (c *Cache) Range(prefix, token string, limit int) (Page, error) {
+	return c.RangeContext(context.Background(), prefix, token, limit)
+}
+
+// RangeContext returns a page of the entries with the prefix, from memory if the prefix is loaded.
+func (c *Cache) RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error) {
+	c.mut.RLock()
+	if c.cached(prefix) {
+		defer c.mut.RUnlock()
+		if err := checkRange(prefix, token, limit); err != nil {
+			return Page{}, err
+		}
+		return rangeKeys(slices.Collect(maps.Keys(c.entries)), prefix, token, limit, func(key string) []byte {
+			return bytes.Clone(c.entries[key])
+		}), nil
+	}
+	c.mut.RUnlock()
+	return c.Store.RangeContext(ctx, prefix, token, limit)
+}
+
+// Put saves the value in the store and in memory.
+func (c *Cache) Put(key string, value []byte) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext saves the value in the store and in memory.
+func (c *Cache) PutContext(ctx context.Context, key string, value []byte) error {
+	if err := c.Store.PutContext(ctx, key, value); err != nil {
+		return err
+	}
+	c.apply(Event{Type: EventPut, Key: key, Value: bytes.Clone(value)})
+	return nil
+}
+
+// Delete deletes the key from the store and from memory.
+func (c *Cache) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the key from the store and from memory.
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	if err := c.Store.DeleteContext(ctx, key); err != nil {
+		return err
+	}
+	c.apply(Event{Type: EventDelete, Key: key})
+	return nil
+}
+
+// BeginTransaction starts a transaction, its changes are applied to memory on commit.
+func (c *Cache) BeginTransaction() (Transaction, error) {
+	return c.BeginTransactionContext(context.Background())
+}
+
+// BeginTransactionContext starts a transaction, its changes are applied to memory on commit.
+func (c *Cache) BeginTransactionContext(ctx context.Context) (Transaction, error) {
+	tx, err := c.Store.BeginTransactionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheTransaction{Transaction: tx, cache: c}, nil
+}
+
+// Close stops watching the store.
+func (c *Cache) Close() {
+	close(c.cancel)
+	c.wg.Wait()
+}
+
+// watch loads the prefix and applies its changes, the prefix is reloaded if the watch fails.
+func (c *Cache) watch(prefix string) {
+	defer c.wg.Done()
+	for {
+		events, cancel := c.Store.Watch(prefix)
+		if err := c.load(prefix); err != nil {
+			c.log.Error("failed to load cached keys", zap.String("prefix", prefix), zap.Error(err))
+		} else {
+			c.follow(events)
+			c.log.Info("watch of cached keys ended, reloading", zap.String("prefix", prefix))
+		}
+		cancel()
+		c.unload(prefix)
+		select {
+		case <-c.cancel:
+			return
+		case <-time.After(cacheRetryInterval):
+		}
+	}
+}
+
+// follow applies the events until the watch ends or the cache is closed.
+func (c *Cache) follow(events <-chan Event) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			c.apply(event)
+		case <-c.cancel:
+			return
+		}
+	}
+}
+
+// load reads the keys of the prefix into memory. Changes watched during the load are applied afterwards and
+// overwrite the loaded values in the order they happened.
+func (c *Cache) load(prefix string) error {
+	entries := make(map[string][]byte)
+	err := Scan(context.Background(), c.Store, prefix, func(entry KeyValue) error {
+		entries[entry.Key] = entry.Value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for key, value := range entries {
+		c.entries[key] = value
+	}
+	c.loaded[prefix] = true
+	return nil
+}
+
+// unload serves the prefix from the store until it is loaded again.
+func (c *Cache) unload(prefix string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.loaded, prefix)
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *Cache) apply(event Event) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.cached(event.Key) {
+		return
+	}
+	if event.Type == EventDelete {
+		delete(c.entries, event.Key)
+		return
+	}
+	c.entries[event.Key] = event.Value
+}
+
+// cached returns whether the key is served from memory, the caller holds the lock.
+func (c *Cache) cached(key string) bool {
+	for prefix := range c.loaded {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheTransaction records the changes of a transaction and applies them to the cache once they are committed.
+type cacheTransaction struct {
+	Transaction
+	cache   *Cache
+	changes []Event
+}
+
+// Put saves a value to store by key.
+func (t *cacheTransaction) Put(key string, value []byte) error {
+	if err := t.Transaction.Put(key, value); err != nil {
+		return err
+	}
+	t.changes = append(t.changes, Event{Type: EventPut, Key: key, Value: bytes.Clone(value)})
+	return nil
+}
+
+// Delete deletes the key.
+func (t *cacheTransaction) Delete(key string) error {
+	if err := t.Transaction.Delete(key); err != nil {
+		return err
+	}
+	t.changes = append(t.changes, Event{Type: EventDelete, Key: key})
+	return nil
+}
+
+// Commit persists the changes and applies them to the cache.
+func (t *cacheTransaction) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext persists the changes and applies them to the cache.
+func (t *cacheTransaction) CommitContext(ctx context.Context) error {
+	if err := t.Transaction.CommitContext(ctx); err != nil {
+		return err
+	}
+	for _, event := range t.changes {
+		t.cache.apply(event)
+	}
+	t.changes = nil
+	return nil
+}
@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backingStore := NewStdStore()
+	require.NoError(backingStore.Put("uuid-a", []byte("a")))
+	cache := NewCache(zap.NewNop(), backingStore, "uuid-")
+	defer cache.Close()
+	assert.Eventually(func() bool {
+		cache.mut.RLock()
+		defer cache.mut.RUnlock()
+		return cache.loaded["uuid-"]
+	}, time.Second, time.Millisecond)
+
+	value, err := cache.Get("uuid-a")
+	require.NoError(err)
+	assert.Equal([]byte("a"), value)
+
+	// changes of other writers are watched
+	require.NoError(backingStore.Put("uuid-b", []byte("b")))
+	require.NoError(backingStore.Delete("uuid-a"))
+	assert.Eventually(func() bool {
+		value, err := cache.Get("uuid-b")
+		_, unsetErr := cache.Get("uuid-a")
+		return err == nil && string(value) == "b" && unsetErr != nil
+	}, time.Second, time.Millisecond)
+
+	// own changes are visible immediately
+	require.NoError(cache.Put("uuid-c", []byte("c")))
+	cache.mut.RLock()
+	assert.Equal([]byte("c"), cache.entries["uuid-c"])
+	cache.mut.RUnlock()
+	require.NoError(cache.Delete("uuid-c"))
+	_, err = cache.Get("uuid-c")
+	var unsetErr *ValueUnsetError
+	assert.ErrorAs(err, &unsetErr)
+
+	// other keys are read from the store
+	require.NoError(backingStore.Put("other", []byte("o")))
+	value, err = cache.Get("other")
+	require.NoError(err)
+	assert.Equal([]byte("o"), value)
+	cache.mut.RLock()
+	assert.NotContains(cache.entries, "other")
+	cache.mut.RUnlock()
+
+	// ranges of loaded prefixes are read from memory
+	require.NoError(cache.Put("uuid-d", []byte("d")))
+	page, err := cache.Range("uuid-", "", 1)
+	require.NoError(err)
+	assert.Equal([]KeyValue{{Key: "uuid-b", Value: []byte("b")}}, page.Entries)
+	page, err = cache.Range("uuid-", page.Next, 1)
+	require.NoError(err)
+	assert.Equal([]KeyValue{{Key: "uuid-d", Value: []byte("d")}}, page.Entries)
+	assert.Empty(page.Next)
+	page, err = cache.Range("oth", "", 1)
+	require.NoError(err)
+	assert.Equal([]KeyValue{{Key: "other", Value: []byte("o")}}, page.Entries)
+}
+
+func TestCacheReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backingStore := &failingWatchStore{StdStore: NewStdStore()}
+	require.NoError(backingStore.Put("uuid-a", []byte("a")))
+	cache := NewCache(zap.NewNop(), backingStore, "uuid-")
+	defer cache.Close()
+
+	// the failed watch is restarted and the prefix reloaded
+	assert.Eventually(func() bool {
+		backingStore.mut.Lock()
+		defer backingStore.mut.Unlock()
+		return backingStore.watches > 1
+	}, 5*time.Second, time.Millisecond)
+	value, err := cache.Get("uuid-a")
+	require.NoError(err)
+	assert.Equal([]byte("a"), value)
+}
+
+func TestCacheTransaction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// the changes are never watched, they are visible only because the cache applies them
+	backingStore := &silentWatchStore{StdStore: NewStdStore()}
+	require.NoError(backingStore.Put("uuid-a", []byte("a")))
+	cache := NewCache(zap.NewNop(), backingStore, "uuid-")
+	defer cache.Close()
+	assert.Eventually(func() bool {
+		cache.mut.RLock()
+		defer cache.mut.RUnlock()
+		return cache.loaded["uuid-"]
+	}, time.Second, time.Millisecond)
+
+	tx, err := cache.BeginTransaction()
+	require.NoError(err)
+	require.NoError(tx.Put("uuid-b", []byte("b")))
+	require.NoError(tx.Delete("uuid-a"))
+	require.NoError(tx.Commit())
+	value, err := cache.Get("uuid-b")
+	require.NoError(err)
+	assert.Equal([]byte("b"), value)
+	_, err = cache.Get("uuid-a")
+	var unsetErr *ValueUnsetError
+	assert.ErrorAs(err, &unsetErr)
+
+	// rolled back changes are not applied
+	tx, err = cache.BeginTransaction()
+	require.NoError(err)
+	require.NoError(tx.Put("uuid-c", []byte("c")))
+	tx.Rollback()
+	_, err = cache.Get("uuid-c")
+	assert.ErrorAs(err, &unsetErr)
+}
+
+// silentWatchStore never reports changes.
+type silentWatchStore struct {
+	*StdStore
+}
+
+func (s *silentWatchStore) Watch(string) (<-chan Event, func()) {
+	events := make(chan Event)
+	var once sync.Once
+	return events, func() { once.Do(func() { close(events) }) }
+}
+
+// failingWatchStore fails the first watch.
+type failingWatchStore struct {
+	*StdStore
+	mut     sync.Mutex
+	watches int
+}
+
+func (s *failingWatchStore) Watch(prefix string) (<-chan Event, func()) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.watches++
+	if s.watches == 1 {
+		events := make(chan Event)
+		close(events)
+		return events, func() {}
+	}
+	return s.StdStore.Watch(prefix)
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store backends selectable by configuration.
+const (
+	// BackendEtcd is the etcd of the cluster.
+	BackendEtcd = "etcd"
+	// BackendBolt is an embedded database on disk for single node and development use.
+	BackendBolt = "bolt"
+)
+
+// Config selects the backend of the store.
+type Config struct {
+	// Backend is "etcd" or "bolt". Defaults to etcd.
+	Backend string `yaml:"backend"`
+	// Path is the database file of the bolt backend.
+	Path string `yaml:"path"`
+	// Locking serializes all etcd transactions with one lock instead of optimistic transactions.
+	Locking bool `yaml:"locking"`
+	// Timeout is the deadline of each etcd call. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Validate checks that the backend is known and complete.
+func (c Config) Validate() error {
+	switch c.Backend {
+	case "", BackendEtcd:
+		if c.Timeout < 0 {
+			return errors.New("store: timeout must not be negative")
+		}
+		return nil
+	case BackendBolt:
+		if c.Path == "" {
+			return errors.New("store: path is required for the bolt backend")
+		}
+		return nil
+	default:
+		return fmt.Errorf("store: unknown backend %q, use %s or %s", c.Backend, BackendEtcd, BackendBolt)
+	}
+}
+
+// Open opens the store of the configuration, etcd connects to the etcd of the cluster.
+func Open(conf Config, etcd func() (Store, error)) (Store, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.Backend == BackendBolt {
+		boltStore, err := NewBoltStore(conf.Path)
+		if err != nil {
+			return nil, err
+		}
+		return boltStore, nil
+	}
+	etcdStore, err := etcd()
+	if err != nil {
+		return nil, err
+	}
+	if locker, ok := etcdStore.(interface{ SetLocking(bool) }); ok {
+		locker.SetLocking(conf.Locking)
+	}
+	if timeouter, ok := etcdStore.(interface{ SetTimeout(time.Duration) }); ok && conf.Timeout > 0 {
+		timeouter.SetTimeout(conf.Timeout)
+	}
+	return etcdStore, nil
+}
@@ -9,26 +9,36 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // TODO: Generate certificates for this user.
 const (
 	etcdPrefix  = "delegatioRegion"
 	dialTimeout = 10 * time.Second
+	// callTimeout bounds every call to etcd, so a stalled etcd does not block the callers forever.
+	callTimeout = 10 * time.Second
+	// transferPageSize is the number of entries read per range request during Transfer.
+	transferPageSize = 500
 )
 
 // EtcdStore is a store that uses etcd as a backend.
 type EtcdStore struct {
 	client *clientv3.Client
+	// locking serializes all transactions with one lock instead of checking the revisions of the read keys on commit.
+	locking bool
+	timeout time.Duration
 }
 
 // NewEtcdStore creates a new EtcdStore.
@@ -60,14 +70,31 @@ func NewEtcdStore(endpoints []string, logger *zap.Logger, caCert, cert, key []by
 		return nil, err
 	}
 
-	return &EtcdStore{client: cli}, nil
+	return &EtcdStore{client: cli, timeout: callTimeout}, nil
+}
+
+// SetTimeout sets the deadline of each call to etcd, calls fail with an UnavailableError after it.
+func (s *EtcdStore) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// callContext bounds one call to etcd.
+func (s *EtcdStore) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout)
 }
 
 // Get retrieves a value from EtcdStore by Type and Name.
 func (s *EtcdStore) Get(request string) ([]byte, error) {
-	values, err := s.client.Get(context.TODO(), etcdPrefix+request)
+	return s.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value from EtcdStore by Type and Name.
+func (s *EtcdStore) GetContext(ctx context.Context, request string) ([]byte, error) {
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+	values, err := s.client.Get(ctx, etcdPrefix+request)
 	if err != nil {
-		return nil, err
+		return nil, etcdError(ctx, err)
 	}
 	if values.Count == 0 {
 		return nil, &ValueUnsetError{requestedValue: request}
@@ -80,51 +107,202 @@ func (s *EtcdStore) Get(request string) ([]byte, error) {
 
 // Put saves a value in EtcdStore by Type and Name.
 func (s *EtcdStore) Put(request string, requestData []byte) error {
-	_, err := s.client.Put(context.TODO(), etcdPrefix+request, string(requestData))
-	return err
+	return s.PutContext(context.Background(), request, requestData)
+}
+
+// PutContext saves a value in EtcdStore by Type and Name.
+func (s *EtcdStore) PutContext(ctx context.Context, request string, requestData []byte) error {
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+	_, err := s.client.Put(ctx, etcdPrefix+request, string(requestData))
+	return etcdError(ctx, err)
 }
 
 // Iterator returns an Iterator for a given prefix.
 func (s *EtcdStore) Iterator(prefix string) (Iterator, error) {
-	resp, err := s.client.Get(context.TODO(), etcdPrefix+prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
-	keys := make([]string, 0, len(resp.Kvs))
+	return s.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an Iterator for a given prefix, the keys are read in pages while iterating.
+func (s *EtcdStore) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	iter := &EtcdIterator{store: s, ctx: ctx, prefix: prefix}
+	if err := iter.fetch(); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// Range returns a page of the entries with the prefix, starting after the continuation token.
+func (s *EtcdStore) Range(prefix, token string, limit int) (Page, error) {
+	return s.RangeContext(context.Background(), prefix, token, limit)
+}
+
+// RangeContext returns a page of the entries with the prefix, starting after the continuation token.
+func (s *EtcdStore) RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error) {
+	return s.rangePage(ctx, prefix, token, limit, false)
+}
+
+// rangePage reads one page of the prefix with a single request.
+func (s *EtcdStore) rangePage(ctx context.Context, prefix, token string, limit int, keysOnly bool) (Page, error) {
+	if err := checkRange(prefix, token, limit); err != nil {
+		return Page{}, err
+	}
+	start := etcdPrefix + prefix
+	if token != "" {
+		// the smallest key after the token
+		start = etcdPrefix + token + "\x00"
+	}
+	opts := []clientv3.OpOption{
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(etcdPrefix + prefix)),
+		clientv3.WithLimit(int64(limit)),
+	}
+	if keysOnly {
+		opts = append(opts, clientv3.WithKeysOnly())
+	}
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+	resp, err := s.client.Get(ctx, start, opts...)
+	if err != nil {
+		return Page{}, etcdError(ctx, err)
+	}
+	page := Page{Entries: make([]KeyValue, 0, len(resp.Kvs))}
 	for _, kv := range resp.Kvs {
-		key := strings.TrimPrefix(string(kv.Key), etcdPrefix)
-		keys = append(keys, key)
+		page.Entries = append(page.Entries, KeyValue{Key: strings.TrimPrefix(string(kv.Key), etcdPrefix), Value: kv.Value})
+	}
+	if resp.More && len(page.Entries) > 0 {
+		page.Next = page.Entries[len(page.Entries)-1].Key
 	}
-	output := &EtcdIterator{keys: keys}
-	return output, err
+	return page, nil
 }
 
-// Transfer transfers all entries from this store to the given store.
-// TODO: Implement this function, currently this function is never called.
-func (s *EtcdStore) Transfer(_ Store) error {
-	panic("etcd store Transfer() function not implemented, should never be called")
+// Transfer transfers all entries from this store to the given store. The entries are read in pages from one revision
+// and written in batches of transactions.
+func (s *EtcdStore) Transfer(newstore Store) error {
+	key := etcdPrefix
+	rangeEnd := clientv3.GetPrefixRangeEnd(etcdPrefix)
+	var revision int64
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(rangeEnd), clientv3.WithLimit(transferPageSize)}
+		if revision != 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		ctx, cancel := s.callContext(context.Background())
+		resp, err := s.client.Get(ctx, key, opts...)
+		cancel()
+		if err != nil {
+			return etcdError(ctx, err)
+		}
+		// all pages are read from the revision of the first page, so the copy is consistent
+		revision = resp.Header.Revision
+		for batch := range slices.Chunk(resp.Kvs, transferBatchSize) {
+			keys := make([]string, 0, len(batch))
+			values := make([][]byte, 0, len(batch))
+			for _, kv := range batch {
+				keys = append(keys, strings.TrimPrefix(string(kv.Key), etcdPrefix))
+				values = append(values, kv.Value)
+			}
+			if err := putBatch(newstore, keys, values); err != nil {
+				return err
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// continue after the last key of the page
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// Watch returns the changes of the keys with the given prefix until cancel is called. The channel is closed if the
+// watch fails, e.g. after a compaction of the watched revision.
+func (s *EtcdStore) Watch(prefix string) (<-chan Event, func()) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	events := make(chan Event)
+	// the watch starts after the current revision, so no change after Watch returns is missed
+	getCtx, cancelGet := s.callContext(ctx)
+	resp, err := s.client.Get(getCtx, etcdPrefix+prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancelGet()
+	if err != nil {
+		close(events)
+		return events, cancel
+	}
+	watchChan := s.client.Watch(ctx, etcdPrefix+prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			if resp.Canceled || resp.Err() != nil {
+				return
+			}
+			for _, etcdEvent := range resp.Events {
+				event := Event{Key: strings.TrimPrefix(string(etcdEvent.Kv.Key), etcdPrefix)}
+				if etcdEvent.Type == clientv3.EventTypeDelete {
+					event.Type = EventDelete
+				} else {
+					event.Type = EventPut
+					event.Value = etcdEvent.Kv.Value
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, cancel
 }
 
 // Delete deletes the store entry with the given key.
 func (s *EtcdStore) Delete(key string) error {
-	_, err := s.client.Delete(context.TODO(), etcdPrefix+key)
-	return err
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes the store entry with the given key.
+func (s *EtcdStore) DeleteContext(ctx context.Context, key string) error {
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+	_, err := s.client.Delete(ctx, etcdPrefix+key)
+	return etcdError(ctx, err)
+}
+
+// SetLocking selects the lock-based transactions, which serialize all transactions of all clients on one lock.
+// By default transactions are optimistic: they commit only if the keys they read were not changed in the meantime,
+// so transactions on disjoint keys commit in parallel.
+func (s *EtcdStore) SetLocking(locking bool) {
+	s.locking = locking
 }
 
 // BeginTransaction starts a new transaction.
 func (s *EtcdStore) BeginTransaction() (Transaction, error) {
-	sess, err := concurrency.NewSession(s.client)
-	if err != nil {
-		return nil, err
-	}
-	mut := concurrency.NewLocker(sess, etcdPrefix)
-	mut.Lock()
+	return s.BeginTransactionContext(context.Background())
+}
 
-	return &EtcdTransaction{
+// BeginTransactionContext starts a new transaction. Lock-based transactions wait for the lock until the context is done.
+func (s *EtcdStore) BeginTransactionContext(ctx context.Context) (Transaction, error) {
+	tx := &EtcdTransaction{
 		store:              s,
 		dataInsert:         map[string][]byte{},
 		dataDelete:         map[string]struct{}{},
+		readRevisions:      map[string]int64{},
+		coveredReads:       map[string]int64{},
+		readPrefixes:       map[string]int64{},
 		ongoingTransaction: true,
-		mut:                mut,
-		session:            sess,
-	}, nil
+	}
+	if !s.locking {
+		return tx, nil
+	}
+	sess, err := concurrency.NewSession(s.client, concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, etcdError(ctx, err)
+	}
+	mut := concurrency.NewMutex(sess, etcdPrefix)
+	if err := mut.Lock(ctx); err != nil {
+		sess.Close()
+		return nil, etcdError(ctx, err)
+	}
+	tx.mut = mut
+	tx.session = sess
+	return tx, nil
 }
 
 // Close closes the etcd client.
@@ -134,16 +312,29 @@ func (s *EtcdStore) Close() error {
 
 // EtcdTransaction is a transaction that uses etcd as a backend.
 type EtcdTransaction struct {
-	store              *EtcdStore
-	dataInsert         map[string][]byte
-	dataDelete         map[string]struct{}
+	store      *EtcdStore
+	dataInsert map[string][]byte
+	dataDelete map[string]struct{}
+	// readRevisions are the modification revisions of the keys read by the transaction, 0 for missing keys.
+	readRevisions map[string]int64
+	// coveredReads are the keys read after their prefix was iterated, the compare of the prefix covers their changes
+	// except for deletes.
+	coveredReads map[string]int64
+	// readPrefixes are the revisions at which the prefixes were iterated.
+	readPrefixes       map[string]int64
 	ongoingTransaction bool
-	session            *concurrency.Session
-	mut                sync.Locker
+	// session and mut are only set for lock-based transactions.
+	session *concurrency.Session
+	mut     *concurrency.Mutex
 }
 
 // Get retrieves a value from EtcdTransaction by Name.
 func (t *EtcdTransaction) Get(request string) ([]byte, error) {
+	return t.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value from EtcdTransaction by Name.
+func (t *EtcdTransaction) GetContext(ctx context.Context, request string) ([]byte, error) {
 	if !t.ongoingTransaction {
 		return nil, fmt.Errorf("EtcdTransaction Pointer is nil, but Get function is called")
 	}
@@ -153,7 +344,18 @@ func (t *EtcdTransaction) Get(request string) ([]byte, error) {
 	if _, ok := t.dataDelete[request]; ok {
 		return nil, &ValueUnsetError{requestedValue: request}
 	}
-	return t.store.Get(request)
+	ctx, cancel := t.store.callContext(ctx)
+	defer cancel()
+	resp, err := t.store.client.Get(ctx, etcdPrefix+request)
+	if err != nil {
+		return nil, etcdError(ctx, err)
+	}
+	if len(resp.Kvs) == 0 {
+		t.recordRead(request, 0)
+		return nil, &ValueUnsetError{requestedValue: request}
+	}
+	t.recordRead(request, resp.Kvs[0].ModRevision)
+	return resp.Kvs[0].Value, nil
 }
 
 // Put saves a value.
@@ -177,9 +379,21 @@ func (t *EtcdTransaction) Delete(key string) error {
 
 // Iterator returns an iterator for all keys in the transaction with a given prefix.
 func (t *EtcdTransaction) Iterator(prefix string) (Iterator, error) {
-	resp, err := t.store.client.Get(context.TODO(), etcdPrefix+prefix, clientv3.WithPrefix())
+	return t.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an iterator for all keys in the transaction with a given prefix.
+func (t *EtcdTransaction) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	ctx, cancel := t.store.callContext(ctx)
+	defer cancel()
+	resp, err := t.store.client.Get(ctx, etcdPrefix+prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
 	if err != nil {
-		return nil, err
+		return nil, etcdError(ctx, err)
+	}
+	// keys created or changed under the prefix after the iteration conflict with the transaction, one compare of
+	// the whole prefix keeps the number of compares independent of the number of keys
+	if _, ok := t.readPrefixes[prefix]; !ok {
+		t.readPrefixes[prefix] = resp.Header.Revision
 	}
 	var keys []string
 	for _, v := range resp.Kvs {
@@ -193,12 +407,17 @@ func (t *EtcdTransaction) Iterator(prefix string) (Iterator, error) {
 			keys = append(keys, k)
 		}
 	}
-	output := &EtcdIterator{idx: 0, keys: keys}
-	return output, err
+	return &EtcdIterator{idx: 0, keys: keys}, nil
 }
 
 // Commit ends a transaction and persists the changes.
 func (t *EtcdTransaction) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext ends a transaction and persists the changes. Optimistic transactions return ErrConflict if a key
+// read by the transaction was changed by another client in the meantime, nothing is written then.
+func (t *EtcdTransaction) CommitContext(ctx context.Context) error {
 	if !t.ongoingTransaction {
 		return fmt.Errorf("no ongoing transaction")
 	}
@@ -216,47 +435,153 @@ func (t *EtcdTransaction) Commit() error {
 			ops = append(ops, clientv3.OpDelete(etcdPrefix+k))
 		}
 	}
+	var cmps []clientv3.Cmp
+	if t.mut == nil {
+		cmps = t.compares()
+	}
 	// transaction, so either everything gets applied or nothing
-	_, err := t.store.client.Txn(context.TODO()).Then(ops...).Commit()
+	ctx, cancel := t.store.callContext(ctx)
+	defer cancel()
+	resp, err := t.store.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
 	if err != nil {
-		return err
+		return etcdError(ctx, err)
+	}
+	t.Rollback()
+	if !resp.Succeeded {
+		return ErrConflict
 	}
-	t.session.Close()
-	t.mut.Unlock()
-	t.ongoingTransaction = false
 	return nil
 }
 
 // Rollback aborts a transaction.
 func (t *EtcdTransaction) Rollback() {
-	if t.ongoingTransaction {
+	if t.ongoingTransaction && t.mut != nil {
+		ctx, cancel := t.store.callContext(context.Background())
+		defer cancel()
+		// closing the session releases the lock as well, even if the unlock fails
+		_ = t.mut.Unlock(ctx)
 		t.session.Close()
-		t.mut.Unlock()
 	}
 	t.ongoingTransaction = false
 }
 
+// recordRead remembers the revision of the first read of the key.
+func (t *EtcdTransaction) recordRead(key string, revision int64) {
+	if _, ok := t.readRevisions[key]; ok {
+		return
+	}
+	if _, ok := t.coveredReads[key]; ok {
+		return
+	}
+	for prefix := range t.readPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			t.coveredReads[key] = revision
+			return
+		}
+	}
+	t.readRevisions[key] = revision
+}
+
+// compares checks that the read keys and prefixes are unchanged. The keys read after their prefix was iterated are
+// only compared if the transaction writes them, so a concurrently deleted key is not written again. The number of
+// compares is therefore bounded by the number of writes and iterated prefixes.
+func (t *EtcdTransaction) compares() []clientv3.Cmp {
+	cmps := make([]clientv3.Cmp, 0, len(t.readRevisions)+len(t.readPrefixes))
+	for key, revision := range t.readRevisions {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(etcdPrefix+key), "=", revision))
+	}
+	for key, revision := range t.coveredReads {
+		_, inserted := t.dataInsert[key]
+		_, deleted := t.dataDelete[key]
+		if inserted || deleted {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(etcdPrefix+key), "=", revision))
+		}
+	}
+	for prefix, revision := range t.readPrefixes {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(etcdPrefix+prefix), "<", revision+1).WithPrefix())
+	}
+	return cmps
+}
+
+// etcdError returns an UnavailableError if etcd could not be reached before the deadline.
+func etcdError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return &UnavailableError{Err: err}
+	}
+	code := status.Code(err)
+	var etcdErr interface{ Code() codes.Code }
+	if errors.As(err, &etcdErr) {
+		code = etcdErr.Code()
+	}
+	if code == codes.Unavailable || code == codes.DeadlineExceeded {
+		return &UnavailableError{Err: err}
+	}
+	return err
+}
+
 // EtcdIterator is an iterator for etcdstore.
 type EtcdIterator struct {
 	idx  int
 	keys []string
+
+	// store is set if the keys are read in pages, next is the continuation token of the following page.
+	store  *EtcdStore
+	ctx    context.Context
+	prefix string
+	next   string
+	err    error
 }
 
 // GetNext gets the next element.
 func (i *EtcdIterator) GetNext() (string, error) {
-	if i.idx >= len(i.keys) {
+	if !i.HasNext() {
 		return "", fmt.Errorf("index out of range [%d] with length %d", i.idx, len(i.keys))
 	}
+	if i.err != nil {
+		// the iteration ends with the error of the failed page
+		err := i.err
+		i.store, i.err = nil, nil
+		return "", err
+	}
 	key := i.keys[i.idx]
 	i.idx++
 	return key, nil
 }
 
-// HasNext returns true if there are elements left to get with GetNext().
+// HasNext returns true if there are elements left to get with GetNext(). If reading the next page fails, the error
+// is returned by GetNext.
 func (i *EtcdIterator) HasNext() bool {
+	if i.idx < len(i.keys) || i.err != nil {
+		return true
+	}
+	if i.store == nil || i.next == "" {
+		return false
+	}
+	if err := i.fetch(); err != nil {
+		i.err = err
+		return true
+	}
 	return i.idx < len(i.keys)
 }
 
+// fetch reads the page after the continuation token.
+func (i *EtcdIterator) fetch() error {
+	page, err := i.store.rangePage(i.ctx, i.prefix, i.next, transferPageSize, true)
+	if err != nil {
+		return err
+	}
+	i.keys = i.keys[:0]
+	for _, entry := range page.Entries {
+		i.keys = append(i.keys, entry.Key)
+	}
+	i.idx = 0
+	i.next = page.Next
+	return nil
+}
+
 // EtcdStoreFactory is a factory to create EtcdStores.
 type EtcdStoreFactory struct {
 	Endpoint string
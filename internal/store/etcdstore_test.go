@@ -9,6 +9,7 @@ package store
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -17,6 +18,7 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -79,7 +81,68 @@ func TestEtcdStore(t *testing.T) {
 	testStore(t, func() (Store, error) {
 		return store, nil
 	})
+	t.Run("optimisticConflict", func(t *testing.T) {
+		testEtcdConflict(t, store)
+	})
+	// the lock-based transactions pass the same tests
+	store.SetLocking(true)
+	testStore(t, func() (Store, error) {
+		return store, nil
+	})
 
 	// Usually call it with a defer statement. However this causes problems with the construct above
 	require.NoError(dockerClient.ContainerStop(ctx, createResp.ID, container.StopOptions{Timeout: nil}))
 }
+
+func testEtcdConflict(t *testing.T, store *EtcdStore) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(store.Put("conflict", []byte("0")))
+	first, err := store.BeginTransaction()
+	require.NoError(err)
+	second, err := store.BeginTransaction()
+	require.NoError(err)
+	_, err = first.Get("conflict")
+	require.NoError(err)
+	_, err = second.Get("conflict")
+	require.NoError(err)
+	require.NoError(first.Put("conflict", []byte("1")))
+	require.NoError(second.Put("conflict", []byte("2")))
+	// disjoint keys commit in parallel
+	other, err := store.BeginTransaction()
+	require.NoError(err)
+	require.NoError(other.Put("disjoint", []byte("1")))
+
+	require.NoError(first.Commit())
+	assert.ErrorIs(second.Commit(), ErrConflict)
+	require.NoError(other.Commit())
+	value, err := store.Get("conflict")
+	require.NoError(err)
+	assert.Equal([]byte("1"), value)
+}
+
+func TestEtcdCompares(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tx := &EtcdTransaction{
+		dataInsert:         map[string][]byte{},
+		dataDelete:         map[string]struct{}{},
+		readRevisions:      map[string]int64{},
+		coveredReads:       map[string]int64{},
+		readPrefixes:       map[string]int64{},
+		ongoingTransaction: true,
+	}
+	tx.recordRead("uuid-before", 3)
+	tx.readPrefixes["uuid-"] = 10
+	for i := range 200 {
+		tx.recordRead(fmt.Sprintf("uuid-%d", i), int64(i))
+	}
+	tx.recordRead("other", 7)
+	require.NoError(tx.Put("uuid-1", []byte("changed")))
+	require.NoError(tx.Delete("uuid-2"))
+
+	// the prefix, the keys read outside of the iteration and the written keys
+	assert.Len(tx.compares(), 5)
+}
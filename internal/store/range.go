@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// rangePageSize is the number of entries Scan reads per page.
+const rangePageSize = 500
+
+// Ranger reads the entries of a prefix in pages.
+type Ranger interface {
+	RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error)
+}
+
+// Scan calls fn for every entry with the prefix in key order, the entries are read page by page. Scan stops at the
+// first error of fn and returns it.
+func Scan(ctx context.Context, s Ranger, prefix string, fn func(KeyValue) error) error {
+	token := ""
+	for {
+		page, err := s.RangeContext(ctx, prefix, token, rangePageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		token = page.Next
+	}
+}
+
+// checkRange validates the arguments of a range read.
+func checkRange(prefix, token string, limit int) error {
+	if limit <= 0 {
+		return fmt.Errorf("range limit must be positive, got %d", limit)
+	}
+	if token != "" && !strings.HasPrefix(token, prefix) {
+		return fmt.Errorf("continuation token %q does not belong to prefix %q", token, prefix)
+	}
+	return nil
+}
+
+// rangeKeys returns the page of the keys in memory, value is called for the keys of the page.
+func rangeKeys(keys []string, prefix, token string, limit int, value func(string) []byte) Page {
+	matching := make([]string, 0)
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) && key > token {
+			matching = append(matching, key)
+		}
+	}
+	slices.Sort(matching)
+
+	var page Page
+	for _, key := range matching[:min(limit, len(matching))] {
+		page.Entries = append(page.Entries, KeyValue{Key: key, Value: value(key)})
+	}
+	if len(matching) > limit {
+		page.Next = matching[limit-1]
+	}
+	return page
+}
@@ -6,21 +6,27 @@
 package store
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 )
 
 // StdStore is the standard implementation of the Store interface.
 type StdStore struct {
-	data       map[string]string
-	mut, txmut sync.Mutex
+	data     map[string]string
+	mut      sync.Mutex
+	txmut    txLock
+	notifier notifier
 }
 
 // NewStdStore creates and initializes a new StdStore object.
 func NewStdStore() *StdStore {
 	s := &StdStore{
-		data: make(map[string]string),
+		data:  make(map[string]string),
+		txmut: newTxLock(),
 	}
 
 	return s
@@ -28,6 +34,14 @@ func NewStdStore() *StdStore {
 
 // Get retrieves a value from StdStore by Type and Name.
 func (s *StdStore) Get(request string) ([]byte, error) {
+	return s.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value from StdStore by Type and Name.
+func (s *StdStore) GetContext(ctx context.Context, request string) ([]byte, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	s.mut.Lock()
 	value, ok := s.data[request]
 	s.mut.Unlock()
@@ -40,7 +54,12 @@ func (s *StdStore) Get(request string) ([]byte, error) {
 
 // Put saves a value in StdStore by Type and Name.
 func (s *StdStore) Put(request string, requestData []byte) error {
-	tx, err := s.BeginTransaction()
+	return s.PutContext(context.Background(), request, requestData)
+}
+
+// PutContext saves a value in StdStore by Type and Name.
+func (s *StdStore) PutContext(ctx context.Context, request string, requestData []byte) error {
+	tx, err := s.BeginTransactionContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -53,7 +72,12 @@ func (s *StdStore) Put(request string, requestData []byte) error {
 
 // Delete deletes one element from the store.
 func (s *StdStore) Delete(key string) error {
-	tx, err := s.BeginTransaction()
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext deletes one element from the store.
+func (s *StdStore) DeleteContext(ctx context.Context, key string) error {
+	tx, err := s.BeginTransactionContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -67,6 +91,14 @@ func (s *StdStore) Delete(key string) error {
 // Iterator returns an iterator for keys saved in StdStore with a given prefix.
 // For an empty prefix this is an iterator for all keys in StdStore.
 func (s *StdStore) Iterator(prefix string) (Iterator, error) {
+	return s.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an iterator for keys saved in StdStore with a given prefix.
+func (s *StdStore) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	keys := make([]string, 0)
 	s.mut.Lock()
 	for k := range s.data {
@@ -79,10 +111,37 @@ func (s *StdStore) Iterator(prefix string) (Iterator, error) {
 	return &StdIterator{0, keys}, nil
 }
 
+// Range returns a page of the entries with the prefix, starting after the continuation token.
+func (s *StdStore) Range(prefix, token string, limit int) (Page, error) {
+	return s.RangeContext(context.Background(), prefix, token, limit)
+}
+
+// RangeContext returns a page of the entries with the prefix, starting after the continuation token.
+func (s *StdStore) RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error) {
+	if err := contextError(ctx); err != nil {
+		return Page{}, err
+	}
+	if err := checkRange(prefix, token, limit); err != nil {
+		return Page{}, err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return rangeKeys(slices.Collect(maps.Keys(s.data)), prefix, token, limit, func(key string) []byte {
+		return []byte(s.data[key])
+	}), nil
+}
+
 // BeginTransaction starts a new transaction.
 func (s *StdStore) BeginTransaction() (Transaction, error) {
+	return s.BeginTransactionContext(context.Background())
+}
+
+// BeginTransactionContext starts a new transaction, it waits until other transactions are committed or rolled back.
+func (s *StdStore) BeginTransactionContext(ctx context.Context) (Transaction, error) {
 	tx := stdTransaction{store: s, data: map[string]string{}}
-	s.txmut.Lock()
+	if err := s.txmut.lock(ctx); err != nil {
+		return nil, err
+	}
 
 	s.mut.Lock()
 	for k, v := range s.data {
@@ -93,26 +152,38 @@ func (s *StdStore) BeginTransaction() (Transaction, error) {
 	return &tx, nil
 }
 
+// Watch returns the changes of the keys with the given prefix until cancel is called.
+func (s *StdStore) Watch(prefix string) (<-chan Event, func()) {
+	return s.notifier.watch(prefix)
+}
+
 func (s *StdStore) commit(data map[string]string) error {
 	s.mut.Lock()
+	events := changes(s.data, data)
 	s.data = data
 	s.mut.Unlock()
+	s.notifier.publish(events)
 
-	s.txmut.Unlock()
+	s.txmut.unlock()
 
 	return nil
 }
 
-// Transfer transfers the store content to another store.
+// Transfer transfers the store content to another store in batches of transactions.
 func (s *StdStore) Transfer(newstore Store) error {
 	s.mut.Lock()
-	// copy key:value pairs from the old storage into etcd
-	for key, value := range s.data {
-		if err := newstore.Put(key, []byte(value)); err != nil {
+	keys := slices.Sorted(maps.Keys(s.data))
+	values := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, []byte(s.data[key]))
+	}
+	s.mut.Unlock()
+	for start := 0; start < len(keys); start += transferBatchSize {
+		end := min(start+transferBatchSize, len(keys))
+		if err := putBatch(newstore, keys[start:end], values[start:end]); err != nil {
 			return err
 		}
 	}
-	s.mut.Unlock()
 	return nil
 }
 
@@ -123,6 +194,14 @@ type stdTransaction struct {
 
 // Get retrieves a value.
 func (t *stdTransaction) Get(request string) ([]byte, error) {
+	return t.GetContext(context.Background(), request)
+}
+
+// GetContext retrieves a value.
+func (t *stdTransaction) GetContext(ctx context.Context, request string) ([]byte, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	if value, ok := t.data[request]; ok {
 		return []byte(value), nil
 	}
@@ -142,6 +221,14 @@ func (t *stdTransaction) Delete(key string) error {
 
 // Iterator returns an iterator for all keys in the transaction with a given prefix.
 func (t *stdTransaction) Iterator(prefix string) (Iterator, error) {
+	return t.IteratorContext(context.Background(), prefix)
+}
+
+// IteratorContext returns an iterator for all keys in the transaction with a given prefix.
+func (t *stdTransaction) IteratorContext(ctx context.Context, prefix string) (Iterator, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	keys := make([]string, 0)
 	for k := range t.data {
 		if strings.HasPrefix(k, prefix) {
@@ -154,6 +241,18 @@ func (t *stdTransaction) Iterator(prefix string) (Iterator, error) {
 
 // Commit ends a transaction and persists the changes.
 func (t *stdTransaction) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext ends a transaction and persists the changes.
+func (t *stdTransaction) CommitContext(ctx context.Context) error {
+	if t.store == nil {
+		return fmt.Errorf("no ongoing transaction")
+	}
+	if err := contextError(ctx); err != nil {
+		t.Rollback()
+		return err
+	}
 	if err := t.store.commit(t.data); err != nil {
 		return err
 	}
@@ -164,8 +263,25 @@ func (t *stdTransaction) Commit() error {
 // Rollback aborts a transaction.
 func (t *stdTransaction) Rollback() {
 	if t.store != nil {
-		t.store.txmut.Unlock()
+		t.store.txmut.unlock()
+		t.store = nil
+	}
+}
+
+// changes returns the events turning the old into the new data.
+func changes(old, data map[string]string) []Event {
+	var events []Event
+	for _, key := range slices.Sorted(maps.Keys(data)) {
+		if value, ok := old[key]; !ok || value != data[key] {
+			events = append(events, Event{Type: EventPut, Key: key, Value: []byte(data[key])})
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := data[key]; !ok {
+			events = append(events, Event{Type: EventDelete, Key: key})
+		}
 	}
+	return events
 }
 
 // StdIterator is the standard Iterator implementation.
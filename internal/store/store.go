@@ -6,12 +6,15 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
 )
 
 // Store is the interface for persistent store.
-// Currently two backends are supported,
-// stdstore (mainly for testing) and etcd for production.
+// Currently three backends are supported,
+// stdstore (mainly for testing), etcd for production and BoltStore for single node and development use.
+// The configured backend is either etcd or BoltStore.
 type Store interface {
 	// BeginTransaction starts a new transaction.
 	BeginTransaction() (Transaction, error)
@@ -21,10 +24,72 @@ type Store interface {
 	Put(string, []byte) error
 	// Iterator returns an Iterator for a given prefix.
 	Iterator(string) (Iterator, error)
+	// Range returns a page of at most limit entries with the prefix, starting after the continuation token.
+	Range(prefix, token string, limit int) (Page, error)
 	// Transfer copies the whole store Database.
 	Transfer(Store) error
 	// Delete deletes the key.
 	Delete(string) error
+	// Watch returns the changes of the keys with the given prefix after the call until cancel is called.
+	// The channel is closed after cancel or if watching fails, watchers re-read the keys then.
+	Watch(string) (events <-chan Event, cancel func())
+	ContextStore
+}
+
+// ContextStore is the context-aware variant of the Store methods accessing the backend, the methods without context
+// are thin wrappers using context.Background(). Backends bound each call with their own deadline in addition.
+type ContextStore interface {
+	// BeginTransactionContext starts a new transaction.
+	BeginTransactionContext(context.Context) (Transaction, error)
+	// GetContext returns a value from store by key.
+	GetContext(context.Context, string) ([]byte, error)
+	// PutContext saves a value to store by key.
+	PutContext(context.Context, string, []byte) error
+	// IteratorContext returns an Iterator for a given prefix.
+	IteratorContext(context.Context, string) (Iterator, error)
+	// RangeContext returns a page of at most limit entries with the prefix in key order, starting after the
+	// continuation token of the previous page. An empty token starts with the first entry.
+	RangeContext(ctx context.Context, prefix, token string, limit int) (Page, error)
+	// DeleteContext deletes the key.
+	DeleteContext(context.Context, string) error
+}
+
+// EventType is the type of a change of a key.
+type EventType int
+
+const (
+	// EventPut is a created or updated key.
+	EventPut EventType = iota
+	// EventDelete is a deleted key.
+	EventDelete
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "delete"
+	}
+	return "put"
+}
+
+// Event is a change of a key, the value is nil for deleted keys.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+// KeyValue is an entry of the store.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Page is a batch of entries returned by a range read. Next is the continuation token of the following page, it is
+// empty after the last page. The pages are read one by one, they are not a snapshot of the whole range.
+type Page struct {
+	Entries []KeyValue
+	Next    string
 }
 
 // Transaction is a Store transaction.
@@ -39,6 +104,12 @@ type Transaction interface {
 	Iterator(string) (Iterator, error)
 	// Commit ends a transaction and persists the changes.
 	Commit() error
+	// GetContext returns a value from store by key.
+	GetContext(context.Context, string) ([]byte, error)
+	// IteratorContext returns an Iterator for a given prefix.
+	IteratorContext(context.Context, string) (Iterator, error)
+	// CommitContext ends a transaction and persists the changes.
+	CommitContext(context.Context) error
 	// Rollback aborts a transaction. Noop if already committed.
 	Rollback()
 }
@@ -51,6 +122,16 @@ type Iterator interface {
 	HasNext() bool
 }
 
+// Errors of the store, they are matched with errors.Is.
+var (
+	// ErrNotFound is returned for keys which are not set, see ValueUnsetError.
+	ErrNotFound = errors.New("store: requested value not set")
+	// ErrUnavailable is returned if the backend could not be reached in time, see UnavailableError.
+	ErrUnavailable = errors.New("store: backend unavailable")
+	// ErrConflict is returned by Commit if another transaction changed a key read by the transaction, see Update.
+	ErrConflict = errors.New("store: transaction conflicts with a concurrent change")
+)
+
 // ValueUnsetError is an error raised by unset values in the store.
 type ValueUnsetError struct {
 	requestedValue string
@@ -60,3 +141,59 @@ type ValueUnsetError struct {
 func (s *ValueUnsetError) Error() string {
 	return fmt.Sprintf("store: requested value not set: %s", s.requestedValue)
 }
+
+// Is matches ErrNotFound.
+func (s *ValueUnsetError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// UnavailableError is raised if the backend could not be reached in time or the context is done.
+type UnavailableError struct {
+	Err error
+}
+
+// Error implements the Error interface.
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("store: backend unavailable: %v", e.Err)
+}
+
+// Unwrap returns the cause, i.e. context.DeadlineExceeded.
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrUnavailable.
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// contextError returns an UnavailableError if the context is done.
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &UnavailableError{Err: err}
+	}
+	return nil
+}
+
+// txLock serializes transactions, unlike sync.Mutex waiting for it can be canceled.
+type txLock chan struct{}
+
+func newTxLock() txLock {
+	return make(txLock, 1)
+}
+
+func (l txLock) lock(ctx context.Context) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+func (l txLock) unlock() {
+	<-l
+}
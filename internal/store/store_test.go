@@ -6,6 +6,10 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,6 +41,12 @@ func testStore(t *testing.T, storeFactory func() (Store, error)) {
 	t.Run("testIteratorRace", TestIteratorRace)
 	t.Run("testTransactionIteratorPutPrefix", TestTransactionIteratorPutPrefix)
 	t.Run("testStoreByValue", TestStoreByValue)
+	t.Run("testTransfer", TestTransfer)
+	t.Run("testWatch", TestWatch)
+	t.Run("testUpdate", TestUpdate)
+	t.Run("testContext", TestContext)
+	t.Run("testRange", TestRange)
+	t.Run("testScan", TestScan)
 }
 
 func TestBasic(t *testing.T) {
@@ -417,3 +427,224 @@ func TestStoreByValue(t *testing.T) {
 	require.NoError(err)
 	assert.NotEqual(storeValue[0], testValue[0])
 }
+
+func TestTransfer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	// more entries than fit into one batch
+	for i := range 2*transferBatchSize + 1 {
+		require.NoError(store.Put(fmt.Sprintf("transfer-%d", i), []byte{byte(i)}))
+	}
+	newstore := NewStdStore()
+	require.NoError(store.Transfer(newstore))
+	for i := range 2*transferBatchSize + 1 {
+		value, err := newstore.Get(fmt.Sprintf("transfer-%d", i))
+		require.NoError(err)
+		assert.Equal([]byte{byte(i)}, value)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	events, cancel := store.Watch("watch-")
+	defer cancel()
+
+	require.NoError(store.Put("watch-a", []byte("a")))
+	require.NoError(store.Put("unwatched", []byte("a")))
+	require.NoError(store.Delete("watch-a"))
+	tx, err := store.BeginTransaction()
+	require.NoError(err)
+	require.NoError(tx.Put("watch-b", []byte("b")))
+	require.NoError(tx.Commit())
+
+	for _, expected := range []Event{
+		{Type: EventPut, Key: "watch-a", Value: []byte("a")},
+		{Type: EventDelete, Key: "watch-a"},
+		{Type: EventPut, Key: "watch-b", Value: []byte("b")},
+	} {
+		select {
+		case event := <-events:
+			assert.Equal(expected, event)
+		case <-time.After(5 * time.Second):
+			require.FailNow("missing event", expected.Key)
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	require.NoError(store.Put("counter", []byte("0")))
+
+	// concurrent read-modify-write transactions on the same key must not lose increments
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Update(store, func(tx Transaction) error {
+				value, err := tx.Get("counter")
+				if err != nil {
+					return err
+				}
+				counter, err := strconv.Atoi(string(value))
+				if err != nil {
+					return err
+				}
+				return tx.Put("counter", []byte(strconv.Itoa(counter+1)))
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+	value, err := store.Get("counter")
+	require.NoError(err)
+	assert.Equal([]byte("5"), value)
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	require.NoError(store.PutContext(context.Background(), "key", []byte("value")))
+
+	_, err = store.GetContext(context.Background(), "missing")
+	assert.ErrorIs(err, ErrNotFound)
+	assert.NotErrorIs(err, ErrUnavailable)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.GetContext(ctx, "key")
+	assert.ErrorIs(err, ErrUnavailable)
+	_, err = store.IteratorContext(ctx, "")
+	assert.ErrorIs(err, ErrUnavailable)
+	assert.ErrorIs(store.PutContext(ctx, "key", []byte("other")), ErrUnavailable)
+	_, err = store.BeginTransactionContext(ctx)
+	assert.ErrorIs(err, ErrUnavailable)
+
+	// a transaction whose context is done before the commit writes nothing
+	txCtx, txCancel := context.WithCancel(context.Background())
+	tx, err := store.BeginTransactionContext(txCtx)
+	require.NoError(err)
+	require.NoError(tx.Put("key", []byte("other")))
+	txCancel()
+	assert.ErrorIs(tx.CommitContext(txCtx), ErrUnavailable)
+	tx.Rollback()
+
+	value, err := store.GetContext(context.Background(), "key")
+	require.NoError(err)
+	assert.Equal([]byte("value"), value)
+}
+
+func TestRange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	for i := range 5 {
+		require.NoError(store.Put(fmt.Sprintf("range-%d", i), []byte(strconv.Itoa(i))))
+	}
+	require.NoError(store.Put("rangf", []byte("outside")))
+	require.NoError(store.Put("rang", []byte("outside")))
+
+	var entries []KeyValue
+	var pages int
+	token := ""
+	for {
+		page, err := store.Range("range-", token, 2)
+		require.NoError(err)
+		assert.LessOrEqual(len(page.Entries), 2)
+		entries = append(entries, page.Entries...)
+		pages++
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+	assert.Equal(3, pages)
+	require.Len(entries, 5)
+	for i, entry := range entries {
+		assert.Equal(fmt.Sprintf("range-%d", i), entry.Key)
+		assert.Equal([]byte(strconv.Itoa(i)), entry.Value)
+	}
+
+	// a page which ends with the last entry has no continuation token
+	page, err := store.Range("range-", "", 5)
+	require.NoError(err)
+	assert.Len(page.Entries, 5)
+	assert.Empty(page.Next)
+
+	page, err = store.Range("missing-", "", 5)
+	require.NoError(err)
+	assert.Empty(page.Entries)
+	assert.Empty(page.Next)
+
+	_, err = store.Range("range-", "", 0)
+	assert.Error(err)
+	_, err = store.Range("range-", "other", 1)
+	assert.Error(err)
+}
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	store, err := newStore()
+	require.NoError(err)
+	count := rangePageSize + 10
+	tx, err := store.BeginTransaction()
+	require.NoError(err)
+	for i := range count {
+		require.NoError(tx.Put(fmt.Sprintf("scan-%04d", i), []byte(strconv.Itoa(i))))
+	}
+	require.NoError(tx.Commit())
+
+	var keys []string
+	require.NoError(Scan(context.Background(), store, "scan-", func(entry KeyValue) error {
+		keys = append(keys, entry.Key)
+		return nil
+	}))
+	require.Len(keys, count)
+	assert.Equal("scan-0000", keys[0])
+	assert.Equal(fmt.Sprintf("scan-%04d", count-1), keys[count-1])
+
+	// the keys of the iterator are read in pages as well
+	iter, err := store.Iterator("scan-")
+	require.NoError(err)
+	iterated := 0
+	for iter.HasNext() {
+		_, err := iter.GetNext()
+		require.NoError(err)
+		iterated++
+	}
+	assert.Equal(count, iterated)
+
+	stopErr := fmt.Errorf("stop")
+	calls := 0
+	err = Scan(context.Background(), store, "scan-", func(KeyValue) error {
+		calls++
+		return stopErr
+	})
+	assert.ErrorIs(err, stopErr)
+	assert.Equal(1, calls)
+}
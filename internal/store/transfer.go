@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// transferBatchSize is the number of entries written in one transaction, etcd allows 128 operations per transaction by default.
+const transferBatchSize = 100
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// DryRun only computes the checksum of the source, nothing is written.
+	DryRun bool
+	// Force writes to a destination which is not empty, the entries of the source replace existing entries.
+	Force bool
+	// Progress is called with the number of entries written so far, it may be nil.
+	Progress func(written int)
+}
+
+// MigrateResult summarizes a migration.
+type MigrateResult struct {
+	// Entries is the number of entries in the source.
+	Entries int
+	// Checksum is the checksum of the source, the destination has the same checksum over the keys of the source.
+	Checksum string
+}
+
+// Migrate transfers all entries of src to dst and verifies the checksum of the transferred entries. The destination
+// must be empty unless forced, entries of dst which do not exist in src are kept.
+func Migrate(src, dst Store, opts MigrateOptions) (MigrateResult, error) {
+	keys, err := allKeys(src)
+	if err != nil {
+		return MigrateResult{}, fmt.Errorf("listing the source: %w", err)
+	}
+	checksum, err := checksumKeys(src, keys)
+	if err != nil {
+		return MigrateResult{}, fmt.Errorf("checksum of the source: %w", err)
+	}
+	result := MigrateResult{Entries: len(keys), Checksum: checksum}
+	if opts.DryRun {
+		return result, nil
+	}
+	if !opts.Force {
+		page, err := dst.Range("", "", 1)
+		if err != nil {
+			return result, fmt.Errorf("listing the destination: %w", err)
+		}
+		if len(page.Entries) > 0 {
+			return result, fmt.Errorf("the destination is not empty, it contains %s", page.Entries[0].Key)
+		}
+	}
+	if err := src.Transfer(&progressStore{Store: dst, progress: opts.Progress}); err != nil {
+		return result, fmt.Errorf("transfer: %w", err)
+	}
+	written, err := checksumKeys(dst, keys)
+	if err != nil {
+		return result, fmt.Errorf("checksum of the destination: %w", err)
+	}
+	if written != checksum {
+		return result, fmt.Errorf("checksum mismatch: source %s, destination %s", checksum, written)
+	}
+	return result, nil
+}
+
+// Checksum returns the number of entries and the SHA-256 checksum of all entries of the store.
+func Checksum(s Store) (int, string, error) {
+	keys, err := allKeys(s)
+	if err != nil {
+		return 0, "", err
+	}
+	checksum, err := checksumKeys(s, keys)
+	return len(keys), checksum, err
+}
+
+// checksumKeys hashes the length prefixed keys and values in the given, sorted order.
+func checksumKeys(s Store, keys []string) (string, error) {
+	hash := sha256.New()
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(binary.BigEndian.AppendUint64(nil, uint64(len(key))))
+		hash.Write([]byte(key))
+		hash.Write(binary.BigEndian.AppendUint64(nil, uint64(len(value))))
+		hash.Write(value)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// allKeys returns the sorted keys of the store.
+func allKeys(s Store) ([]string, error) {
+	iter, err := s.Iterator("")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for iter.HasNext() {
+		key, err := iter.GetNext()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// putBatch writes the entries in one transaction.
+func putBatch(s Store, keys []string, values [][]byte) error {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, key := range keys {
+		if err := tx.Put(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// progressStore reports the number of entries written to the store.
+type progressStore struct {
+	Store
+	written  int
+	progress func(written int)
+}
+
+// Put saves a value and reports the progress.
+func (s *progressStore) Put(key string, value []byte) error {
+	if err := s.Store.Put(key, value); err != nil {
+		return err
+	}
+	s.report(1)
+	return nil
+}
+
+// BeginTransaction starts a transaction, the progress is reported on commit.
+func (s *progressStore) BeginTransaction() (Transaction, error) {
+	tx, err := s.Store.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &progressTransaction{Transaction: tx, store: s}, nil
+}
+
+func (s *progressStore) report(written int) {
+	s.written += written
+	if s.progress != nil {
+		s.progress(s.written)
+	}
+}
+
+type progressTransaction struct {
+	Transaction
+	store *progressStore
+	puts  int
+}
+
+// Put saves a value.
+func (t *progressTransaction) Put(key string, value []byte) error {
+	if err := t.Transaction.Put(key, value); err != nil {
+		return err
+	}
+	t.puts++
+	return nil
+}
+
+// Commit persists the changes and reports the progress.
+func (t *progressTransaction) Commit() error {
+	if err := t.Transaction.Commit(); err != nil {
+		return err
+	}
+	t.store.report(t.puts)
+	return nil
+}
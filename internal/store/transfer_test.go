@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	testCases := map[string]struct {
+		dst          Store
+		dryRun       bool
+		force        bool
+		expectCopied bool
+		expectErr    bool
+	}{
+		"migrate": {
+			dst:          NewStdStore(),
+			force:        true,
+			expectCopied: true,
+		},
+		"dry run": {
+			dst:    NewStdStore(),
+			dryRun: true,
+		},
+		"destination not empty": {
+			dst:       NewStdStore(),
+			expectErr: true,
+		},
+		"lost writes": {
+			dst:       &lossyStore{Store: NewStdStore()},
+			force:     true,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			src := NewStdStore()
+			for _, key := range []string{"a", "b", "c"} {
+				require.NoError(src.Put(key, []byte(key)))
+			}
+			require.NoError(tc.dst.Put("other", []byte("kept")))
+			_, checksum, err := Checksum(src)
+			require.NoError(err)
+
+			var progress []int
+			result, err := Migrate(src, tc.dst, MigrateOptions{DryRun: tc.dryRun, Force: tc.force, Progress: func(written int) {
+				progress = append(progress, written)
+			}})
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(MigrateResult{Entries: 3, Checksum: checksum}, result)
+			value, err := tc.dst.Get("other")
+			require.NoError(err)
+			assert.Equal([]byte("kept"), value)
+			_, err = tc.dst.Get("a")
+			if !tc.expectCopied {
+				assert.Error(err)
+				assert.Empty(progress)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal([]int{3}, progress)
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	first, second := NewStdStore(), NewStdStore()
+	require.NoError(first.Put("ab", []byte("c")))
+	require.NoError(second.Put("a", []byte("bc")))
+	entries, firstChecksum, err := Checksum(first)
+	require.NoError(err)
+	assert.Equal(1, entries)
+	_, secondChecksum, err := Checksum(second)
+	require.NoError(err)
+	assert.NotEqual(firstChecksum, secondChecksum)
+}
+
+// lossyStore drops the writes of transactions.
+type lossyStore struct {
+	Store
+}
+
+func (s *lossyStore) BeginTransaction() (Transaction, error) {
+	return &lossyTransaction{}, nil
+}
+
+type lossyTransaction struct {
+	Transaction
+}
+
+func (t *lossyTransaction) Put(string, []byte) error { return nil }
+
+func (t *lossyTransaction) Commit() error { return nil }
+
+func (t *lossyTransaction) Rollback() {}
@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// updateAttempts is the number of times a conflicting transaction is run.
+	updateAttempts = 10
+	// updateBackoff is the base of the randomized exponential backoff between the attempts, it is capped at a second.
+	updateBackoff = 10 * time.Millisecond
+)
+
+// Transactor starts transactions, it is implemented by all stores.
+type Transactor interface {
+	BeginTransactionContext(context.Context) (Transaction, error)
+}
+
+// Update runs fn in a transaction and commits it. If the commit conflicts with a concurrent transaction, fn is run
+// again in a new transaction, so fn must only change the store through the transaction.
+func Update(s Store, fn func(Transaction) error) error {
+	return UpdateContext(context.Background(), s, fn)
+}
+
+// UpdateContext runs fn in a transaction like Update, it stops retrying once the context is done.
+func UpdateContext(ctx context.Context, s Transactor, fn func(Transaction) error) error {
+	for attempt := range updateAttempts {
+		tx, err := s.BeginTransactionContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.CommitContext(ctx)
+		tx.Rollback()
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		backoff := min(updateBackoff<<attempt, time.Second)
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-time.After(backoff/2 + rand.N(backoff/2)):
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", updateAttempts, ErrConflict)
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateRetry(t *testing.T) {
+	someErr := errors.New("failed")
+
+	testCases := map[string]struct {
+		conflicts    int
+		canceled     bool
+		fnErr        error
+		expectCalls  int
+		expectErr    error
+		expectCommit bool
+	}{
+		"no conflict": {
+			expectCalls:  1,
+			expectCommit: true,
+		},
+		"retried after conflicts": {
+			conflicts:    2,
+			expectCalls:  3,
+			expectCommit: true,
+		},
+		"canceled": {
+			canceled:  true,
+			expectErr: ErrUnavailable,
+		},
+		"error of fn": {
+			fnErr:       someErr,
+			expectCalls: 1,
+			expectErr:   someErr,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			store := &conflictingStore{StdStore: NewStdStore(), conflicts: tc.conflicts}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.canceled {
+				cancel()
+			}
+			defer cancel()
+			calls := 0
+			err := UpdateContext(ctx, store, func(tx Transaction) error {
+				calls++
+				if err := tx.Put("key", []byte("value")); err != nil {
+					return err
+				}
+				return tc.fnErr
+			})
+			assert.Equal(tc.expectCalls, calls)
+			if tc.expectErr != nil {
+				assert.ErrorIs(err, tc.expectErr)
+			} else {
+				require.NoError(err)
+			}
+			_, err = store.Get("key")
+			assert.Equal(tc.expectCommit, err == nil)
+		})
+	}
+}
+
+// conflictingStore fails the first commits with ErrConflict.
+type conflictingStore struct {
+	*StdStore
+	conflicts int
+}
+
+func (s *conflictingStore) BeginTransactionContext(ctx context.Context) (Transaction, error) {
+	tx, err := s.StdStore.BeginTransactionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conflictingTransaction{Transaction: tx, store: s}, nil
+}
+
+type conflictingTransaction struct {
+	Transaction
+	store *conflictingStore
+}
+
+func (t *conflictingTransaction) CommitContext(ctx context.Context) error {
+	if t.store.conflicts > 0 {
+		t.store.conflicts--
+		t.Transaction.Rollback()
+		return ErrConflict
+	}
+	return t.Transaction.CommitContext(ctx)
+}
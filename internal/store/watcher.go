@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package store
+
+import (
+	"strings"
+	"sync"
+)
+
+// notifier distributes the changes of an in-process store to its watchers.
+type notifier struct {
+	mut      sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+// watch registers a watcher of the prefix.
+func (n *notifier) watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan Event),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	n.mut.Lock()
+	if n.watchers == nil {
+		n.watchers = make(map[*watcher]struct{})
+	}
+	n.watchers[w] = struct{}{}
+	n.mut.Unlock()
+	go w.run()
+
+	var once sync.Once
+	return w.events, func() {
+		once.Do(func() {
+			n.mut.Lock()
+			delete(n.watchers, w)
+			n.mut.Unlock()
+			close(w.done)
+		})
+	}
+}
+
+// publish queues the events for the watchers of matching prefixes, it never blocks on slow watchers.
+func (n *notifier) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	for w := range n.watchers {
+		w.queue(events)
+	}
+}
+
+// watcher sends the queued events of one prefix in order.
+type watcher struct {
+	prefix string
+	events chan Event
+	notify chan struct{}
+	done   chan struct{}
+
+	mut     sync.Mutex
+	pending []Event
+}
+
+func (w *watcher) queue(events []Event) {
+	w.mut.Lock()
+	for _, event := range events {
+		if strings.HasPrefix(event.Key, w.prefix) {
+			w.pending = append(w.pending, event)
+		}
+	}
+	w.mut.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) run() {
+	defer close(w.events)
+	for {
+		w.mut.Lock()
+		pending := w.pending
+		w.pending = nil
+		w.mut.Unlock()
+		for _, event := range pending {
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+)
+
+// lastUsedInterval is the resolution of the last use of a public key, logins within the interval are not written.
+const lastUsedInterval = 10 * time.Minute
+
+var (
+	// ErrKeyRevoked is returned when a revoked public key is added.
+	ErrKeyRevoked = errors.New("public key is revoked")
+	// ErrPrimaryKey is returned when a user removes the public key of the user record.
+	ErrPrimaryKey = errors.New("the public key of the user record can only be revoked by an admin")
+)
+
+// AddPublicKey adds the public key in the ssh wire format to the keys of the user. A public key can only belong to
+// one user and revoked keys can not be added again.
+func (s StoreWrapper) AddPublicKey(uuid string, publicKey []byte, label string) error {
+	return s.update(func(tx store.Transaction) error {
+		if _, err := tx.GetContext(s.context(), uuidKeyPrefix+uuid); err != nil {
+			return fmt.Errorf("getting user %s: %w", uuid, err)
+		}
+		var index keyRecord
+		err := getRecord(s.context(), tx, publicKeyPrefix+string(publicKey), &index)
+		if err == nil && index.UUID == uuid {
+			return errors.New("public key is already added")
+		}
+		if err == nil {
+			return errors.New("public key belongs to another user")
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		return putKey(s.context(), tx, string(publicKey), keyRecord{UUID: uuid, Label: label, Added: time.Now()})
+	})
+}
+
+// GetPublicKeys gets the public keys of the user ordered by the time they were added.
+func (s StoreWrapper) GetPublicKeys(uuid string) ([]config.PublicKey, error) {
+	user, err := s.GetUser(uuid)
+	if err != nil {
+		return nil, err
+	}
+	var keys []config.PublicKey
+	err = store.Scan(s.context(), s.Store, userKeyPrefix+uuid+"/", func(entry store.KeyValue) error {
+		var index keyRecord
+		err := getRecord(s.context(), s.Store, publicKeyPrefix+string(entry.Value), &index)
+		// the key was removed between the reads
+		if errors.Is(err, store.ErrNotFound) || err == nil && index.UUID != uuid {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, config.PublicKey{
+			Key:         entry.Value,
+			Fingerprint: fingerprint(entry.Value),
+			Label:       index.Label,
+			Added:       index.Added,
+			LastUsed:    index.LastUsed,
+			Primary:     bytes.Equal(entry.Value, user.PubKey),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(keys, func(a, b config.PublicKey) int {
+		return cmp.Or(a.Added.Compare(b.Added), cmp.Compare(a.Fingerprint, b.Fingerprint))
+	})
+	return keys, nil
+}
+
+// RemovePublicKey removes the public key with the SHA256 fingerprint from the keys of the user. The public key of the
+// user record is kept, since it verifies the signatures of solutions.
+func (s StoreWrapper) RemovePublicKey(uuid, keyFingerprint string) error {
+	return s.update(func(tx store.Transaction) error {
+		publicKey, err := tx.GetContext(s.context(), userKeyPrefix+uuid+"/"+keyFingerprint)
+		if errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("user has no public key %s: %w", keyFingerprint, err)
+		}
+		if err != nil {
+			return err
+		}
+		var user userRecord
+		if err := getRecord(s.context(), tx, uuidKeyPrefix+uuid, &user); err != nil {
+			return fmt.Errorf("getting user %s: %w", uuid, err)
+		}
+		if bytes.Equal(publicKey, user.PubKey) {
+			return ErrPrimaryKey
+		}
+		return deleteKeyIndex(s.context(), tx, string(publicKey), uuid)
+	})
+}
+
+// RevokePublicKey revokes the public key with the SHA256 fingerprint for all users, the key can not be used to log in
+// or be added again. It returns the uuid of the user the key belonged to, which is empty if no user had the key.
+func (s StoreWrapper) RevokePublicKey(keyFingerprint string) (string, error) {
+	if !strings.HasPrefix(keyFingerprint, "SHA256:") {
+		return "", fmt.Errorf("invalid fingerprint %q, expected SHA256:<base64>", keyFingerprint)
+	}
+	var owner string
+	err := s.update(func(tx store.Transaction) error {
+		owner = ""
+		// the keys are indexed by the users, so the key of an unknown owner is searched in the transaction
+		iter, err := tx.IteratorContext(s.context(), publicKeyPrefix)
+		if err != nil {
+			return err
+		}
+		for iter.HasNext() {
+			key, err := iter.GetNext()
+			if err != nil {
+				return err
+			}
+			publicKey := strings.TrimPrefix(key, publicKeyPrefix)
+			if fingerprint([]byte(publicKey)) != keyFingerprint {
+				continue
+			}
+			var index keyRecord
+			if err := getRecord(s.context(), tx, key, &index); err != nil {
+				return err
+			}
+			owner = index.UUID
+			if err := deleteKeyIndex(s.context(), tx, publicKey, owner); err != nil {
+				return err
+			}
+		}
+		return tx.Put(revokedKeyPrefix+keyFingerprint, []byte{})
+	})
+	return owner, err
+}
+
+// PublicKeyRevoked checks whether the public key with the SHA256 fingerprint is revoked.
+func (s StoreWrapper) PublicKeyRevoked(keyFingerprint string) (bool, error) {
+	return s.exists(revokedKeyPrefix + keyFingerprint)
+}
+
+// TouchPublicKey records the use of the public key at the time. The time is only written if the previous use is
+// older than the resolution of the last use.
+func (s StoreWrapper) TouchPublicKey(publicKey []byte, now time.Time) error {
+	var index keyRecord
+	err := getRecord(s.context(), s.Store, publicKeyPrefix+string(publicKey), &index)
+	if err != nil || now.Sub(index.LastUsed) < lastUsedInterval {
+		return err
+	}
+	return s.update(func(tx store.Transaction) error {
+		if err := getRecord(s.context(), tx, publicKeyPrefix+string(publicKey), &index); err != nil {
+			return err
+		}
+		if now.Sub(index.LastUsed) < lastUsedInterval {
+			return nil
+		}
+		index.LastUsed = now
+		return putTxRecord(tx, publicKeyPrefix+string(publicKey), index)
+	})
+}
+
+// putKey saves the index of the public key in the transaction, revoked keys are rejected.
+func putKey(ctx context.Context, tx store.Transaction, publicKey string, index keyRecord) error {
+	keyFingerprint := fingerprint([]byte(publicKey))
+	_, err := tx.GetContext(ctx, revokedKeyPrefix+keyFingerprint)
+	if err == nil {
+		return fmt.Errorf("%s: %w", keyFingerprint, ErrKeyRevoked)
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	index.Version = schemaVersion
+	if err := tx.Put(userKeyIndex(index.UUID, publicKey), []byte(publicKey)); err != nil {
+		return err
+	}
+	return putTxRecord(tx, publicKeyPrefix+publicKey, index)
+}
+
+// userKeyIndex returns the key of the public key in the index of the keys of the user.
+func userKeyIndex(uuid, publicKey string) string {
+	return userKeyPrefix + uuid + "/" + fingerprint([]byte(publicKey))
+}
+
+// fingerprint returns the SHA256 fingerprint of the public key in the ssh wire format, it equals
+// ssh.FingerprintSHA256 of the parsed key.
+func fingerprint(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
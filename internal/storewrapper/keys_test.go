@@ -0,0 +1,188 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(public)
+	require.NoError(t, err)
+	return key
+}
+
+func TestPublicKeys(t *testing.T) {
+	primary, laptop, stolen := newPublicKey(t), newPublicKey(t), newPublicKey(t)
+	testCases := map[string]struct {
+		change       func(StoreWrapper) error
+		expectErr    bool
+		expectErrIs  error
+		expectLabels []string
+	}{
+		"primary key": {
+			change:       func(StoreWrapper) error { return nil },
+			expectLabels: []string{""},
+		},
+		"add key": {
+			change: func(data StoreWrapper) error {
+				return data.AddPublicKey("alice", laptop.Marshal(), "laptop")
+			},
+			expectLabels: []string{"", "laptop"},
+		},
+		"add key twice": {
+			change: func(data StoreWrapper) error {
+				if err := data.AddPublicKey("alice", laptop.Marshal(), "laptop"); err != nil {
+					return err
+				}
+				return data.AddPublicKey("alice", laptop.Marshal(), "desktop")
+			},
+			expectErr:    true,
+			expectLabels: []string{"", "laptop"},
+		},
+		"add key of another user": {
+			change: func(data StoreWrapper) error {
+				return data.AddPublicKey("alice", stolen.Marshal(), "stolen")
+			},
+			expectErr:    true,
+			expectLabels: []string{""},
+		},
+		"add key of unknown user": {
+			change: func(data StoreWrapper) error {
+				return data.AddPublicKey("carol", laptop.Marshal(), "laptop")
+			},
+			expectErr:    true,
+			expectErrIs:  store.ErrNotFound,
+			expectLabels: []string{""},
+		},
+		"remove key": {
+			change: func(data StoreWrapper) error {
+				if err := data.AddPublicKey("alice", laptop.Marshal(), "laptop"); err != nil {
+					return err
+				}
+				return data.RemovePublicKey("alice", ssh.FingerprintSHA256(laptop))
+			},
+			expectLabels: []string{""},
+		},
+		"remove primary key": {
+			change: func(data StoreWrapper) error {
+				return data.RemovePublicKey("alice", ssh.FingerprintSHA256(primary))
+			},
+			expectErr:    true,
+			expectErrIs:  ErrPrimaryKey,
+			expectLabels: []string{""},
+		},
+		"remove key of another user": {
+			change: func(data StoreWrapper) error {
+				return data.RemovePublicKey("alice", ssh.FingerprintSHA256(stolen))
+			},
+			expectErr:    true,
+			expectErrIs:  store.ErrNotFound,
+			expectLabels: []string{""},
+		},
+		"revoke key": {
+			change: func(data StoreWrapper) error {
+				if err := data.AddPublicKey("alice", laptop.Marshal(), "laptop"); err != nil {
+					return err
+				}
+				uuid, err := data.RevokePublicKey(ssh.FingerprintSHA256(laptop))
+				if err != nil || uuid != "alice" {
+					return err
+				}
+				return data.AddPublicKey("alice", laptop.Marshal(), "laptop")
+			},
+			expectErr:    true,
+			expectErrIs:  ErrKeyRevoked,
+			expectLabels: []string{""},
+		},
+		"replace primary key": {
+			change: func(data StoreWrapper) error {
+				if err := data.AddPublicKey("alice", laptop.Marshal(), "laptop"); err != nil {
+					return err
+				}
+				return data.PutUser(config.UserInformation{UUID: "alice", PubKey: newPublicKey(t).Marshal()})
+			},
+			expectLabels: []string{"laptop", ""},
+		},
+		"revoke primary key": {
+			change: func(data StoreWrapper) error {
+				_, err := data.RevokePublicKey(ssh.FingerprintSHA256(primary))
+				return err
+			},
+			expectLabels: []string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := StoreWrapper{Store: store.NewStdStore()}
+			require.NoError(data.PutUser(config.UserInformation{UUID: "alice", PubKey: primary.Marshal()}))
+			require.NoError(data.PutUser(config.UserInformation{UUID: "bob", PubKey: stolen.Marshal()}))
+
+			err := tc.change(data)
+			if tc.expectErr {
+				assert.Error(err)
+				if tc.expectErrIs != nil {
+					assert.ErrorIs(err, tc.expectErrIs)
+				}
+			} else {
+				require.NoError(err)
+			}
+
+			keys, err := data.GetPublicKeys("alice")
+			require.NoError(err)
+			labels := []string{}
+			for _, key := range keys {
+				labels = append(labels, key.Label)
+				// only the keys of the user records have no label
+				assert.Equal(key.Label == "", key.Primary)
+				_, err := data.GetUserByPublicKey(string(key.Key))
+				assert.NoError(err)
+			}
+			assert.Equal(tc.expectLabels, labels)
+			user, err := data.GetUserByPublicKey(string(stolen.Marshal()))
+			require.NoError(err)
+			assert.Equal("bob", user.UUID)
+		})
+	}
+}
+
+func TestTouchPublicKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key := newPublicKey(t)
+	data := StoreWrapper{Store: store.NewStdStore()}
+	require.NoError(data.PutUser(config.UserInformation{UUID: "alice", PubKey: key.Marshal()}))
+	start := time.Unix(1700000000, 0)
+
+	lastUsed := func() time.Time {
+		keys, err := data.GetPublicKeys("alice")
+		require.NoError(err)
+		require.Len(keys, 1)
+		return keys[0].LastUsed
+	}
+	require.NoError(data.TouchPublicKey(key.Marshal(), start))
+	assert.True(start.Equal(lastUsed()))
+	require.NoError(data.TouchPublicKey(key.Marshal(), start.Add(time.Minute)))
+	assert.True(start.Equal(lastUsed()))
+	require.NoError(data.TouchPublicKey(key.Marshal(), start.Add(lastUsedInterval)))
+	assert.True(start.Add(lastUsedInterval).Equal(lastUsed()))
+	assert.ErrorIs(data.TouchPublicKey(newPublicKey(t).Marshal(), start), store.ErrNotFound)
+}
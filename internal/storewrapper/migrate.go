@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+)
+
+// migrations upgrade the records of the store, migrations[v] upgrades from schema version v to v+1. Several servers
+// may migrate the same store at once, so a migration must skip the records which are already upgraded.
+var migrations = []func(StoreWrapper) error{
+	migrateVersioned,
+	migrateUserKeys,
+}
+
+// SchemaVersion returns the schema version of the store, stores written before the schema was versioned have version 0.
+func (s StoreWrapper) SchemaVersion() (int, error) {
+	value, err := s.Store.GetContext(s.context(), schemaVersionKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(value))
+}
+
+// MigrateSchema upgrades the records written by older versions to the current schema version. It returns the schema
+// version of the store before the migration.
+func (s StoreWrapper) MigrateSchema() (int, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	}
+	if version > schemaVersion {
+		return version, fmt.Errorf("store has schema version %d, supported up to %d: %w", version, schemaVersion, ErrSchemaVersion)
+	}
+	for next := version; next < schemaVersion; next++ {
+		if err := migrations[next](s); err != nil {
+			return version, fmt.Errorf("migrating to schema version %d: %w", next+1, err)
+		}
+		if err := s.Store.PutContext(s.context(), schemaVersionKey, []byte(strconv.Itoa(next+1))); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// migrateVersioned adds the version to the records, replaces the copies of the users under their public keys with an
+// index and moves the points of users and teams to grade records. Each record is upgraded in its own transaction,
+// records upgraded by another server in the meantime are skipped.
+func migrateVersioned(s StoreWrapper) error {
+	steps := []struct {
+		prefix  string
+		migrate func(ctx context.Context, tx store.Transaction, key string) error
+	}{
+		{uuidKeyPrefix, migrateUser},
+		{publicKeyPrefix, migrateKey},
+		{challengeLocationPrefix, migrateChallenge},
+		{teamPrefix, migrateTeam},
+	}
+	for _, step := range steps {
+		var keys []string
+		err := store.Scan(s.context(), s.Store, step.prefix, func(entry store.KeyValue) error {
+			var header recordHeader
+			if err := json.Unmarshal(entry.Value, &header); err != nil {
+				return fmt.Errorf("decoding %s: %w", entry.Key, err)
+			}
+			if header.Version == 0 {
+				keys = append(keys, entry.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := s.update(func(tx store.Transaction) error {
+				return step.migrate(s.context(), tx, key)
+			}); err != nil {
+				return fmt.Errorf("migrating %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateUser moves the points of the user to grades.
+func migrateUser(ctx context.Context, tx store.Transaction, key string) error {
+	var rec userRecord
+	if err := getRecord(ctx, tx, key, &rec); err != nil || rec.Version > 0 {
+		return ignoreNotFound(err)
+	}
+	rec.UUID = strings.TrimPrefix(key, uuidKeyPrefix)
+	if err := putPoints(ctx, tx, rec.UUID, rec.Points); err != nil {
+		return err
+	}
+	rec.Points = nil
+	rec.Version = schemaVersion
+	return putTxRecord(tx, key, rec)
+}
+
+// migrateKey replaces the copy of the user with an index. Users which only exist under their public key are created,
+// copies without uuid are kept, since they can not be indexed.
+func migrateKey(ctx context.Context, tx store.Transaction, key string) error {
+	var rec userRecord
+	if err := getRecord(ctx, tx, key, &rec); err != nil || rec.Version > 0 || rec.UUID == "" {
+		return ignoreNotFound(err)
+	}
+	var user userRecord
+	err := getRecord(ctx, tx, uuidKeyPrefix+rec.UUID, &user)
+	if errors.Is(err, store.ErrNotFound) {
+		if len(rec.PubKey) == 0 {
+			rec.PubKey = []byte(strings.TrimPrefix(key, publicKeyPrefix))
+		}
+		if err := putPoints(ctx, tx, rec.UUID, rec.Points); err != nil {
+			return err
+		}
+		rec.Points = nil
+		rec.Version = schemaVersion
+		err = putTxRecord(tx, uuidKeyPrefix+rec.UUID, rec)
+	}
+	if err != nil {
+		return err
+	}
+	return putTxRecord(tx, key, keyRecord{recordHeader: recordHeader{schemaVersion}, UUID: rec.UUID})
+}
+
+// migrateChallenge adds the version to the challenge, challenges stored as null become empty challenges.
+func migrateChallenge(ctx context.Context, tx store.Transaction, key string) error {
+	var rec challengeRecord
+	if err := getRecord(ctx, tx, key, &rec); err != nil || rec.Version > 0 {
+		return ignoreNotFound(err)
+	}
+	rec.Version = schemaVersion
+	return putTxRecord(tx, key, rec)
+}
+
+// migrateTeam moves the points of the team to grades of the team workspace.
+func migrateTeam(ctx context.Context, tx store.Transaction, key string) error {
+	var rec teamRecord
+	if err := getRecord(ctx, tx, key, &rec); err != nil || rec.Version > 0 {
+		return ignoreNotFound(err)
+	}
+	workspace := config.TeamWorkspacePrefix + strings.TrimPrefix(key, teamPrefix)
+	if err := putPoints(ctx, tx, workspace, rec.Points); err != nil {
+		return err
+	}
+	rec.Points = nil
+	rec.Version = schemaVersion
+	return putTxRecord(tx, key, rec)
+}
+
+// migrateUserKeys adds the public keys to the index of the keys of their users. Each key is indexed in its own
+// transaction, indexing a key again writes the same entry.
+func migrateUserKeys(s StoreWrapper) error {
+	var keys []string
+	err := store.Scan(s.context(), s.Store, publicKeyPrefix, func(entry store.KeyValue) error {
+		keys = append(keys, entry.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := s.update(func(tx store.Transaction) error {
+			var index keyRecord
+			if err := getRecord(s.context(), tx, key, &index); err != nil || index.UUID == "" {
+				return ignoreNotFound(err)
+			}
+			publicKey := strings.TrimPrefix(key, publicKeyPrefix)
+			return tx.Put(userKeyIndex(index.UUID, publicKey), []byte(publicKey))
+		})
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// putPoints saves the points as grades of the workspace, grades which already exist are newer and kept.
+func putPoints(ctx context.Context, tx store.Transaction, workspace string, points map[string]int) error {
+	for exercise, value := range points {
+		key := gradeKey(workspace, exercise)
+		_, err := tx.GetContext(ctx, key)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		grade := gradeRecord{recordHeader{schemaVersion}, config.Grade{Workspace: workspace, Exercise: exercise, Points: value}}
+		if err := putTxRecord(tx, key, grade); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignoreNotFound ignores the error of records deleted in the meantime.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,397 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+)
+
+// schemaVersion is the version of the records written by this version, older records are upgraded by MigrateSchema.
+const schemaVersion = 2
+
+// ErrSchemaVersion is returned for records written by a newer version.
+var ErrSchemaVersion = errors.New("unsupported schema version")
+
+// recordHeader is embedded in the records of users, public keys, challenges, grades and teams. Records written before
+// the schema was versioned have version 0.
+type recordHeader struct {
+	Version int `json:"version"`
+}
+
+func (h recordHeader) version() int {
+	return h.Version
+}
+
+// userRecord is stored under the uuid of the user.
+type userRecord struct {
+	recordHeader
+	config.UserInformation
+}
+
+// keyRecord indexes a user by the public key. In schema version 0 the public key held a full copy of the user, which
+// has the same UUID field.
+type keyRecord struct {
+	recordHeader
+	UUID     string
+	Label    string `json:",omitempty"`
+	Added    time.Time
+	LastUsed time.Time
+}
+
+// challengeRecord is stored under the name of the challenge.
+type challengeRecord struct {
+	recordHeader
+	config.ContainerInformation
+}
+
+// gradeRecord is stored under the workspace and the exercise.
+type gradeRecord struct {
+	recordHeader
+	config.Grade
+}
+
+// teamRecord is stored under the name of the team.
+type teamRecord struct {
+	recordHeader
+	config.TeamInformation
+}
+
+// getter reads from a store or a transaction.
+type getter interface {
+	GetContext(context.Context, string) ([]byte, error)
+}
+
+// PutUser saves the user and indexes it by its public key in one transaction. The index of the previous public key
+// of the user is removed, a public key can only belong to one user.
+func (s StoreWrapper) PutUser(user config.UserInformation) error {
+	if user.UUID == "" {
+		return errors.New("user has no uuid")
+	}
+	user.Points = nil
+	privKey, err := s.seal(uuidKeyPrefix+user.UUID, user.PrivKey)
+	if err != nil {
+		return err
+	}
+	user.PrivKey = privKey
+	return s.update(func(tx store.Transaction) error {
+		return putUser(s.context(), tx, user)
+	})
+}
+
+// GetUser gets the user with the uuid.
+func (s StoreWrapper) GetUser(uuid string) (config.UserInformation, error) {
+	value, err := s.Store.GetContext(s.context(), uuidKeyPrefix+uuid)
+	if err != nil {
+		return config.UserInformation{}, err
+	}
+	return s.decodeUser(uuidKeyPrefix+uuid, value)
+}
+
+// GetUserByPublicKey gets the user the public key belongs to.
+func (s StoreWrapper) GetUserByPublicKey(publicKey string) (config.UserInformation, error) {
+	var index keyRecord
+	if err := getRecord(s.context(), s.Store, publicKeyPrefix+publicKey, &index); err != nil {
+		return config.UserInformation{}, err
+	}
+	if index.UUID == "" {
+		return config.UserInformation{}, fmt.Errorf("public key belongs to no user: %w", store.ErrNotFound)
+	}
+	return s.GetUser(index.UUID)
+}
+
+// UUIDExists checks whether the user is in the store.
+func (s StoreWrapper) UUIDExists(uuid string) (bool, error) {
+	return s.exists(uuidKeyPrefix + uuid)
+}
+
+// PublicKeyExists checks whether the publicKey is in the store.
+func (s StoreWrapper) PublicKeyExists(publicKey string) (bool, error) {
+	return s.exists(publicKeyPrefix + publicKey)
+}
+
+// GetAllUsers gets all users indexed by their uuid.
+func (s StoreWrapper) GetAllUsers() (map[string]config.UserInformation, error) {
+	return getAll(s, uuidKeyPrefix, s.decodeUser)
+}
+
+// decodeUser decodes the user record of the key and decrypts the private key of the user.
+func (s StoreWrapper) decodeUser(key string, value []byte) (config.UserInformation, error) {
+	var rec userRecord
+	if err := decodeRecord(key, value, &rec); err != nil {
+		return config.UserInformation{}, err
+	}
+	privKey, err := s.open(key, rec.PrivKey)
+	if err != nil {
+		return config.UserInformation{}, err
+	}
+	rec.PrivKey = privKey
+	return rec.UserInformation, nil
+}
+
+// PutChallenge puts a challenge into the store.
+func (s StoreWrapper) PutChallenge(name string, challenge config.ContainerInformation) error {
+	return s.putRecord(challengeLocationPrefix+name, challengeRecord{recordHeader{schemaVersion}, challenge})
+}
+
+// GetChallenge gets a challenge.
+func (s StoreWrapper) GetChallenge(name string) (config.ContainerInformation, error) {
+	var rec challengeRecord
+	err := getRecord(s.context(), s.Store, challengeLocationPrefix+name, &rec)
+	return rec.ContainerInformation, err
+}
+
+// ChallengeExists checks whether the challenge is in the store.
+func (s StoreWrapper) ChallengeExists(name string) (bool, error) {
+	return s.exists(challengeLocationPrefix + name)
+}
+
+// GetAllChallenges gets all challenges indexed by their name.
+func (s StoreWrapper) GetAllChallenges() (map[string]config.ContainerInformation, error) {
+	return getAll(s, challengeLocationPrefix, func(key string, value []byte) (config.ContainerInformation, error) {
+		var rec challengeRecord
+		err := decodeRecord(key, value, &rec)
+		return rec.ContainerInformation, err
+	})
+}
+
+// PutGrade saves the points of the workspace for the exercise, previous points are replaced.
+func (s StoreWrapper) PutGrade(grade config.Grade) error {
+	if grade.Workspace == "" || strings.Contains(grade.Workspace, "/") || grade.Exercise == "" {
+		return fmt.Errorf("invalid grade of workspace %q for exercise %q", grade.Workspace, grade.Exercise)
+	}
+	return s.putRecord(gradeKey(grade.Workspace, grade.Exercise), gradeRecord{recordHeader{schemaVersion}, grade})
+}
+
+// GetGrades gets the points of the workspace indexed by the exercise.
+func (s StoreWrapper) GetGrades(workspace string) (map[string]int, error) {
+	return getAll(s, gradeKey(workspace, ""), func(key string, value []byte) (int, error) {
+		var rec gradeRecord
+		err := decodeRecord(key, value, &rec)
+		return rec.Points, err
+	})
+}
+
+// PutTeamData puts a team into the store.
+func (s StoreWrapper) PutTeamData(name string, team config.TeamInformation) error {
+	value, err := s.encodeTeam(teamPrefix+name, team)
+	if err != nil {
+		return err
+	}
+	return s.Store.PutContext(s.context(), teamPrefix+name, value)
+}
+
+// GetTeamData gets a team.
+func (s StoreWrapper) GetTeamData(name string) (config.TeamInformation, error) {
+	value, err := s.Store.GetContext(s.context(), teamPrefix+name)
+	if err != nil {
+		return config.TeamInformation{}, err
+	}
+	return s.decodeTeam(teamPrefix+name, value)
+}
+
+// UpdateTeams changes the teams, indexed by their name, with fn in one transaction. Teams which fn removes from the
+// map are deleted, added or changed teams are stored. Concurrent changes of the teams conflict, so the membership
+// checks of fn see all committed changes.
+func (s StoreWrapper) UpdateTeams(fn func(teams map[string]config.TeamInformation) error) error {
+	return s.update(func(tx store.Transaction) error {
+		iter, err := tx.IteratorContext(s.context(), teamPrefix)
+		if err != nil {
+			return err
+		}
+		stored := make(map[string]config.TeamInformation)
+		for iter.HasNext() {
+			key, err := iter.GetNext()
+			if err != nil {
+				return err
+			}
+			value, err := tx.GetContext(s.context(), key)
+			if err != nil {
+				return err
+			}
+			if stored[strings.TrimPrefix(key, teamPrefix)], err = s.decodeTeam(key, value); err != nil {
+				return err
+			}
+		}
+		teams := make(map[string]config.TeamInformation, len(stored))
+		for name, team := range stored {
+			team.Members = slices.Clone(team.Members)
+			teams[name] = team
+		}
+		if err := fn(teams); err != nil {
+			return err
+		}
+		for name := range stored {
+			if _, ok := teams[name]; !ok {
+				if err := tx.Delete(teamPrefix + name); err != nil {
+					return err
+				}
+			}
+		}
+		for name, team := range teams {
+			if old, ok := stored[name]; ok && reflect.DeepEqual(old, team) {
+				continue
+			}
+			value, err := s.encodeTeam(teamPrefix+name, team)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(teamPrefix+name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAllTeams gets all teams indexed by their name.
+func (s StoreWrapper) GetAllTeams() (map[string]config.TeamInformation, error) {
+	return getAll(s, teamPrefix, s.decodeTeam)
+}
+
+// encodeTeam encrypts the private key of the team and encodes it.
+func (s StoreWrapper) encodeTeam(key string, team config.TeamInformation) ([]byte, error) {
+	team.Points = nil
+	privKey, err := s.seal(key, team.PrivKey)
+	if err != nil {
+		return nil, err
+	}
+	team.PrivKey = privKey
+	return json.Marshal(teamRecord{recordHeader{schemaVersion}, team})
+}
+
+// decodeTeam decodes the team and decrypts its private key.
+func (s StoreWrapper) decodeTeam(key string, value []byte) (config.TeamInformation, error) {
+	var rec teamRecord
+	if err := decodeRecord(key, value, &rec); err != nil {
+		return config.TeamInformation{}, err
+	}
+	privKey, err := s.open(key, rec.PrivKey)
+	if err != nil {
+		return config.TeamInformation{}, err
+	}
+	rec.PrivKey = privKey
+	return rec.TeamInformation, nil
+}
+
+// update runs fn in a transaction, it is retried on conflicts.
+func (s StoreWrapper) update(fn func(store.Transaction) error) error {
+	return store.UpdateContext(s.context(), s.Store, fn)
+}
+
+// exists checks whether the key is in the store.
+func (s StoreWrapper) exists(key string) (bool, error) {
+	_, err := s.Store.GetContext(s.context(), key)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// putRecord saves the record under the key.
+func (s StoreWrapper) putRecord(key string, rec any) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.Store.PutContext(s.context(), key, data)
+}
+
+// putUser saves the user and the index of its public key in the transaction.
+func putUser(ctx context.Context, tx store.Transaction, user config.UserInformation) error {
+	var previous userRecord
+	err := getRecord(ctx, tx, uuidKeyPrefix+user.UUID, &previous)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if err == nil && len(previous.PubKey) > 0 && !bytes.Equal(previous.PubKey, user.PubKey) {
+		if err := deleteKeyIndex(ctx, tx, string(previous.PubKey), user.UUID); err != nil {
+			return err
+		}
+	}
+	if len(user.PubKey) > 0 {
+		var index keyRecord
+		err := getRecord(ctx, tx, publicKeyPrefix+string(user.PubKey), &index)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if err == nil && index.UUID != "" && index.UUID != user.UUID {
+			return fmt.Errorf("public key of user %s already belongs to user %s", user.UUID, index.UUID)
+		}
+		// the label and the timestamps of a key which is already indexed are kept
+		if err != nil || index.UUID == "" {
+			if err := putKey(ctx, tx, string(user.PubKey), keyRecord{UUID: user.UUID, Added: time.Now()}); err != nil {
+				return err
+			}
+		}
+	}
+	return putTxRecord(tx, uuidKeyPrefix+user.UUID, userRecord{recordHeader{schemaVersion}, user})
+}
+
+// deleteKeyIndex removes the index of the public key and its entry in the keys of the user if it belongs to the user.
+func deleteKeyIndex(ctx context.Context, tx store.Transaction, publicKey, uuid string) error {
+	var index keyRecord
+	err := getRecord(ctx, tx, publicKeyPrefix+publicKey, &index)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if index.UUID != uuid {
+		return nil
+	}
+	if err := tx.Delete(userKeyIndex(uuid, publicKey)); err != nil {
+		return err
+	}
+	return tx.Delete(publicKeyPrefix + publicKey)
+}
+
+// gradeKey returns the key of the grade, the grades of a workspace share the prefix of the empty exercise.
+func gradeKey(workspace, exercise string) string {
+	return gradePrefix + workspace + "/" + exercise
+}
+
+// putTxRecord saves the record under the key in the transaction.
+func putTxRecord(tx store.Transaction, key string, rec any) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, data)
+}
+
+// getRecord reads and decodes the record of the key.
+func getRecord(ctx context.Context, g getter, key string, rec interface{ version() int }) error {
+	value, err := g.GetContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	return decodeRecord(key, value, rec)
+}
+
+// decodeRecord decodes the record, records of newer schema versions are rejected.
+func decodeRecord(key string, value []byte, rec interface{ version() int }) error {
+	if err := json.Unmarshal(value, rec); err != nil {
+		return fmt.Errorf("decoding %s: %w", key, err)
+	}
+	if rec.version() > schemaVersion {
+		return fmt.Errorf("%s has schema version %d, supported up to %d: %w", key, rec.version(), schemaVersion, ErrSchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
+)
+
+// ErrNoKeyRing is returned when an encrypted secret is read without keys.
+var ErrNoKeyRing = errors.New("secret is encrypted, but no key ring is configured")
+
+// RotateSecrets encrypts the secrets which are stored in plaintext with the current key of the key ring and wraps the
+// data keys of the secrets sealed with an older key again. Each record is changed in its own transaction, it returns
+// the number of changed records.
+func (s StoreWrapper) RotateSecrets() (int, error) {
+	if s.Keys == nil {
+		return 0, ErrNoKeyRing
+	}
+	secrets := []struct {
+		prefix string
+		reseal func(key string, value []byte) ([]byte, bool, error)
+	}{
+		{uuidKeyPrefix, s.resealUser},
+		{teamPrefix, s.resealTeam},
+		{mfaPrefix, s.resealMFA},
+		{hostKeyPrefix, s.resealHostKey},
+		{privKeyLocation, s.resealValue},
+		{caKeyLocation, s.resealValue},
+	}
+	rotated := 0
+	for _, secret := range secrets {
+		var keys []string
+		err := store.Scan(s.context(), s.Store, secret.prefix, func(entry store.KeyValue) error {
+			if _, changed, err := secret.reseal(entry.Key, entry.Value); err != nil || changed {
+				keys = append(keys, entry.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+		for _, key := range keys {
+			changed := false
+			err := s.update(func(tx store.Transaction) error {
+				value, err := tx.GetContext(s.context(), key)
+				if err != nil {
+					return err
+				}
+				value, changed, err = secret.reseal(key, value)
+				if err != nil || !changed {
+					return err
+				}
+				return tx.Put(key, value)
+			})
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return rotated, fmt.Errorf("encrypting %s: %w", key, err)
+			}
+			if err == nil && changed {
+				rotated++
+			}
+		}
+	}
+	return rotated, nil
+}
+
+// resealUser encrypts the private key of the user record again.
+func (s StoreWrapper) resealUser(key string, value []byte) ([]byte, bool, error) {
+	var rec userRecord
+	if err := decodeRecord(key, value, &rec); err != nil {
+		return nil, false, err
+	}
+	privKey, changed, err := s.reseal(key, rec.PrivKey)
+	if err != nil || !changed {
+		return value, false, err
+	}
+	rec.PrivKey = privKey
+	value, err = json.Marshal(rec)
+	return value, true, err
+}
+
+// resealTeam encrypts the private key of the team record again.
+func (s StoreWrapper) resealTeam(key string, value []byte) ([]byte, bool, error) {
+	var rec teamRecord
+	if err := decodeRecord(key, value, &rec); err != nil {
+		return nil, false, err
+	}
+	privKey, changed, err := s.reseal(key, rec.PrivKey)
+	if err != nil || !changed {
+		return value, false, err
+	}
+	rec.PrivKey = privKey
+	value, err = json.Marshal(rec)
+	return value, true, err
+}
+
+// resealMFA encrypts the TOTP secret of the second factor again.
+func (s StoreWrapper) resealMFA(key string, value []byte) ([]byte, bool, error) {
+	data, err := decodeJSON[config.MFAData](key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	secret, changed, err := s.reseal(key, data.Secret)
+	if err != nil || !changed {
+		return value, false, err
+	}
+	data.Secret = secret
+	value, err = json.Marshal(data)
+	return value, true, err
+}
+
+// resealHostKey encrypts the private keys of the host key record again.
+func (s StoreWrapper) resealHostKey(key string, value []byte) ([]byte, bool, error) {
+	var hostKey config.HostKey
+	if err := json.Unmarshal(value, &hostKey); err != nil {
+		return nil, false, fmt.Errorf("decoding %s: %w", key, err)
+	}
+	privateKey, changed, err := s.reseal(key, hostKey.PrivateKey)
+	if err != nil {
+		return nil, false, err
+	}
+	nextPrivateKey, nextChanged, err := s.reseal(key, hostKey.NextPrivateKey)
+	if err != nil || !changed && !nextChanged {
+		return value, false, err
+	}
+	hostKey.PrivateKey, hostKey.NextPrivateKey = privateKey, nextPrivateKey
+	value, err = json.Marshal(hostKey)
+	return value, true, err
+}
+
+// resealValue encrypts a record which is a secret as a whole again.
+func (s StoreWrapper) resealValue(key string, value []byte) ([]byte, bool, error) {
+	return s.reseal(key, value)
+}
+
+// reseal encrypts the secret with the current key if it is stored in plaintext, the data key of a secret sealed with
+// an older key is wrapped with the current key.
+func (s StoreWrapper) reseal(key string, secret []byte) ([]byte, bool, error) {
+	if len(secret) == 0 || s.Keys.Current(secret) {
+		return secret, false, nil
+	}
+	if !envelope.IsSealed(secret) {
+		sealed, err := s.Keys.Seal(secret, []byte(key))
+		return sealed, true, err
+	}
+	rewrapped, err := s.Keys.Rewrap(secret)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading %s: %w", key, err)
+	}
+	return rewrapped, true, nil
+}
+
+// seal encrypts the secret of the record with the key. Without key ring the secret is returned unchanged.
+func (s StoreWrapper) seal(key string, secret []byte) ([]byte, error) {
+	if s.Keys == nil || len(secret) == 0 {
+		return secret, nil
+	}
+	return s.Keys.Seal(secret, []byte(key))
+}
+
+// open decrypts the secret of the record with the key, secrets stored in plaintext are returned unchanged.
+func (s StoreWrapper) open(key string, secret []byte) ([]byte, error) {
+	if !envelope.IsSealed(secret) {
+		return secret, nil
+	}
+	if s.Keys == nil {
+		return nil, fmt.Errorf("reading %s: %w", key, ErrNoKeyRing)
+	}
+	plaintext, err := s.Keys.Open(secret, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+	return plaintext, nil
+}
+
+// putSecret encrypts the secret and saves it under the key.
+func (s StoreWrapper) putSecret(key string, secret []byte) error {
+	sealed, err := s.seal(key, secret)
+	if err != nil {
+		return err
+	}
+	return s.Store.PutContext(s.context(), key, sealed)
+}
+
+// getSecret reads and decrypts the secret saved under the key.
+func (s StoreWrapper) getSecret(key string) ([]byte, error) {
+	value, err := s.Store.GetContext(s.context(), key)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(key, value)
+}
+
+// encodeHostKey encrypts the private keys of the host key and encodes it.
+func (s StoreWrapper) encodeHostKey(key string, hostKey config.HostKey) ([]byte, error) {
+	var err error
+	if hostKey.PrivateKey, err = s.seal(key, hostKey.PrivateKey); err != nil {
+		return nil, err
+	}
+	if hostKey.NextPrivateKey, err = s.seal(key, hostKey.NextPrivateKey); err != nil {
+		return nil, err
+	}
+	return json.Marshal(hostKey)
+}
+
+// encodeMFAData encrypts the TOTP secret of the second factor and encodes it.
+func (s StoreWrapper) encodeMFAData(key string, data config.MFAData) ([]byte, error) {
+	var err error
+	if data.Secret, err = s.seal(key, data.Secret); err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+// decodeMFAData decodes the second factor and decrypts its TOTP secret.
+func (s StoreWrapper) decodeMFAData(key string, value []byte) (config.MFAData, error) {
+	data, err := decodeJSON[config.MFAData](key, value)
+	if err != nil {
+		return data, err
+	}
+	data.Secret, err = s.open(key, data.Secret)
+	return data, err
+}
+
+// decodeHostKey decodes the host key and decrypts its private keys.
+func (s StoreWrapper) decodeHostKey(key string, value []byte) (config.HostKey, error) {
+	hostKey, err := decodeJSON[config.HostKey](key, value)
+	if err != nil {
+		return hostKey, err
+	}
+	if hostKey.PrivateKey, err = s.open(key, hostKey.PrivateKey); err != nil {
+		return hostKey, err
+	}
+	hostKey.NextPrivateKey, err = s.open(key, hostKey.NextPrivateKey)
+	return hostKey, err
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKeyRing(t *testing.T, current string, ids ...string) *envelope.KeyRing {
+	keys := make(map[string][]byte)
+	for _, id := range append(ids, current) {
+		keys[id] = bytes.Repeat([]byte(id[:1]), 32)
+	}
+	keyRing, err := envelope.NewKeyRing(current, keys)
+	require.NoError(t, err)
+	return keyRing
+}
+
+// putSecrets writes a secret of every kind and returns the keys of the records.
+func putSecrets(t *testing.T, data StoreWrapper) []string {
+	require := require.New(t)
+	require.NoError(data.PutUser(config.UserInformation{UUID: "alice", PubKey: []byte("key-a"), PrivKey: []byte("secret-user")}))
+	require.NoError(data.PutPrivKey([]byte("secret-server")))
+	require.NoError(data.PutCAKey([]byte("secret-ca")))
+	require.NoError(data.PutHostKey("ed25519", config.HostKey{PrivateKey: []byte("secret-host"), NextPrivateKey: []byte("secret-next")}))
+	require.NoError(data.PutTeamData("red", config.TeamInformation{Name: "red", PrivKey: []byte("secret-team"), PubKey: []byte("public")}))
+	require.NoError(data.PutMFAData("alice", config.MFAData{Secret: []byte("secret-mfa")}))
+	return []string{uuidKeyPrefix + "alice", privKeyLocation, caKeyLocation, hostKeyPrefix + "ed25519", teamPrefix + "red", mfaPrefix + "alice"}
+}
+
+// assertSecrets checks that the secrets written by putSecrets are read.
+func assertSecrets(t *testing.T, data StoreWrapper) {
+	assert := assert.New(t)
+	require := require.New(t)
+	user, err := data.GetUser("alice")
+	require.NoError(err)
+	assert.Equal([]byte("secret-user"), user.PrivKey)
+	privKey, err := data.GetPrivKey()
+	require.NoError(err)
+	assert.Equal([]byte("secret-server"), privKey)
+	caKey, err := data.GetCAKey()
+	require.NoError(err)
+	assert.Equal([]byte("secret-ca"), caKey)
+	hostKeys, err := data.GetHostKeys()
+	require.NoError(err)
+	assert.Equal(config.HostKey{PrivateKey: []byte("secret-host"), NextPrivateKey: []byte("secret-next")}, hostKeys["ed25519"])
+	team, err := data.GetTeamData("red")
+	require.NoError(err)
+	assert.Equal([]byte("secret-team"), team.PrivKey)
+	mfaData, err := data.GetMFAData("alice")
+	require.NoError(err)
+	assert.Equal([]byte("secret-mfa"), mfaData.Secret)
+}
+
+func TestSecrets(t *testing.T) {
+	testCases := map[string]struct {
+		writeKeys       *envelope.KeyRing
+		readKeys        *envelope.KeyRing
+		expectEncrypted bool
+		expectErr       error
+	}{
+		"encrypted": {
+			writeKeys:       newKeyRing(t, "a"),
+			readKeys:        newKeyRing(t, "a"),
+			expectEncrypted: true,
+		},
+		"encrypted with a previous key": {
+			writeKeys:       newKeyRing(t, "a"),
+			readKeys:        newKeyRing(t, "b", "a"),
+			expectEncrypted: true,
+		},
+		"plaintext": {},
+		"plaintext read with key ring": {
+			readKeys: newKeyRing(t, "a"),
+		},
+		"encrypted read without key ring": {
+			writeKeys:       newKeyRing(t, "a"),
+			expectEncrypted: true,
+			expectErr:       ErrNoKeyRing,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backingStore := store.NewStdStore()
+			keys := putSecrets(t, StoreWrapper{Store: backingStore, Keys: tc.writeKeys})
+			for _, key := range keys {
+				value, err := backingStore.Get(key)
+				require.NoError(err)
+				// the secrets of JSON records are base64 encoded
+				plaintext := bytes.Contains(value, []byte("secret")) || bytes.Contains(value, []byte(base64.StdEncoding.EncodeToString([]byte("secret"))))
+				assert.Equal(tc.expectEncrypted, !plaintext, key)
+			}
+
+			data := StoreWrapper{Store: backingStore, Keys: tc.readKeys}
+			if tc.expectErr != nil {
+				_, err := data.GetCAKey()
+				assert.ErrorIs(err, tc.expectErr)
+				_, err = data.GetUser("alice")
+				assert.ErrorIs(err, tc.expectErr)
+				return
+			}
+			assertSecrets(t, data)
+		})
+	}
+}
+
+func TestRotateSecrets(t *testing.T) {
+	testCases := map[string]struct {
+		writeKeys     *envelope.KeyRing
+		rotateKeys    *envelope.KeyRing
+		expectRotated int
+		expectErr     bool
+	}{
+		"plaintext": {
+			rotateKeys:    newKeyRing(t, "a"),
+			expectRotated: 6,
+		},
+		"previous key": {
+			writeKeys:     newKeyRing(t, "a"),
+			rotateKeys:    newKeyRing(t, "b", "a"),
+			expectRotated: 6,
+		},
+		"current key": {
+			writeKeys:  newKeyRing(t, "a"),
+			rotateKeys: newKeyRing(t, "a"),
+		},
+		"unknown key": {
+			writeKeys:  newKeyRing(t, "a"),
+			rotateKeys: newKeyRing(t, "b"),
+			expectErr:  true,
+		},
+		"no key ring": {
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backingStore := store.NewStdStore()
+			putSecrets(t, StoreWrapper{Store: backingStore, Keys: tc.writeKeys})
+			data := StoreWrapper{Store: backingStore, Keys: tc.rotateKeys}
+			rotated, err := data.RotateSecrets()
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.expectRotated, rotated)
+
+			// the previous key is no longer needed
+			assertSecrets(t, StoreWrapper{Store: backingStore, Keys: newKeyRing(t, tc.rotateKeys.CurrentID())})
+			rotated, err = data.RotateSecrets()
+			require.NoError(err)
+			assert.Zero(rotated)
+		})
+	}
+}
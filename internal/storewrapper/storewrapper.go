@@ -5,123 +5,211 @@
 package storewrapper
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
 	"github.com/benschlueter/delegatio/internal/store"
 )
 
 const (
 	challengeLocationPrefix = "challenge-"
 	publicKeyPrefix         = "publickey-"
+	userKeyPrefix           = "userkey-"
 	uuidKeyPrefix           = "uuid-"
 	privKeyLocation         = "privkey-ssh"
+	caKeyLocation           = "cakey-ssh"
+	hostKeyPrefix           = "hostkey-"
+	revokedCertPrefix       = "revokedcert-"
+	revokedKeyPrefix        = "revokedkey-"
+	mfaPrefix               = "mfa-"
+	rateLimitPrefix         = "ratelimit-"
+	sessionLeasePrefix      = "sessionlease-"
+	teamPrefix              = "team-"
+	gradePrefix             = "grade-"
+	schemaVersionKey        = "schema-version"
+	backupKey               = "backup-last"
 )
 
+// CachedPrefixes returns the prefixes of the public keys, users, challenges and teams. They are read for every
+// connection and grading request and change rarely, so they can be served from a store.Cache.
+func CachedPrefixes() []string {
+	return []string{publicKeyPrefix, uuidKeyPrefix, challengeLocationPrefix, teamPrefix}
+}
+
 // StoreWrapper is a wrapper for the store interface.
 type StoreWrapper struct {
 	Store interface {
-		Get(string) ([]byte, error)
-		Put(string, []byte) error
-		Delete(string) error
-		Iterator(string) (store.Iterator, error)
+		GetContext(context.Context, string) ([]byte, error)
+		PutContext(context.Context, string, []byte) error
+		DeleteContext(context.Context, string) error
+		IteratorContext(context.Context, string) (store.Iterator, error)
+		RangeContext(ctx context.Context, prefix, token string, limit int) (store.Page, error)
+		BeginTransactionContext(context.Context) (store.Transaction, error)
 	}
+	// Keys encrypts the secrets, i.e. the private keys of the users, the host keys and the key of the certificate
+	// authority. Without keys new secrets are stored in plaintext and encrypted secrets can not be read.
+	Keys *envelope.KeyRing
+	ctx  context.Context
 }
 
-// PutChallengeData puts a challenge into the store.
-func (s StoreWrapper) PutChallengeData(challengeName string, target any) error {
-	challengeData, err := json.Marshal(target)
-	if err != nil {
-		return err
-	}
-	return s.Store.Put(challengeLocationPrefix+challengeName, challengeData)
+// WithContext returns a copy of the wrapper whose store calls are bound to the context.
+func (s StoreWrapper) WithContext(ctx context.Context) StoreWrapper {
+	s.ctx = ctx
+	return s
 }
 
-// GetChallengeData gets a challenge.
-func (s StoreWrapper) GetChallengeData(challengeName string, target any) error {
-	challengeData, err := s.Store.Get(challengeLocationPrefix + challengeName)
-	if err != nil {
-		return err
+func (s StoreWrapper) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
 	}
-	return json.Unmarshal(challengeData, target)
+	return s.ctx
 }
 
-// ChallengeExists checks whether the challenge is in the store.
-func (s StoreWrapper) ChallengeExists(challengeName string) (bool, error) {
-	_, err := s.Store.Get(challengeLocationPrefix + challengeName)
-	if errors.Is(err, &store.ValueUnsetError{}) {
-		return false, nil
-	}
-	if err != nil {
-		return false, err
-	}
-	return true, nil
-}
-
-// GetAllChallenges gets all challenge names.
-func (s StoreWrapper) GetAllChallenges() (map[string]config.ContainerInformation, error) {
-	chIterator, err := s.Store.Iterator(challengeLocationPrefix)
+// GetAllKeys prints everything in the store.
+func (s StoreWrapper) GetAllKeys() (keys []string, err error) {
+	stIterator, err := s.Store.IteratorContext(s.context(), "")
 	if err != nil {
-		return nil, err
+		return
 	}
-	challenges := make(map[string]config.ContainerInformation)
-	for chIterator.HasNext() {
-		key, err := chIterator.GetNext()
+	for stIterator.HasNext() {
+		key, err := stIterator.GetNext()
 		if err != nil {
 			return nil, err
 		}
-		key = strings.TrimPrefix(key, challengeLocationPrefix)
-		var challenge config.ContainerInformation
-		if err := s.GetChallengeData(key, &challenge); err != nil {
-			return nil, err
-		}
-		challenges[key] = challenge
+		keys = append(keys, key)
 	}
-	return challenges, nil
+	return
 }
 
-// PutDataIdxByPubKey puts a publicKey and associated data of the key into the store.
-func (s StoreWrapper) PutDataIdxByPubKey(pubkey string, target any) error {
-	publicKeyData, err := json.Marshal(target)
+// PutPrivKey puts a privKey into the store. It is the single host key of older installations.
+func (s StoreWrapper) PutPrivKey(privkey []byte) error {
+	return s.putSecret(privKeyLocation, privkey)
+}
+
+// GetPrivKey gets the privKey, it is imported into the host keys by hostkey.Ensure.
+func (s StoreWrapper) GetPrivKey() ([]byte, error) {
+	return s.getSecret(privKeyLocation)
+}
+
+// PutHostKey puts the host key of the key type into the store.
+func (s StoreWrapper) PutHostKey(keyType string, hostKey config.HostKey) error {
+	hostKeyData, err := s.encodeHostKey(hostKeyPrefix+keyType, hostKey)
 	if err != nil {
 		return err
 	}
-	return s.Store.Put(publicKeyPrefix+pubkey, publicKeyData)
+	return s.Store.PutContext(s.context(), hostKeyPrefix+keyType, hostKeyData)
 }
 
-// PutDataIdxByUUID puts a uuid and associated data of the key into the store.
-func (s StoreWrapper) PutDataIdxByUUID(uuid string, target any) error {
-	publicKeyData, err := json.Marshal(target)
+// UpdateHostKey changes the host key of the key type with fn in one transaction, so concurrent rotations of the key
+// conflict. It returns store.ErrNotFound if the store has no host key of the key type.
+func (s StoreWrapper) UpdateHostKey(keyType string, fn func(*config.HostKey) error) error {
+	key := hostKeyPrefix + keyType
+	return s.update(func(tx store.Transaction) error {
+		value, err := tx.GetContext(s.context(), key)
+		if err != nil {
+			return err
+		}
+		hostKey, err := s.decodeHostKey(key, value)
+		if err != nil {
+			return err
+		}
+		if err := fn(&hostKey); err != nil {
+			return err
+		}
+		value, err = s.encodeHostKey(key, hostKey)
+		if err != nil {
+			return err
+		}
+		return tx.Put(key, value)
+	})
+}
+
+// GetHostKeys gets the host keys indexed by the key type.
+func (s StoreWrapper) GetHostKeys() (map[string]config.HostKey, error) {
+	return getAll(s, hostKeyPrefix, s.decodeHostKey)
+}
+
+// PutCAKey puts the private key of the ssh certificate authority into the store.
+func (s StoreWrapper) PutCAKey(privkey []byte) error {
+	return s.putSecret(caKeyLocation, privkey)
+}
+
+// GetCAKey gets the private key of the ssh certificate authority.
+func (s StoreWrapper) GetCAKey() ([]byte, error) {
+	return s.getSecret(caKeyLocation)
+}
+
+// RevokeCertificate marks the certificate with the serial as revoked.
+func (s StoreWrapper) RevokeCertificate(serial uint64) error {
+	return s.Store.PutContext(s.context(), revokedCertPrefix+strconv.FormatUint(serial, 10), []byte{})
+}
+
+// CertificateRevoked checks whether the certificate with the serial is revoked.
+func (s StoreWrapper) CertificateRevoked(serial uint64) (bool, error) {
+	var perr *store.ValueUnsetError
+	_, err := s.Store.GetContext(s.context(), revokedCertPrefix+strconv.FormatUint(serial, 10))
+	if errors.As(err, &perr) {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	return s.Store.Put(uuidKeyPrefix+uuid, publicKeyData)
+	return true, nil
 }
 
-// GetPublicKeyData gets data associated with the publicKey.
-func (s StoreWrapper) GetPublicKeyData(publickey string, target any) error {
-	publicKeyData, err := s.Store.Get(publicKeyPrefix + publickey)
+// PutMFAData puts the second factor of the user into the store, the TOTP secret is encrypted with the key ring.
+func (s StoreWrapper) PutMFAData(uuid string, data config.MFAData) error {
+	value, err := s.encodeMFAData(mfaPrefix+uuid, data)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(publicKeyData, target)
+	return s.Store.PutContext(s.context(), mfaPrefix+uuid, value)
 }
 
-// GetUUIDData gets data associated with the uuid.
-func (s StoreWrapper) GetUUIDData(uuid string, target any) error {
-	uuidData, err := s.Store.Get(uuidKeyPrefix + uuid)
+// GetMFAData gets the second factor of the user.
+func (s StoreWrapper) GetMFAData(uuid string) (config.MFAData, error) {
+	value, err := s.Store.GetContext(s.context(), mfaPrefix+uuid)
 	if err != nil {
-		return err
+		return config.MFAData{}, err
 	}
-	return json.Unmarshal(uuidData, target)
+	return s.decodeMFAData(mfaPrefix+uuid, value)
+}
+
+// UpdateMFAData changes the second factor of the user with fn in one transaction. Concurrent updates, e.g. two logins
+// with the same code on different servers, conflict, so fn of the second update sees the changes of the first.
+func (s StoreWrapper) UpdateMFAData(uuid string, fn func(*config.MFAData) error) error {
+	key := mfaPrefix + uuid
+	return s.update(func(tx store.Transaction) error {
+		value, err := tx.GetContext(s.context(), key)
+		if err != nil {
+			return err
+		}
+		data, err := s.decodeMFAData(key, value)
+		if err != nil {
+			return err
+		}
+		if err := fn(&data); err != nil {
+			return err
+		}
+		value, err = s.encodeMFAData(key, data)
+		if err != nil {
+			return err
+		}
+		return tx.Put(key, value)
+	})
 }
 
-// PublicKeyExists checks whether the publicKey is in the store.
-func (s StoreWrapper) PublicKeyExists(publicKey string) (bool, error) {
+// MFAEnrolled checks whether the user has enrolled a second factor.
+func (s StoreWrapper) MFAEnrolled(uuid string) (bool, error) {
 	var perr *store.ValueUnsetError
-	_, err := s.Store.Get(publicKeyPrefix + publicKey)
+	_, err := s.Store.GetContext(s.context(), mfaPrefix+uuid)
 	if errors.As(err, &perr) {
 		return false, nil
 	}
@@ -131,63 +219,241 @@ func (s StoreWrapper) PublicKeyExists(publicKey string) (bool, error) {
 	return true, nil
 }
 
-// UUIDExists checks whether the publicKey is in the store.
-func (s StoreWrapper) UUIDExists(uuid string) (bool, error) {
-	var perr *store.ValueUnsetError
-	_, err := s.Store.Get(uuidKeyPrefix + uuid)
-	if errors.As(err, &perr) {
-		return false, nil
+// DeleteMFAData removes the second factor of the user, the user enrolls again on the next login.
+func (s StoreWrapper) DeleteMFAData(uuid string) error {
+	return s.Store.DeleteContext(s.context(), mfaPrefix+uuid)
+}
+
+// GetRateLimitState gets the rate limit state of the key, it is empty if no state exists.
+func (s StoreWrapper) GetRateLimitState(key string) (config.RateLimitState, error) {
+	value, err := s.Store.GetContext(s.context(), rateLimitPrefix+key)
+	if errors.Is(err, store.ErrNotFound) {
+		return config.RateLimitState{}, nil
 	}
 	if err != nil {
-		return false, err
+		return config.RateLimitState{}, err
 	}
-	return true, nil
+	return decodeJSON[config.RateLimitState](rateLimitPrefix+key, value)
 }
 
-// GetAllPublicKeys gets all publicKeys and the associated user information.
-func (s StoreWrapper) GetAllPublicKeys() (map[string]config.UserInformation, error) {
-	pubKeyIterator, err := s.Store.Iterator(publicKeyPrefix)
+// UpdateRateLimitState changes the rate limit state of the key with fn in one transaction, fn gets an empty state if
+// none exists. Concurrent updates of other servers conflict and are retried, so no update is lost.
+func (s StoreWrapper) UpdateRateLimitState(key string, fn func(*config.RateLimitState) error) error {
+	key = rateLimitPrefix + key
+	return s.update(func(tx store.Transaction) error {
+		var state config.RateLimitState
+		value, err := tx.GetContext(s.context(), key)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			if state, err = decodeJSON[config.RateLimitState](key, value); err != nil {
+				return err
+			}
+		}
+		if err := fn(&state); err != nil {
+			return err
+		}
+		return putTxRecord(tx, key, state)
+	})
+}
+
+// DeleteRateLimitState removes the rate limit state of the key.
+func (s StoreWrapper) DeleteRateLimitState(key string) error {
+	return s.Store.DeleteContext(s.context(), rateLimitPrefix+key)
+}
+
+// DeleteExpiredRateLimitStates removes the rate limit states which expired before now and returns their number.
+// Each state is checked again in the transaction deleting it, so states renewed in the meantime are kept.
+func (s StoreWrapper) DeleteExpiredRateLimitStates(now time.Time) (int, error) {
+	expired, err := s.expiredRateLimitStates(now)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	userData := make(map[string]config.UserInformation)
-	for pubKeyIterator.HasNext() {
-		key, err := pubKeyIterator.GetNext()
-		if err != nil {
-			return nil, err
+	deleted := 0
+	for _, key := range expired {
+		// the transaction is retried on conflicts, so the deletion is only counted once it committed
+		var removed bool
+		err := s.update(func(tx store.Transaction) error {
+			removed = false
+			value, err := tx.GetContext(s.context(), key)
+			if err != nil {
+				return err
+			}
+			state, err := decodeJSON[config.RateLimitState](key, value)
+			if err != nil || !state.Expires.Before(now) {
+				return err
+			}
+			removed = true
+			return tx.Delete(key)
+		})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return deleted, err
 		}
-		key = strings.TrimPrefix(key, publicKeyPrefix)
-		var user config.UserInformation
-		if err := s.GetPublicKeyData(key, &user); err != nil {
-			return nil, err
+		if err == nil && removed {
+			deleted++
 		}
-		userData[key] = user
 	}
-	return userData, nil
+	return deleted, nil
 }
 
-// GetAllKeys prints everything in the store.
-func (s StoreWrapper) GetAllKeys() (keys []string, err error) {
-	stIterator, err := s.Store.Iterator("")
+// expiredRateLimitStates returns the keys of the rate limit states which expired before now.
+func (s StoreWrapper) expiredRateLimitStates(now time.Time) ([]string, error) {
+	var expired []string
+	err := store.Scan(s.context(), s.Store, rateLimitPrefix, func(entry store.KeyValue) error {
+		state, err := decodeJSON[config.RateLimitState](entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+		if state.Expires.Before(now) {
+			expired = append(expired, entry.Key)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// PutSessionLease puts the lease of a session of the user into the store.
+func (s StoreWrapper) PutSessionLease(uuid, sessionID string, lease config.SessionLease) error {
+	leaseData, err := json.Marshal(lease)
 	if err != nil {
-		return
+		return err
 	}
-	for stIterator.HasNext() {
-		key, err := stIterator.GetNext()
+	return s.Store.PutContext(s.context(), sessionLeasePrefix+uuid+"/"+sessionID, leaseData)
+}
+
+// UpdateSessionLeases changes the leases of the sessions of the user, indexed by the session ID, with fn in one
+// transaction. Leases which fn removes from the map are deleted, added or changed leases are stored.
+func (s StoreWrapper) UpdateSessionLeases(uuid string, fn func(leases map[string]config.SessionLease) error) error {
+	prefix := sessionLeasePrefix + uuid + "/"
+	return s.update(func(tx store.Transaction) error {
+		iter, err := tx.IteratorContext(s.context(), prefix)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		keys = append(keys, key)
-	}
-	return
+		stored := make(map[string]config.SessionLease)
+		for iter.HasNext() {
+			key, err := iter.GetNext()
+			if err != nil {
+				return err
+			}
+			value, err := tx.GetContext(s.context(), key)
+			if err != nil {
+				return err
+			}
+			if stored[strings.TrimPrefix(key, prefix)], err = decodeJSON[config.SessionLease](key, value); err != nil {
+				return err
+			}
+		}
+		leases := make(map[string]config.SessionLease, len(stored))
+		for id, lease := range stored {
+			leases[id] = lease
+		}
+		if err := fn(leases); err != nil {
+			return err
+		}
+		for id := range stored {
+			if _, ok := leases[id]; !ok {
+				if err := tx.Delete(prefix + id); err != nil {
+					return err
+				}
+			}
+		}
+		for id, lease := range leases {
+			if old, ok := stored[id]; ok && old.Expires.Equal(lease.Expires) {
+				continue
+			}
+			if err := putTxRecord(tx, prefix+id, lease); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// PutPrivKey puts a privKey into the store.
-func (s StoreWrapper) PutPrivKey(privkey []byte) error {
-	return s.Store.Put(privKeyLocation, privkey)
+// DeleteSessionLease removes the lease of a session of the user.
+func (s StoreWrapper) DeleteSessionLease(uuid, sessionID string) error {
+	return s.Store.DeleteContext(s.context(), sessionLeasePrefix+uuid+"/"+sessionID)
 }
 
-// GetPrivKey gets the privKey.
-func (s StoreWrapper) GetPrivKey() ([]byte, error) {
-	return s.Store.Get(privKeyLocation)
+// GetSessionLeases gets the leases of all sessions of the user indexed by the session ID.
+func (s StoreWrapper) GetSessionLeases(uuid string) (map[string]config.SessionLease, error) {
+	return getAll(s, sessionLeasePrefix+uuid+"/", decodeJSON[config.SessionLease])
+}
+
+// ClaimBackup records that a scheduled backup is taken at now. It returns false if another server took a backup
+// within the interval before now.
+func (s StoreWrapper) ClaimBackup(now time.Time, interval time.Duration) (bool, error) {
+	claimed := false
+	err := s.update(func(tx store.Transaction) error {
+		claimed = false
+		value, err := tx.GetContext(s.context(), backupKey)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			var last time.Time
+			if err := last.UnmarshalText(value); err != nil {
+				return fmt.Errorf("decoding %s: %w", backupKey, err)
+			}
+			if now.Sub(last) < interval {
+				return nil
+			}
+		}
+		text, err := now.UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		claimed = true
+		return tx.Put(backupKey, text)
+	})
+	return claimed, err
+}
+
+// ReleaseBackup removes the claim of the backup taken at now after the backup failed, so the next check of any
+// server takes it again. A newer claim is kept.
+func (s StoreWrapper) ReleaseBackup(now time.Time) error {
+	return s.update(func(tx store.Transaction) error {
+		value, err := tx.GetContext(s.context(), backupKey)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var last time.Time
+		if err := last.UnmarshalText(value); err != nil {
+			return fmt.Errorf("decoding %s: %w", backupKey, err)
+		}
+		if !last.Equal(now) {
+			return nil
+		}
+		return tx.Delete(backupKey)
+	})
+}
+
+// getAll reads the entries of the prefix in one scan and decodes them, indexed by the key without the prefix.
+func getAll[T any](s StoreWrapper, prefix string, decode func(key string, value []byte) (T, error)) (map[string]T, error) {
+	entries := make(map[string]T)
+	err := store.Scan(s.context(), s.Store, prefix, func(entry store.KeyValue) error {
+		target, err := decode(entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+		entries[strings.TrimPrefix(entry.Key, prefix)] = target
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// decodeJSON decodes the JSON value of the key.
+func decodeJSON[T any](key string, value []byte) (T, error) {
+	var target T
+	if err := json.Unmarshal(value, &target); err != nil {
+		return target, fmt.Errorf("decoding %s: %w", key, err)
+	}
+	return target, nil
 }
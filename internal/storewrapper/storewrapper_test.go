@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package storewrapper
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestPutUser(t *testing.T) {
+	testCases := map[string]struct {
+		users      []config.UserInformation
+		expectErr  bool
+		expectKeys map[string]string
+	}{
+		"new user": {
+			users:      []config.UserInformation{{UUID: "alice", PubKey: []byte("key-a")}},
+			expectKeys: map[string]string{"key-a": "alice"},
+		},
+		"user without key": {
+			users:      []config.UserInformation{{UUID: "alice"}},
+			expectKeys: map[string]string{},
+		},
+		"changed key": {
+			users: []config.UserInformation{
+				{UUID: "alice", PubKey: []byte("key-a")},
+				{UUID: "alice", PubKey: []byte("key-b")},
+			},
+			expectKeys: map[string]string{"key-b": "alice"},
+		},
+		"key of another user": {
+			users: []config.UserInformation{
+				{UUID: "alice", PubKey: []byte("key-a")},
+				{UUID: "bob", PubKey: []byte("key-a")},
+			},
+			expectErr:  true,
+			expectKeys: map[string]string{"key-a": "alice"},
+		},
+		"no uuid": {
+			users:      []config.UserInformation{{PubKey: []byte("key-a")}},
+			expectErr:  true,
+			expectKeys: map[string]string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := StoreWrapper{Store: store.NewStdStore()}
+			var err error
+			for _, user := range tc.users {
+				if err = data.PutUser(user); err != nil {
+					break
+				}
+			}
+			if tc.expectErr {
+				assert.Error(err)
+			} else {
+				require.NoError(err)
+			}
+
+			keys, err := getAll(data, publicKeyPrefix, func(key string, value []byte) (string, error) {
+				var index keyRecord
+				err := decodeRecord(key, value, &index)
+				return index.UUID, err
+			})
+			require.NoError(err)
+			assert.Equal(tc.expectKeys, keys)
+			for key, uuid := range tc.expectKeys {
+				user, err := data.GetUserByPublicKey(key)
+				require.NoError(err)
+				assert.Equal(uuid, user.UUID)
+			}
+		})
+	}
+}
+
+func TestGrades(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := StoreWrapper{Store: store.NewStdStore()}
+	require.NoError(data.PutGrade(config.Grade{Workspace: "alice", Exercise: "1", Points: 5}))
+	require.NoError(data.PutGrade(config.Grade{Workspace: "alice", Exercise: "1", Points: 8}))
+	require.NoError(data.PutGrade(config.Grade{Workspace: "alice", Exercise: "2", Points: 3}))
+	require.NoError(data.PutGrade(config.Grade{Workspace: "alice-2", Exercise: "1", Points: 1}))
+	assert.Error(data.PutGrade(config.Grade{Workspace: "a/b", Exercise: "1"}))
+	assert.Error(data.PutGrade(config.Grade{Workspace: "alice"}))
+
+	grades, err := data.GetGrades("alice")
+	require.NoError(err)
+	assert.Equal(map[string]int{"1": 8, "2": 3}, grades)
+}
+
+func TestMigrateSchema(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.Len(migrations, schemaVersion)
+	backingStore := store.NewStdStore()
+	// records of schema version 0
+	legacy := map[string]string{
+		"uuid-alice":         `{"UUID":"alice","Username":"alice","PubKey":"a2V5LWE=","Points":{"1":5}}`,
+		"publickey-key-a":    `{"UUID":"alice","Username":"stale","PubKey":"a2V5LWE=","Points":{"1":2}}`,
+		"publickey-key-b":    `{"UUID":"bob","Username":"bob","Points":{"2":7}}`,
+		"publickey-key-c":    `{"Username":"nobody"}`,
+		"challenge-project":  `{"ContainerName":"project","Teams":true}`,
+		"challenge-exam":     `null`,
+		"team-red":           `{"Name":"red","Members":["alice","bob"],"Points":{"1":9}}`,
+		"hostkey-ssh-rsa":    `{}`,
+		"grade-alice/1":      `{"version":1,"Workspace":"alice","Exercise":"1","Points":6}`,
+		"sessionlease-alice": `{}`,
+	}
+	for key, value := range legacy {
+		require.NoError(backingStore.Put(key, []byte(value)))
+	}
+	data := StoreWrapper{Store: backingStore}
+
+	previous, err := data.MigrateSchema()
+	require.NoError(err)
+	assert.Equal(0, previous)
+	version, err := data.SchemaVersion()
+	require.NoError(err)
+	assert.Equal(schemaVersion, version)
+
+	users, err := data.GetAllUsers()
+	require.NoError(err)
+	assert.Len(users, 2)
+	assert.Equal("alice", users["alice"].Username)
+	assert.Nil(users["alice"].Points)
+	// users which only existed under their public key get the key
+	assert.Equal([]byte("key-b"), users["bob"].PubKey)
+
+	user, err := data.GetUserByPublicKey("key-a")
+	require.NoError(err)
+	assert.Equal("alice", user.Username)
+	user, err = data.GetUserByPublicKey("key-b")
+	require.NoError(err)
+	assert.Equal("bob", user.UUID)
+	_, err = data.GetUserByPublicKey("key-c")
+	assert.ErrorIs(err, store.ErrNotFound)
+	// the keys are indexed by their users
+	keys, err := data.GetPublicKeys("bob")
+	require.NoError(err)
+	require.Len(keys, 1)
+	assert.Equal([]byte("key-b"), keys[0].Key)
+	assert.True(keys[0].Primary)
+
+	// grades which already exist are newer than the points of the records
+	grades, err := data.GetGrades("alice")
+	require.NoError(err)
+	assert.Equal(map[string]int{"1": 6}, grades)
+	grades, err = data.GetGrades("bob")
+	require.NoError(err)
+	assert.Equal(map[string]int{"2": 7}, grades)
+	grades, err = data.GetGrades("team--red")
+	require.NoError(err)
+	assert.Equal(map[string]int{"1": 9}, grades)
+
+	challenges, err := data.GetAllChallenges()
+	require.NoError(err)
+	assert.Equal(map[string]config.ContainerInformation{
+		"project": {ContainerName: "project", Teams: true},
+		"exam":    {},
+	}, challenges)
+	team, err := data.GetTeamData("red")
+	require.NoError(err)
+	assert.Equal([]string{"alice", "bob"}, team.Members)
+	assert.Nil(team.Points)
+
+	for _, key := range []string{"uuid-alice", "publickey-key-a", "challenge-exam", "team-red"} {
+		value, err := backingStore.Get(key)
+		require.NoError(err)
+		var header recordHeader
+		require.NoError(decodeRecord(key, value, &header))
+		assert.Equal(schemaVersion, header.Version, key)
+	}
+
+	// the store is up to date
+	previous, err = data.MigrateSchema()
+	require.NoError(err)
+	assert.Equal(schemaVersion, previous)
+}
+
+func TestSchemaVersionTooNew(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	backingStore := store.NewStdStore()
+	data := StoreWrapper{Store: backingStore}
+	require.NoError(backingStore.Put("uuid-alice", []byte(fmt.Sprintf(`{"version":%d,"UUID":"alice"}`, schemaVersion+1))))
+	_, err := data.GetUser("alice")
+	assert.ErrorIs(err, ErrSchemaVersion)
+
+	require.NoError(backingStore.Put(schemaVersionKey, []byte(strconv.Itoa(schemaVersion+1))))
+	_, err = data.MigrateSchema()
+	assert.ErrorIs(err, ErrSchemaVersion)
+}
@@ -0,0 +1,252 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package team manages the teams in the store. The members of a team share one workspace, i.e. the container and
+// the persistent volume of the challenges with teams enabled, and one grade.
+// Every change of the teams is one transaction, so concurrent changes never make a user member of two teams.
+package team
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"golang.org/x/crypto/ssh"
+)
+
+// workspacePrefix prefixes the identifier of the kubernetes ressources of a team, uuids never start with it.
+const workspacePrefix = config.TeamWorkspacePrefix
+
+// maxNameLength keeps the names of the kubernetes ressources of the workspace below 63 characters.
+const maxNameLength = 40
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Workspace returns the identifier of the kubernetes ressources of the team.
+func Workspace(name string) string {
+	return workspacePrefix + name
+}
+
+// FromWorkspace returns the name of the team of the workspace identifier, it returns false for users.
+func FromWorkspace(identifier string) (string, bool) {
+	return strings.CutPrefix(identifier, workspacePrefix)
+}
+
+// ValidateName checks that the name can be used in the names of kubernetes ressources.
+func ValidateName(name string) error {
+	if len(name) > maxNameLength || !nameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid team name %q, use at most %d lower case letters, digits and dashes", name, maxNameLength)
+	}
+	return nil
+}
+
+// Create creates a team with the members. The members must not be member of another team.
+func Create(data storewrapper.StoreWrapper, name string, members []string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	for _, uuid := range members {
+		if err := checkUser(data, uuid); err != nil {
+			return err
+		}
+	}
+	return data.UpdateTeams(func(teams map[string]config.TeamInformation) error {
+		if _, ok := teams[name]; ok {
+			return fmt.Errorf("team %s already exists", name)
+		}
+		for _, uuid := range members {
+			if other, ok := findMember(teams, uuid); ok {
+				return fmt.Errorf("user %s is already member of team %s", uuid, other.Name)
+			}
+		}
+		teams[name] = config.TeamInformation{Name: name, Members: slices.Compact(slices.Sorted(slices.Values(members)))}
+		return nil
+	})
+}
+
+// Delete removes the team. The workspace of the team is kept.
+func Delete(data storewrapper.StoreWrapper, name string) error {
+	return data.UpdateTeams(func(teams map[string]config.TeamInformation) error {
+		if _, ok := teams[name]; !ok {
+			return fmt.Errorf("team %s does not exist", name)
+		}
+		delete(teams, name)
+		return nil
+	})
+}
+
+// Move makes the user a member of the team and removes the user from the previous team.
+func Move(data storewrapper.StoreWrapper, uuid, name string) error {
+	if err := checkUser(data, uuid); err != nil {
+		return err
+	}
+	return data.UpdateTeams(func(teams map[string]config.TeamInformation) error {
+		target, ok := teams[name]
+		if !ok {
+			return fmt.Errorf("team %s does not exist", name)
+		}
+		if slices.Contains(target.Members, uuid) {
+			return nil
+		}
+		removeMember(teams, uuid)
+		target.Members = append(target.Members, uuid)
+		slices.Sort(target.Members)
+		teams[name] = target
+		return nil
+	})
+}
+
+// Remove removes the user from its team, nothing happens if the user is no member of a team.
+func Remove(data storewrapper.StoreWrapper, uuid string) error {
+	return data.UpdateTeams(func(teams map[string]config.TeamInformation) error {
+		removeMember(teams, uuid)
+		return nil
+	})
+}
+
+// WorkspaceKey returns the private key of the workspace of the team, it is created on the first call. The key is
+// written into the container shared by the members, the grader accepts solutions of the team signed with it.
+func WorkspaceKey(data storewrapper.StoreWrapper, name string) ([]byte, error) {
+	current, err := get(data, name)
+	if err != nil || current.PrivKey != nil {
+		return current.PrivKey, err
+	}
+	privKey, pubKey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	err = data.UpdateTeams(func(teams map[string]config.TeamInformation) error {
+		current = teams[name]
+		if current.Name == "" {
+			return fmt.Errorf("team %s does not exist", name)
+		}
+		// a concurrent connection created the key first
+		if current.PrivKey != nil {
+			return nil
+		}
+		current.PrivKey, current.PubKey = privKey, pubKey
+		teams[name] = current
+		return nil
+	})
+	return current.PrivKey, err
+}
+
+// Of returns the team of the user, it returns false if the user is no member of a team.
+func Of(data storewrapper.StoreWrapper, uuid string) (config.TeamInformation, bool, error) {
+	teams, err := data.GetAllTeams()
+	if err != nil {
+		return config.TeamInformation{}, false, err
+	}
+	team, ok := findMember(teams, uuid)
+	return team, ok, nil
+}
+
+// Teammates returns the uuids of the other members of the team of the user.
+func Teammates(data storewrapper.StoreWrapper, uuid string) ([]string, error) {
+	team, ok, err := Of(data, uuid)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return slices.DeleteFunc(team.Members, func(member string) bool { return member == uuid }), nil
+}
+
+// ResolveWorkspace returns the identifier of the kubernetes ressources the user works on in the challenge.
+// Members of a team share the workspace of the team if the challenge has teams enabled, otherwise it is the uuid.
+func ResolveWorkspace(data storewrapper.StoreWrapper, challenge, uuid string) (string, error) {
+	challengeData, err := data.GetChallenge(challenge)
+	if errors.Is(err, store.ErrNotFound) {
+		return uuid, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !challengeData.Teams {
+		return uuid, nil
+	}
+	team, ok, err := Of(data, uuid)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return uuid, nil
+	}
+	return Workspace(team.Name), nil
+}
+
+// RecordPoints records the points of the team for the exercise as grade of the team workspace.
+func RecordPoints(data storewrapper.StoreWrapper, name, exercise string, points int) error {
+	if _, err := get(data, name); err != nil {
+		return err
+	}
+	return data.PutGrade(config.Grade{Workspace: Workspace(name), Exercise: exercise, Points: points})
+}
+
+// Points returns the points of the team indexed by the exercise.
+func Points(data storewrapper.StoreWrapper, name string) (map[string]int, error) {
+	return data.GetGrades(Workspace(name))
+}
+
+// get returns the team, an error is returned if it does not exist.
+func get(data storewrapper.StoreWrapper, name string) (config.TeamInformation, error) {
+	team, err := data.GetTeamData(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return team, fmt.Errorf("team %s does not exist", name)
+	}
+	return team, err
+}
+
+// checkUser checks that the user exists.
+func checkUser(data storewrapper.StoreWrapper, uuid string) error {
+	exists, err := data.UUIDExists(uuid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s does not exist", uuid)
+	}
+	return nil
+}
+
+// removeMember removes the user from its team.
+func removeMember(teams map[string]config.TeamInformation, uuid string) {
+	current, ok := findMember(teams, uuid)
+	if !ok {
+		return
+	}
+	current.Members = slices.DeleteFunc(current.Members, func(member string) bool { return member == uuid })
+	teams[current.Name] = current
+}
+
+// generateKey creates the RSA key pair of a workspace, the grader only verifies RSA signatures.
+func generateKey() (privKey []byte, pubKey []byte, err error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	return privKey, publicKey.Marshal(), nil
+}
+
+// findMember returns the team of the user.
+func findMember(teams map[string]config.TeamInformation, uuid string) (config.TeamInformation, bool) {
+	for _, team := range teams {
+		if slices.Contains(team.Members, uuid) {
+			return team, true
+		}
+	}
+	return config.TeamInformation{}, false
+}
@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package team
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func testData(t *testing.T, users ...string) storewrapper.StoreWrapper {
+	data := storewrapper.StoreWrapper{Store: store.NewStdStore()}
+	for _, uuid := range users {
+		require.NoError(t, data.PutUser(config.UserInformation{UUID: uuid}))
+	}
+	require.NoError(t, data.PutChallenge("project", config.ContainerInformation{Teams: true}))
+	require.NoError(t, data.PutChallenge("exam", config.ContainerInformation{}))
+	return data
+}
+
+func TestCreate(t *testing.T) {
+	testCases := map[string]struct {
+		name          string
+		members       []string
+		expectMembers []string
+		expectErr     bool
+	}{
+		"team": {
+			name:          "red",
+			members:       []string{"carol", "bob", "bob"},
+			expectMembers: []string{"bob", "carol"},
+		},
+		"empty team": {
+			name: "blue",
+		},
+		"existing team": {
+			name:      "green",
+			expectErr: true,
+		},
+		"member of other team": {
+			name:      "red",
+			members:   []string{"alice"},
+			expectErr: true,
+		},
+		"unknown user": {
+			name:      "red",
+			members:   []string{"mallory"},
+			expectErr: true,
+		},
+		"invalid name": {
+			name:      "Red_Team",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := testData(t, "alice", "bob", "carol")
+			require.NoError(Create(data, "green", []string{"alice"}))
+
+			err := Create(data, tc.name, tc.members)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			team, err := data.GetTeamData(tc.name)
+			require.NoError(err)
+			assert.Equal(tc.name, team.Name)
+			assert.Equal(tc.expectMembers, team.Members)
+		})
+	}
+}
+
+func TestMembership(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := testData(t, "alice", "bob", "carol")
+	require.NoError(Create(data, "red", []string{"alice", "bob"}))
+	require.NoError(Create(data, "blue", nil))
+
+	teammates, err := Teammates(data, "alice")
+	require.NoError(err)
+	assert.Equal([]string{"bob"}, teammates)
+	teammates, err = Teammates(data, "carol")
+	require.NoError(err)
+	assert.Empty(teammates)
+
+	require.NoError(Move(data, "bob", "blue"))
+	team, ok, err := Of(data, "bob")
+	require.NoError(err)
+	require.True(ok)
+	assert.Equal("blue", team.Name)
+	red, err := data.GetTeamData("red")
+	require.NoError(err)
+	assert.Equal([]string{"alice"}, red.Members)
+	assert.Error(Move(data, "bob", "green"))
+	assert.Error(Move(data, "mallory", "blue"))
+
+	require.NoError(Remove(data, "bob"))
+	_, ok, err = Of(data, "bob")
+	require.NoError(err)
+	assert.False(ok)
+	require.NoError(Remove(data, "bob"))
+
+	require.NoError(Delete(data, "red"))
+	assert.Error(Delete(data, "red"))
+	_, ok, err = Of(data, "alice")
+	require.NoError(err)
+	assert.False(ok)
+}
+
+func TestConcurrentMoves(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := testData(t, "alice")
+	names := []string{"red", "blue", "green", "yellow"}
+	for _, name := range names {
+		require.NoError(Create(data, name, nil))
+	}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(Move(data, "alice", name))
+		}()
+	}
+	wg.Wait()
+	teams, err := data.GetAllTeams()
+	require.NoError(err)
+	memberships := 0
+	for _, team := range teams {
+		memberships += len(team.Members)
+	}
+	assert.Equal(1, memberships)
+}
+
+func TestWorkspaceKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := testData(t, "alice")
+	require.NoError(Create(data, "red", []string{"alice"}))
+	_, err := WorkspaceKey(data, "blue")
+	assert.Error(err)
+
+	key, err := WorkspaceKey(data, "red")
+	require.NoError(err)
+	assert.Contains(string(key), "RSA PRIVATE KEY")
+	again, err := WorkspaceKey(data, "red")
+	require.NoError(err)
+	assert.Equal(key, again)
+	team, err := data.GetTeamData("red")
+	require.NoError(err)
+	assert.NotEmpty(team.PubKey)
+	// changes of the membership keep the key
+	require.NoError(Remove(data, "alice"))
+	team, err = data.GetTeamData("red")
+	require.NoError(err)
+	assert.Equal(key, team.PrivKey)
+}
+
+func TestWorkspaceName(t *testing.T) {
+	// uuids start with the name of the authentication backend and a dash, the backend team is reserved
+	for _, uuid := range []string{"team-alice", "teams-alice", "ldap--alice"} {
+		_, ok := FromWorkspace(uuid)
+		assert.False(t, ok, uuid)
+	}
+	for _, name := range []string{"red", "a--b", fmt.Sprintf("%040d", 0)} {
+		require.NoError(t, ValidateName(name))
+		teamName, ok := FromWorkspace(Workspace(name))
+		assert.True(t, ok)
+		assert.Equal(t, name, teamName)
+	}
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	testCases := map[string]struct {
+		challenge       string
+		uuid            string
+		expectWorkspace string
+	}{
+		"team challenge": {
+			challenge:       "project",
+			uuid:            "alice",
+			expectWorkspace: "team--red",
+		},
+		"team challenge without team": {
+			challenge:       "project",
+			uuid:            "carol",
+			expectWorkspace: "carol",
+		},
+		"challenge without teams": {
+			challenge:       "exam",
+			uuid:            "alice",
+			expectWorkspace: "alice",
+		},
+		"unknown challenge": {
+			challenge:       "lab",
+			uuid:            "alice",
+			expectWorkspace: "alice",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := testData(t, "alice", "carol")
+			require.NoError(Create(data, "red", []string{"alice"}))
+
+			workspace, err := ResolveWorkspace(data, tc.challenge, tc.uuid)
+			require.NoError(err)
+			assert.Equal(tc.expectWorkspace, workspace)
+			teamName, ok := FromWorkspace(workspace)
+			assert.Equal(workspace != tc.uuid, ok)
+			if ok {
+				assert.Equal(Workspace(teamName), workspace)
+			}
+		})
+	}
+}
+
+func TestRecordPoints(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := testData(t, "alice")
+	require.NoError(Create(data, "red", []string{"alice"}))
+	require.NoError(RecordPoints(data, "red", "1", 5))
+	require.NoError(RecordPoints(data, "red", "1", 8))
+	points, err := Points(data, "red")
+	require.NoError(err)
+	assert.Equal(map[string]int{"1": 8}, points)
+	assert.Error(RecordPoints(data, "blue", "1", 5))
+}
@@ -0,0 +1,414 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// admin is the administration tool of the ssh server. It is shipped in the ssh image and runs next to the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/benschlueter/delegatio/internal/hostkey"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/internal/team"
+	"github.com/benschlueter/delegatio/ssh/keys"
+	"github.com/benschlueter/delegatio/ssh/kubernetes"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const usage = `usage: admin [-config file | -dir directory] recordings <command>
+       admin [-config file] hostkeys <command>
+       admin [-config file] teams <command>
+       admin [-config file] keys <command>
+       admin certificates <command>
+       admin -config file backups <command>
+       admin store <command>
+
+recordings commands:
+  list [-challenge name] [-user uuid]     list the recordings
+  replay [-speed 1] [-idle 2s] <key>      replay a recording in the terminal
+
+hostkeys commands:
+  list                                    list the host keys in the store
+  rotate <rsa|ecdsa|ed25519>              generate the next key, it is advertised after SIGHUP to the ssh servers
+  complete <rsa|ecdsa|ed25519>            replace the key with the next key, it is used after SIGHUP to the ssh servers
+
+teams commands:
+  list                                    list the teams with their members and points
+  create <name> [uuid...]                 create a team with the members
+  delete <name>                           delete the team, its workspace is kept
+  move <uuid> <name>                      move the user to the team
+  remove <uuid>                           remove the user from its team
+
+keys commands:
+  list <uuid>                             list the public keys of the user
+  revoke <fingerprint>                    revoke the public key for all users, it can not be added again
+
+certificates commands:
+  revoke <serial>                         revoke the user certificate with the serial, see ssh-keygen -L
+
+backups commands, the destination is the backup section of the configuration:
+  list                                    list the snapshots
+  create                                  take a snapshot of the store of the cluster
+  restore [-dry-run] [-force] <name>      verify the snapshot and write it to the empty store of the cluster
+
+store commands, a store is cluster, etcd://host:port[?ca=file&cert=file&key=file] or file:path:
+  migrate [-dry-run] [-force] <from> <to> copy all entries to the empty destination and verify the checksum
+  backup [-dry-run] [-force] <file>       copy the store of the cluster to the new file
+  restore [-dry-run] [-force] <file>      copy the file to the empty store of the cluster
+  checksum <store>                        print the number of entries and the checksum
+`
+
+func main() {
+	configPath := flag.String("config", "", "path to the ssh server configuration containing the recording directory and the encryption key ring")
+	directory := flag.String("dir", "", "directory of the recordings, overrides the configuration")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	fs := afero.NewOsFs()
+	if err := run(ctx, fs, connectStore, *configPath, *directory, flag.Args(), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// connectStore connects to the store of the ssh server.
+func connectStore() (store.Store, error) {
+	client, err := kubernetes.NewK8sAPIWrapper(zap.NewNop())
+	if err != nil {
+		return nil, err
+	}
+	return client.GetStore()
+}
+
+func run(ctx context.Context, fs afero.Fs, connect func() (store.Store, error), configPath, directory string, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "recordings":
+		return runRecordings(ctx, fs, configPath, directory, args, out)
+	case "hostkeys":
+		backingStore, err := connect()
+		if err != nil {
+			return fmt.Errorf("connecting to the store: %w", err)
+		}
+		keyRing, err := loadKeyRing(fs, configPath)
+		if err != nil {
+			return err
+		}
+		return runHostKeys(storewrapper.StoreWrapper{Store: backingStore, Keys: keyRing}, args[1:], out)
+	case "teams":
+		backingStore, err := connect()
+		if err != nil {
+			return fmt.Errorf("connecting to the store: %w", err)
+		}
+		keyRing, err := loadKeyRing(fs, configPath)
+		if err != nil {
+			return err
+		}
+		return runTeams(storewrapper.StoreWrapper{Store: backingStore, Keys: keyRing}, args[1:], out)
+	case "keys":
+		backingStore, err := connect()
+		if err != nil {
+			return fmt.Errorf("connecting to the store: %w", err)
+		}
+		keyRing, err := loadKeyRing(fs, configPath)
+		if err != nil {
+			return err
+		}
+		return runKeys(storewrapper.StoreWrapper{Store: backingStore, Keys: keyRing}, args[1:], out)
+	case "certificates":
+		backingStore, err := connect()
+		if err != nil {
+			return fmt.Errorf("connecting to the store: %w", err)
+		}
+		return runCertificates(storewrapper.StoreWrapper{Store: backingStore}, args[1:], out)
+	case "backups":
+		return runBackups(ctx, fs, connect, configPath, args[1:], out)
+	case "store":
+		return runStore(fs, connect, args[1:], out)
+	default:
+		return errors.New(usage)
+	}
+}
+
+// loadKeyRing reads the key ring which encrypts the secrets in the store. It is nil without configuration or if
+// encryption is not configured.
+func loadKeyRing(fs afero.Fs, configPath string) (*envelope.KeyRing, error) {
+	if configPath == "" {
+		return nil, nil
+	}
+	conf, err := serverconfig.LoadFile(file.NewHandler(fs), configPath)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Encryption == nil {
+		return nil, nil
+	}
+	return envelope.Load(*conf.Encryption, file.NewHandler(fs), func(name string) (map[string][]byte, error) {
+		client, err := kubernetes.NewK8sAPIWrapper(zap.NewNop())
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.DefaultTimeout)
+		defer cancel()
+		return client.Client.GetSecretData(ctx, config.SSHNamespaceName, name)
+	})
+}
+
+func runRecordings(ctx context.Context, fs afero.Fs, configPath, directory string, args []string, out io.Writer) error {
+	if directory == "" {
+		if configPath == "" {
+			return errors.New("either -config or -dir is required")
+		}
+		conf, err := serverconfig.LoadFile(file.NewHandler(fs), configPath)
+		if err != nil {
+			return err
+		}
+		if conf.Recording == nil {
+			return errors.New("recording is not configured")
+		}
+		directory = conf.Recording.Directory
+	}
+	storage := recording.NewDirectoryStorage(fs, directory)
+	switch args[1] {
+	case "list":
+		return listRecordings(storage, args[2:], out)
+	case "replay":
+		return replayRecording(ctx, storage, args[2:], out)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[1], usage)
+	}
+}
+
+func runHostKeys(data storewrapper.StoreWrapper, args []string, out io.Writer) error {
+	switch args[0] {
+	case "list":
+		return listHostKeys(data, out)
+	case "rotate", "complete":
+		if len(args) != 2 || !slices.Contains(hostkey.Types, args[1]) {
+			return fmt.Errorf("%s requires the key type, one of %s", args[0], strings.Join(hostkey.Types, ", "))
+		}
+		if args[0] == "rotate" {
+			next, err := hostkey.Rotate(data, args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "generated next %s host key %s, send SIGHUP to every ssh server to advertise it\n", args[1], ssh.FingerprintSHA256(next))
+			return nil
+		}
+		retired, err := hostkey.Complete(data, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "retired %s host key %s, send SIGHUP to every ssh server to use the next key\n", args[1], ssh.FingerprintSHA256(retired))
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func listHostKeys(data storewrapper.StoreWrapper, out io.Writer) error {
+	hostKeys, err := hostkey.Load(data)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TYPE\tFINGERPRINT\tSTATE")
+	for _, signer := range hostKeys.Current {
+		fmt.Fprintf(writer, "%s\t%s\tcurrent\n", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	for _, signer := range hostKeys.Next {
+		fmt.Fprintf(writer, "%s\t%s\tnext\n", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return writer.Flush()
+}
+
+func runTeams(data storewrapper.StoreWrapper, args []string, out io.Writer) error {
+	switch args[0] {
+	case "list":
+		return listTeams(data, out)
+	case "create":
+		if len(args) < 2 {
+			return errors.New("create requires the name of the team")
+		}
+		if err := team.Create(data, args[1], args[2:]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created team %s\n", args[1])
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("delete requires the name of the team")
+		}
+		if err := team.Delete(data, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "deleted team %s\n", args[1])
+		return nil
+	case "move":
+		if len(args) != 3 {
+			return errors.New("move requires the uuid of the user and the name of the team")
+		}
+		if err := team.Move(data, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "moved %s to team %s, it works on the workspace of the team after reconnecting\n", args[1], args[2])
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("remove requires the uuid of the user")
+		}
+		if err := team.Remove(data, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "removed %s from its team\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func listTeams(data storewrapper.StoreWrapper, out io.Writer) error {
+	teams, err := data.GetAllTeams()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tMEMBERS\tPOINTS")
+	for _, name := range slices.Sorted(maps.Keys(teams)) {
+		grades, err := team.Points(data, name)
+		if err != nil {
+			return err
+		}
+		points := make([]string, 0, len(grades))
+		for _, exercise := range slices.Sorted(maps.Keys(grades)) {
+			points = append(points, fmt.Sprintf("%s=%d", exercise, grades[exercise]))
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", name, strings.Join(teams[name].Members, ","), strings.Join(points, ","))
+	}
+	return writer.Flush()
+}
+
+func runKeys(data storewrapper.StoreWrapper, args []string, out io.Writer) error {
+	switch args[0] {
+	case "list":
+		if len(args) != 2 {
+			return errors.New("list requires the uuid of the user")
+		}
+		publicKeys, err := data.GetPublicKeys(args[1])
+		if err != nil {
+			return err
+		}
+		return keys.Write(out, publicKeys)
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("revoke requires the SHA256 fingerprint of the key")
+		}
+		uuid, err := data.RevokePublicKey(args[1])
+		if err != nil {
+			return err
+		}
+		if uuid == "" {
+			fmt.Fprintf(out, "revoked %s, it belonged to no user\n", args[1])
+			return nil
+		}
+		fmt.Fprintf(out, "revoked %s of user %s\n", args[1], uuid)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runCertificates(data storewrapper.StoreWrapper, args []string, out io.Writer) error {
+	switch args[0] {
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("revoke requires the serial of the certificate")
+		}
+		serial, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing serial: %w", err)
+		}
+		if err := data.RevokeCertificate(serial); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "revoked certificate %d\n", serial)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func listRecordings(storage recording.Storage, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	challenge := flags.String("challenge", "", "only list recordings of the challenge")
+	user := flags.String("user", "", "only list recordings of the user, requires -challenge")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	prefix := ""
+	if *challenge != "" {
+		prefix = *challenge + "/"
+		if *user != "" {
+			prefix += *user + "/"
+		}
+	} else if *user != "" {
+		return errors.New("-user requires -challenge")
+	}
+	objects, err := storage.List(prefix)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tSIZE\tMODIFIED")
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, recording.Suffix) {
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\n", object.Key, object.Size, object.ModTime.Format(time.RFC3339))
+	}
+	return writer.Flush()
+}
+
+func replayRecording(ctx context.Context, storage recording.Storage, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 1, "playback speed")
+	idle := flags.Duration("idle", 2*time.Second, "maximum pause between two outputs, 0 keeps the recorded pauses")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("replay requires the key of the recording")
+	}
+	reader, err := storage.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return recording.Replay(ctx, reader, out, *speed, *idle)
+}
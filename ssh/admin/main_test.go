@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestCertificates(t *testing.T) {
+	testCases := map[string]struct {
+		args          []string
+		expectErr     bool
+		expectRevoked uint64
+	}{
+		"revoke": {
+			args:          []string{"certificates", "revoke", "4242"},
+			expectRevoked: 4242,
+		},
+		"revoke without serial": {
+			args:      []string{"certificates", "revoke"},
+			expectErr: true,
+		},
+		"invalid serial": {
+			args:      []string{"certificates", "revoke", "-1"},
+			expectErr: true,
+		},
+		"unknown command": {
+			args:      []string{"certificates", "list"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backingStore := store.NewStdStore()
+			connect := func() (store.Store, error) { return backingStore, nil }
+			var out bytes.Buffer
+			err := run(context.Background(), afero.NewMemMapFs(), connect, "", "", tc.args, &out)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Contains(out.String(), "revoked certificate")
+			data := storewrapper.StoreWrapper{Store: backingStore}
+			revoked, err := data.CertificateRevoked(tc.expectRevoked)
+			require.NoError(err)
+			assert.True(revoked)
+			revoked, err = data.CertificateRevoked(tc.expectRevoked + 1)
+			require.NoError(err)
+			assert.False(revoked)
+		})
+	}
+}
+
+func TestStoreRestore(t *testing.T) {
+	testCases := map[string]struct {
+		existing    bool
+		args        []string
+		expectErr   bool
+		expectValue []byte
+		expectOther bool
+	}{
+		"restore": {
+			args:        []string{"store", "restore", "/backup/store.json"},
+			expectValue: []byte("restored"),
+		},
+		"store not empty": {
+			existing:    true,
+			args:        []string{"store", "restore", "/backup/store.json"},
+			expectErr:   true,
+			expectValue: []byte("existing"),
+			expectOther: true,
+		},
+		"forced": {
+			existing:    true,
+			args:        []string{"store", "restore", "-force", "/backup/store.json"},
+			expectValue: []byte("restored"),
+			expectOther: true,
+		},
+		"dry run": {
+			args: []string{"store", "restore", "-dry-run", "/backup/store.json"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fs := afero.NewMemMapFs()
+			require.NoError(afero.WriteFile(fs, "/backup/store.json", []byte(`{"entries":{"key":"cmVzdG9yZWQ="}}`), 0o600))
+			backingStore := store.NewStdStore()
+			if tc.existing {
+				require.NoError(backingStore.Put("key", []byte("existing")))
+				require.NoError(backingStore.Put("other", []byte("existing")))
+			}
+			connect := func() (store.Store, error) { return backingStore, nil }
+			var out bytes.Buffer
+			err := run(context.Background(), fs, connect, "", "", tc.args, &out)
+			if tc.expectErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+			value, err := backingStore.Get("key")
+			if tc.expectValue == nil {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.expectValue, value)
+			_, err = backingStore.Get("other")
+			assert.Equal(tc.expectOther, err == nil)
+		})
+	}
+}
@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/backup"
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// clusterBackend is the store of the ssh server.
+const clusterBackend = "cluster"
+
+// snapshot is the file format of store backups.
+type snapshot struct {
+	Entries map[string][]byte `json:"entries"`
+}
+
+// backend is an opened store backend, save persists the content of file backends.
+type backend struct {
+	store store.Store
+	save  func() error
+	close func() error
+}
+
+func runStore(fs afero.Fs, connect func() (store.Store, error), args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only compute the number of entries and the checksum of the source")
+	force := flags.Bool("force", false, "write to a destination which is not empty")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	var from, to string
+	switch args[0] {
+	case "migrate":
+		if flags.NArg() != 2 {
+			return errors.New("migrate requires the source and the destination")
+		}
+		from, to = flags.Arg(0), flags.Arg(1)
+	case "backup":
+		if flags.NArg() != 1 {
+			return errors.New("backup requires the path of the backup")
+		}
+		from, to = clusterBackend, "file:"+flags.Arg(0)
+	case "restore":
+		if flags.NArg() != 1 {
+			return errors.New("restore requires the path of the backup")
+		}
+		from, to = "file:"+flags.Arg(0), clusterBackend
+	case "checksum":
+		if flags.NArg() != 1 {
+			return errors.New("checksum requires the store")
+		}
+		src, err := openBackend(fs, connect, flags.Arg(0), false)
+		if err != nil {
+			return err
+		}
+		defer src.close()
+		entries, checksum, err := store.Checksum(src.store)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d entries, checksum sha256:%s\n", entries, checksum)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+	return migrateStore(fs, connect, from, to, store.MigrateOptions{DryRun: *dryRun, Force: *force}, out)
+}
+
+// migrateStore copies all entries from the source to the destination backend, which must be empty unless forced.
+func migrateStore(fs afero.Fs, connect func() (store.Store, error), from, to string, opts store.MigrateOptions, out io.Writer) error {
+	src, err := openBackend(fs, connect, from, false)
+	if err != nil {
+		return fmt.Errorf("opening the source: %w", err)
+	}
+	defer src.close()
+	dst, err := openBackend(fs, connect, to, true)
+	if err != nil {
+		return fmt.Errorf("opening the destination: %w", err)
+	}
+	defer dst.close()
+
+	opts.Progress = func(written int) {
+		fmt.Fprintf(out, "transferred %d entries\n", written)
+	}
+	result, err := store.Migrate(src.store, dst.store, opts)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		fmt.Fprintf(out, "dry run: would transfer %d entries from %s to %s, checksum sha256:%s\n", result.Entries, from, to, result.Checksum)
+		return nil
+	}
+	if err := dst.save(); err != nil {
+		return fmt.Errorf("saving the destination: %w", err)
+	}
+	fmt.Fprintf(out, "transferred %d entries from %s to %s, checksum sha256:%s verified\n", result.Entries, from, to, result.Checksum)
+	return nil
+}
+
+// openBackend opens the store of the spec, which is "cluster", "etcd://host:port[,host:port][?ca=file&cert=file&key=file]"
+// or "file:path". A missing file is an empty store if it is the destination.
+func openBackend(fs afero.Fs, connect func() (store.Store, error), spec string, destination bool) (backend, error) {
+	noop := func() error { return nil }
+	if spec == clusterBackend {
+		backingStore, err := connect()
+		if err != nil {
+			return backend{}, fmt.Errorf("connecting to the store: %w", err)
+		}
+		return backend{store: backingStore, save: noop, close: noop}, nil
+	}
+	if path, ok := strings.CutPrefix(spec, "file:"); ok {
+		return openFileBackend(fs, path, destination)
+	}
+	if strings.HasPrefix(spec, "etcd://") {
+		return openEtcdBackend(fs, spec)
+	}
+	return backend{}, fmt.Errorf("unknown store %q, use %s, etcd://host:port or file:path", spec, clusterBackend)
+}
+
+func openEtcdBackend(fs afero.Fs, spec string) (backend, error) {
+	etcdURL, err := url.Parse(spec)
+	if err != nil {
+		return backend{}, err
+	}
+	var credentials [3][]byte
+	for i, name := range []string{"ca", "cert", "key"} {
+		path := etcdURL.Query().Get(name)
+		if path == "" {
+			continue
+		}
+		if credentials[i], err = afero.ReadFile(fs, path); err != nil {
+			return backend{}, err
+		}
+	}
+	etcdStore, err := store.NewEtcdStore(strings.Split(etcdURL.Host, ","), zap.NewNop(), credentials[0], credentials[1], credentials[2])
+	if err != nil {
+		return backend{}, err
+	}
+	return backend{store: etcdStore, save: func() error { return nil }, close: etcdStore.Close}, nil
+}
+
+// openFileBackend loads the backup into memory, save writes the memory back to the file.
+func openFileBackend(fs afero.Fs, path string, destination bool) (backend, error) {
+	memory := store.NewStdStore()
+	content, err := afero.ReadFile(fs, path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && destination:
+	case err != nil:
+		return backend{}, err
+	default:
+		var backup snapshot
+		if err := json.Unmarshal(content, &backup); err != nil {
+			return backend{}, fmt.Errorf("parsing the backup %s: %w", path, err)
+		}
+		for key, value := range backup.Entries {
+			if err := memory.Put(key, value); err != nil {
+				return backend{}, err
+			}
+		}
+	}
+	save := func() error {
+		backup := snapshot{Entries: make(map[string][]byte)}
+		iter, err := memory.Iterator("")
+		if err != nil {
+			return err
+		}
+		for iter.HasNext() {
+			key, err := iter.GetNext()
+			if err != nil {
+				return err
+			}
+			if backup.Entries[key], err = memory.Get(key); err != nil {
+				return err
+			}
+		}
+		content, err := json.MarshalIndent(backup, "", "  ")
+		if err != nil {
+			return err
+		}
+		// the backup contains private keys
+		tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		if err := afero.WriteFile(fs, tmp, content, 0o600); err != nil {
+			return err
+		}
+		return fs.Rename(tmp, path)
+	}
+	return backend{store: memory, save: save, close: func() error { return nil }}, nil
+}
+
+func runBackups(ctx context.Context, fs afero.Fs, connect func() (store.Store, error), configPath string, args []string, out io.Writer) error {
+	if configPath == "" {
+		return errors.New("backups require -config")
+	}
+	conf, err := serverconfig.LoadFile(file.NewHandler(fs), configPath)
+	if err != nil {
+		return err
+	}
+	if conf.Backup == nil {
+		return errors.New("backup is not configured")
+	}
+	destination, err := backup.Open(*conf.Backup, fs)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		objects, err := destination.List(ctx)
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tSIZE\tMODIFIED")
+		for _, object := range objects {
+			fmt.Fprintf(writer, "%s\t%d\t%s\n", object.Name, object.Size, object.ModTime.Format(time.RFC3339))
+		}
+		return writer.Flush()
+	case "create":
+		backingStore, err := connect()
+		if err != nil {
+			return fmt.Errorf("connecting to the store: %w", err)
+		}
+		info, err := backup.Create(ctx, backingStore, destination, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "saved snapshot %s with %d entries, checksum sha256:%s\n", info.Name, info.Entries, info.Checksum)
+		return nil
+	case "restore":
+		return restoreBackup(ctx, destination, connect, args, out)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// restoreBackup writes the snapshot to the store of a fresh cluster.
+func restoreBackup(ctx context.Context, destination backup.Destination, connect func() (store.Store, error), args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only read and verify the snapshot")
+	force := flags.Bool("force", false, "write the snapshot to a store which is not empty")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("restore requires the name of the snapshot")
+	}
+	backingStore, err := connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the store: %w", err)
+	}
+	info, err := backup.Restore(ctx, destination, flags.Arg(0), backingStore, backup.RestoreOptions{
+		DryRun: *dryRun,
+		Force:  *force,
+		Progress: func(written int) {
+			fmt.Fprintf(out, "restored %d entries\n", written)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintf(out, "dry run: snapshot %s taken at %s has %d entries, checksum sha256:%s verified\n", info.Name, info.Created.Format(time.RFC3339), info.Entries, info.Checksum)
+		return nil
+	}
+	fmt.Fprintf(out, "restored snapshot %s with %d entries, checksum sha256:%s verified\n", info.Name, info.Entries, info.Checksum)
+	return nil
+}
@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package audit writes a structured log of the activity on the ssh server as JSON lines.
+// Events never contain secrets, i.e. passwords, keys, verification codes or the transferred data.
+package audit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Event types.
+const (
+	// EventAuthSuccess is emitted when a user is authenticated.
+	EventAuthSuccess = "auth.success"
+	// EventAuthPartial is emitted when the first factor is accepted and a second factor is required.
+	EventAuthPartial = "auth.partial"
+	// EventAuthFailure is emitted when an authentication attempt fails.
+	EventAuthFailure = "auth.failure"
+	// EventSessionStart is emitted when an authenticated connection is served.
+	EventSessionStart = "session.start"
+	// EventSessionEnd is emitted when an authenticated connection is closed.
+	EventSessionEnd = "session.end"
+	// EventSessionTimeout is emitted when a connection is closed because of the idle timeout or the maximum duration.
+	EventSessionTimeout = "session.timeout"
+	// EventShell is emitted for shell requests.
+	EventShell = "channel.shell"
+	// EventExec is emitted for exec requests.
+	EventExec = "channel.exec"
+	// EventSubsystem is emitted for subsystem requests.
+	EventSubsystem = "channel.subsystem"
+	// EventPortForward is emitted when a direct-tcpip channel is opened.
+	EventPortForward = "channel.port-forward"
+	// EventAgentForward is emitted for agent forwarding requests.
+	EventAgentForward = "channel.agent-forward"
+	// EventX11Forward is emitted for X11 forwarding requests.
+	EventX11Forward = "channel.x11-forward"
+	// EventChannelEnd is emitted when a channel is closed, it contains the transferred bytes.
+	EventChannelEnd = "channel.end"
+)
+
+// Event is a single audit event.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// UUID is the authenticated user, it is empty for failed authentications.
+	UUID string `json:"uuid,omitempty"`
+	// Challenge is the challenge the user connects to, i.e. the ssh user name.
+	Challenge string `json:"challenge,omitempty"`
+	SourceIP  string `json:"sourceIP,omitempty"`
+	// SessionID is the hex encoded ssh session ID, it is shared by all events of a connection.
+	SessionID string `json:"sessionID,omitempty"`
+	// AuthMethod is the ssh authentication method of failed attempts, i.e. "password" or "publickey".
+	// Events of authenticated connections contain the authentication type "pk", "pw" or "cert".
+	AuthMethod string `json:"authMethod,omitempty"`
+	// Channel is the type of the channel of channel events.
+	Channel string `json:"channel,omitempty"`
+	// Command is the command of exec events.
+	Command string `json:"command,omitempty"`
+	// Subsystem is the requested subsystem of subsystem events.
+	Subsystem string `json:"subsystem,omitempty"`
+	// Destination is the host and port of port forwarding events.
+	Destination string `json:"destination,omitempty"`
+	// BytesFromClient and BytesToClient are the bytes transferred over the channel or connection.
+	BytesFromClient int64 `json:"bytesFromClient,omitempty"`
+	BytesToClient   int64 `json:"bytesToClient,omitempty"`
+	// Duration is the duration of sessions and channels in seconds.
+	Duration float64 `json:"duration,omitempty"`
+	// Accepted reports whether a request was accepted.
+	Accepted *bool `json:"accepted,omitempty"`
+	// Reason describes why the server closed a connection.
+	Reason string `json:"reason,omitempty"`
+	// Error describes why an authentication or request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// ConnectionEvent returns an event identifying the connection.
+func ConnectionEvent(eventType string, conn ssh.ConnMetadata) Event {
+	event := Event{Type: eventType}
+	if conn == nil {
+		return event
+	}
+	event.Challenge = conn.User()
+	event.SessionID = hex.EncodeToString(conn.SessionID())
+	if addr := conn.RemoteAddr(); addr != nil {
+		event.SourceIP = addr.String()
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			event.SourceIP = host
+		}
+	}
+	return event
+}
+
+// Bool returns a pointer to b, it is used to set Accepted.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Logger writes audit events as JSON lines. It is safe for concurrent use, a nil Logger discards all events.
+type Logger struct {
+	mux     sync.Mutex
+	writer  io.Writer
+	closer  io.Closer
+	encoder *json.Encoder
+	now     func() time.Time
+}
+
+// NewLogger creates a Logger writing to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		writer:  w,
+		encoder: json.NewEncoder(w),
+		now:     time.Now,
+	}
+}
+
+// Open creates a Logger writing to the sink. The sink is "stdout", "stderr" or the path of a file, events are
+// appended to the file.
+func Open(sink string) (*Logger, error) {
+	switch sink {
+	case "stdout":
+		return NewLogger(os.Stdout), nil
+	case "stderr":
+		return NewLogger(os.Stderr), nil
+	}
+	file, err := os.OpenFile(sink, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	logger := NewLogger(file)
+	logger.closer = file
+	return logger, nil
+}
+
+// Log writes the event, the time is set if it is empty. Write errors are ignored, the audit log must not break sessions.
+func (l *Logger) Log(event Event) {
+	if l == nil {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if event.Time.IsZero() {
+		event.Time = l.now().UTC()
+	}
+	_ = l.encoder.Encode(&event)
+}
+
+// Close closes the sink if it is a file.
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.closer.Close()
+}
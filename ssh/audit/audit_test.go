@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	logger.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	logger.Log(Event{Type: EventAuthFailure, Challenge: "testchallenge", AuthMethod: "password", Error: "invalid password"})
+	logger.Log(Event{Type: EventChannelEnd, UUID: "uuid", BytesFromClient: 10, BytesToClient: 20, Accepted: Bool(true)})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(lines, 2)
+	assert.JSONEq(`{"time":"2024-01-02T03:04:05Z","type":"auth.failure","challenge":"testchallenge","authMethod":"password","error":"invalid password"}`, lines[0])
+	var event Event
+	require.NoError(json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(EventChannelEnd, event.Type)
+	assert.Equal(int64(10), event.BytesFromClient)
+	assert.Equal(int64(20), event.BytesToClient)
+	assert.True(*event.Accepted)
+
+	var nilLogger *Logger
+	assert.NotPanics(func() { nilLogger.Log(Event{Type: EventShell}) })
+	assert.NoError(nilLogger.Close())
+}
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		logger, err := Open(path)
+		require.NoError(err)
+		logger.Log(Event{Type: EventSessionStart})
+		require.NoError(logger.Close())
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.Equal(2, strings.Count(string(data), "\n"))
+
+	stat, err := os.Stat(path)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0o600), stat.Mode().Perm())
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	assert.Error(err)
+}
+
+func TestConnectionEvent(t *testing.T) {
+	testCases := map[string]struct {
+		conn     ssh.ConnMetadata
+		expected Event
+	}{
+		"tcp address": {
+			conn: &stubConnMetadata{user: "testchallenge", sessionID: []byte{0xab, 0xcd}, addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4242}},
+			expected: Event{
+				Type:      EventSessionStart,
+				Challenge: "testchallenge",
+				SessionID: "abcd",
+				SourceIP:  "10.0.0.1",
+			},
+		},
+		"address without port": {
+			conn: &stubConnMetadata{user: "testchallenge", addr: &net.UnixAddr{Name: "/run/ssh.sock", Net: "unix"}},
+			expected: Event{
+				Type:      EventSessionStart,
+				Challenge: "testchallenge",
+				SourceIP:  "/run/ssh.sock",
+			},
+		},
+		"no connection": {
+			expected: Event{Type: EventSessionStart},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ConnectionEvent(EventSessionStart, tc.conn))
+		})
+	}
+}
+
+func TestCountingChannel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	stub := &stubChannel{in: bytes.NewBufferString("input")}
+	channel := NewCountingChannel(stub)
+	data, err := io.ReadAll(channel)
+	require.NoError(err)
+	assert.Equal("input", string(data))
+	_, err = channel.Write([]byte("output"))
+	require.NoError(err)
+	_, err = channel.Stderr().Write([]byte("error"))
+	require.NoError(err)
+
+	fromClient, toClient := channel.Transferred()
+	assert.Equal(int64(5), fromClient)
+	assert.Equal(int64(11), toClient)
+	assert.Equal("outputerror", stub.out.String())
+}
+
+type stubConnMetadata struct {
+	ssh.ConnMetadata
+	user      string
+	sessionID []byte
+	addr      net.Addr
+}
+
+func (c *stubConnMetadata) User() string {
+	return c.user
+}
+
+func (c *stubConnMetadata) SessionID() []byte {
+	return c.sessionID
+}
+
+func (c *stubConnMetadata) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type stubChannel struct {
+	ssh.Channel
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (c *stubChannel) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *stubChannel) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *stubChannel) Stderr() io.ReadWriter {
+	return &c.out
+}
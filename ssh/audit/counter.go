@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package audit
+
+import (
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CountingChannel counts the bytes read from and written to a channel.
+type CountingChannel struct {
+	ssh.Channel
+	fromClient atomic.Int64
+	toClient   atomic.Int64
+}
+
+// NewCountingChannel wraps the channel.
+func NewCountingChannel(channel ssh.Channel) *CountingChannel {
+	return &CountingChannel{Channel: channel}
+}
+
+// Read reads from the channel and counts the bytes received from the client.
+func (c *CountingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.fromClient.Add(int64(n))
+	return n, err
+}
+
+// Write writes to the channel and counts the bytes sent to the client.
+func (c *CountingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.toClient.Add(int64(n))
+	return n, err
+}
+
+// Stderr returns the stderr stream of the channel, writes are counted as bytes sent to the client.
+func (c *CountingChannel) Stderr() io.ReadWriter {
+	return &countingStderr{ReadWriter: c.Channel.Stderr(), toClient: &c.toClient}
+}
+
+// Transferred returns the bytes received from and sent to the client.
+func (c *CountingChannel) Transferred() (fromClient, toClient int64) {
+	return c.fromClient.Load(), c.toClient.Load()
+}
+
+type countingStderr struct {
+	io.ReadWriter
+	toClient *atomic.Int64
+}
+
+func (s *countingStderr) Write(p []byte) (int, error) {
+	n, err := s.ReadWriter.Write(p)
+	s.toClient.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package auth contains the backends used to authenticate users with a password or keyboard-interactive logins.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Method is a ssh authentication method supported by an Authenticator.
+type Method int
+
+const (
+	// MethodPassword authenticates users with the "password" method.
+	MethodPassword Method = iota
+	// MethodKeyboardInteractive authenticates users with the "keyboard-interactive" method.
+	MethodKeyboardInteractive
+)
+
+// Credentials are the credentials presented by a user.
+type Credentials struct {
+	Username string
+	// Password is set for MethodPassword.
+	Password string
+	// Challenge is set for MethodKeyboardInteractive.
+	Challenge ssh.KeyboardInteractiveChallenge
+}
+
+// Authenticator is an authentication backend.
+type Authenticator interface {
+	// Name returns the name of the backend.
+	Name() string
+	// Method returns the authentication method handled by the backend.
+	Method() Method
+	// Authenticate verifies the credentials and returns the information about the user.
+	Authenticate(ctx context.Context, creds Credentials) (*config.UserInformation, error)
+}
+
+// ErrNoAuthenticator is returned if no backend handles the authentication method.
+var ErrNoAuthenticator = errors.New("no authentication backend for method")
+
+// Chain tries multiple backends in order.
+type Chain []Authenticator
+
+// NewChain creates the backends configured in conf.
+func NewChain(logger *zap.Logger, conf []serverconfig.AuthenticationBackend) (Chain, error) {
+	var chain Chain
+	for i, backend := range conf {
+		var authenticator Authenticator
+		var err error
+		switch backend.Type {
+		case serverconfig.BackendLDAP:
+			authenticator = NewLdap(logger.Named("ldap"), backend.LDAP)
+		case serverconfig.BackendOIDC:
+			authenticator = NewOIDC(logger.Named("oidc"), backend.OIDC)
+		case serverconfig.BackendHtpasswd:
+			authenticator, err = NewHtpasswd(logger.Named("htpasswd"), backend.Htpasswd)
+		default:
+			err = fmt.Errorf("unknown backend type %q", backend.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating authentication backend %d: %w", i, err)
+		}
+		name := backend.Name
+		if name == "" {
+			name = backend.Type
+		}
+		chain = append(chain, &namespaced{Authenticator: authenticator, name: name})
+	}
+	return chain, nil
+}
+
+// namespaced prefixes the uuids of the users of a backend with the name of the backend. Backends derive the uuids
+// from their own user names, which would otherwise let a user of one backend take over the account of another.
+type namespaced struct {
+	Authenticator
+	name string
+}
+
+// Name returns the name of the backend.
+func (n *namespaced) Name() string {
+	return n.name + " (" + n.Authenticator.Name() + ")"
+}
+
+// Authenticate authenticates the user with the backend and prefixes the uuid.
+func (n *namespaced) Authenticate(ctx context.Context, creds Credentials) (*config.UserInformation, error) {
+	userData, err := n.Authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+	userData.UUID = n.name + "-" + userData.UUID
+	return userData, nil
+}
+
+// Supports checks whether a backend handles the method.
+func (c Chain) Supports(method Method) bool {
+	for _, authenticator := range c {
+		if authenticator.Method() == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate tries all backends handling the method and returns the user of the first successful backend.
+func (c Chain) Authenticate(ctx context.Context, method Method, creds Credentials) (*config.UserInformation, error) {
+	var errs []error
+	for _, authenticator := range c {
+		if authenticator.Method() != method {
+			continue
+		}
+		userData, err := authenticator.Authenticate(ctx, creds)
+		if err == nil {
+			return userData, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", authenticator.Name(), err))
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoAuthenticator
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	testCases := map[string]struct {
+		chain      Chain
+		method     Method
+		expectErr  error
+		expectUUID string
+	}{
+		"first backend succeeds": {
+			chain:      Chain{&stubAuthenticator{uuid: "first"}, &stubAuthenticator{uuid: "second"}},
+			expectUUID: "first",
+		},
+		"fallback to second backend": {
+			chain:      Chain{&stubAuthenticator{err: errors.New("failed")}, &stubAuthenticator{uuid: "second"}},
+			expectUUID: "second",
+		},
+		"all backends fail": {
+			chain: Chain{&stubAuthenticator{err: errors.New("failed")}, &stubAuthenticator{err: errors.New("failed")}},
+		},
+		"other method is skipped": {
+			chain:      Chain{&stubAuthenticator{uuid: "kbi", method: MethodKeyboardInteractive}, &stubAuthenticator{uuid: "pw"}},
+			expectUUID: "pw",
+		},
+		"no backend for method": {
+			chain:     Chain{&stubAuthenticator{uuid: "pw"}},
+			method:    MethodKeyboardInteractive,
+			expectErr: ErrNoAuthenticator,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			userData, err := tc.chain.Authenticate(context.Background(), tc.method, Credentials{Username: "user", Password: "password"})
+			if tc.expectUUID == "" {
+				assert.Error(err)
+				if tc.expectErr != nil {
+					assert.ErrorIs(err, tc.expectErr)
+				}
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expectUUID, userData.UUID)
+		})
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, nil, 0o600))
+
+	testCases := map[string]struct {
+		conf          []serverconfig.AuthenticationBackend
+		expectErr     bool
+		expectMethods []Method
+	}{
+		"all backends": {
+			conf: []serverconfig.AuthenticationBackend{
+				{Type: serverconfig.BackendLDAP, LDAP: &serverconfig.LDAPConfig{URL: "ldaps://ldap.example.com", BindDN: "cn=%s"}},
+				{Type: serverconfig.BackendOIDC, OIDC: &serverconfig.OIDCConfig{Issuer: "https://id.example.com", ClientID: "client"}},
+				{Type: serverconfig.BackendHtpasswd, Htpasswd: &serverconfig.HtpasswdConfig{Path: htpasswdPath}},
+			},
+			expectMethods: []Method{MethodPassword, MethodKeyboardInteractive, MethodPassword},
+		},
+		"missing htpasswd file": {
+			conf: []serverconfig.AuthenticationBackend{
+				{Type: serverconfig.BackendHtpasswd, Htpasswd: &serverconfig.HtpasswdConfig{Path: filepath.Join(t.TempDir(), "missing")}},
+			},
+			expectErr: true,
+		},
+		"unknown backend": {
+			conf:      []serverconfig.AuthenticationBackend{{Type: "kerberos"}},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			chain, err := NewChain(zap.NewNop(), tc.conf)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(t, err)
+			var methods []Method
+			for _, authenticator := range chain {
+				methods = append(methods, authenticator.Method())
+			}
+			assert.Equal(tc.expectMethods, methods)
+		})
+	}
+}
+
+func TestNewChainNamespace(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(err)
+	staff := filepath.Join(t.TempDir(), "staff")
+	require.NoError(os.WriteFile(staff, []byte("alice:"+string(hash)+"\n"), 0o600))
+	students := filepath.Join(t.TempDir(), "students")
+	require.NoError(os.WriteFile(students, []byte("bob:"+string(hash)+"\n"), 0o600))
+
+	chain, err := NewChain(zap.NewNop(), []serverconfig.AuthenticationBackend{
+		{Type: serverconfig.BackendHtpasswd, Name: "staff", Htpasswd: &serverconfig.HtpasswdConfig{Path: staff}},
+		{Type: serverconfig.BackendHtpasswd, Htpasswd: &serverconfig.HtpasswdConfig{Path: students}},
+	})
+	require.NoError(err)
+
+	userData, err := chain.Authenticate(context.Background(), MethodPassword, Credentials{Username: "alice", Password: "secret"})
+	require.NoError(err)
+	assert.Equal("staff-alice", userData.UUID)
+	assert.Equal("alice", userData.Username)
+	userData, err = chain.Authenticate(context.Background(), MethodPassword, Credentials{Username: "bob", Password: "secret"})
+	require.NoError(err)
+	assert.Equal("htpasswd-bob", userData.UUID)
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	content := "# users of the course\n\nalice:" + string(hash) + "\n"
+
+	testCases := map[string]struct {
+		username   string
+		password   string
+		file       string
+		expectErr  bool
+		expectUUID string
+	}{
+		"valid password": {
+			username:   "alice",
+			password:   "secret",
+			file:       content,
+			expectUUID: "alice",
+		},
+		"wrong password": {
+			username:  "alice",
+			password:  "wrong",
+			file:      content,
+			expectErr: true,
+		},
+		"unknown user": {
+			username:  "bob",
+			password:  "secret",
+			file:      content,
+			expectErr: true,
+		},
+		"unsupported hash": {
+			username:  "alice",
+			password:  "secret",
+			file:      "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+			expectErr: true,
+		},
+		"malformed line": {
+			username:  "alice",
+			password:  "secret",
+			file:      "alice\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			require.NoError(t, os.WriteFile(path, []byte(tc.file), 0o600))
+			htpasswd := &Htpasswd{log: zap.NewNop(), path: path}
+
+			userData, err := htpasswd.Authenticate(context.Background(), Credentials{Username: tc.username, Password: tc.password})
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expectUUID, userData.UUID)
+		})
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	_, err := bcrypt.Cost(dummyHash)
+	assert.NoError(t, err)
+}
+
+type stubAuthenticator struct {
+	method Method
+	uuid   string
+	err    error
+}
+
+func (s *stubAuthenticator) Name() string {
+	return "stub"
+}
+
+func (s *stubAuthenticator) Method() Method {
+	return s.method
+}
+
+func (s *stubAuthenticator) Authenticate(_ context.Context, _ Credentials) (*config.UserInformation, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &config.UserInformation{UUID: s.uuid}, nil
+}
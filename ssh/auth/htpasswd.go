@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so they cannot be distinguished by the response time.
+var dummyHash = []byte("$2a$10$7EqJtq98hPqEX7fNZaFWoOhi5BWX4Z0I6Xdbm/.QWv6HmjDrSxCAy")
+
+// Htpasswd authenticates users against a local htpasswd file with bcrypt hashed passwords.
+// The file is read on every login, so changes take effect without a restart.
+type Htpasswd struct {
+	log  *zap.Logger
+	path string
+}
+
+// NewHtpasswd creates a new Htpasswd backend and checks that the file can be parsed.
+func NewHtpasswd(logger *zap.Logger, conf *serverconfig.HtpasswdConfig) (*Htpasswd, error) {
+	h := &Htpasswd{
+		log:  logger,
+		path: conf.Path,
+	}
+	if _, err := h.readFile(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Name returns the name of the backend.
+func (h *Htpasswd) Name() string {
+	return "htpasswd " + h.path
+}
+
+// Method returns MethodPassword.
+func (h *Htpasswd) Method() Method {
+	return MethodPassword
+}
+
+// Authenticate compares the password with the hash of the user. The username is used as uuid.
+func (h *Htpasswd) Authenticate(_ context.Context, creds Credentials) (*config.UserInformation, error) {
+	users, err := h.readFile()
+	if err != nil {
+		h.log.Error("reading htpasswd file", zap.Error(err))
+		return nil, err
+	}
+	hash, ok := users[creds.Username]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(creds.Password))
+		return nil, errors.New("invalid username or password")
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(creds.Password)); err != nil {
+		return nil, errors.New("invalid username or password")
+	}
+	return &config.UserInformation{
+		Username: creds.Username,
+		UUID:     creds.Username,
+	}, nil
+}
+
+// readFile parses the htpasswd file. Empty lines and lines starting with # are ignored.
+func (h *Htpasswd) readFile() (map[string][]byte, error) {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseHtpasswd(data)
+}
+
+func parseHtpasswd(data []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(entry, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported: %w", line, err)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
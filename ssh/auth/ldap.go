@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	goLdap "github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// Ldap is a struct to interact with the LDAP server.
+type Ldap struct {
+	log  *zap.Logger
+	conf *serverconfig.LDAPConfig
+}
+
+// NewLdap creates a new Ldap struct.
+func NewLdap(logger *zap.Logger, conf *serverconfig.LDAPConfig) *Ldap {
+	return &Ldap{
+		conf: conf,
+		log:  logger,
+	}
+}
+
+// Name returns the name of the backend.
+func (l *Ldap) Name() string {
+	return "ldap " + l.conf.URL
+}
+
+// Method returns MethodPassword.
+func (l *Ldap) Method() Method {
+	return MethodPassword
+}
+
+// Authenticate binds with the credentials of the user and reads the user information.
+func (l *Ldap) Authenticate(_ context.Context, creds Credentials) (*config.UserInformation, error) {
+	// an empty password results in an unauthenticated bind, which succeeds on most servers
+	if creds.Password == "" {
+		return nil, errors.New("empty password")
+	}
+	return l.Search(creds.Username, creds.Password)
+}
+
+func (l *Ldap) dial(username, password string) (*goLdap.Conn, error) {
+	// Connect to LDAP server
+	patchedDn := l.bindDN(username)
+	connection, err := goLdap.DialURL(l.conf.URL)
+	if err != nil {
+		l.log.Error("ldap dial", zap.Error(err))
+		return nil, err
+	}
+	if l.conf.StartTLS {
+		serverURL, err := url.Parse(l.conf.URL)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		if err := connection.StartTLS(&tls.Config{ServerName: serverURL.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+			l.log.Error("ldap starttls", zap.Error(err))
+			connection.Close()
+			return nil, err
+		}
+	}
+	// Bind to LDAP server
+	l.log.Info("binding to ldap server", zap.String("dn", patchedDn))
+	if err := connection.Bind(patchedDn, password); err != nil {
+		l.log.Error("ldap bind", zap.Error(err), zap.String("dn", patchedDn))
+		connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+// Search searches for a user in the LDAP server and parses the data.
+func (l *Ldap) Search(username, password string) (*config.UserInformation, error) {
+	l.log.Info("searching for user", zap.String("username", username))
+	connection, err := l.dial(username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	patchedDn := l.bindDN(username)
+
+	searchRequest := goLdap.NewSearchRequest(
+		patchedDn,
+		goLdap.ScopeBaseObject,
+		goLdap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		l.attributes(),
+		nil,
+	)
+	sr, err := connection.Search(searchRequest)
+	if err != nil {
+		l.log.Error("ldap search", zap.Error(err), zap.String("dn", patchedDn))
+		return nil, err
+	}
+	// Sanity check: make sure the user is unique
+	if len(sr.Entries) != 1 {
+		l.log.Error("ldap user isn't unique", zap.String("dn", patchedDn))
+		return nil, fmt.Errorf("user not unique %s", patchedDn)
+	}
+	return l.userInformation(username, sr.Entries[0]), nil
+}
+
+// bindDN returns the DN of the user.
+func (l *Ldap) bindDN(username string) string {
+	return fmt.Sprintf(l.conf.BindDN, goLdap.EscapeDN(username))
+}
+
+// attributes returns the LDAP attributes which are requested in a search.
+func (l *Ldap) attributes() []string {
+	mapping := l.conf.Attributes
+	var attributes []string
+	for _, attribute := range append([]string{mapping.UUID, mapping.LegiNumber, mapping.Email, mapping.Gender}, mapping.RealName...) {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// userInformation maps the attributes of the entry to the user information.
+func (l *Ldap) userInformation(username string, entry *goLdap.Entry) *config.UserInformation {
+	mapping := l.conf.Attributes
+	getAttribute := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return entry.GetAttributeValue(name)
+	}
+	uuid := username
+	if mapping.UUID != "" {
+		uuid = username + "-" + getAttribute(mapping.UUID)
+	}
+	var realName []string
+	for _, attribute := range mapping.RealName {
+		realName = append(realName, getAttribute(attribute))
+	}
+	return &config.UserInformation{
+		Username:   username,
+		UUID:       uuid,
+		LegiNumber: getAttribute(mapping.LegiNumber),
+		Email:      getAttribute(mapping.Email),
+		RealName:   strings.Join(realName, " "),
+		Gender:     getAttribute(mapping.Gender),
+	}
+}
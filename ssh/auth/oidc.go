@@ -0,0 +1,270 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// deviceCodeGrantType is the grant type of the device authorization flow (RFC 8628).
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// defaultPollInterval is the polling interval in seconds if the provider does not specify one.
+	defaultPollInterval = 5
+	// maxResponseSize limits the size of responses read from the provider.
+	maxResponseSize = 1 << 20
+)
+
+// OIDC authenticates users with the OAuth 2.0 device authorization flow of an OpenID Connect provider.
+// The verification URL and code are shown through a keyboard-interactive challenge, afterwards the token endpoint
+// is polled until the user completed the login in the browser. The user information is read from the userinfo endpoint.
+type OIDC struct {
+	log    *zap.Logger
+	conf   *serverconfig.OIDCConfig
+	client *http.Client
+	// pollUnit is the unit of the polling interval, it is replaced in tests.
+	pollUnit time.Duration
+}
+
+// NewOIDC creates a new OIDC backend.
+func NewOIDC(logger *zap.Logger, conf *serverconfig.OIDCConfig) *OIDC {
+	return &OIDC{
+		log:      logger,
+		conf:     conf,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		pollUnit: time.Second,
+	}
+}
+
+// Name returns the name of the backend.
+func (o *OIDC) Name() string {
+	return "oidc " + o.conf.Issuer
+}
+
+// Method returns MethodKeyboardInteractive.
+func (o *OIDC) Method() Method {
+	return MethodKeyboardInteractive
+}
+
+// oidcEndpoints are the endpoints of the provider used by the device flow.
+type oidcEndpoints struct {
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	UserinfoEndpoint            string `json:"userinfo_endpoint"`
+}
+
+// deviceAuthorization is the response of the device authorization endpoint.
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+// Authenticate runs the device authorization flow.
+func (o *OIDC) Authenticate(ctx context.Context, creds Credentials) (*config.UserInformation, error) {
+	if creds.Challenge == nil {
+		return nil, errors.New("no keyboard-interactive challenge")
+	}
+	endpoints, err := o.discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering endpoints: %w", err)
+	}
+	device, err := o.authorizeDevice(ctx, endpoints.DeviceAuthorizationEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("requesting device code: %w", err)
+	}
+	instruction := fmt.Sprintf("Open %s and enter the code %s to log in.\n", device.VerificationURI, device.UserCode)
+	if device.VerificationURIComplete != "" {
+		instruction = fmt.Sprintf("Open %s to log in.\n", device.VerificationURIComplete)
+	}
+	if _, err := creds.Challenge("", instruction, nil, nil); err != nil {
+		return nil, err
+	}
+	accessToken, err := o.pollToken(ctx, endpoints.TokenEndpoint, device)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.userInfo(ctx, endpoints.UserinfoEndpoint, accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("requesting user info: %w", err)
+	}
+	return o.userInformation(claims)
+}
+
+// discover reads the endpoints from the discovery document of the issuer.
+func (o *OIDC) discover(ctx context.Context) (*oidcEndpoints, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.conf.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints oidcEndpoints
+	if err := o.doJSON(req, &endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.DeviceAuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.UserinfoEndpoint == "" {
+		return nil, errors.New("provider does not support the device authorization flow")
+	}
+	return &endpoints, nil
+}
+
+// authorizeDevice requests a device and user code.
+func (o *OIDC) authorizeDevice(ctx context.Context, endpoint string) (*deviceAuthorization, error) {
+	scopes := o.conf.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	form := o.clientForm()
+	form.Set("scope", strings.Join(scopes, " "))
+	req, err := o.formRequest(ctx, endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	var device deviceAuthorization
+	if err := o.doJSON(req, &device); err != nil {
+		return nil, err
+	}
+	if device.DeviceCode == "" || device.UserCode == "" || device.VerificationURI == "" {
+		return nil, errors.New("incomplete device authorization response")
+	}
+	return &device, nil
+}
+
+// pollToken polls the token endpoint until the user completed the login, denied it or the device code expired.
+func (o *OIDC) pollToken(ctx context.Context, endpoint string, device *deviceAuthorization) (string, error) {
+	if device.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(device.ExpiresIn)*o.pollUnit)
+		defer cancel()
+	}
+	interval := device.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	form := o.clientForm()
+	form.Set("grant_type", deviceCodeGrantType)
+	form.Set("device_code", device.DeviceCode)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for device authorization: %w", ctx.Err())
+		case <-time.After(time.Duration(interval) * o.pollUnit):
+		}
+		req, err := o.formRequest(ctx, endpoint, form)
+		if err != nil {
+			return "", err
+		}
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		var token tokenResponse
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&token)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("decoding token response: %w", err)
+		}
+		switch token.Error {
+		case "":
+			if token.AccessToken == "" {
+				return "", errors.New("token response contains no access token")
+			}
+			return token.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += defaultPollInterval
+		default:
+			return "", fmt.Errorf("device authorization failed: %s", token.Error)
+		}
+	}
+}
+
+// userInfo requests the claims of the user.
+func (o *OIDC) userInfo(ctx context.Context, endpoint, accessToken string) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	claims := make(map[string]any)
+	if err := o.doJSON(req, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// userInformation maps the claims to the user information.
+func (o *OIDC) userInformation(claims map[string]any) (*config.UserInformation, error) {
+	claim := func(name, fallback string) string {
+		if name == "" {
+			name = fallback
+		}
+		value, _ := claims[name].(string)
+		return value
+	}
+	uuid := claim(o.conf.UUIDClaim, "sub")
+	if uuid == "" {
+		return nil, errors.New("user info contains no uuid claim")
+	}
+	return &config.UserInformation{
+		Username: claim(o.conf.UsernameClaim, "preferred_username"),
+		UUID:     uuid,
+		Email:    claim("email", ""),
+		RealName: claim("name", ""),
+	}, nil
+}
+
+// clientForm returns the form values identifying the client.
+func (o *OIDC) clientForm() url.Values {
+	form := url.Values{}
+	form.Set("client_id", o.conf.ClientID)
+	if o.conf.ClientSecret != "" {
+		form.Set("client_secret", o.conf.ClientSecret)
+	}
+	return form
+}
+
+func (o *OIDC) formRequest(ctx context.Context, endpoint string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// doJSON sends the request and decodes a successful JSON response into target.
+func (o *OIDC) doJSON(req *http.Request, target any) error {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, req.URL)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(target)
+}
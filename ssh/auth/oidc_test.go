@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOIDCAuthenticate(t *testing.T) {
+	testCases := map[string]struct {
+		tokenErrors     []string
+		userInfo        map[string]any
+		challengeErr    bool
+		expectErr       bool
+		expectUUID      string
+		expectUsername  string
+		expectedPolling int32
+	}{
+		"login completed": {
+			tokenErrors:     []string{"authorization_pending", "slow_down"},
+			userInfo:        map[string]any{"sub": "1234", "preferred_username": "alice", "email": "alice@example.com"},
+			expectUUID:      "1234",
+			expectUsername:  "alice",
+			expectedPolling: 3,
+		},
+		"access denied": {
+			tokenErrors:     []string{"authorization_pending", "access_denied"},
+			expectErr:       true,
+			expectedPolling: 2,
+		},
+		"missing uuid claim": {
+			userInfo:        map[string]any{"preferred_username": "alice"},
+			expectErr:       true,
+			expectedPolling: 1,
+		},
+		"challenge fails": {
+			challengeErr: true,
+			expectErr:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var polls atomic.Int32
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+				writeJSON(w, map[string]string{
+					"device_authorization_endpoint": server.URL + "/device",
+					"token_endpoint":                server.URL + "/token",
+					"userinfo_endpoint":             server.URL + "/userinfo",
+				})
+			})
+			mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal("client", r.FormValue("client_id"))
+				writeJSON(w, map[string]any{
+					"device_code":      "device-code",
+					"user_code":        "ABCD-EFGH",
+					"verification_uri": server.URL + "/activate",
+					"expires_in":       1000,
+					"interval":         1,
+				})
+			})
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(deviceCodeGrantType, r.FormValue("grant_type"))
+				assert.Equal("device-code", r.FormValue("device_code"))
+				poll := int(polls.Add(1))
+				if poll <= len(tc.tokenErrors) {
+					writeJSON(w, map[string]string{"error": tc.tokenErrors[poll-1]})
+					return
+				}
+				writeJSON(w, map[string]string{"access_token": "token", "token_type": "Bearer"})
+			})
+			mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				writeJSON(w, tc.userInfo)
+			})
+
+			oidc := NewOIDC(zap.NewNop(), &serverconfig.OIDCConfig{Issuer: server.URL, ClientID: "client"})
+			oidc.pollUnit = time.Millisecond
+			var instruction string
+			challenge := func(_, inst string, questions []string, _ []bool) ([]string, error) {
+				instruction = inst
+				assert.Empty(questions)
+				if tc.challengeErr {
+					return nil, errors.New("challenge failed")
+				}
+				return nil, nil
+			}
+
+			userData, err := oidc.Authenticate(context.Background(), Credentials{Username: "course", Challenge: challenge})
+			assert.Equal(tc.expectedPolling, polls.Load())
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Contains(instruction, "ABCD-EFGH")
+			assert.Equal(tc.expectUUID, userData.UUID)
+			assert.Equal(tc.expectUsername, userData.Username)
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
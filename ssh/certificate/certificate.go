@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package certificate
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// clockSkew is subtracted from the start of the validity window of issued certificates.
+const clockSkew = 5 * time.Minute
+
+// Authority issues and verifies OpenSSH user certificates.
+type Authority struct {
+	signer   ssh.Signer
+	validity time.Duration
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// NewAuthority creates an Authority from a PEM encoded private key.
+// Issued certificates are valid for the given duration.
+func NewAuthority(privKey []byte, validity time.Duration) (*Authority, error) {
+	signer, err := ssh.ParsePrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ca private key: %w", err)
+	}
+	return &Authority{
+		signer:   signer,
+		validity: validity,
+		now:      time.Now,
+	}, nil
+}
+
+// PublicKey returns the public key of the authority.
+func (a *Authority) PublicKey() ssh.PublicKey {
+	return a.signer.PublicKey()
+}
+
+// Sign issues a short-lived user certificate for the key. The uuid is used as key ID and as the only principal.
+func (a *Authority) Sign(uuid string, key ssh.PublicKey) (*ssh.Certificate, error) {
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("cannot sign a certificate")
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	now := a.now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           uuid,
+		ValidPrincipals: []string{uuid},
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(a.validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, a.signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Authenticate verifies that the certificate is a valid user certificate of this authority and returns the uuid
+// of the user. The uuid is taken from the first principal, or from the key ID if the certificate has no principals.
+// Certificates with critical options are rejected, since none are supported.
+func (a *Authority) Authenticate(cert *ssh.Certificate, isRevoked func(*ssh.Certificate) bool) (string, error) {
+	if cert.CertType != ssh.UserCert {
+		return "", errors.New("certificate is not a user certificate")
+	}
+	uuid := cert.KeyId
+	if len(cert.ValidPrincipals) > 0 {
+		uuid = cert.ValidPrincipals[0]
+	}
+	if uuid == "" {
+		return "", errors.New("certificate has neither a principal nor a key id")
+	}
+	if cert.SignatureKey == nil || string(cert.SignatureKey.Marshal()) != string(a.signer.PublicKey().Marshal()) {
+		return "", errors.New("certificate is not signed by the authority")
+	}
+	if len(cert.CriticalOptions) > 0 {
+		return "", errors.New("certificate contains unsupported critical options")
+	}
+	checker := &ssh.CertChecker{
+		IsRevoked: isRevoked,
+		Clock:     a.now,
+	}
+	if err := checker.CheckCert(uuid, cert); err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
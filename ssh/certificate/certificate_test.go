@@ -0,0 +1,188 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package certificate
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	testCases := map[string]struct {
+		modify     func(*testing.T, *ssh.Certificate, ssh.Signer)
+		clock      time.Time
+		revoked    bool
+		expectErr  bool
+		expectUUID string
+	}{
+		"valid certificate": {
+			clock:      now.Add(time.Hour),
+			expectUUID: "user-uuid",
+		},
+		"uuid from key id": {
+			modify: func(t *testing.T, cert *ssh.Certificate, ca ssh.Signer) {
+				cert.ValidPrincipals = nil
+				cert.KeyId = "other-uuid"
+				require.NoError(t, cert.SignCert(rand.Reader, ca))
+			},
+			clock:      now.Add(time.Hour),
+			expectUUID: "other-uuid",
+		},
+		"expired": {
+			clock:     now.Add(3 * time.Hour),
+			expectErr: true,
+		},
+		"not yet valid": {
+			clock:     now.Add(-time.Hour),
+			expectErr: true,
+		},
+		"revoked": {
+			clock:     now.Add(time.Hour),
+			revoked:   true,
+			expectErr: true,
+		},
+		"host certificate": {
+			modify: func(t *testing.T, cert *ssh.Certificate, ca ssh.Signer) {
+				cert.CertType = ssh.HostCert
+				require.NoError(t, cert.SignCert(rand.Reader, ca))
+			},
+			clock:     now.Add(time.Hour),
+			expectErr: true,
+		},
+		"critical option": {
+			modify: func(t *testing.T, cert *ssh.Certificate, ca ssh.Signer) {
+				cert.CriticalOptions = map[string]string{"source-address": "10.0.0.1/32"}
+				require.NoError(t, cert.SignCert(rand.Reader, ca))
+			},
+			clock:     now.Add(time.Hour),
+			expectErr: true,
+		},
+		"signed by other authority": {
+			modify: func(t *testing.T, cert *ssh.Certificate, _ ssh.Signer) {
+				other, err := ssh.ParsePrivateKey(newCAKey(t))
+				require.NoError(t, err)
+				require.NoError(t, cert.SignCert(rand.Reader, other))
+			},
+			clock:     now.Add(time.Hour),
+			expectErr: true,
+		},
+		"tampered certificate": {
+			modify: func(_ *testing.T, cert *ssh.Certificate, _ ssh.Signer) {
+				cert.ValidBefore += 3600
+			},
+			clock:     now.Add(time.Hour),
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			authority, err := NewAuthority(newCAKey(t), 2*time.Hour)
+			require.NoError(err)
+			authority.now = func() time.Time { return now }
+			_, userKey, err := ed25519.GenerateKey(rand.Reader)
+			require.NoError(err)
+			userPub, err := ssh.NewPublicKey(userKey.Public())
+			require.NoError(err)
+
+			cert, err := authority.Sign("user-uuid", userPub)
+			require.NoError(err)
+			if tc.modify != nil {
+				tc.modify(t, cert, authority.signer)
+			}
+
+			authority.now = func() time.Time { return tc.clock }
+			uuid, err := authority.Authenticate(cert, func(*ssh.Certificate) bool { return tc.revoked })
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.expectUUID, uuid)
+		})
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	userPub, err := ssh.NewPublicKey(userKey.Public())
+	require.NoError(t, err)
+	authorizedKey := string(ssh.MarshalAuthorizedKey(userPub))
+
+	testCases := map[string]struct {
+		uuid          string
+		authType      string
+		authorizedKey string
+		expectErr     bool
+	}{
+		"password authentication": {
+			uuid:          "user-uuid",
+			authType:      "pw",
+			authorizedKey: authorizedKey,
+		},
+		"public key authentication": {
+			uuid:          "user-uuid",
+			authType:      "pk",
+			authorizedKey: authorizedKey,
+		},
+		"certificate authentication": {
+			uuid:          "user-uuid",
+			authType:      "cert",
+			authorizedKey: authorizedKey,
+			expectErr:     true,
+		},
+		"no user": {
+			authType:      "pk",
+			authorizedKey: authorizedKey,
+			expectErr:     true,
+		},
+		"invalid key": {
+			uuid:          "user-uuid",
+			authType:      "pk",
+			authorizedKey: "ssh-ed25519 invalid",
+			expectErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			authority, err := NewAuthority(newCAKey(t), time.Hour)
+			require.NoError(err)
+			cert, err := authority.signRequest(tc.uuid, tc.authType, tc.authorizedKey)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal([]string{tc.uuid}, cert.ValidPrincipals)
+			assert.Equal(userPub.Marshal(), cert.Key.Marshal())
+			_, err = authority.Authenticate(cert, nil)
+			assert.NoError(err)
+		})
+	}
+}
+
+func newCAKey(t *testing.T) []byte {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(privKey, "")
+	require.NoError(t, err)
+	return pem.EncodeToMemory(block)
+}
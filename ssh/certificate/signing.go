@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package certificate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// ServeSigningConnection handles a connection of the certificate signing user. The command of every exec request
+// must be a public key in authorized_keys format, the certificate for the key is written to the channel:
+//
+//	ssh certificate@<gateway> "$(cat ~/.ssh/id_ed25519.pub)" > ~/.ssh/id_ed25519-cert.pub
+//
+// Only users authenticated with a password or a registered public key may request certificates,
+// so certificates cannot be renewed with a certificate.
+func (a *Authority) ServeSigningConnection(ctx context.Context, log *zap.Logger, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	uuid := conn.Permissions.Extensions[config.AuthenticatedUserID]
+	authType := conn.Permissions.Extensions[config.AuthenticationType]
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case newChannel, ok := <-chans:
+			if !ok {
+				return
+			}
+			if newChannel.ChannelType() != "session" {
+				if err := newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported"); err != nil {
+					log.Error("failed to reject channel", zap.Error(err))
+				}
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				log.Error("could not accept the channel", zap.Error(err))
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer channel.Close()
+				a.serveSigningChannel(log, uuid, authType, channel, requests)
+			}()
+		}
+	}
+}
+
+// serveSigningChannel answers the first exec request of the channel with a certificate.
+func (a *Authority) serveSigningChannel(log *zap.Logger, uuid, authType string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		var execReq payload.ExecRequest
+		if err := ssh.Unmarshal(req.Payload, &execReq); err != nil {
+			log.Error("could not unmarshal exec payload", zap.Error(err))
+			_ = req.Reply(false, nil)
+			continue
+		}
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+		exitStatus := uint32(0)
+		cert, err := a.signRequest(uuid, authType, execReq.Command)
+		if err != nil {
+			log.Info("certificate signing rejected", zap.String("uuid", uuid), zap.Error(err))
+			_, _ = fmt.Fprintf(channel.Stderr(), "signing failed: %v\n", err)
+			exitStatus = 1
+		} else {
+			log.Info("issued certificate", zap.String("uuid", uuid), zap.Uint64("serial", cert.Serial))
+			_, _ = channel.Write(ssh.MarshalAuthorizedKey(cert))
+		}
+		if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(payload.ExitStatusRequest{Status: exitStatus})); err != nil {
+			log.Error("failed to send exit status", zap.Error(err))
+		}
+		return
+	}
+}
+
+// signRequest parses the public key and signs it for the user.
+func (a *Authority) signRequest(uuid, authType, authorizedKey string) (*ssh.Certificate, error) {
+	if authType != "pk" && authType != "pw" {
+		return nil, fmt.Errorf("authentication type %q may not request certificates", authType)
+	}
+	if uuid == "" {
+		return nil, errors.New("no authenticated user")
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	return a.Sign(uuid, key)
+}
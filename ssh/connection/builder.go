@@ -8,13 +8,17 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"sync"
-	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/channels"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -27,6 +31,13 @@ type Builder struct {
 	connection     *ssh.ServerConn
 	log            *zap.Logger
 	k8sHelper      kubernetes.K8sAPI
+	recorder       *recording.Recorder
+	auditLogger    *audit.Logger
+	conf           *serverconfig.Config
+	hostKeys       []ssh.Signer
+	workspace      string
+	workspaceKey   []byte
+	teammates      forward.TeammatesFunc
 }
 
 // NewBuilder returns a sshConnection.
@@ -54,6 +65,42 @@ func (s *Builder) SetGlobalRequests(reqs <-chan *ssh.Request) {
 	s.globalRequests = reqs
 }
 
+// SetRecorder sets the recorder of shells, shells are not recorded if it is nil.
+func (s *Builder) SetRecorder(recorder *recording.Recorder) {
+	s.recorder = recorder
+}
+
+// SetAuditLogger sets the audit logger, channels are not audited if it is nil.
+func (s *Builder) SetAuditLogger(auditLogger *audit.Logger) {
+	s.auditLogger = auditLogger
+}
+
+// SetConfig sets the configuration of the server, the default configuration is used if it is not set.
+func (s *Builder) SetConfig(conf *serverconfig.Config) {
+	s.conf = conf
+}
+
+// SetHostKeys sets the host keys advertised to the client, no keys are advertised if it is empty.
+func (s *Builder) SetHostKeys(hostKeys []ssh.Signer) {
+	s.hostKeys = hostKeys
+}
+
+// SetWorkspace sets the identifier of the kubernetes ressources of the user, the uuid is used if it is not set.
+func (s *Builder) SetWorkspace(workspace string) {
+	s.workspace = workspace
+}
+
+// SetWorkspaceKey sets the private key written into the container of the workspace, it signs the solutions submitted
+// to the grader. No key is written if it is empty.
+func (s *Builder) SetWorkspaceKey(key []byte) {
+	s.workspaceKey = key
+}
+
+// SetTeammates sets the lookup of the teammates, their containers are not reachable by port forwards if it is nil.
+func (s *Builder) SetTeammates(teammates forward.TeammatesFunc) {
+	s.teammates = teammates
+}
+
 // SetLogger sets the logger.
 func (s *Builder) SetLogger(log *zap.Logger) {
 	s.log = log
@@ -79,58 +126,106 @@ func (s *Builder) Build() (*Handler, error) {
 		return nil, errors.New("no logger provided")
 	}
 
+	conf := s.conf
+	if conf == nil {
+		conf = serverconfig.Default()
+	}
+	motd, err := conf.RenderMOTD(serverconfig.MOTDData{
+		Version:   config.Version,
+		Challenge: s.connection.User(),
+		UUID:      userID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rendering motd: %w", err)
+	}
+	timeouts := conf.Session.Timeouts(s.connection.User())
+	forwardPolicy := forward.NewPolicy(conf.Forwarding, s.teammates)
+	workspace := s.workspace
+	if workspace == "" {
+		workspace = userID
+	}
+	channelTypes := make(map[string]bool)
+	for _, channelType := range conf.ChannelTypes {
+		channelTypes[channelType] = true
+	}
+
 	userK8SAPI := kubernetes.NewK8sAPIUserWrapper(s.k8sHelper, &config.KubeRessourceIdentifier{
 		// Namespace will define the challenge / container we're using
 		Namespace:      config.UserNamespace,
-		UserIdentifier: userID,
+		UserIdentifier: workspace,
 		// Currently unused, but required for later.
 		ContainerIdentifier: s.connection.User(),
 	})
+	userK8SAPI.AuthenticatedUserID = userID
 
 	return &Handler{
 		wg:                  &sync.WaitGroup{},
-		maxKeepAliveRetries: 3,
-		keepAliveInterval:   10 * time.Second,
+		maxKeepAliveRetries: conf.KeepAlive.MaxRetries,
+		keepAliveInterval:   conf.KeepAlive.Interval,
+		idleTimeout:         timeouts.IdleTimeout,
+		maxDuration:         timeouts.MaxDuration,
+		timeoutWarning:      conf.Session.Warning,
+		maxSessions:         conf.Session.MaxSessions,
+		channelTypes:        channelTypes,
+		hostKeys:            s.hostKeys,
 		connection:          s.connection,
 		channel:             s.channel,
 		globalRequests:      s.globalRequests,
 		log:                 s.log.Named("connection").Named(logIdentifier),
 		K8sAPIUser:          userK8SAPI,
+		auditLogger:         s.auditLogger,
 
-		newSessionHandler:     newSession,
+		newSessionHandler: func(log *zap.Logger, connection ssh.Conn, channel ssh.Channel, requests <-chan *ssh.Request, api kubernetes.K8sAPIUser) (channels.Channel, error) {
+			return newSession(log, connection, channel, requests, api, s.recorder, s.auditLogger, conf.Subsystems, conf.SFTP.Quota, motd)
+		},
 		newDirectTCPIPHandler: newDirectTCPIP,
-		writeFileToContainer:  writeFileToContainer,
+		resolveForwardTarget: func(ctx context.Context, data *payload.ForwardTCPChannelOpen) (forward.Target, error) {
+			return forwardPolicy.Resolve(ctx, s.connection.User(), userID, workspace, data.HostToConnect, data.PortToConnect)
+		},
+		writeFileToContainer: func(ctx context.Context, _ *ssh.ServerConn, api kubernetes.K8sAPIUser) error {
+			return writeKeyToContainer(ctx, api, s.workspaceKey)
+		},
 	}, nil
 }
 
-func writeFileToContainer(ctx context.Context, conn *ssh.ServerConn, api kubernetes.K8sAPIUser) error {
-	if conn.Permissions.Extensions[config.AuthenticationType] != "pw" {
+// writeKeyToContainer writes the private key of the workspace into the container.
+func writeKeyToContainer(ctx context.Context, api kubernetes.K8sAPIUser, key []byte) error {
+	if len(key) == 0 {
 		return nil
 	}
 	return api.WriteFileInPod(ctx, &config.KubeFileWriteConfig{
 		Namespace:      config.UserNamespace,
-		UserIdentifier: conn.Permissions.Extensions[config.AuthenticatedUserID],
+		UserIdentifier: api.GetWorkspaceID(),
 		FileName:       "delegatio_priv_key",
-		FileData:       []byte(conn.Permissions.Extensions[config.AuthenticatedPrivKey]),
+		FileData:       key,
 		FilePath:       "/root/.ssh",
 	})
 }
 
-func newSession(log *zap.Logger, channel ssh.Channel, requests <-chan *ssh.Request, api kubernetes.K8sAPIUser) (channels.Channel, error) {
+func newSession(log *zap.Logger, connection ssh.Conn, channel ssh.Channel, requests <-chan *ssh.Request, api kubernetes.K8sAPIUser, recorder *recording.Recorder, auditLogger *audit.Logger,
+	subsystems map[string]string, sftpQuota int64, motd string,
+) (channels.Channel, error) {
 	builder := channels.SessionBuilderSkeleton()
+	builder.SetRecorder(recorder)
+	builder.SetAuditLogger(auditLogger)
+	builder.SetSubsystems(subsystems)
+	builder.SetSFTPQuota(sftpQuota)
+	builder.SetMOTD(motd)
 	builder.SetRequests(requests)
+	builder.SetConnection(connection)
 	builder.SetChannel(channel)
 	builder.SetLog(log)
 	builder.SetK8sUserAPI(api)
 	return builder.Build()
 }
 
-func newDirectTCPIP(log *zap.Logger, channel ssh.Channel, requests <-chan *ssh.Request, api kubernetes.K8sAPIUser, data *payload.ForwardTCPChannelOpen) (channels.Channel, error) {
+func newDirectTCPIP(log *zap.Logger, channel ssh.Channel, requests <-chan *ssh.Request, api kubernetes.K8sAPIUser, data *payload.ForwardTCPChannelOpen, target forward.Target) (channels.Channel, error) {
 	builder := channels.DirectTCPIPBuilderSkeleton()
 	builder.SetRequests(requests)
 	builder.SetChannel(channel)
 	builder.SetLog(log)
 	builder.SetK8sUserAPI(api)
 	builder.SetDirectTCPIPData(data)
+	builder.SetForwardTarget(target)
 	return builder.Build()
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/benschlueter/delegatio/internal/config"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
@@ -173,7 +174,7 @@ func TestNewSession(t *testing.T) {
 				k8sUserAPI = &kubernetes.K8sAPIUserWrapper{}
 			}
 
-			_, err := newSession(log, channel, request, k8sUserAPI)
+			_, err := newSession(log, nil, channel, request, k8sUserAPI, nil, nil, nil, 0, "")
 
 			if tc.expectErr {
 				assert.Error(err)
@@ -263,7 +264,7 @@ func TestNewDirectTCPIP(t *testing.T) {
 				tcpIPData = &payload.ForwardTCPChannelOpen{}
 			}
 
-			_, err := newDirectTCPIP(log, channel, request, k8sUserAPI, tcpIPData)
+			_, err := newDirectTCPIP(log, channel, request, k8sUserAPI, tcpIPData, forward.Target{})
 
 			if tc.expectErr {
 				assert.Error(err)
@@ -333,3 +334,11 @@ func (k *stubK8sHelper) CreateAndWaitForRessources(context.Context, *config.Kube
 func (k *stubK8sHelper) WriteFileInPod(context.Context, *config.KubeFileWriteConfig) error {
 	return nil
 }
+
+func (k *stubK8sHelper) CreateSocketForwardInPod(context.Context, *config.KubeSocketForwardConfig) error {
+	return nil
+}
+
+func (k *stubK8sHelper) ServeSFTPInPod(context.Context, *config.KubeSFTPConfig) error {
+	return nil
+}
@@ -7,10 +7,14 @@ package channels
 import (
 	"context"
 	"errors"
+	"net"
 	"sync"
 
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
+	"github.com/benschlueter/delegatio/ssh/recording"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -19,17 +23,27 @@ import (
 type Builder struct {
 	channelType     string
 	channel         ssh.Channel
+	connection      ssh.Conn
 	requests        <-chan *ssh.Request
 	logger          *zap.Logger
 	directTCPIPData *payload.ForwardTCPChannelOpen
+	forwardTarget   forward.Target
 	k8sAPIUser      kubernetes.K8sAPIUser
+	recorder        *recording.Recorder
+	auditLogger     *audit.Logger
+	subsystems      map[string]string
+	sftpQuota       int64
+	motd            string
 
 	onStartup    []func(context.Context, *callbackData)
 	onRequest    []func(context.Context, *ssh.Request, *callbackData)
 	onReqShell   []func(context.Context, *ssh.Request, *callbackData)
+	onReqExec    []func(context.Context, *ssh.Request, *callbackData)
 	onReqPty     []func(context.Context, *ssh.Request, *callbackData)
 	onReqWinCh   []func(context.Context, *ssh.Request, *callbackData)
 	onReqSubSys  []func(context.Context, *ssh.Request, *callbackData)
+	onReqAgent   []func(context.Context, *ssh.Request, *callbackData)
+	onReqX11     []func(context.Context, *ssh.Request, *callbackData)
 	onReqDefault []func(context.Context, *ssh.Request, *callbackData)
 }
 
@@ -49,6 +63,11 @@ func (b *Builder) SetChannel(channel ssh.Channel) {
 	b.channel = channel
 }
 
+// SetConnection sets the ssh connection, which is used to open channels to the client.
+func (b *Builder) SetConnection(connection ssh.Conn) {
+	b.connection = connection
+}
+
 // SetRequests sets the requests.
 func (b *Builder) SetRequests(requests <-chan *ssh.Request) {
 	b.requests = requests
@@ -69,6 +88,11 @@ func (b *Builder) SetOnReqShell(onReqShell func(context.Context, *ssh.Request, *
 	b.onReqShell = append(b.onReqShell, onReqShell)
 }
 
+// SetOnReqExec sets the onReqExec callback.
+func (b *Builder) SetOnReqExec(onReqExec func(context.Context, *ssh.Request, *callbackData)) {
+	b.onReqExec = append(b.onReqExec, onReqExec)
+}
+
 // SetOnReqPty sets the onReqPty callback.
 func (b *Builder) SetOnReqPty(onReqPty func(context.Context, *ssh.Request, *callbackData)) {
 	b.onReqPty = append(b.onReqPty, onReqPty)
@@ -84,6 +108,16 @@ func (b *Builder) SetOnReqSubSys(onReqSubSys func(context.Context, *ssh.Request,
 	b.onReqSubSys = append(b.onReqSubSys, onReqSubSys)
 }
 
+// SetOnReqAgentForward sets the onReqAgent callback.
+func (b *Builder) SetOnReqAgentForward(onReqAgent func(context.Context, *ssh.Request, *callbackData)) {
+	b.onReqAgent = append(b.onReqAgent, onReqAgent)
+}
+
+// SetOnReqX11 sets the onReqX11 callback.
+func (b *Builder) SetOnReqX11(onReqX11 func(context.Context, *ssh.Request, *callbackData)) {
+	b.onReqX11 = append(b.onReqX11, onReqX11)
+}
+
 // SetOnReqDefault sets the onReqDefault callback.
 func (b *Builder) SetOnReqDefault(onReqDefault func(context.Context, *ssh.Request, *callbackData)) {
 	b.onReqDefault = append(b.onReqDefault, onReqDefault)
@@ -99,11 +133,42 @@ func (b *Builder) SetK8sUserAPI(api kubernetes.K8sAPIUser) {
 	b.k8sAPIUser = api
 }
 
+// SetRecorder sets the recorder of shells, shells are not recorded if it is nil.
+func (b *Builder) SetRecorder(recorder *recording.Recorder) {
+	b.recorder = recorder
+}
+
+// SetAuditLogger sets the audit logger, requests are not audited if it is nil.
+func (b *Builder) SetAuditLogger(auditLogger *audit.Logger) {
+	b.auditLogger = auditLogger
+}
+
+// SetSubsystems sets the table mapping the requested subsystems to the built-in implementations.
+// Only the SFTP server is available if it is nil.
+func (b *Builder) SetSubsystems(subsystems map[string]string) {
+	b.subsystems = subsystems
+}
+
+// SetSFTPQuota sets the number of bytes a user may store using SFTP, config.SFTPQuota is used if it is zero.
+func (b *Builder) SetSFTPQuota(quota int64) {
+	b.sftpQuota = quota
+}
+
+// SetMOTD sets the message written to shells before they are started.
+func (b *Builder) SetMOTD(motd string) {
+	b.motd = motd
+}
+
 // SetDirectTCPIPData sets the directTCPIPData.
 func (b *Builder) SetDirectTCPIPData(directTCPIPData *payload.ForwardTCPChannelOpen) {
 	b.directTCPIPData = directTCPIPData
 }
 
+// SetForwardTarget sets the resolved destination of direct-tcpip channels, the own container is used if it is unset.
+func (b *Builder) SetForwardTarget(target forward.Target) {
+	b.forwardTarget = target
+}
+
 // Build builds the channel.
 func (b *Builder) Build() (*Handler, error) {
 	if b.channel == nil {
@@ -131,7 +196,15 @@ func (b *Builder) Build() (*Handler, error) {
 			wg:              &sync.WaitGroup{},
 			log:             b.logger.Named("channels").Named(b.channelType),
 			channel:         b.channel,
+			connection:      b.connection,
 			directTCPIPData: b.directTCPIPData,
+			forwardTarget:   b.forwardTarget,
+			dial:            (&net.Dialer{}).DialContext,
+			recorder:        b.recorder,
+			auditLogger:     b.auditLogger,
+			subsystems:      b.subsystems,
+			sftpQuota:       b.sftpQuota,
+			motd:            b.motd,
 			K8sAPIUser:      b.k8sAPIUser,
 		},
 		log:               b.logger.Named(b.channelType),
@@ -139,10 +212,13 @@ func (b *Builder) Build() (*Handler, error) {
 		onRequestCallback: b.onRequest,
 		onDefaultCallback: b.onReqDefault,
 		funcMap: map[string][]func(context.Context, *ssh.Request, *callbackData){
-			"shell":         b.onReqShell,
-			"pty-req":       b.onReqPty,
-			"window-change": b.onReqWinCh,
-			"subsystem":     b.onReqSubSys,
+			"shell":                      b.onReqShell,
+			"exec":                       b.onReqExec,
+			"pty-req":                    b.onReqPty,
+			"window-change":              b.onReqWinCh,
+			"subsystem":                  b.onReqSubSys,
+			"auth-agent-req@openssh.com": b.onReqAgent,
+			"x11-req":                    b.onReqX11,
 		},
 	}
 	return handler, nil
@@ -6,12 +6,23 @@ package channels
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/tools/remotecommand"
@@ -22,12 +33,23 @@ import (
 // callbackData is the data passed to the callbacks.
 type callbackData struct {
 	channel         ssh.Channel
+	connection      ssh.Conn
+	env             []string
+	agentForwarding bool
+	x11Forwarding   bool
 	cancel          context.CancelFunc
 	wg              *sync.WaitGroup
 	log             *zap.Logger
 	ptyReqData      *payload.PtyRequest
 	directTCPIPData *payload.ForwardTCPChannelOpen
+	forwardTarget   forward.Target
+	dial            func(ctx context.Context, network, address string) (net.Conn, error)
 	terminalResizer *TerminalSizeHandler
+	recorder        *recording.Recorder
+	auditLogger     *audit.Logger
+	subsystems      map[string]string
+	sftpQuota       int64
+	motd            string
 	kubernetes.K8sAPIUser
 }
 
@@ -54,11 +76,26 @@ func (rd *callbackData) handleShell(ctx context.Context) {
 
 	execConf := config.KubeExecConfig{
 		Namespace:      rd.GetNamespace(),
-		UserIdentifier: rd.GetAuthenticatedUserID(),
+		UserIdentifier: rd.GetWorkspaceID(),
 		Command:        "bash",
 		Communication:  rd.channel,
 		WinQueue:       rd.terminalResizer,
 		Tty:            tty,
+		Env:            rd.env,
+	}
+	if rec := rd.startRecording(); rec != nil {
+		defer func() {
+			if err := rec.Close(); err != nil {
+				rd.log.Error("failed to close recording", zap.Error(err))
+			}
+		}()
+		execConf.Communication = rec.Channel(rd.channel)
+		execConf.WinQueue = rec.SizeQueue(rd.terminalResizer)
+	}
+	if rd.motd != "" {
+		if _, err := execConf.Communication.Write([]byte(rd.motd)); err != nil {
+			rd.log.Error("failed to write motd", zap.Error(err))
+		}
 	}
 	rd.log.Info("executeCommandInPod", zap.Any("config", execConf))
 	if err := rd.ExecuteCommandInPod(ctx, &execConf); err != nil {
@@ -70,52 +107,136 @@ func (rd *callbackData) handleShell(ctx context.Context) {
 	_, _ = rd.channel.Write([]byte("graceful termination\n"))
 }
 
+// handleExec handles the "exec" request. The command is run by bash in the pod with the environment of the
+// session, i.e. the forwarded agent and display, and its exit status is sent to the client.
+func (rd *callbackData) handleExec(ctx context.Context, command string) {
+	rd.log.Info("handleExec", zap.String("command", command), zap.Any("pty", rd.ptyReqData))
+
+	defer func() {
+		rd.cancel()
+		rd.wg.Done()
+	}()
+	tty := false
+	if rd.ptyReqData != nil {
+		if err := rd.terminalResizer.Fill(
+			&remotecommand.TerminalSize{
+				Width:  uint16(rd.ptyReqData.WidthColumns),
+				Height: uint16(rd.ptyReqData.HeightRows),
+			}); err != nil {
+			rd.log.Error("failled to fill window", zap.Error(err))
+		}
+		tty = true
+	}
+
+	execConf := config.KubeExecConfig{
+		Namespace:      rd.GetNamespace(),
+		UserIdentifier: rd.GetWorkspaceID(),
+		Command:        "bash",
+		Args:           []string{"-c", command},
+		Communication:  rd.channel,
+		WinQueue:       rd.terminalResizer,
+		Tty:            tty,
+		Env:            rd.env,
+	}
+	// the agent reports the exit code of the command as error number.
+	exitStatus := uint32(0)
+	var errno syscall.Errno
+	err := rd.ExecuteCommandInPod(ctx, &execConf)
+	switch {
+	case errors.As(err, &errno):
+		exitStatus = uint32(errno)
+	case err != nil:
+		rd.log.Error("executeCommandInPod exited", zap.Error(err))
+		exitStatus = 255
+	}
+	if _, err := rd.channel.SendRequest("exit-status", false, ssh.Marshal(payload.ExitStatusRequest{Status: exitStatus})); err != nil {
+		rd.log.Error("failed to send exit status", zap.Error(err))
+	}
+}
+
+// startRecording starts the recording of a shell with a pty. It returns nil if the shell is not recorded.
+func (rd *callbackData) startRecording() *recording.Recording {
+	if rd.recorder == nil || rd.ptyReqData == nil {
+		return nil
+	}
+	var sessionID string
+	if rd.connection != nil {
+		sessionID = hex.EncodeToString(rd.connection.SessionID())
+	}
+	rec, err := rd.recorder.Start(rd.GetUserInformation().ContainerIdentifier, rd.GetAuthenticatedUserID(), sessionID,
+		rd.ptyReqData.WidthColumns, rd.ptyReqData.HeightRows, rd.ptyReqData.Term)
+	if err != nil {
+		rd.log.Error("failed to start recording", zap.Error(err))
+		return nil
+	}
+	return rec
+}
+
+// subsystem returns the built-in implementation of the requested subsystem.
+func (rd *callbackData) subsystem(name string) (string, bool) {
+	if rd.subsystems == nil {
+		if name != serverconfig.SubsystemSFTP {
+			return "", false
+		}
+		return name, true
+	}
+	implementation, ok := rd.subsystems[name]
+	return implementation, ok
+}
+
 // handleSubsystem handles the "subsystem" request. Currently only SFTP is supported.
-// This is used by "scp" to copy files from the localhost to the pod or vice versa.
+// The SFTP server runs in the gateway and accesses the files of the pod through the agent.
+// This is used by "scp" and "sftp" to copy files from the localhost to the pod or vice versa.
 func (rd *callbackData) handleSubsystem(ctx context.Context, cmd string) {
 	rd.log.Info("handleSubsystem callback", zap.String("subsystem", cmd))
 	defer func() {
 		rd.cancel()
 		rd.wg.Done()
 	}()
-	subSysMap := map[string]string{
-		"sftp": "/usr/lib/ssh/sftp-server",
-	}
-	parsedSubsystem, ok := subSysMap[cmd]
-	if !ok {
+	if cmd != serverconfig.SubsystemSFTP {
 		rd.log.Error("unknown subsystem", zap.String("subsystem", cmd))
 		return
 	}
 
-	execConf := config.KubeExecConfig{
+	sftpConf := config.KubeSFTPConfig{
 		Namespace:      rd.GetNamespace(),
-		UserIdentifier: fmt.Sprintf("%s-statefulset-0", rd.GetAuthenticatedUserID()),
-		Command:        parsedSubsystem,
+		UserIdentifier: rd.GetWorkspaceID(),
 		Communication:  rd.channel,
-		WinQueue:       rd.terminalResizer,
-		Tty:            false,
+		HomeDirectory:  config.UserHomeDirectory,
+		Quota:          rd.sftpQuota,
 	}
-	err := rd.ExecuteCommandInPod(ctx, &execConf)
-	if err != nil {
-		rd.log.Error("ExecuteCommandInPod exited", zap.Error(err))
+	if sftpConf.Quota == 0 {
+		sftpConf.Quota = config.SFTPQuota
+	}
+	if err := rd.ServeSFTPInPod(ctx, &sftpConf); err != nil {
+		rd.log.Error("serveSFTPInPod exited", zap.Error(err))
 		_, _ = rd.channel.Write([]byte(fmt.Sprintf("closing connection, reason: %v", err)))
 	}
 }
 
-// handlePortForward handles the "direct-tcpip" request. This is used for "kubectl port-forward".
+// handlePortForward handles the "direct-tcpip" request. Containers are reached with "kubectl port-forward",
+// shared services are dialed by the ssh server.
 func (rd *callbackData) handlePortForward(ctx context.Context) {
-	rd.log.Info("handlePortForward callback", zap.Any("data", rd.directTCPIPData))
+	rd.log.Info("handlePortForward callback", zap.Any("data", rd.directTCPIPData), zap.Stringer("target", rd.forwardTarget))
 
 	defer func() {
 		rd.cancel()
 		rd.wg.Done()
 	}()
+	if rd.forwardTarget.Address != "" {
+		rd.dialForward(ctx)
+		return
+	}
 	forwardConf := config.KubeForwardConfig{
 		Namespace:     rd.GetNamespace(),
-		PodName:       fmt.Sprintf("%s-statefulset-0", rd.GetAuthenticatedUserID()),
+		PodName:       forward.PodName(rd.GetWorkspaceID()),
 		Communication: rd.channel,
 		Port:          fmt.Sprint(rd.directTCPIPData.PortToConnect),
 	}
+	if rd.forwardTarget.PodName != "" {
+		forwardConf.Namespace = rd.forwardTarget.Namespace
+		forwardConf.PodName = rd.forwardTarget.PodName
+	}
 	// this call will block until the context is cancelled, the channel is closed from the client side, or kubeapi is closing the channel (most likely an error).
 	err := rd.CreatePodPortForward(ctx, &forwardConf)
 	if err != nil {
@@ -123,3 +244,167 @@ func (rd *callbackData) handlePortForward(ctx context.Context) {
 		return
 	}
 }
+
+// dialForward connects the channel to the address of the target until either side closes the connection or the
+// context is cancelled.
+func (rd *callbackData) dialForward(ctx context.Context) {
+	address := net.JoinHostPort(rd.forwardTarget.Address, strconv.FormatUint(uint64(rd.forwardTarget.Port), 10))
+	conn, err := rd.dial(ctx, "tcp", address)
+	if err != nil {
+		rd.log.Info("failed to dial forward target", zap.String("address", address), zap.Error(err))
+		return
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(rd.channel, conn)
+		_ = rd.channel.CloseWrite()
+	}()
+	_, _ = io.Copy(conn, rd.channel)
+	if tcpConn, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = tcpConn.CloseWrite()
+	}
+	<-done
+}
+
+// handleAgentForward handles the "auth-agent-req@openssh.com" request. The agent in the pod listens on a unix socket
+// and every connection to it is relayed to the client through an "auth-agent@openssh.com" channel.
+// The socket path is sent on ready once the socket exists, ready is closed when the forwarding stops.
+func (rd *callbackData) handleAgentForward(ctx context.Context, ready chan<- string) {
+	rd.log.Info("handleAgentForward callback")
+	defer func() {
+		close(ready)
+		rd.wg.Done()
+	}()
+
+	forwardConf := config.KubeSocketForwardConfig{
+		Namespace:      rd.GetNamespace(),
+		UserIdentifier: rd.GetWorkspaceID(),
+		Network:        "unix",
+		Ready: func(address string) {
+			ready <- address
+		},
+		Connect: func() (io.ReadWriteCloser, error) {
+			return rd.openChannel("auth-agent@openssh.com", nil)
+		},
+	}
+	// this call will block until the context is cancelled, i.e. the session is closed.
+	if err := rd.CreateSocketForwardInPod(ctx, &forwardConf); err != nil {
+		rd.log.Error("createSocketForwardInPod exited", zap.Error(err))
+	}
+}
+
+// handleX11Forward handles the "x11-req" request. The agent in the pod listens on the socket of the first free
+// display and every connection to it is relayed to the client through a "x11" channel. The pod only knows a
+// fake cookie, which is replaced by the real cookie of the client when a X11 connection is set up.
+// The environment for the session is sent on ready once the display exists, ready is closed when the forwarding stops.
+func (rd *callbackData) handleX11Forward(ctx context.Context, x11Req *payload.X11Request, ready chan<- []string) {
+	rd.log.Info("handleX11Forward callback", zap.Bool("singleConnection", x11Req.SingleConnection), zap.Uint32("screen", x11Req.ScreenNumber))
+	defer func() {
+		close(ready)
+		rd.wg.Done()
+	}()
+	if x11Req.AuthProtocol != x11AuthProtocol {
+		rd.log.Error("unsupported x11 authentication protocol", zap.String("protocol", x11Req.AuthProtocol))
+		return
+	}
+	realCookie, err := hex.DecodeString(x11Req.AuthCookie)
+	if err != nil {
+		rd.log.Error("failed to decode x11 cookie", zap.Error(err))
+		return
+	}
+	fakeCookie, err := newX11Cookie(len(realCookie))
+	if err != nil {
+		rd.log.Error("failed to create x11 cookie", zap.Error(err))
+		return
+	}
+
+	var connMux sync.Mutex
+	connections := 0
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		authorityFile := fmt.Sprintf("Xauthority-%d", display)
+		if err := rd.WriteFileInPod(ctx, &config.KubeFileWriteConfig{
+			Namespace:      rd.GetNamespace(),
+			UserIdentifier: rd.GetWorkspaceID(),
+			FileName:       authorityFile,
+			FilePath:       x11AuthorityDir,
+			FileData:       xauthorityEntry(display, x11AuthProtocol, fakeCookie),
+		}); err != nil {
+			rd.log.Error("failed to write xauthority file", zap.Error(err))
+			return
+		}
+		started := false
+		forwardConf := config.KubeSocketForwardConfig{
+			Namespace:      rd.GetNamespace(),
+			UserIdentifier: rd.GetWorkspaceID(),
+			Network:        "unix",
+			Address:        filepath.Join(x11SocketDir, fmt.Sprintf("X%d", display)),
+			Ready: func(string) {
+				started = true
+				ready <- []string{
+					fmt.Sprintf("DISPLAY=:%d.%d", display, x11Req.ScreenNumber),
+					"XAUTHORITY=" + filepath.Join(x11AuthorityDir, authorityFile),
+				}
+			},
+			Connect: func() (io.ReadWriteCloser, error) {
+				connMux.Lock()
+				defer connMux.Unlock()
+				if x11Req.SingleConnection && connections > 0 {
+					return nil, errors.New("x11 forwarding is limited to a single connection")
+				}
+				connections++
+				channel, err := rd.openChannel("x11", ssh.Marshal(payload.X11ChannelOpen{OriginatorAddress: "127.0.0.1"}))
+				if err != nil {
+					return nil, err
+				}
+				return &x11CookieSpoofer{
+					ReadWriteCloser: channel,
+					protocol:        x11AuthProtocol,
+					fakeCookie:      fakeCookie,
+					realCookie:      realCookie,
+				}, nil
+			},
+		}
+		// this call will block until the context is cancelled, i.e. the session is closed.
+		err := rd.CreateSocketForwardInPod(ctx, &forwardConf)
+		if started || ctx.Err() != nil {
+			if err != nil {
+				rd.log.Error("createSocketForwardInPod exited", zap.Error(err))
+			}
+			return
+		}
+		rd.log.Debug("x11 display not available", zap.Int("display", display), zap.Error(err))
+	}
+	rd.log.Error("no free x11 display found")
+}
+
+// logAudit writes an audit event of a request on the channel. fill sets the fields specific to the request, it may be nil.
+func (rd *callbackData) logAudit(eventType string, accepted bool, fill func(*audit.Event)) {
+	if rd.auditLogger == nil {
+		return
+	}
+	event := audit.ConnectionEvent(eventType, rd.connection)
+	event.UUID = rd.GetAuthenticatedUserID()
+	event.Channel = "session"
+	event.Accepted = audit.Bool(accepted)
+	if fill != nil {
+		fill(&event)
+	}
+	rd.auditLogger.Log(event)
+}
+
+// openChannel opens a new channel to the client. Requests on the channel are discarded.
+func (rd *callbackData) openChannel(channelType string, extraData []byte) (ssh.Channel, error) {
+	if rd.connection == nil {
+		return nil, errors.New("no connection to open a channel on")
+	}
+	channel, requests, err := rd.connection.OpenChannel(channelType, extraData)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(requests)
+	return channel, nil
+}
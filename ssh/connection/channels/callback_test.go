@@ -5,15 +5,24 @@
 package channels
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"net"
 	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/benschlueter/delegatio/internal/config"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
@@ -110,6 +119,70 @@ func TestHandleShell(t *testing.T) {
 	}
 }
 
+func TestHandleShellRecording(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		pty             *payload.PtyRequest
+		expectRecording bool
+	}{
+		"shell with pty is recorded": {
+			pty:             &payload.PtyRequest{Term: "xterm", WidthColumns: 80, HeightRows: 24},
+			expectRecording: true,
+		},
+		"shell without pty is not recorded": {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			storage := recording.NewDirectoryStorage(afero.NewMemMapFs(), "/recordings")
+			recorder := recording.NewRecorder(zap.NewNop(), storage, &serverconfig.RecordingConfig{
+				Default: serverconfig.RecordingPolicy{Enabled: true},
+			})
+			rd := &callbackData{
+				channel:         &stubChannel{},
+				wg:              &sync.WaitGroup{},
+				log:             zap.NewNop(),
+				terminalResizer: NewTerminalSizeHandler(10),
+				ptyReqData:      tc.pty,
+				recorder:        recorder,
+				K8sAPIUser: &kubernetes.K8sAPIUserWrapper{
+					K8sAPI: &stubK8sAPIWrapper{
+						execFunc: func(_ context.Context, kec *config.KubeExecConfig) error {
+							_, err := kec.Communication.Write([]byte("hello"))
+							return err
+						},
+					},
+					UserInformation: &config.KubeRessourceIdentifier{
+						Namespace:           "ns-test",
+						UserIdentifier:      "user-test",
+						ContainerIdentifier: "challenge-test",
+					},
+				},
+				cancel: func() {},
+			}
+			rd.wg.Add(1)
+			rd.handleShell(context.Background())
+
+			objects, err := storage.List("challenge-test/user-test/")
+			require.NoError(err)
+			if !tc.expectRecording {
+				assert.Empty(objects)
+				return
+			}
+			require.Len(objects, 1)
+			reader, err := storage.Open(objects[0].Key)
+			require.NoError(err)
+			defer reader.Close()
+			var out bytes.Buffer
+			require.NoError(recording.Replay(context.Background(), reader, &out, 1000, 0))
+			assert.Equal("hello", out.String())
+		})
+	}
+}
+
 func TestHandleSubsystem(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	testCases := map[string]struct {
@@ -137,21 +210,21 @@ func TestHandleSubsystem(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			assert := assert.New(t)
 			// require := require.New(t)
-			var execFunc func(ctx context.Context, kec *config.KubeExecConfig) error
+			var sftpFunc func(ctx context.Context, ksc *config.KubeSFTPConfig) error
 
 			if tc.closeByServer {
-				execFunc = func(_ context.Context, kec *config.KubeExecConfig) error {
-					kec.Communication.Close()
+				sftpFunc = func(_ context.Context, ksc *config.KubeSFTPConfig) error {
+					ksc.Communication.Close()
 					return tc.serverErr
 				}
 			} else {
-				execFunc = func(ctx context.Context, kec *config.KubeExecConfig) error {
+				sftpFunc = func(ctx context.Context, ksc *config.KubeSFTPConfig) error {
 					for {
 						select {
 						case <-ctx.Done():
 							return ctx.Err()
 						default:
-							if _, err := kec.Communication.Write([]byte("hello")); err != nil {
+							if _, err := ksc.Communication.Write([]byte("hello")); err != nil {
 								return err
 							}
 						}
@@ -168,7 +241,7 @@ func TestHandleSubsystem(t *testing.T) {
 				terminalResizer: NewTerminalSizeHandler(10),
 				K8sAPIUser: &kubernetes.K8sAPIUserWrapper{
 					K8sAPI: &stubK8sAPIWrapper{
-						execFunc: execFunc,
+						sftpFunc: sftpFunc,
 					},
 					UserInformation: &config.KubeRessourceIdentifier{
 						Namespace:      "ns-test",
@@ -200,6 +273,44 @@ func TestHandleSubsystem(t *testing.T) {
 	}
 }
 
+func TestSubsystemTable(t *testing.T) {
+	testCases := map[string]struct {
+		subsystems           map[string]string
+		requested            string
+		expectImplementation string
+		expectOK             bool
+	}{
+		"default sftp": {
+			requested:            "sftp",
+			expectImplementation: "sftp",
+			expectOK:             true,
+		},
+		"default unknown": {
+			requested: "netconf",
+		},
+		"alias": {
+			subsystems:           map[string]string{"sftp-server": "sftp"},
+			requested:            "sftp-server",
+			expectImplementation: "sftp",
+			expectOK:             true,
+		},
+		"disabled sftp": {
+			subsystems: map[string]string{},
+			requested:  "sftp",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			rd := &callbackData{subsystems: tc.subsystems}
+			implementation, ok := rd.subsystem(tc.requested)
+			assert.Equal(tc.expectOK, ok)
+			assert.Equal(tc.expectImplementation, implementation)
+		})
+	}
+}
+
 func TestHandlePortForward(t *testing.T) {
 	defer goleak.VerifyNone(t)
 	testCases := map[string]struct {
@@ -291,11 +402,230 @@ func TestHandlePortForward(t *testing.T) {
 	}
 }
 
+func TestHandlePortForwardTarget(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var forwardConf *config.KubeForwardConfig
+	k8sAPIUser := &kubernetes.K8sAPIUserWrapper{
+		K8sAPI: &stubK8sAPIWrapper{
+			forwardFunc: func(_ context.Context, kec *config.KubeForwardConfig) error {
+				forwardConf = kec
+				return nil
+			},
+		},
+		UserInformation: &config.KubeRessourceIdentifier{
+			Namespace:      "ns-test",
+			UserIdentifier: "user-test",
+		},
+	}
+
+	// teammates' containers are forwarded with the kubernetes API.
+	rd := &callbackData{
+		channel:         &stubChannel{reqChan: make(chan *ssh.Request)},
+		wg:              &sync.WaitGroup{},
+		log:             zaptest.NewLogger(t),
+		directTCPIPData: &payload.ForwardTCPChannelOpen{HostToConnect: "bob", PortToConnect: 22},
+		forwardTarget:   forward.Target{Namespace: "users", PodName: "bob-statefulset-0", Port: 22},
+		K8sAPIUser:      k8sAPIUser,
+		cancel:          func() {},
+	}
+	rd.wg.Add(1)
+	rd.handlePortForward(context.Background())
+	require.NotNil(forwardConf)
+	assert.Equal("users", forwardConf.Namespace)
+	assert.Equal("bob-statefulset-0", forwardConf.PodName)
+	assert.Equal("22", forwardConf.Port)
+
+	// shared services are dialed by the ssh server.
+	client, channelEnd := net.Pipe()
+	remote, dialEnd := net.Pipe()
+	var dialed string
+	rd = &callbackData{
+		channel:         &stubPipeChannel{conn: channelEnd},
+		wg:              &sync.WaitGroup{},
+		log:             zaptest.NewLogger(t),
+		directTCPIPData: &payload.ForwardTCPChannelOpen{HostToConnect: "target", PortToConnect: 80},
+		forwardTarget:   forward.Target{Address: "target.exam.svc.cluster.local", Port: 80},
+		dial: func(_ context.Context, _, address string) (net.Conn, error) {
+			dialed = address
+			return dialEnd, nil
+		},
+		K8sAPIUser: k8sAPIUser,
+		cancel:     func() {},
+	}
+	rd.wg.Add(1)
+	go rd.handlePortForward(context.Background())
+	_, err := client.Write([]byte("ping"))
+	require.NoError(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(remote, buf)
+	require.NoError(err)
+	assert.Equal("ping", string(buf))
+	_, err = remote.Write([]byte("pong"))
+	require.NoError(err)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(err)
+	assert.Equal("pong", string(buf))
+	assert.NoError(remote.Close())
+	rd.wg.Wait()
+	assert.NoError(client.Close())
+	assert.Equal("target.exam.svc.cluster.local:80", dialed)
+}
+
+type stubPipeChannel struct {
+	ssh.Channel
+	conn net.Conn
+}
+
+func (c *stubPipeChannel) Read(p []byte) (int, error) {
+	return c.conn.Read(p)
+}
+
+func (c *stubPipeChannel) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *stubPipeChannel) CloseWrite() error {
+	return c.conn.Close()
+}
+
+func TestHandleExec(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		execErr          error
+		expectExitStatus uint32
+	}{
+		"success": {
+			execErr: syscall.Errno(0),
+		},
+		"non zero exit code": {
+			execErr:          syscall.Errno(3),
+			expectExitStatus: 3,
+		},
+		"agent error": {
+			execErr:          errors.New("connection refused"),
+			expectExitStatus: 255,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var execConf *config.KubeExecConfig
+			stubChannel := &stubChannel{reqChan: make(chan *ssh.Request)}
+			rd := &callbackData{
+				channel:         stubChannel,
+				env:             []string{"SSH_AUTH_SOCK=/tmp/delegatio-test/agent.sock", "DISPLAY=:10.0"},
+				wg:              &sync.WaitGroup{},
+				log:             zap.NewNop(),
+				terminalResizer: NewTerminalSizeHandler(10),
+				K8sAPIUser: &kubernetes.K8sAPIUserWrapper{
+					K8sAPI: &stubK8sAPIWrapper{
+						execFunc: func(_ context.Context, kec *config.KubeExecConfig) error {
+							execConf = kec
+							return tc.execErr
+						},
+					},
+					UserInformation: &config.KubeRessourceIdentifier{
+						Namespace:      "ns-test",
+						UserIdentifier: "user-test",
+					},
+				},
+				cancel: func() {},
+			}
+			rd.wg.Add(1)
+			go rd.handleExec(context.Background(), "git push origin main")
+			rd.wg.Wait()
+
+			require.NotNil(execConf)
+			assert.Equal("bash", execConf.Command)
+			assert.Equal([]string{"-c", "git push origin main"}, execConf.Args)
+			assert.Equal(rd.env, execConf.Env)
+			assert.False(execConf.Tty)
+			require.Len(stubChannel.sentRequests, 1)
+			assert.Equal("exit-status", stubChannel.sentRequests[0].Type)
+			var exitStatus payload.ExitStatusRequest
+			require.NoError(ssh.Unmarshal(stubChannel.sentRequests[0].Payload, &exitStatus))
+			assert.Equal(tc.expectExitStatus, exitStatus.Status)
+		})
+	}
+}
+
+func TestHandleAgentForward(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		socketFunc  func(ctx context.Context, kec *config.KubeSocketForwardConfig) error
+		expectReady bool
+	}{
+		"socket ready": {
+			socketFunc: func(ctx context.Context, kec *config.KubeSocketForwardConfig) error {
+				kec.Ready("/tmp/delegatio-test/agent.sock")
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			expectReady: true,
+		},
+		"socket error": {
+			socketFunc: func(context.Context, *config.KubeSocketForwardConfig) error {
+				return errors.New("listen error")
+			},
+		},
+		"no connection to open channels": {
+			socketFunc: func(ctx context.Context, kec *config.KubeSocketForwardConfig) error {
+				kec.Ready("/tmp/delegatio-test/agent.sock")
+				_, err := kec.Connect()
+				return err
+			},
+			expectReady: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rd := &callbackData{
+				wg:  &sync.WaitGroup{},
+				log: zap.NewNop(),
+				K8sAPIUser: &kubernetes.K8sAPIUserWrapper{
+					K8sAPI: &stubK8sAPIWrapper{
+						socketFunc: tc.socketFunc,
+					},
+					UserInformation: &config.KubeRessourceIdentifier{
+						Namespace:      "ns-test",
+						UserIdentifier: "user-test",
+					},
+				},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			ready := make(chan string, 1)
+			rd.wg.Add(1)
+			go rd.handleAgentForward(ctx, ready)
+
+			socket, ok := <-ready
+			assert.Equal(tc.expectReady, ok)
+			if tc.expectReady {
+				assert.Equal("/tmp/delegatio-test/agent.sock", socket)
+			}
+			cancel()
+			rd.wg.Wait()
+			_, ok = <-ready
+			assert.False(ok)
+		})
+	}
+}
+
 type stubK8sAPIWrapper struct {
 	CreateAndWaitForRessourcesErr error
 	execFunc                      func(ctx context.Context, kec *config.KubeExecConfig) error
 	forwardFunc                   func(ctx context.Context, kec *config.KubeForwardConfig) error
 	writeFunc                     func(ctx context.Context, kec *config.KubeFileWriteConfig) error
+	socketFunc                    func(ctx context.Context, kec *config.KubeSocketForwardConfig) error
+	sftpFunc                      func(ctx context.Context, ksc *config.KubeSFTPConfig) error
 }
 
 func (k *stubK8sAPIWrapper) CreateAndWaitForRessources(_ context.Context, _ *config.KubeRessourceIdentifier) error {
@@ -313,3 +643,11 @@ func (k *stubK8sAPIWrapper) CreatePodPortForward(ctx context.Context, conf *conf
 func (k *stubK8sAPIWrapper) WriteFileInPod(ctx context.Context, conf *config.KubeFileWriteConfig) error {
 	return k.writeFunc(ctx, conf)
 }
+
+func (k *stubK8sAPIWrapper) CreateSocketForwardInPod(ctx context.Context, conf *config.KubeSocketForwardConfig) error {
+	return k.socketFunc(ctx, conf)
+}
+
+func (k *stubK8sAPIWrapper) ServeSFTPInPod(ctx context.Context, conf *config.KubeSFTPConfig) error {
+	return k.sftpFunc(ctx, conf)
+}
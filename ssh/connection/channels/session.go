@@ -7,6 +7,7 @@ package channels
 import (
 	"context"
 
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
@@ -32,11 +33,32 @@ func SessionBuilderSkeleton() *Builder {
 		rd.log.Info("shell request", zap.Any("data", req.Payload))
 		rd.wg.Add(1)
 		go rd.handleShell(ctx)
+		rd.logAudit(audit.EventShell, true, nil)
 		if err := req.Reply(true, nil); err != nil {
 			rd.log.Error("failled to reply to \"shell\" request", zap.Error(err))
 		}
 	})
 
+	builder.SetOnReqExec(func(ctx context.Context, req *ssh.Request, rd *callbackData) {
+		var execReq payload.ExecRequest
+		if err := ssh.Unmarshal(req.Payload, &execReq); err != nil {
+			rd.log.Error("failled to unmarshal exec request", zap.Error(err))
+			if err := req.Reply(false, nil); err != nil {
+				rd.log.Error("failled to reply to \"exec\" request", zap.Error(err))
+			}
+			return
+		}
+		rd.log.Info("exec request", zap.String("command", execReq.Command))
+		rd.wg.Add(1)
+		go rd.handleExec(ctx, execReq.Command)
+		rd.logAudit(audit.EventExec, true, func(event *audit.Event) {
+			event.Command = execReq.Command
+		})
+		if err := req.Reply(true, nil); err != nil {
+			rd.log.Error("failled to reply to \"exec\" request", zap.Error(err))
+		}
+	})
+
 	builder.SetOnReqSubSys(func(ctx context.Context, req *ssh.Request, rd *callbackData) {
 		subSys := payload.SubsystemRequest{}
 		if err := ssh.Unmarshal(req.Payload, &subSys); err != nil {
@@ -44,8 +66,19 @@ func SessionBuilderSkeleton() *Builder {
 			return
 		}
 		rd.log.Info("subsystem request", zap.Any("data", subSys))
+		implementation, ok := rd.subsystem(subSys.Subsystem)
+		rd.logAudit(audit.EventSubsystem, ok, func(event *audit.Event) {
+			event.Subsystem = subSys.Subsystem
+		})
+		if !ok {
+			rd.log.Info("subsystem is not enabled", zap.String("subsystem", subSys.Subsystem))
+			if err := req.Reply(false, nil); err != nil {
+				rd.log.Error("failled to respond to \"subsystem\" request", zap.Error(err))
+			}
+			return
+		}
 		rd.wg.Add(1)
-		go rd.handleSubsystem(ctx, subSys.Subsystem)
+		go rd.handleSubsystem(ctx, implementation)
 		if err := req.Reply(true, nil); err != nil {
 			rd.log.Error("failled to respond to \"subsystem\" request", zap.Error(err))
 		}
@@ -79,6 +112,58 @@ func SessionBuilderSkeleton() *Builder {
 		}
 	})
 
+	builder.SetOnReqAgentForward(func(ctx context.Context, req *ssh.Request, rd *callbackData) {
+		rd.log.Info("agent forwarding request")
+		if rd.agentForwarding {
+			if err := req.Reply(true, nil); err != nil {
+				rd.log.Error("failled to respond to \"auth-agent-req@openssh.com\" request", zap.Error(err))
+			}
+			return
+		}
+		ready := make(chan string, 1)
+		rd.wg.Add(1)
+		go rd.handleAgentForward(ctx, ready)
+		socket, ok := <-ready
+		if ok {
+			rd.agentForwarding = true
+			rd.env = append(rd.env, "SSH_AUTH_SOCK="+socket)
+		}
+		rd.logAudit(audit.EventAgentForward, ok, nil)
+		if err := req.Reply(ok, nil); err != nil {
+			rd.log.Error("failled to respond to \"auth-agent-req@openssh.com\" request", zap.Error(err))
+		}
+	})
+
+	builder.SetOnReqX11(func(ctx context.Context, req *ssh.Request, rd *callbackData) {
+		x11Req := payload.X11Request{}
+		if err := ssh.Unmarshal(req.Payload, &x11Req); err != nil {
+			rd.log.Error("failled to unmarshal x11 request", zap.Error(err))
+			if err := req.Reply(false, nil); err != nil {
+				rd.log.Error("failled to respond to \"x11-req\" request", zap.Error(err))
+			}
+			return
+		}
+		rd.log.Info("x11 request", zap.Bool("singleConnection", x11Req.SingleConnection), zap.String("protocol", x11Req.AuthProtocol))
+		if rd.x11Forwarding {
+			if err := req.Reply(false, nil); err != nil {
+				rd.log.Error("failled to respond to \"x11-req\" request", zap.Error(err))
+			}
+			return
+		}
+		ready := make(chan []string, 1)
+		rd.wg.Add(1)
+		go rd.handleX11Forward(ctx, &x11Req, ready)
+		env, ok := <-ready
+		if ok {
+			rd.x11Forwarding = true
+			rd.env = append(rd.env, env...)
+		}
+		rd.logAudit(audit.EventX11Forward, ok, nil)
+		if err := req.Reply(ok, nil); err != nil {
+			rd.log.Error("failled to respond to \"x11-req\" request", zap.Error(err))
+		}
+	})
+
 	builder.SetOnRequest(func(_ context.Context, req *ssh.Request, rd *callbackData) {
 		rd.log.Debug("request", zap.Any("data", req))
 	})
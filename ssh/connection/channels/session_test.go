@@ -5,7 +5,9 @@
 package channels
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"sync"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
 	"github.com/stretchr/testify/assert"
@@ -105,6 +108,7 @@ func TestSession(t *testing.T) {
 				&kubernetes.K8sAPIUserWrapper{
 					K8sAPI: &stubK8sAPIWrapper{
 						execFunc: func(context.Context, *config.KubeExecConfig) error { return nil },
+						sftpFunc: func(context.Context, *config.KubeSFTPConfig) error { return nil },
 					},
 					UserInformation: &config.KubeRessourceIdentifier{
 						Namespace:      "test-ns",
@@ -260,6 +264,17 @@ func TestSessionBlockingExec(t *testing.T) {
 							}
 							return nil
 						},
+						sftpFunc: func(ctx context.Context, ksc *config.KubeSFTPConfig) error {
+							select {
+							case <-ctx.Done():
+								return ctx.Err()
+							default:
+								if _, err := ksc.Communication.Write([]byte("hello")); err != nil {
+									return err
+								}
+							}
+							return nil
+						},
 					},
 					UserInformation: &config.KubeRessourceIdentifier{
 						Namespace:      "test-ns",
@@ -348,10 +363,64 @@ func TestSessionBlockingExec(t *testing.T) {
 	}
 }
 
+func TestSessionAudit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	assert := assert.New(t)
+	require := require.New(t)
+
+	requests := make(chan *ssh.Request, 2)
+	var buf bytes.Buffer
+	builder := SessionBuilderSkeleton()
+	builder.SetRequests(requests)
+	builder.SetChannel(&stubChannel{reqChan: requests})
+	builder.SetLog(zap.NewNop())
+	builder.SetAuditLogger(audit.NewLogger(&buf))
+	builder.SetK8sUserAPI(
+		&kubernetes.K8sAPIUserWrapper{
+			K8sAPI: &stubK8sAPIWrapper{
+				execFunc: func(ctx context.Context, _ *config.KubeExecConfig) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+				sftpFunc: func(context.Context, *config.KubeSFTPConfig) error { return nil },
+			},
+			UserInformation: &config.KubeRessourceIdentifier{
+				Namespace:      "test-ns",
+				UserIdentifier: "test-user",
+			},
+		},
+	)
+	handler, err := builder.Build()
+	require.NoError(err)
+
+	// the sftp subsystem cancels the handler once it exits, so it is sent last.
+	requests <- &ssh.Request{Type: "exec", Payload: ssh.Marshal(payload.ExecRequest{Command: "cat /etc/passwd"})}
+	requests <- &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(payload.SubsystemRequest{Subsystem: "sftp"})}
+	go handler.Serve(context.Background())
+	handler.Wait()
+
+	var events []audit.Event
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var event audit.Event
+		require.NoError(decoder.Decode(&event))
+		events = append(events, event)
+	}
+	require.Len(events, 2)
+	assert.Equal(audit.EventExec, events[0].Type)
+	assert.Equal("cat /etc/passwd", events[0].Command)
+	assert.Equal("test-user", events[0].UUID)
+	assert.True(*events[0].Accepted)
+	assert.Equal(audit.EventSubsystem, events[1].Type)
+	assert.Equal("sftp", events[1].Subsystem)
+	assert.True(*events[1].Accepted)
+}
+
 type stubChannel struct {
-	reqChan chan *ssh.Request
-	closed  bool
-	mux     sync.Mutex
+	reqChan      chan *ssh.Request
+	closed       bool
+	sentRequests []*ssh.Request
+	mux          sync.Mutex
 }
 
 func (cs *stubChannel) Read(_ []byte) (int, error) {
@@ -382,7 +451,10 @@ func (cs *stubChannel) CloseWrite() error {
 	return nil
 }
 
-func (cs *stubChannel) SendRequest(_ string, _ bool, _ []byte) (bool, error) {
+func (cs *stubChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.sentRequests = append(cs.sentRequests, &ssh.Request{Type: name, WantReply: wantReply, Payload: payload})
 	return true, nil
 }
 
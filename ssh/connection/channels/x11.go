@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package channels
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// x11DisplayOffset is the first display number used for forwarded X11 displays (same as OpenSSH).
+	x11DisplayOffset = 10
+	// x11MaxDisplays is the number of displays tried before the forwarding is rejected.
+	x11MaxDisplays = 100
+	// x11AuthProtocol is the only supported X11 authentication protocol.
+	x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+	// x11SocketDir is the directory where X11 clients look for the display sockets.
+	x11SocketDir = "/tmp/.X11-unix"
+	// x11AuthorityDir is the directory in the pod where the Xauthority files are written to. Unlike the shared socket
+	// directory it is only accessible by the user running the commands of the session, since it contains the cookies.
+	x11AuthorityDir = "/tmp/delegatio-x11"
+	// xauthFamilyWild is the Xauthority address family matching every host.
+	xauthFamilyWild = 0xffff
+)
+
+// newX11Cookie returns a random cookie with the given length.
+// It is used inside the pod instead of the real cookie of the client.
+func newX11Cookie(length int) ([]byte, error) {
+	cookie := make([]byte, length)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	return cookie, nil
+}
+
+// xauthorityEntry encodes an Xauthority file entry for the display, which matches every host.
+func xauthorityEntry(display int, protocol string, cookie []byte) []byte {
+	var buf bytes.Buffer
+	writeField := func(data []byte) {
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(data)))
+		buf.Write(data)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, uint16(xauthFamilyWild))
+	writeField(nil)
+	writeField([]byte(strconv.Itoa(display)))
+	writeField([]byte(protocol))
+	writeField(cookie)
+	return buf.Bytes()
+}
+
+// x11CookieSpoofer replaces the fake cookie in the connection setup of a X11 client with the real cookie of the
+// ssh client, so the real cookie never leaves the gateway. All data following the setup is passed through.
+type x11CookieSpoofer struct {
+	io.ReadWriteCloser
+	protocol   string
+	fakeCookie []byte
+	realCookie []byte
+	setup      []byte
+	done       bool
+}
+
+// Write buffers data until the connection setup is complete, checks and replaces the cookie and
+// writes everything to the underlying connection.
+func (s *x11CookieSpoofer) Write(p []byte) (int, error) {
+	if s.done {
+		return s.ReadWriteCloser.Write(p)
+	}
+	s.setup = append(s.setup, p...)
+	// byte-order (1), unused (1), major (2), minor (2), name length (2), data length (2), unused (2)
+	if len(s.setup) < 12 {
+		return len(p), nil
+	}
+	var order binary.ByteOrder
+	switch s.setup[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return 0, ErrX11InvalidSetup
+	}
+	nameLen := int(order.Uint16(s.setup[6:8]))
+	dataLen := int(order.Uint16(s.setup[8:10]))
+	dataStart := 12 + pad4(nameLen)
+	if len(s.setup) < dataStart+pad4(dataLen) {
+		return len(p), nil
+	}
+	name := s.setup[12 : 12+nameLen]
+	data := s.setup[dataStart : dataStart+dataLen]
+	if string(name) != s.protocol || subtle.ConstantTimeCompare(data, s.fakeCookie) != 1 {
+		return 0, ErrX11AuthMismatch
+	}
+	copy(data, s.realCookie)
+	s.done = true
+	setup := s.setup
+	s.setup = nil
+	if _, err := s.ReadWriteCloser.Write(setup); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// pad4 rounds n up to the next multiple of four.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+var (
+	// ErrX11InvalidSetup is returned when a X11 client sends a malformed connection setup.
+	ErrX11InvalidSetup = errors.New("x11: invalid connection setup")
+	// ErrX11AuthMismatch is returned when a X11 client does not use the cookie of the forwarding.
+	ErrX11AuthMismatch = errors.New("x11: authentication data does not match")
+)
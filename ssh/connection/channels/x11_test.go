@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package channels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX11CookieSpoofer(t *testing.T) {
+	realCookie := bytes.Repeat([]byte{0xaa}, 16)
+	fakeCookie := bytes.Repeat([]byte{0xbb}, 16)
+	otherCookie := bytes.Repeat([]byte{0xcc}, 16)
+
+	testCases := map[string]struct {
+		setup      []byte
+		chunkSize  int
+		expectErr  error
+		expectData []byte
+	}{
+		"little endian": {
+			setup:      x11Setup(binary.LittleEndian, 'l', x11AuthProtocol, fakeCookie),
+			expectData: x11Setup(binary.LittleEndian, 'l', x11AuthProtocol, realCookie),
+		},
+		"big endian": {
+			setup:      x11Setup(binary.BigEndian, 'B', x11AuthProtocol, fakeCookie),
+			expectData: x11Setup(binary.BigEndian, 'B', x11AuthProtocol, realCookie),
+		},
+		"setup in small chunks": {
+			setup:      x11Setup(binary.LittleEndian, 'l', x11AuthProtocol, fakeCookie),
+			chunkSize:  5,
+			expectData: x11Setup(binary.LittleEndian, 'l', x11AuthProtocol, realCookie),
+		},
+		"wrong cookie": {
+			setup:     x11Setup(binary.LittleEndian, 'l', x11AuthProtocol, otherCookie),
+			expectErr: ErrX11AuthMismatch,
+		},
+		"wrong protocol": {
+			setup:     x11Setup(binary.LittleEndian, 'l', "XDM-AUTHORIZATION-1", fakeCookie),
+			expectErr: ErrX11AuthMismatch,
+		},
+		"invalid byte order": {
+			setup:     x11Setup(binary.LittleEndian, 'x', x11AuthProtocol, fakeCookie),
+			expectErr: ErrX11InvalidSetup,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			channel := &recordingChannel{}
+			spoofer := &x11CookieSpoofer{
+				ReadWriteCloser: channel,
+				protocol:        x11AuthProtocol,
+				fakeCookie:      fakeCookie,
+				realCookie:      realCookie,
+			}
+			chunkSize := tc.chunkSize
+			if chunkSize == 0 {
+				chunkSize = len(tc.setup)
+			}
+			var err error
+			for i := 0; i < len(tc.setup) && err == nil; i += chunkSize {
+				_, err = spoofer.Write(tc.setup[i:min(i+chunkSize, len(tc.setup))])
+			}
+			if tc.expectErr != nil {
+				assert.ErrorIs(err, tc.expectErr)
+				assert.Empty(channel.written)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.expectData, channel.written)
+
+			_, err = spoofer.Write([]byte("payload"))
+			require.NoError(err)
+			assert.Equal(append(tc.expectData, []byte("payload")...), channel.written)
+		})
+	}
+}
+
+func TestXauthorityEntry(t *testing.T) {
+	entry := xauthorityEntry(10, x11AuthProtocol, []byte{0x01, 0x02})
+	expected := []byte{
+		0xff, 0xff, // family wild
+		0x00, 0x00, // empty address
+		0x00, 0x02, '1', '0', // display
+	}
+	expected = append(expected, 0x00, byte(len(x11AuthProtocol)))
+	expected = append(expected, []byte(x11AuthProtocol)...)
+	expected = append(expected, 0x00, 0x02, 0x01, 0x02)
+	assert.Equal(t, expected, entry)
+}
+
+// x11Setup creates a X11 connection setup message.
+func x11Setup(order binary.ByteOrder, orderByte byte, protocol string, cookie []byte) []byte {
+	setup := make([]byte, 12)
+	setup[0] = orderByte
+	order.PutUint16(setup[2:4], 11)
+	order.PutUint16(setup[6:8], uint16(len(protocol)))
+	order.PutUint16(setup[8:10], uint16(len(cookie)))
+	setup = append(setup, []byte(protocol)...)
+	setup = append(setup, make([]byte, pad4(len(protocol))-len(protocol))...)
+	setup = append(setup, cookie...)
+	return append(setup, make([]byte, pad4(len(cookie))-len(cookie))...)
+}
+
+// recordingChannel records all data written to it.
+type recordingChannel struct {
+	io.ReadCloser
+	written []byte
+}
+
+func (c *recordingChannel) Write(data []byte) (int, error) {
+	c.written = append(c.written, data...)
+	return len(data), nil
+}
@@ -6,13 +6,19 @@ package connection
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/audit"
 	"github.com/benschlueter/delegatio/ssh/connection/channels"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
@@ -20,16 +26,38 @@ import (
 
 // Handler is the connection handler. It handles the global connection and the channels.
 type Handler struct {
-	log                   *zap.Logger
-	wg                    *sync.WaitGroup
-	connection            *ssh.ServerConn
-	globalRequests        <-chan *ssh.Request
-	channel               <-chan ssh.NewChannel
-	maxKeepAliveRetries   int
-	keepAliveInterval     time.Duration
-	newDirectTCPIPHandler func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen) (channels.Channel, error)
-	newSessionHandler     func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error)
-	writeFileToContainer  func(context.Context, *ssh.ServerConn, kubernetes.K8sAPIUser) error
+	log                 *zap.Logger
+	wg                  *sync.WaitGroup
+	connection          *ssh.ServerConn
+	globalRequests      <-chan *ssh.Request
+	channel             <-chan ssh.NewChannel
+	maxKeepAliveRetries int
+	keepAliveInterval   time.Duration
+	// idleTimeout closes the connection without channel data for the duration, it is disabled if it is not positive.
+	idleTimeout time.Duration
+	// maxDuration closes the connection after the duration, it is disabled if it is not positive.
+	maxDuration time.Duration
+	// timeoutWarning is the time before a timeout at which the user is warned.
+	timeoutWarning time.Duration
+	// lastActivity is the time of the last channel data in unix nanoseconds.
+	lastActivity atomic.Int64
+	// maxSessions limits the concurrent session channels, it is disabled if it is not positive.
+	maxSessions int
+	// hostKeys are advertised to the client, they include the next keys of ongoing rotations.
+	hostKeys []ssh.Signer
+	// channelTypes are the enabled channel types, all types are enabled if it is nil.
+	channelTypes          map[string]bool
+	newDirectTCPIPHandler func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen, forward.Target) (channels.Channel, error)
+	// resolveForwardTarget resolves the destination of direct-tcpip channels, it returns a *forward.DeniedError for denied destinations.
+	resolveForwardTarget func(context.Context, *payload.ForwardTCPChannelOpen) (forward.Target, error)
+	newSessionHandler    func(*zap.Logger, ssh.Conn, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error)
+	writeFileToContainer func(context.Context, *ssh.ServerConn, kubernetes.K8sAPIUser) error
+	// auditLogger is nil if channels are not audited.
+	auditLogger *audit.Logger
+	// sessions are the open session channels, messages are broadcast to them.
+	sessions     map[ssh.Channel]struct{}
+	sessionCount int
+	sessionMux   sync.Mutex
 	// Also needed by channel handlers
 	kubernetes.K8sAPIUser
 }
@@ -49,20 +77,26 @@ func (c *Handler) HandleGlobalConnection(ctx context.Context) {
 	ctx, closeAndWaitForKeepAlive := c.keepAlive(ctx, c.connection, make(chan struct{}))
 	defer closeAndWaitForKeepAlive()
 
-	// Discard all global out-of-band Requests.
+	// Discard all global out-of-band Requests, except the proofs of the host keys.
 	closeAndWaitForHandleGlobalRequests := c.handleGlobalRequests(ctx, make(chan struct{}))
 	defer closeAndWaitForHandleGlobalRequests()
+	c.advertiseHostKeys()
+
+	// watchTimeouts cancels the ctx if the connection is idle or exceeds its maximum duration.
+	ctx, closeAndWaitForWatchTimeouts := c.watchTimeouts(ctx, make(chan struct{}))
+	defer closeAndWaitForWatchTimeouts()
 
 	c.log.Info("waiting for ressources to be ready")
 	// Check that all kubernetes ressources are ready and usable for future use.
 	if err := c.CreateAndWaitForRessources(ctx, &config.KubeRessourceIdentifier{
 		Namespace:      c.GetNamespace(),
-		UserIdentifier: c.GetAuthenticatedUserID(),
+		UserIdentifier: c.GetWorkspaceID(),
 		NodeName:       c.GetNodeName(),
 	}); err != nil {
 		c.log.Error("creating/waiting for kubernetes ressources",
 			zap.Error(err),
 			zap.String("userID", c.GetAuthenticatedUserID()),
+			zap.String("workspace", c.GetWorkspaceID()),
 			zap.String("challenge", c.connection.User()),
 		)
 		return
@@ -107,6 +141,13 @@ func (c *Handler) handleChannels(ctx context.Context) {
 
 func (c *Handler) handleChannel(ctx context.Context, newChannel ssh.NewChannel) {
 	defer c.wg.Done()
+	if c.channelTypes != nil && !c.channelTypes[newChannel.ChannelType()] {
+		c.log.Info("channel type is disabled", zap.String("type", newChannel.ChannelType()))
+		if err := newChannel.Reject(ssh.Prohibited, fmt.Sprintf("channel type %s is disabled", newChannel.ChannelType())); err != nil {
+			c.log.Error("failed to reject channel", zap.Error(err))
+		}
+		return
+	}
 	// Currently unsupported channel types: "x11", and "forwarded-tcpip".
 	switch newChannel.ChannelType() {
 	case "session":
@@ -126,13 +167,25 @@ func (c *Handler) handleChannel(ctx context.Context, newChannel ssh.NewChannel)
 // or the ctx is cancelled.
 func (c *Handler) handleChannelTypeSession(ctx context.Context, newChannel ssh.NewChannel) {
 	c.log.Debug("handling new session channel request")
+	if !c.reserveSession() {
+		c.log.Info("session limit reached", zap.Int("maxSessions", c.maxSessions))
+		if err := newChannel.Reject(ssh.ResourceShortage, fmt.Sprintf("at most %d sessions are allowed per connection", c.maxSessions)); err != nil {
+			c.log.Error("failed to reject channel", zap.Error(err))
+		}
+		return
+	}
+	defer c.releaseSession()
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		c.log.Error("could not accept the channel", zap.Error(err))
 		return
 	}
+	channel = c.trackActivity(channel)
+	c.addSession(channel)
+	defer c.removeSession(channel)
+	channel, auditChannelEnd := c.auditChannel(channel, newChannel.ChannelType(), "")
 
-	handler, err := c.newSessionHandler(c.log, channel, requests, c.K8sAPIUser)
+	handler, err := c.newSessionHandler(c.log, c.connection, channel, requests, c.K8sAPIUser)
 	if err != nil {
 		c.log.Error("could not create session handler", zap.Error(err))
 		return
@@ -140,6 +193,7 @@ func (c *Handler) handleChannelTypeSession(ctx context.Context, newChannel ssh.N
 	c.log.Debug("starting session handler goroutine")
 	go handler.Serve(ctx)
 	handler.Wait()
+	auditChannelEnd()
 }
 
 // handleChannelTypeDirectTCPIP handles the DirectTCPIP request from the client. We get a channel and should connect it to the
@@ -158,12 +212,29 @@ func (c *Handler) handleChannelTypeDirectTCPIP(ctx context.Context, newChannel s
 		return
 	}
 	c.log.Debug("payload unmarshal successful", zap.Any("payload", tcpipData))
+	destination := net.JoinHostPort(tcpipData.HostToConnect, strconv.FormatUint(uint64(tcpipData.PortToConnect), 10))
+	target, err := c.resolveForwardTarget(ctx, &tcpipData)
+	if err != nil {
+		c.log.Info("direct-tcpip destination rejected", zap.String("destination", destination), zap.Error(err))
+		c.auditDeniedForward(newChannel.ChannelType(), destination, err)
+		reason, message := ssh.ConnectionFailed, "could not resolve the destination"
+		var deniedErr *forward.DeniedError
+		if errors.As(err, &deniedErr) {
+			reason, message = ssh.Prohibited, deniedErr.Reason
+		}
+		if err := newChannel.Reject(reason, message); err != nil {
+			c.log.Error("failed to reject channel", zap.Error(err))
+		}
+		return
+	}
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		c.log.Error("could not accept the channel", zap.Error(err))
 		return
 	}
-	handler, err := c.newDirectTCPIPHandler(c.log, channel, requests, c.K8sAPIUser, &tcpipData)
+	channel = c.trackActivity(channel)
+	channel, auditChannelEnd := c.auditChannel(channel, newChannel.ChannelType(), destination)
+	handler, err := c.newDirectTCPIPHandler(c.log, channel, requests, c.K8sAPIUser, &tcpipData, target)
 	if err != nil {
 		c.log.Error("could not create directtcpip handler", zap.Error(err))
 		return
@@ -171,6 +242,94 @@ func (c *Handler) handleChannelTypeDirectTCPIP(ctx context.Context, newChannel s
 	c.log.Debug("starting directtcpip handler goroutine")
 	go handler.Serve(ctx)
 	handler.Wait()
+	auditChannelEnd()
+}
+
+// Broadcast writes the message to the stderr stream of all open sessions.
+func (c *Handler) Broadcast(message string) {
+	c.sessionMux.Lock()
+	defer c.sessionMux.Unlock()
+	for channel := range c.sessions {
+		if _, err := channel.Stderr().Write([]byte("\r\n" + message + "\r\n")); err != nil {
+			c.log.Debug("failed to broadcast message", zap.Error(err))
+		}
+	}
+}
+
+// reserveSession counts a new session, it returns false if the session limit is reached.
+func (c *Handler) reserveSession() bool {
+	c.sessionMux.Lock()
+	defer c.sessionMux.Unlock()
+	if c.maxSessions > 0 && c.sessionCount >= c.maxSessions {
+		return false
+	}
+	c.sessionCount++
+	return true
+}
+
+func (c *Handler) releaseSession() {
+	c.sessionMux.Lock()
+	defer c.sessionMux.Unlock()
+	c.sessionCount--
+}
+
+func (c *Handler) addSession(channel ssh.Channel) {
+	c.sessionMux.Lock()
+	defer c.sessionMux.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[ssh.Channel]struct{})
+	}
+	c.sessions[channel] = struct{}{}
+}
+
+func (c *Handler) removeSession(channel ssh.Channel) {
+	c.sessionMux.Lock()
+	defer c.sessionMux.Unlock()
+	delete(c.sessions, channel)
+}
+
+// auditChannel counts the bytes transferred over the channel. The returned function writes the "channel.end" audit event.
+// Port forwards, identified by a destination, are audited when they are opened as well.
+func (c *Handler) auditChannel(channel ssh.Channel, channelType, destination string) (ssh.Channel, func()) {
+	if c.auditLogger == nil {
+		return channel, func() {}
+	}
+	start := time.Now()
+	counter := audit.NewCountingChannel(channel)
+	if destination != "" {
+		event := c.auditEvent(audit.EventPortForward)
+		event.Channel = channelType
+		event.Destination = destination
+		c.auditLogger.Log(event)
+	}
+	return counter, func() {
+		event := c.auditEvent(audit.EventChannelEnd)
+		event.Channel = channelType
+		event.Destination = destination
+		event.BytesFromClient, event.BytesToClient = counter.Transferred()
+		event.Duration = time.Since(start).Seconds()
+		c.auditLogger.Log(event)
+	}
+}
+
+// auditDeniedForward writes a rejected port forward to the audit log.
+func (c *Handler) auditDeniedForward(channelType, destination string, err error) {
+	if c.auditLogger == nil {
+		return
+	}
+	event := c.auditEvent(audit.EventPortForward)
+	event.Channel = channelType
+	event.Destination = destination
+	event.Accepted = audit.Bool(false)
+	event.Error = err.Error()
+	c.auditLogger.Log(event)
+}
+
+// auditEvent returns an audit event identifying the connection and the user.
+func (c *Handler) auditEvent(eventType string) audit.Event {
+	event := audit.ConnectionEvent(eventType, c.connection)
+	event.UUID = c.GetAuthenticatedUserID()
+	return event
 }
 
 // keepAlive sends keep alive requests to the client, if the client is not respong 4 times, deallocate all server ressources.
@@ -212,6 +371,119 @@ func (c *Handler) keepAlive(ctx context.Context, sshConn *ssh.ServerConn, done c
 	}
 }
 
+// trackActivity records the time of the data transferred over the channel for the idle timeout.
+func (c *Handler) trackActivity(channel ssh.Channel) ssh.Channel {
+	c.touch()
+	return &activityChannel{Channel: channel, touch: c.touch}
+}
+
+func (c *Handler) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// watchTimeouts cancels the returned context if no channel data was transferred within the idle timeout, or if the
+// connection exceeds its maximum duration. The sessions are warned before and the reason is written to the audit log.
+func (c *Handler) watchTimeouts(ctx context.Context, done chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if c.idleTimeout <= 0 && c.maxDuration <= 0 {
+		return ctx, cancel
+	}
+	start := time.Now()
+	c.touch()
+	go func() {
+		t := time.NewTicker(c.timeoutInterval())
+		defer func() {
+			t.Stop()
+			done <- struct{}{}
+		}()
+		// warned is the deadline the sessions were warned about, the idle deadline moves with every activity.
+		var warned time.Time
+		for {
+			select {
+			case now := <-t.C:
+				deadline, reason := c.deadline(start)
+				if !now.Before(deadline) {
+					c.log.Info("session timeout reached; closing connection", zap.String("reason", reason))
+					c.Broadcast(fmt.Sprintf("Closing the connection: %s reached.", reason))
+					c.auditTimeout(reason)
+					cancel()
+					return
+				}
+				if !deadline.Equal(warned) && !now.Before(deadline.Add(-c.timeoutWarning)) {
+					warned = deadline
+					c.Broadcast(fmt.Sprintf("The connection is closed in %s: %s.", deadline.Sub(now).Round(time.Second), reason))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		<-done
+	}
+}
+
+// deadline returns the earliest timeout of the connection and its reason.
+func (c *Handler) deadline(start time.Time) (time.Time, string) {
+	var deadline time.Time
+	var reason string
+	if c.idleTimeout > 0 {
+		deadline = time.Unix(0, c.lastActivity.Load()).Add(c.idleTimeout)
+		reason = "idle timeout"
+	}
+	if c.maxDuration > 0 {
+		if maxDeadline := start.Add(c.maxDuration); deadline.IsZero() || maxDeadline.Before(deadline) {
+			deadline = maxDeadline
+			reason = "maximum session duration"
+		}
+	}
+	return deadline, reason
+}
+
+// timeoutInterval returns the interval in which the timeouts are checked.
+func (c *Handler) timeoutInterval() time.Duration {
+	interval := 10 * time.Second
+	for _, timeout := range []time.Duration{c.idleTimeout, c.maxDuration, c.timeoutWarning} {
+		if timeout > 0 {
+			interval = min(interval, timeout/4)
+		}
+	}
+	return max(interval, time.Millisecond)
+}
+
+// auditTimeout writes the reason a connection is closed to the audit log.
+func (c *Handler) auditTimeout(reason string) {
+	if c.auditLogger == nil {
+		return
+	}
+	event := c.auditEvent(audit.EventSessionTimeout)
+	event.Reason = reason
+	c.auditLogger.Log(event)
+}
+
+// activityChannel calls touch whenever data is read from or written to the channel.
+type activityChannel struct {
+	ssh.Channel
+	touch func()
+}
+
+func (a *activityChannel) Read(p []byte) (int, error) {
+	n, err := a.Channel.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+func (a *activityChannel) Write(p []byte) (int, error) {
+	n, err := a.Channel.Write(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
 func (c *Handler) handleGlobalRequests(ctx context.Context, done chan struct{}) context.CancelFunc {
 	ctx, cancel := context.WithCancel(ctx)
 	c.log.Debug("starting handleGlobalRequests")
@@ -226,6 +498,10 @@ func (c *Handler) handleGlobalRequests(ctx context.Context, done chan struct{})
 					c.log.Debug("handleGlobalRequests stopped by closed chan")
 					return
 				}
+				if req.Type == hostKeysProveRequest {
+					c.proveHostKeys(req)
+					continue
+				}
 				if req.WantReply {
 					if err := req.Reply(false, nil); err != nil {
 						c.log.Error("failed to reply to request", zap.Error(err))
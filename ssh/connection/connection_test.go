@@ -5,8 +5,10 @@
 package connection
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -15,6 +17,7 @@ import (
 	"github.com/benschlueter/delegatio/internal/config"
 	"github.com/benschlueter/delegatio/ssh/connection/channels"
 	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"github.com/benschlueter/delegatio/ssh/forward"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
@@ -29,8 +32,10 @@ func TestHandleChannel(t *testing.T) {
 	testCases := map[string]struct {
 		channel                ssh.NewChannel
 		expectFinish           bool
-		sessionHandlerFunc     func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error)
-		directtcpIPHandlerFunc func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen) (channels.Channel, error)
+		sessionHandlerFunc     func(*zap.Logger, ssh.Conn, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error)
+		directtcpIPHandlerFunc func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen, forward.Target) (channels.Channel, error)
+		resolveFunc            func(context.Context, *payload.ForwardTCPChannelOpen) (forward.Target, error)
+		expectReason           ssh.RejectionReason
 		logMessages            []string
 		nonLogMessages         []string
 	}{
@@ -49,7 +54,7 @@ func TestHandleChannel(t *testing.T) {
 				channelType: "session",
 			},
 			expectFinish: true,
-			sessionHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error) {
+			sessionHandlerFunc: func(*zap.Logger, ssh.Conn, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error) {
 				return nil, testErr
 			},
 			logMessages: []string{
@@ -61,7 +66,7 @@ func TestHandleChannel(t *testing.T) {
 				channelType: "session",
 			},
 			expectFinish: false,
-			sessionHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error) {
+			sessionHandlerFunc: func(*zap.Logger, ssh.Conn, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser) (channels.Channel, error) {
 				return &stubHandler{done: make(chan struct{})}, nil
 			},
 			nonLogMessages: []string{
@@ -134,7 +139,7 @@ func TestHandleChannel(t *testing.T) {
 				channelType: "direct-tcpip",
 				data:        ssh.Marshal(payload.ForwardTCPChannelOpen{}),
 			},
-			directtcpIPHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen) (channels.Channel, error) {
+			directtcpIPHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen, forward.Target) (channels.Channel, error) {
 				return nil, testErr
 			},
 			expectFinish: true,
@@ -147,12 +152,47 @@ func TestHandleChannel(t *testing.T) {
 				"could not accept the channel",
 			},
 		},
+		"direct-tcpip destination denied": {
+			channel: &stubNewChannel{
+				channelType: "direct-tcpip",
+				data:        ssh.Marshal(payload.ForwardTCPChannelOpen{HostToConnect: "mallory", PortToConnect: 22}),
+			},
+			resolveFunc: func(context.Context, *payload.ForwardTCPChannelOpen) (forward.Target, error) {
+				return forward.Target{}, &forward.DeniedError{Reason: "destination mallory is not allowed"}
+			},
+			expectFinish: true,
+			expectReason: ssh.Prohibited,
+			logMessages: []string{
+				"direct-tcpip destination rejected",
+			},
+			nonLogMessages: []string{
+				"could not accept the channel",
+				"starting directtcpip handler goroutine",
+			},
+		},
+		"direct-tcpip destination error": {
+			channel: &stubNewChannel{
+				channelType: "direct-tcpip",
+				data:        ssh.Marshal(payload.ForwardTCPChannelOpen{HostToConnect: "bob", PortToConnect: 22}),
+			},
+			resolveFunc: func(context.Context, *payload.ForwardTCPChannelOpen) (forward.Target, error) {
+				return forward.Target{}, testErr
+			},
+			expectFinish: true,
+			expectReason: ssh.ConnectionFailed,
+			logMessages: []string{
+				"direct-tcpip destination rejected",
+			},
+			nonLogMessages: []string{
+				"starting directtcpip handler goroutine",
+			},
+		},
 		"direct-tcpip closed by ctx": {
 			channel: &stubNewChannel{
 				channelType: "direct-tcpip",
 				data:        ssh.Marshal(payload.ForwardTCPChannelOpen{}),
 			},
-			directtcpIPHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen) (channels.Channel, error) {
+			directtcpIPHandlerFunc: func(*zap.Logger, ssh.Channel, <-chan *ssh.Request, kubernetes.K8sAPIUser, *payload.ForwardTCPChannelOpen, forward.Target) (channels.Channel, error) {
 				return &stubHandler{done: make(chan struct{})}, nil
 			},
 			expectFinish: false,
@@ -174,10 +214,17 @@ func TestHandleChannel(t *testing.T) {
 			observedZapCore, observedLogs := observer.New(zap.DebugLevel)
 			observedLogger := zap.New(observedZapCore)
 
+			resolveFunc := tc.resolveFunc
+			if resolveFunc == nil {
+				resolveFunc = func(context.Context, *payload.ForwardTCPChannelOpen) (forward.Target, error) {
+					return forward.Target{}, nil
+				}
+			}
 			handler := Handler{
 				log:                   observedLogger,
 				newSessionHandler:     tc.sessionHandlerFunc,
 				newDirectTCPIPHandler: tc.directtcpIPHandlerFunc,
+				resolveForwardTarget:  resolveFunc,
 				wg:                    &sync.WaitGroup{},
 				writeFileToContainer:  func(context.Context, *ssh.ServerConn, kubernetes.K8sAPIUser) error { return nil },
 			}
@@ -190,6 +237,9 @@ func TestHandleChannel(t *testing.T) {
 				cancel()
 			}
 			handler.wg.Wait()
+			if tc.expectReason != 0 {
+				assert.Equal(tc.expectReason, tc.channel.(*stubNewChannel).rejectReason)
+			}
 			for _, v := range tc.logMessages {
 				logs := observedLogs.FilterMessage(v).TakeAll()
 				assert.GreaterOrEqual(len(logs), 1)
@@ -506,6 +556,142 @@ func TestGlobalRequests(t *testing.T) {
 	}
 }
 
+func TestBroadcast(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := Handler{log: zap.NewNop()}
+	first := &stubStderrChannel{}
+	second := &stubStderrChannel{}
+	handler.addSession(first)
+	handler.addSession(second)
+	handler.Broadcast("restarting")
+	handler.removeSession(second)
+	handler.Broadcast("closing")
+
+	assert.Equal("\r\nrestarting\r\n\r\nclosing\r\n", first.stderr.String())
+	assert.Equal("\r\nrestarting\r\n", second.stderr.String())
+}
+
+func TestChannelLimits(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		channelTypes map[string]bool
+		maxSessions  int
+		openSessions int
+		channel      *stubNewChannel
+		expectReason ssh.RejectionReason
+	}{
+		"disabled channel type": {
+			channelTypes: map[string]bool{"session": true},
+			channel:      &stubNewChannel{channelType: "direct-tcpip"},
+			expectReason: ssh.Prohibited,
+		},
+		"session limit reached": {
+			maxSessions:  2,
+			openSessions: 2,
+			channel:      &stubNewChannel{channelType: "session"},
+			expectReason: ssh.ResourceShortage,
+		},
+		"session below limit": {
+			channelTypes: map[string]bool{"session": true},
+			maxSessions:  2,
+			openSessions: 1,
+			channel:      &stubNewChannel{channelType: "session", acceptErr: errors.New("accept failed")},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			handler := Handler{
+				log:          zap.NewNop(),
+				wg:           &sync.WaitGroup{},
+				channelTypes: tc.channelTypes,
+				maxSessions:  tc.maxSessions,
+			}
+			for i := 0; i < tc.openSessions; i++ {
+				assert.True(handler.reserveSession())
+			}
+			handler.wg.Add(1)
+			handler.handleChannel(context.Background(), tc.channel)
+			assert.Equal(tc.expectReason, tc.channel.rejectReason)
+			assert.Equal(tc.openSessions, handler.sessionCount)
+		})
+	}
+}
+
+func TestWatchTimeouts(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testCases := map[string]struct {
+		idleTimeout   time.Duration
+		maxDuration   time.Duration
+		warning       time.Duration
+		expectClose   bool
+		expectMessage []string
+	}{
+		"idle timeout": {
+			idleTimeout:   20 * time.Millisecond,
+			expectClose:   true,
+			expectMessage: []string{"idle timeout reached"},
+		},
+		"maximum session duration": {
+			idleTimeout:   time.Hour,
+			maxDuration:   40 * time.Millisecond,
+			warning:       30 * time.Millisecond,
+			expectClose:   true,
+			expectMessage: []string{"The connection is closed in", "maximum session duration reached"},
+		},
+		"disabled": {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			handler := Handler{
+				log:            zap.NewNop(),
+				idleTimeout:    tc.idleTimeout,
+				maxDuration:    tc.maxDuration,
+				timeoutWarning: tc.warning,
+				sessions:       make(map[ssh.Channel]struct{}),
+			}
+			session := &stubStderrChannel{}
+			handler.addSession(session)
+			ctx, closeAndWait := handler.watchTimeouts(context.Background(), make(chan struct{}))
+			channel := handler.trackActivity(session)
+			_, err := channel.Write([]byte("activity"))
+			assert.NoError(err)
+			if tc.expectClose {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+					assert.Fail("connection was not closed")
+				}
+			} else {
+				assert.NoError(ctx.Err())
+			}
+			closeAndWait()
+			for _, message := range tc.expectMessage {
+				assert.Contains(session.stderr.String(), message)
+			}
+		})
+	}
+}
+
+type stubStderrChannel struct {
+	ssh.Channel
+	stderr bytes.Buffer
+}
+
+func (c *stubStderrChannel) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *stubStderrChannel) Stderr() io.ReadWriter {
+	return &c.stderr
+}
+
 type stubConn struct {
 	sendRequestErr error
 	openChannelErr error
@@ -554,17 +740,19 @@ func (c *stubConn) LocalAddr() net.Addr {
 }
 
 type stubNewChannel struct {
-	acceptErr   error
-	rejectErr   error
-	channelType string
-	data        []byte
+	acceptErr    error
+	rejectErr    error
+	channelType  string
+	data         []byte
+	rejectReason ssh.RejectionReason
 }
 
 func (s *stubNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
 	return nil, nil, s.acceptErr
 }
 
-func (s *stubNewChannel) Reject(_ ssh.RejectionReason, _ string) error {
+func (s *stubNewChannel) Reject(reason ssh.RejectionReason, _ string) error {
+	s.rejectReason = reason
 	return s.rejectErr
 }
 
@@ -594,6 +782,8 @@ type stubK8sAPIWrapper struct {
 	ExecuteCommandInPodErr        error
 	CreatePodPortForwardErr       error
 	WriteFileInPodErr             error
+	CreateSocketForwardInPodErr   error
+	ServeSFTPInPodErr             error
 }
 
 func (k *stubK8sAPIWrapper) CreateAndWaitForRessources(_ context.Context, _ *config.KubeRessourceIdentifier) error {
@@ -611,3 +801,11 @@ func (k *stubK8sAPIWrapper) CreatePodPortForward(_ context.Context, _ *config.Ku
 func (k *stubK8sAPIWrapper) WriteFileInPod(_ context.Context, _ *config.KubeFileWriteConfig) error {
 	return k.WriteFileInPodErr
 }
+
+func (k *stubK8sAPIWrapper) CreateSocketForwardInPod(_ context.Context, _ *config.KubeSocketForwardConfig) error {
+	return k.CreateSocketForwardInPodErr
+}
+
+func (k *stubK8sAPIWrapper) ServeSFTPInPod(_ context.Context, _ *config.KubeSFTPConfig) error {
+	return k.ServeSFTPInPodErr
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package connection
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// hostKeysRequest advertises all host keys of the server, clients with UpdateHostKeys learn the new keys.
+	hostKeysRequest = "hostkeys-00@openssh.com"
+	// hostKeysProveRequest asks the server to prove the possession of the private keys of the advertised keys.
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// advertiseHostKeys sends the host keys to the client. The request does not want a reply.
+func (c *Handler) advertiseHostKeys() {
+	if len(c.hostKeys) == 0 {
+		return
+	}
+	if _, _, err := c.connection.SendRequest(hostKeysRequest, false, hostKeysPayload(c.hostKeys)); err != nil {
+		c.log.Info("failed to advertise host keys", zap.Error(err))
+	}
+}
+
+// proveHostKeys replies with a signature of each requested host key.
+func (c *Handler) proveHostKeys(req *ssh.Request) {
+	proof, err := hostKeysProof(c.connection.SessionID(), c.hostKeys, req.Payload)
+	if err != nil {
+		c.log.Info("failed to prove host keys", zap.Error(err))
+	}
+	if !req.WantReply {
+		return
+	}
+	if err := req.Reply(err == nil, proof); err != nil {
+		c.log.Error("failed to reply to request", zap.Error(err))
+	}
+}
+
+// hostKeysPayload encodes the public keys as a sequence of strings.
+func hostKeysPayload(hostKeys []ssh.Signer) []byte {
+	var payload []byte
+	for _, hostKey := range hostKeys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{hostKey.PublicKey().Marshal()})...)
+	}
+	return payload
+}
+
+// hostKeysProof signs each public key of the payload with the private key of the matching host key.
+// The signed data is the request name, the session identifier and the public key, as defined in OpenSSH's PROTOCOL.
+func hostKeysProof(sessionID []byte, hostKeys []ssh.Signer, payload []byte) ([]byte, error) {
+	var proof []byte
+	for len(payload) > 0 {
+		var key struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &key); err != nil {
+			return nil, fmt.Errorf("parsing requested host keys: %w", err)
+		}
+		payload = key.Rest
+		hostKey, err := findHostKey(hostKeys, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, key.Key})
+		signature, err := signHostKeyProof(hostKey, data)
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(signature)})...)
+	}
+	return proof, nil
+}
+
+// findHostKey returns the host key of the public key, clients must only request keys advertised by the server.
+func findHostKey(hostKeys []ssh.Signer, publicKey []byte) (ssh.Signer, error) {
+	for _, hostKey := range hostKeys {
+		if bytes.Equal(hostKey.PublicKey().Marshal(), publicKey) {
+			return hostKey, nil
+		}
+	}
+	return nil, errors.New("requested host key is not a host key of the server")
+}
+
+// signHostKeyProof signs RSA proofs with SHA-512, clients reject the SHA-1 signatures of ssh-rsa.
+func signHostKeyProof(hostKey ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if signer, ok := hostKey.(ssh.AlgorithmSigner); ok && hostKey.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return signer.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	}
+	return hostKey.Sign(rand.Reader, data)
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package connection
+
+import (
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/hostkey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeysProof(t *testing.T) {
+	sessionID := []byte("session")
+	current := testHostKey(t, hostkey.TypeECDSA)
+	next := testHostKey(t, hostkey.TypeEd25519)
+	unknown := testHostKey(t, hostkey.TypeEd25519)
+	hostKeys := []ssh.Signer{current, next}
+
+	testCases := map[string]struct {
+		requested []ssh.Signer
+		expectErr bool
+	}{
+		"all keys": {
+			requested: hostKeys,
+		},
+		"next key": {
+			requested: []ssh.Signer{next},
+		},
+		"unknown key": {
+			requested: []ssh.Signer{current, unknown},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			proof, err := hostKeysProof(sessionID, hostKeys, hostKeysPayload(tc.requested))
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			for _, requested := range tc.requested {
+				var signature struct {
+					Signature []byte
+					Rest      []byte `ssh:"rest"`
+				}
+				require.NoError(ssh.Unmarshal(proof, &signature))
+				proof = signature.Rest
+				var sig ssh.Signature
+				require.NoError(ssh.Unmarshal(signature.Signature, &sig))
+				data := ssh.Marshal(struct {
+					Request   string
+					SessionID []byte
+					Key       []byte
+				}{hostKeysProveRequest, sessionID, requested.PublicKey().Marshal()})
+				assert.NoError(requested.PublicKey().Verify(data, &sig))
+			}
+			assert.Empty(proof)
+		})
+	}
+}
+
+func TestHostKeysProofMalformed(t *testing.T) {
+	_, err := hostKeysProof([]byte("session"), nil, []byte{0, 0, 0, 9, 1})
+	assert.Error(t, err)
+}
+
+func testHostKey(t *testing.T, keyType string) ssh.Signer {
+	privateKey, err := hostkey.Generate(keyType)
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	require.NoError(t, err)
+	return signer
+}
@@ -35,3 +35,31 @@ type ForwardTCPChannelOpen struct {
 	OriginatorAddress string
 	OriginatorPort    uint32
 }
+
+// X11Request is the payload for a x11-req request.
+// RFC 4254 Section 6.3.1.
+type X11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// X11ChannelOpen is the payload for a x11 channel open request.
+// RFC 4254 Section 6.3.2.
+type X11ChannelOpen struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// ExecRequest is the payload for an exec request.
+// RFC 4254 Section 6.5.
+type ExecRequest struct {
+	Command string
+}
+
+// ExitStatusRequest is the payload for an exit-status request.
+// RFC 4254 Section 6.10.
+type ExitStatusRequest struct {
+	Status uint32
+}
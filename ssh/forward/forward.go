@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package forward resolves the destinations of direct-tcpip channels, which make the ssh server a jump host.
+// Users reach their workspace, their own container, the services shared by the users of their challenge and, if teams
+// are configured, the containers of their teammates. All other destinations are denied.
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+)
+
+// TeamHost is the host name of the team workspace in challenges with teams enabled.
+const TeamHost = "team"
+
+// Target is the resolved destination of a direct-tcpip channel.
+type Target struct {
+	// Namespace and PodName identify the container, the port is forwarded with the kubernetes API.
+	Namespace string
+	PodName   string
+	// Address is dialed by the ssh server instead, it is set for shared services.
+	Address string
+	Port    uint32
+}
+
+// String returns the destination of the target.
+func (t Target) String() string {
+	host := t.Address
+	if host == "" {
+		host = t.Namespace + "/" + t.PodName
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(t.Port), 10))
+}
+
+// DeniedError is returned for destinations the policy does not allow, the reason is sent to the client.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
+// TeammatesFunc returns the uuids of the teammates of the user in the challenge, their own containers are reachable.
+type TeammatesFunc func(ctx context.Context, challenge, uuid string) ([]string, error)
+
+// Policy decides which destinations are reachable.
+type Policy struct {
+	services  map[string][]serverconfig.ForwardService
+	teammates TeammatesFunc
+}
+
+// NewPolicy returns the policy of the configuration. Teammates are not reachable if teammates is nil.
+func NewPolicy(conf serverconfig.ForwardingConfig, teammates TeammatesFunc) *Policy {
+	return &Policy{services: conf.Services, teammates: teammates}
+}
+
+// PodName returns the name of the container of the user.
+func PodName(uuid string) string {
+	return fmt.Sprintf("%s-statefulset-0", uuid)
+}
+
+// Resolve returns the target of the host and port requested by the user in the challenge. Localhost is the container
+// of the workspace, which is shared by the team in challenges with teams enabled. There the team workspace is also
+// reachable as TeamHost, while the uuid of the user always names the own container of the user.
+// A *DeniedError is returned if the destination is not allowed.
+func (p *Policy) Resolve(ctx context.Context, challenge, uuid, workspace, host string, port uint32) (Target, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch host {
+	// clients forward to localhost to reach their workspace, e.g. ssh -L 8080:localhost:80.
+	case "", "localhost", "127.0.0.1", "::1":
+		return Target{Namespace: config.UserNamespace, PodName: PodName(workspace), Port: port}, nil
+	case uuid, PodName(uuid):
+		return Target{Namespace: config.UserNamespace, PodName: PodName(uuid), Port: port}, nil
+	}
+	if workspace != uuid && (host == TeamHost || host == workspace || host == PodName(workspace)) {
+		return Target{Namespace: config.UserNamespace, PodName: PodName(workspace), Port: port}, nil
+	}
+	for _, service := range p.services[challenge] {
+		if service.Name != host {
+			continue
+		}
+		if len(service.Ports) > 0 && !slices.Contains(service.Ports, port) {
+			return Target{}, &DeniedError{Reason: fmt.Sprintf("port %d of service %s is not reachable, allowed ports are %s", port, host, formatPorts(service.Ports))}
+		}
+		address := service.Address
+		if address == "" {
+			address = service.Name
+		}
+		return Target{Address: address, Port: port}, nil
+	}
+	if p.teammates != nil {
+		teammates, err := p.teammates(ctx, challenge, uuid)
+		if err != nil {
+			return Target{}, fmt.Errorf("getting teammates: %w", err)
+		}
+		for _, teammate := range teammates {
+			if host == teammate || host == PodName(teammate) {
+				return Target{Namespace: config.UserNamespace, PodName: PodName(teammate), Port: port}, nil
+			}
+		}
+	}
+	return Target{}, &DeniedError{Reason: p.deniedReason(challenge, host, workspace != uuid)}
+}
+
+// deniedReason lists the reachable destinations.
+func (p *Policy) deniedReason(challenge, host string, team bool) string {
+	reachable := "your workspace (localhost), your own container (your uuid)"
+	if team {
+		reachable += ", the workspace of your team (" + TeamHost + ")"
+	}
+	if p.teammates != nil {
+		reachable += ", the containers of your teammates (their uuid)"
+	}
+	if services := p.services[challenge]; len(services) > 0 {
+		names := make([]string, 0, len(services))
+		for _, service := range services {
+			names = append(names, service.Name)
+		}
+		reachable += fmt.Sprintf(" and the services of challenge %s (%s)", challenge, strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("destination %s is not allowed, reachable are %s", host, reachable)
+}
+
+func formatPorts(ports []uint32) string {
+	formatted := make([]string, 0, len(ports))
+	for _, port := range ports {
+		formatted = append(formatted, strconv.FormatUint(uint64(port), 10))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package forward
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestResolve(t *testing.T) {
+	conf := serverconfig.ForwardingConfig{
+		Services: map[string][]serverconfig.ForwardService{
+			"exam": {
+				{Name: "target", Address: "target.exam.svc.cluster.local", Ports: []uint32{80, 443}},
+				{Name: "db"},
+			},
+		},
+	}
+	teammates := func(_ context.Context, challenge, uuid string) ([]string, error) {
+		if challenge == "exam" && uuid == "alice" {
+			return []string{"bob"}, nil
+		}
+		return nil, nil
+	}
+	ownPod := Target{Namespace: config.UserNamespace, PodName: "alice-statefulset-0", Port: 8080}
+
+	testCases := map[string]struct {
+		teammates    TeammatesFunc
+		workspace    string
+		challenge    string
+		host         string
+		port         uint32
+		expectTarget Target
+		expectDenied bool
+		expectErr    bool
+	}{
+		"localhost": {
+			challenge:    "exam",
+			host:         "localhost",
+			port:         8080,
+			expectTarget: ownPod,
+		},
+		"own pod name": {
+			challenge:    "lab",
+			host:         "Alice-statefulset-0.",
+			port:         8080,
+			expectTarget: ownPod,
+		},
+		"own uuid": {
+			challenge:    "exam",
+			host:         "alice",
+			port:         8080,
+			expectTarget: ownPod,
+		},
+		"team workspace": {
+			workspace:    "team--red",
+			challenge:    "project",
+			host:         "localhost",
+			port:         8080,
+			expectTarget: Target{Namespace: config.UserNamespace, PodName: "team--red-statefulset-0", Port: 8080},
+		},
+		"team workspace by name": {
+			workspace:    "team--red",
+			challenge:    "project",
+			host:         "team",
+			port:         8080,
+			expectTarget: Target{Namespace: config.UserNamespace, PodName: "team--red-statefulset-0", Port: 8080},
+		},
+		"own uuid in team challenge": {
+			workspace:    "team--red",
+			challenge:    "project",
+			host:         "alice",
+			port:         8080,
+			expectTarget: ownPod,
+		},
+		"team without teams": {
+			challenge:    "exam",
+			host:         "team",
+			port:         8080,
+			expectDenied: true,
+		},
+		"shared service": {
+			challenge:    "exam",
+			host:         "target",
+			port:         443,
+			expectTarget: Target{Address: "target.exam.svc.cluster.local", Port: 443},
+		},
+		"shared service without address": {
+			challenge:    "exam",
+			host:         "db",
+			port:         5432,
+			expectTarget: Target{Address: "db", Port: 5432},
+		},
+		"shared service port not allowed": {
+			challenge:    "exam",
+			host:         "target",
+			port:         22,
+			expectDenied: true,
+		},
+		"service of other challenge": {
+			challenge:    "lab",
+			host:         "target",
+			port:         80,
+			expectDenied: true,
+		},
+		"teammate": {
+			teammates:    teammates,
+			challenge:    "exam",
+			host:         "bob",
+			port:         22,
+			expectTarget: Target{Namespace: config.UserNamespace, PodName: "bob-statefulset-0", Port: 22},
+		},
+		"teammate without teams": {
+			challenge:    "exam",
+			host:         "bob",
+			port:         22,
+			expectDenied: true,
+		},
+		"other user": {
+			teammates:    teammates,
+			challenge:    "exam",
+			host:         "mallory-statefulset-0",
+			port:         22,
+			expectDenied: true,
+		},
+		"teammates error": {
+			teammates: func(context.Context, string, string) ([]string, error) {
+				return nil, errors.New("store error")
+			},
+			challenge: "exam",
+			host:      "bob",
+			port:      22,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			workspace := tc.workspace
+			if workspace == "" {
+				workspace = "alice"
+			}
+			policy := NewPolicy(conf, tc.teammates)
+			target, err := policy.Resolve(context.Background(), tc.challenge, "alice", workspace, tc.host, tc.port)
+			var deniedErr *DeniedError
+			if tc.expectDenied {
+				assert.ErrorAs(err, &deniedErr)
+				assert.Contains(deniedErr.Reason, "is not")
+				return
+			}
+			if tc.expectErr {
+				assert.Error(err)
+				assert.False(errors.As(err, &deniedErr))
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expectTarget, target)
+		})
+	}
+}
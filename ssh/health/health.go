@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package health serves the liveness and readiness endpoints of the ssh server.
+// The server is unready until it listens for connections and while it drains, so the load balancer stops sending new connections.
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// LivenessPath always responds with 200 while the process is running.
+	LivenessPath = "/healthz"
+	// ReadinessPath responds with 200 if the server accepts new connections and 503 otherwise.
+	ReadinessPath = config.SSHReadinessPath
+)
+
+// Checker tracks the readiness of the ssh server.
+type Checker struct {
+	log   *zap.Logger
+	ready atomic.Bool
+}
+
+// NewChecker creates a Checker, the server is unready until SetReady is called.
+func NewChecker(logger *zap.Logger) *Checker {
+	return &Checker{log: logger}
+}
+
+// SetReady marks the server as ready or unready.
+func (c *Checker) SetReady(ready bool) {
+	if c.ready.Swap(ready) != ready {
+		c.log.Info("readiness changed", zap.Bool("ready", ready))
+	}
+}
+
+// Ready reports whether the server accepts new connections.
+func (c *Checker) Ready() bool {
+	return c.ready.Load()
+}
+
+// Handler returns the HTTP handler of the liveness and readiness endpoints.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, _ *http.Request) {
+		if !c.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready\n"))
+	})
+	return mux
+}
+
+// Serve serves the endpoints on the listener until the context is cancelled.
+func (c *Checker) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           c.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			c.log.Error("failed to shut down health server", zap.Error(err))
+		}
+	})
+	defer stop()
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package health
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestHandler(t *testing.T) {
+	testCases := map[string]struct {
+		ready        bool
+		path         string
+		expectStatus int
+	}{
+		"liveness while unready": {
+			path:         LivenessPath,
+			expectStatus: http.StatusOK,
+		},
+		"readiness while unready": {
+			path:         ReadinessPath,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+		"readiness while ready": {
+			ready:        true,
+			path:         ReadinessPath,
+			expectStatus: http.StatusOK,
+		},
+		"unknown path": {
+			ready:        true,
+			path:         "/metrics",
+			expectStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			checker := NewChecker(zap.NewNop())
+			checker.SetReady(tc.ready)
+			recorder := httptest.NewRecorder()
+			checker.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.expectStatus, recorder.Code)
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	checker := NewChecker(zap.NewNop())
+	checker.SetReady(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- checker.Serve(ctx, listener)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() int {
+		resp, err := client.Get("http://" + listener.Addr().String() + ReadinessPath)
+		require.NoError(err)
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	assert.Equal(http.StatusOK, get())
+	checker.SetReady(false)
+	assert.Equal(http.StatusServiceUnavailable, get())
+
+	cancel()
+	assert.NoError(<-done)
+}
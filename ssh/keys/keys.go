@@ -0,0 +1,181 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package keys lets users manage the public keys they log in with:
+//
+//	ssh keys@<gateway> list
+//	ssh keys@<gateway> add "$(cat ~/.ssh/id_ed25519.pub)"
+//	ssh keys@<gateway> remove SHA256:...
+//
+// Users logging in with a password name themselves after a plus, i.e. keys+<user>@<gateway>. The comment of an added
+// key is used as its label.
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/ssh/connection/payload"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const usage = `usage: ssh keys@<gateway> <command>, or keys+<user>@<gateway> to log in with a password
+
+commands:
+  list                        list your public keys
+  add <public key>            add a public key in authorized_keys format, the comment is the label
+  remove <fingerprint>        remove the public key with the SHA256 fingerprint
+`
+
+// ServeConnection handles a connection of the key management user. Every exec request runs one command, its output
+// is written to the channel.
+func ServeConnection(ctx context.Context, log *zap.Logger, data storewrapper.StoreWrapper, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	uuid := conn.Permissions.Extensions[config.AuthenticatedUserID]
+	authType := conn.Permissions.Extensions[config.AuthenticationType]
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case newChannel, ok := <-chans:
+			if !ok {
+				return
+			}
+			if newChannel.ChannelType() != "session" {
+				if err := newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported"); err != nil {
+					log.Error("failed to reject channel", zap.Error(err))
+				}
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				log.Error("could not accept the channel", zap.Error(err))
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer channel.Close()
+				serveChannel(log, data.WithContext(ctx), uuid, authType, channel, requests)
+			}()
+		}
+	}
+}
+
+// serveChannel runs the command of the first exec request of the channel.
+func serveChannel(log *zap.Logger, data storewrapper.StoreWrapper, uuid, authType string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		var execReq payload.ExecRequest
+		if err := ssh.Unmarshal(req.Payload, &execReq); err != nil {
+			log.Error("could not unmarshal exec payload", zap.Error(err))
+			_ = req.Reply(false, nil)
+			continue
+		}
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+		exitStatus := uint32(0)
+		if err := run(data, uuid, authType, execReq.Command, channel); err != nil {
+			log.Info("key management command failed", zap.String("uuid", uuid), zap.Error(err))
+			_, _ = fmt.Fprintf(channel.Stderr(), "%v\n", err)
+			exitStatus = 1
+		}
+		if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(payload.ExitStatusRequest{Status: exitStatus})); err != nil {
+			log.Error("failed to send exit status", zap.Error(err))
+		}
+		return
+	}
+}
+
+// run executes the command of the user.
+func run(data storewrapper.StoreWrapper, uuid, authType, command string, out io.Writer) error {
+	if uuid == "" {
+		return errors.New("no authenticated user")
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "list":
+		return list(data, uuid, out)
+	case "add":
+		// a stolen certificate must not be turned into a permanent key
+		if authType != "pk" && authType != "pw" {
+			return fmt.Errorf("authentication type %q may not add keys, log in with a password or a registered key", authType)
+		}
+		key, label, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(command), "add"))))
+		if err != nil {
+			return fmt.Errorf("parsing public key: %w", err)
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			return errors.New("certificates can not be added, request them with ssh certificate@<gateway>")
+		}
+		if err := data.AddPublicKey(uuid, key.Marshal(), label); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "added %s %s\n", ssh.FingerprintSHA256(key), label)
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("remove requires the fingerprint of the key")
+		}
+		if err := data.RemovePublicKey(uuid, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "removed %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// list writes the public keys of the user.
+func list(data storewrapper.StoreWrapper, uuid string, out io.Writer) error {
+	keys, err := data.GetPublicKeys(uuid)
+	if err != nil {
+		return err
+	}
+	return Write(out, keys)
+}
+
+// Write writes the public keys as table, the key of the user record is marked as primary.
+func Write(out io.Writer, keys []config.PublicKey) error {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "FINGERPRINT\tLABEL\tADDED\tLAST USED\tPRIMARY")
+	for _, key := range keys {
+		primary := ""
+		if key.Primary {
+			primary = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", key.Fingerprint, key.Label, formatTime(key.Added), formatTime(key.LastUsed), primary)
+	}
+	return writer.Flush()
+}
+
+// formatTime formats the time, unknown times are shown as "-".
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
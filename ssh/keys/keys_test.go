@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package keys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(public)
+	require.NoError(t, err)
+	return key
+}
+
+func TestRun(t *testing.T) {
+	primary, laptop := newPublicKey(t), newPublicKey(t)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(laptop))) + " my laptop"
+	testCases := map[string]struct {
+		uuid         string
+		authType     string
+		commands     []string
+		expectErr    bool
+		expectOutput []string
+		expectKeys   int
+	}{
+		"list": {
+			uuid:         "alice",
+			authType:     "pk",
+			commands:     []string{"list"},
+			expectOutput: []string{"FINGERPRINT", ssh.FingerprintSHA256(primary)},
+			expectKeys:   1,
+		},
+		"add": {
+			uuid:         "alice",
+			authType:     "pw",
+			commands:     []string{"add " + authorizedKey, "list"},
+			expectOutput: []string{"added " + ssh.FingerprintSHA256(laptop), "my laptop"},
+			expectKeys:   2,
+		},
+		"add with certificate": {
+			uuid:       "alice",
+			authType:   "cert",
+			commands:   []string{"add " + authorizedKey},
+			expectErr:  true,
+			expectKeys: 1,
+		},
+		"add invalid key": {
+			uuid:       "alice",
+			authType:   "pk",
+			commands:   []string{"add ssh-ed25519 invalid"},
+			expectErr:  true,
+			expectKeys: 1,
+		},
+		"remove": {
+			uuid:         "alice",
+			authType:     "pk",
+			commands:     []string{"add " + authorizedKey, "remove " + ssh.FingerprintSHA256(laptop)},
+			expectOutput: []string{"removed " + ssh.FingerprintSHA256(laptop)},
+			expectKeys:   1,
+		},
+		"remove without fingerprint": {
+			uuid:       "alice",
+			authType:   "pk",
+			commands:   []string{"remove"},
+			expectErr:  true,
+			expectKeys: 1,
+		},
+		"unknown command": {
+			uuid:       "alice",
+			authType:   "pk",
+			commands:   []string{"rename"},
+			expectErr:  true,
+			expectKeys: 1,
+		},
+		"no user": {
+			authType:   "pk",
+			commands:   []string{"list"},
+			expectErr:  true,
+			expectKeys: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := storewrapper.StoreWrapper{Store: store.NewStdStore()}
+			require.NoError(data.PutUser(config.UserInformation{UUID: "alice", PubKey: primary.Marshal()}))
+			var out bytes.Buffer
+			var err error
+			for _, command := range tc.commands {
+				if err = run(data, tc.uuid, tc.authType, command, &out); err != nil {
+					break
+				}
+			}
+			if tc.expectErr {
+				assert.Error(err)
+			} else {
+				require.NoError(err)
+			}
+			for _, expected := range tc.expectOutput {
+				assert.Contains(out.String(), expected)
+			}
+			keys, err := data.GetPublicKeys("alice")
+			require.NoError(err)
+			assert.Len(keys, tc.expectKeys)
+		})
+	}
+}
@@ -24,6 +24,8 @@ type K8sAPI interface {
 	ExecuteCommandInPod(context.Context, *config.KubeExecConfig) error
 	CreatePodPortForward(context.Context, *config.KubeForwardConfig) error
 	WriteFileInPod(ctx context.Context, conf *config.KubeFileWriteConfig) error
+	CreateSocketForwardInPod(context.Context, *config.KubeSocketForwardConfig) error
+	ServeSFTPInPod(context.Context, *config.KubeSFTPConfig) error
 }
 
 // K8sAPIWrapper is the struct used to access kubernetes helpers.
@@ -77,42 +79,58 @@ func (k *K8sAPIWrapper) CreateAndWaitForRessources(ctx context.Context, conf *co
 
 // ExecuteCommandInPod executes a command in the specified pod.
 func (k *K8sAPIWrapper) ExecuteCommandInPod(ctx context.Context, conf *config.KubeExecConfig) error {
-	service, err := k.Client.GetService(ctx, conf.Namespace, fmt.Sprintf("%s-service", conf.UserIdentifier))
+	endpoint, err := k.agentEndpoint(ctx, conf.Namespace, conf.UserIdentifier)
 	if err != nil {
-		k.logger.Error("failed to get service", zap.Error(err))
 		return err
 	}
-	k.logger.Info("cluster ip", zap.String("ip", service.Spec.ClusterIP))
+	return k.API.CreateExecInPodgRPC(ctx, endpoint, conf)
+}
 
-	pod, err := k.Client.GetPod(ctx, conf.Namespace, fmt.Sprintf("%s-statefulset-0", conf.UserIdentifier))
+// WriteFileInPod writes a file in the specified pod on a remote agent.
+func (k *K8sAPIWrapper) WriteFileInPod(ctx context.Context, conf *config.KubeFileWriteConfig) error {
+	endpoint, err := k.agentEndpoint(ctx, conf.Namespace, conf.UserIdentifier)
 	if err != nil {
-		k.logger.Error("failed to get pod", zap.Error(err))
 		return err
 	}
-	k.logger.Info("pod ip", zap.String("ip", pod.Status.PodIP))
-	// TODO: there is a race condition, where the pod is ready, but we can't connect to the endpoint yet.
-	// Probably should do a vmapi.dial until it succeeds here.
-	return k.API.CreateExecInPodgRPC(ctx, net.JoinHostPort(pod.Status.PodIP, fmt.Sprint(config.AgentPort)), conf)
+	return k.API.WriteFileInPodgRPC(ctx, endpoint, conf)
 }
 
-// WriteFileInPod writes a file in the specified pod on a remote agent.
-func (k *K8sAPIWrapper) WriteFileInPod(ctx context.Context, conf *config.KubeFileWriteConfig) error {
-	service, err := k.Client.GetService(ctx, conf.Namespace, fmt.Sprintf("%s-service", conf.UserIdentifier))
+// CreateSocketForwardInPod creates a socket in the specified pod and forwards its connections.
+func (k *K8sAPIWrapper) CreateSocketForwardInPod(ctx context.Context, conf *config.KubeSocketForwardConfig) error {
+	endpoint, err := k.agentEndpoint(ctx, conf.Namespace, conf.UserIdentifier)
 	if err != nil {
-		k.logger.Error("failed to get service", zap.Error(err))
 		return err
 	}
+	return k.API.CreateSocketForwardInPodgRPC(ctx, endpoint, conf)
+}
+
+// ServeSFTPInPod serves SFTP backed by the file system of the specified pod.
+func (k *K8sAPIWrapper) ServeSFTPInPod(ctx context.Context, conf *config.KubeSFTPConfig) error {
+	endpoint, err := k.agentEndpoint(ctx, conf.Namespace, conf.UserIdentifier)
+	if err != nil {
+		return err
+	}
+	return k.API.ServeSFTPInPodgRPC(ctx, endpoint, conf)
+}
+
+// agentEndpoint returns the address of the agent running in the pod of the user.
+func (k *K8sAPIWrapper) agentEndpoint(ctx context.Context, namespace, userIdentifier string) (string, error) {
+	service, err := k.Client.GetService(ctx, namespace, fmt.Sprintf("%s-service", userIdentifier))
+	if err != nil {
+		k.logger.Error("failed to get service", zap.Error(err))
+		return "", err
+	}
 	k.logger.Info("cluster ip", zap.String("ip", service.Spec.ClusterIP))
 
-	pod, err := k.Client.GetPod(ctx, conf.Namespace, fmt.Sprintf("%s-statefulset-0", conf.UserIdentifier))
+	pod, err := k.Client.GetPod(ctx, namespace, fmt.Sprintf("%s-statefulset-0", userIdentifier))
 	if err != nil {
 		k.logger.Error("failed to get pod", zap.Error(err))
-		return err
+		return "", err
 	}
 	k.logger.Info("pod ip", zap.String("ip", pod.Status.PodIP))
 	// TODO: there is a race condition, where the pod is ready, but we can't connect to the endpoint yet.
 	// Probably should do a vmapi.dial until it succeeds here.
-	return k.API.WriteFileInPodgRPC(ctx, net.JoinHostPort(pod.Status.PodIP, fmt.Sprint(config.AgentPort)), conf)
+	return net.JoinHostPort(pod.Status.PodIP, fmt.Sprint(config.AgentPort)), nil
 }
 
 // CreatePodPortForward creates a port forward on the specified pod.
@@ -15,6 +15,7 @@ type K8sAPIUser interface {
 	GetUserInformation() *config.KubeRessourceIdentifier
 	GetNamespace() string
 	GetAuthenticatedUserID() string
+	GetWorkspaceID() string
 	GetNodeName() string
 	K8sAPI
 }
@@ -22,6 +23,8 @@ type K8sAPIUser interface {
 // K8sAPIUserWrapper is the struct used to access kubernetes helpers and user data.
 type K8sAPIUserWrapper struct {
 	UserInformation *config.KubeRessourceIdentifier
+	// AuthenticatedUserID is the uuid of the user, if it differs from the identifier of the ressources.
+	AuthenticatedUserID string
 	K8sAPI
 }
 
@@ -45,6 +48,15 @@ func (k *K8sAPIUserWrapper) GetNamespace() string {
 
 // GetAuthenticatedUserID returns the authenticated user id.
 func (k *K8sAPIUserWrapper) GetAuthenticatedUserID() string {
+	if k.AuthenticatedUserID != "" {
+		return k.AuthenticatedUserID
+	}
+	return k.UserInformation.UserIdentifier
+}
+
+// GetWorkspaceID returns the identifier of the kubernetes ressources the user works on.
+// It is the uuid of the user or the workspace of the team of the user.
+func (k *K8sAPIUserWrapper) GetWorkspaceID() string {
 	return k.UserInformation.UserIdentifier
 }
 
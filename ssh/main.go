@@ -7,18 +7,39 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/benschlueter/delegatio/internal/backup"
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/benschlueter/delegatio/internal/hostkey"
+	"github.com/benschlueter/delegatio/internal/store"
 	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/ssh/audit"
+	"github.com/benschlueter/delegatio/ssh/auth"
+	"github.com/benschlueter/delegatio/ssh/certificate"
+	"github.com/benschlueter/delegatio/ssh/health"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
-	"github.com/benschlueter/delegatio/ssh/ldap"
+	"github.com/benschlueter/delegatio/ssh/mfa"
+	"github.com/benschlueter/delegatio/ssh/ratelimit"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/spf13/afero"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to the ssh server configuration, read from the ssh-config ConfigMap if empty")
+	flag.Parse()
 	var client *kubernetes.K8sAPIWrapper
 	var err error
 	zapconf := zap.NewDevelopmentConfig()
@@ -36,32 +57,197 @@ func main() {
 		logger.With(zap.Error(err)).DPanic("failed to create k8s client")
 	}
 
-	store, err := client.GetStore()
+	serverConf, err := loadConfig(client, *configPath, logger)
 	if err != nil {
-		logger.With(zap.Error(err)).DPanic("connecting to etcd")
+		logger.With(zap.Error(err)).DPanic("loading ssh server configuration")
 	}
-	keys, err := storewrapper.StoreWrapper{Store: store}.GetAllKeys()
+	backingStore, err := store.Open(serverConf.Store, client.GetStore)
 	if err != nil {
-		logger.With(zap.Error(err)).DPanic("getting all keys from etcd")
+		logger.With(zap.Error(err)).DPanic("opening the store", zap.String("backend", serverConf.Store.Backend))
+	}
+	if closer, ok := backingStore.(io.Closer); ok {
+		defer func() { _ = closer.Close() }()
+	}
+	var keyRing *envelope.KeyRing
+	if serverConf.Encryption != nil {
+		keyRing, err = loadKeyRing(client, *serverConf.Encryption)
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("loading encryption key ring")
+		}
+		logger.Info("encryption of secrets enabled", zap.String("currentKey", keyRing.CurrentID()))
+	}
+	data := storewrapper.StoreWrapper{Store: backingStore, Keys: keyRing}
+	if serverConf.Store.Backend == store.BackendBolt {
+		// the installer only populates the etcd of the cluster
+		generated, err := hostkey.Ensure(data)
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("generating host keys")
+		}
+		logger.Info("using embedded store", zap.String("path", serverConf.Store.Path), zap.Strings("generatedHostKeys", generated))
+	}
+	// records written by older versions are upgraded before they are served
+	previousVersion, err := data.MigrateSchema()
+	if err != nil {
+		logger.With(zap.Error(err)).DPanic("migrating the store schema", zap.Int("previousVersion", previousVersion))
+	}
+	logger.Info("store schema is up to date", zap.Int("previousVersion", previousVersion))
+	if keyRing != nil {
+		// secrets written in plaintext or with a previous key are encrypted with the current key
+		rotated, err := data.RotateSecrets()
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("encrypting secrets with the current key")
+		}
+		logger.Info("secrets are encrypted with the current key", zap.Int("rotated", rotated))
+	}
+	keys, err := data.GetAllKeys()
+	if err != nil {
+		logger.With(zap.Error(err)).DPanic("getting all keys from the store")
 	}
 	logger.Debug("data in store", zap.Strings("keys", keys))
-	privKey, err := storewrapper.StoreWrapper{Store: store}.GetPrivKey()
+	var authority *certificate.Authority
+	caKey, err := data.GetCAKey()
+	if err != nil {
+		logger.Info("no certificate authority in store, certificate authentication is disabled", zap.Error(err))
+	} else {
+		authority, err = certificate.NewAuthority(caKey, config.SSHCertificateValidity)
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("creating certificate authority")
+		}
+		logger.Info("loaded certificate authority", zap.String("fingerprint", ssh.FingerprintSHA256(authority.PublicKey())))
+	}
+	authenticators, err := auth.NewChain(logger.Named("auth"), serverConf.Authentication)
+	if err != nil {
+		logger.With(zap.Error(err)).DPanic("creating authentication backends")
+	}
+	for _, authenticator := range authenticators {
+		logger.Info("created authentication backend", zap.String("backend", authenticator.Name()))
+	}
+	if len(authenticators) == 0 {
+		logger.Warn("no authentication backend is configured, password and keyboard-interactive logins are disabled")
+	}
+	var verifier *mfa.Verifier
+	if serverConf.MFA != nil {
+		verifier, err = mfa.NewVerifier(logger.Named("mfa"), backingStore, keyRing, serverConf.MFA)
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("creating second factor verifier")
+		}
+		logger.Info("second factor enabled")
+	}
+	limiter := ratelimit.NewLimiter(logger.Named("ratelimit"), backingStore, serverConf.RateLimit)
+	var recorder *recording.Recorder
+	if serverConf.Recording != nil {
+		storage := recording.NewDirectoryStorage(afero.NewOsFs(), serverConf.Recording.Directory)
+		recorder = recording.NewRecorder(logger.Named("recording"), storage, serverConf.Recording)
+		logger.Info("session recording enabled", zap.String("directory", serverConf.Recording.Directory))
+	}
+	var auditLogger *audit.Logger
+	if serverConf.Audit.Sink != serverconfig.AuditSinkNone {
+		auditLogger, err = audit.Open(serverConf.Audit.Sink)
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("opening audit log")
+		}
+		defer func() { _ = auditLogger.Close() }()
+		logger.Info("audit log enabled", zap.String("sink", serverConf.Audit.Sink))
+	}
+	checker := health.NewChecker(logger.Named("health"))
+	healthListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.DefaultIP, config.SSHHealthPort))
 	if err != nil {
-		logger.With(zap.Error(err)).DPanic("gettign priv key for ssh server")
+		logger.With(zap.Error(err)).DPanic("listening for health checks")
 	}
-	logger.Info("pulled private key from store")
-	ldap := ldap.NewLdap(logger.Named("ldap"))
-	logger.Info("created ldap client")
-	server := NewServer(client, logger, store, privKey, ldap)
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	healthDone := make(chan struct{})
+	go func() {
+		defer close(healthDone)
+		if err := checker.Serve(healthCtx, healthListener); err != nil {
+			logger.Error("health server exited", zap.Error(err))
+		}
+	}()
+	// public keys, users, challenges and teams are read on every connection, revocations take effect once watched
+	cache := store.NewCache(logger.Named("cache"), backingStore, storewrapper.CachedPrefixes()...)
+	defer cache.Close()
+	server := NewServer(client, logger, cache, keyRing, authenticators, authority, verifier, limiter, recorder, auditLogger, serverConf, checker)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	done := make(chan struct{})
 	go registerSignalHandler(cancel, done, logger)
+	if serverConf.Backup != nil && serverConf.Backup.Interval > 0 {
+		destination, err := backup.Open(*serverConf.Backup, afero.NewOsFs())
+		if err != nil {
+			logger.With(zap.Error(err)).DPanic("opening backup destination")
+		}
+		// the replicas share the schedule through the store, only one of them takes a snapshot per interval
+		go backup.NewScheduler(logger.Named("backup"), backingStore, destination, *serverConf.Backup).Run(ctx)
+		logger.Info("scheduled backups enabled", zap.Duration("interval", serverConf.Backup.Interval))
+	}
+	go registerReloadHandler(ctx, server, func() (*serverconfig.Config, error) {
+		return loadConfig(client, *configPath, logger)
+	}, logger)
 	server.Start(ctx)
+	stopHealth()
+	<-healthDone
 	<-done
 }
 
+// loadConfig reads the configuration from path. Without a path the ssh-config ConfigMap is used, if it does not exist
+// the default configuration is returned. Other errors reading the ConfigMap are returned, so an unreachable API server
+// does not silently replace the configuration with the default.
+func loadConfig(client *kubernetes.K8sAPIWrapper, path string, log *zap.Logger) (*serverconfig.Config, error) {
+	if path != "" {
+		log.Info("reading configuration from file", zap.String("path", path))
+		return serverconfig.LoadFile(file.NewHandler(afero.NewOsFs()), path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.DefaultTimeout)
+	defer cancel()
+	data, err := client.Client.GetConfigMapData(ctx, config.SSHNamespaceName, config.SSHConfigMapName)
+	if errors.IsNotFound(err) {
+		log.Info("no configuration found, using default configuration", zap.Error(err))
+		return serverconfig.Default(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading configmap %s: %w", config.SSHConfigMapName, err)
+	}
+	raw, ok := data[config.SSHConfigMapKey]
+	if !ok {
+		log.Info("configmap contains no configuration, using default configuration", zap.String("key", config.SSHConfigMapKey))
+		return serverconfig.Default(), nil
+	}
+	log.Info("reading configuration from configmap", zap.String("configmap", config.SSHConfigMapName))
+	return serverconfig.Load([]byte(raw))
+}
+
+// loadKeyRing reads the key ring from the file or the secret in the namespace of the ssh server.
+func loadKeyRing(client *kubernetes.K8sAPIWrapper, conf envelope.Config) (*envelope.KeyRing, error) {
+	return envelope.Load(conf, file.NewHandler(afero.NewOsFs()), func(name string) (map[string][]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), config.DefaultTimeout)
+		defer cancel()
+		return client.Client.GetSecretData(ctx, config.SSHNamespaceName, name)
+	})
+}
+
+// registerReloadHandler reloads the configuration on SIGHUP until the context is cancelled.
+func registerReloadHandler(ctx context.Context, server *Server, load func() (*serverconfig.Config, error), log *zap.Logger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			log.Info("reload signal received")
+			conf, err := load()
+			if err != nil {
+				log.Error("failed to load configuration, keeping the current configuration", zap.Error(err))
+				continue
+			}
+			if err := server.Reload(ctx, conf); err != nil {
+				log.Error("failed to reload configuration, keeping the current configuration", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func registerSignalHandler(cancelContext context.CancelFunc, done chan<- struct{}, log *zap.Logger) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
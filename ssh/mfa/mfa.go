@@ -0,0 +1,195 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package mfa implements time-based one-time passwords (TOTP) as second factor of ssh logins.
+// Users enroll during their first login which requires a second factor, the secret is encrypted with the key ring of
+// the store.
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// recoveryCodeCount is the number of recovery codes created during enrollment.
+	recoveryCodeCount = 10
+	// enrollmentAttempts is the number of codes a user may enter to confirm the enrollment.
+	enrollmentAttempts = 3
+	// defaultIssuer is shown in the authenticator app if no issuer is configured.
+	defaultIssuer = "delegatio"
+	codePrompt    = "Verification code: "
+)
+
+// ErrInvalidCode is returned if neither a valid TOTP code nor an unused recovery code was entered.
+var ErrInvalidCode = errors.New("invalid verification code")
+
+// Verifier enrolls and verifies the second factor of users.
+type Verifier struct {
+	log          *zap.Logger
+	backingStore store.Store
+	keys         *envelope.KeyRing
+	conf         *serverconfig.MFAConfig
+	now          func() time.Time
+}
+
+// NewVerifier creates a new Verifier, keys encrypt the TOTP secrets in the store.
+func NewVerifier(logger *zap.Logger, backingStore store.Store, keys *envelope.KeyRing, conf *serverconfig.MFAConfig) (*Verifier, error) {
+	if keys == nil {
+		return nil, errors.New("a key ring is required to encrypt the totp secrets")
+	}
+	return &Verifier{
+		log:          logger,
+		backingStore: backingStore,
+		keys:         keys,
+		conf:         conf,
+		now:          time.Now,
+	}, nil
+}
+
+// Required checks whether the policy of the course requires a second factor for the authentication method.
+func (v *Verifier) Required(course string, publicKey bool) bool {
+	policy := v.conf.Policy(course)
+	if publicKey {
+		return policy.PublicKey
+	}
+	return policy.Password
+}
+
+// Authenticate asks the user for a verification code. Users without a second factor are enrolled.
+func (v *Verifier) Authenticate(uuid string, challenge ssh.KeyboardInteractiveChallenge) error {
+	enrolled, err := v.data().MFAEnrolled(uuid)
+	if err != nil {
+		v.log.Error("error checking if user is enrolled; likely due to etcd", zap.Error(err))
+		return err
+	}
+	if !enrolled {
+		return v.enroll(uuid, challenge)
+	}
+	return v.verify(uuid, challenge)
+}
+
+// enroll creates a new secret, which is stored after the user entered a valid code. Afterwards the recovery codes are shown.
+func (v *Verifier) enroll(uuid string, challenge ssh.KeyboardInteractiveChallenge) error {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	issuer := v.conf.Issuer
+	if issuer == "" {
+		issuer = defaultIssuer
+	}
+	instruction := fmt.Sprintf("Two-factor authentication is required. Add the key to your authenticator app and enter the code.\n%s\nsecret: %s\n",
+		keyURI(issuer, uuid, secret), secretEncoding.EncodeToString(secret))
+	var step int64
+	for attempt := 0; ; attempt++ {
+		if attempt == enrollmentAttempts {
+			return ErrInvalidCode
+		}
+		code, err := askCode(challenge, instruction)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if step, ok = verifyTOTP(secret, code, v.now(), 0); ok {
+			break
+		}
+		instruction = "Invalid code, please try again.\n"
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := v.data().PutMFAData(uuid, config.MFAData{Secret: secret, LastStep: step, RecoveryCodes: hashes}); err != nil {
+		return fmt.Errorf("storing second factor: %w", err)
+	}
+	v.log.Info("second factor enrolled", zap.String("uuid", uuid))
+	instruction = "Store the recovery codes, each code can be used once instead of a verification code.\n" + strings.Join(codes, "\n") + "\n"
+	if _, err := challenge("", instruction, nil, nil); err != nil {
+		v.log.Info("failed to show recovery codes", zap.String("uuid", uuid), zap.Error(err))
+	}
+	return nil
+}
+
+// verify checks a TOTP code or a recovery code of an enrolled user. The used code is recorded in the same transaction,
+// so a code entered in concurrent logins, even on different servers, is only accepted once.
+func (v *Verifier) verify(uuid string, challenge ssh.KeyboardInteractiveChallenge) error {
+	code, err := askCode(challenge, "")
+	if err != nil {
+		return err
+	}
+	err = v.data().UpdateMFAData(uuid, func(data *config.MFAData) error {
+		if step, ok := verifyTOTP(data.Secret, code, v.now(), data.LastStep); ok {
+			data.LastStep = step
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, stored := range data.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) != 1 {
+				continue
+			}
+			data.RecoveryCodes = append(data.RecoveryCodes[:i], data.RecoveryCodes[i+1:]...)
+			v.log.Info("recovery code used", zap.String("uuid", uuid), zap.Int("remaining", len(data.RecoveryCodes)))
+			return nil
+		}
+		return ErrInvalidCode
+	})
+	if err != nil && !errors.Is(err, ErrInvalidCode) {
+		v.log.Error("verifying second factor", zap.String("uuid", uuid), zap.Error(err))
+	}
+	return err
+}
+
+func (v *Verifier) data() storewrapper.StoreWrapper {
+	return storewrapper.StoreWrapper{Store: v.backingStore, Keys: v.keys}
+}
+
+// askCode asks the user for a single code.
+func askCode(challenge ssh.KeyboardInteractiveChallenge, instruction string) (string, error) {
+	answers, err := challenge("", instruction, []string{codePrompt}, []bool{true})
+	if err != nil {
+		return "", err
+	}
+	if len(answers) != 1 {
+		return "", fmt.Errorf("expected one answer, got %d", len(answers))
+	}
+	return strings.TrimSpace(answers[0]), nil
+}
+
+// newRecoveryCodes creates the recovery codes and their hashes.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes the code, so dashes and the case do not matter.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
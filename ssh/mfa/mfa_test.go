@@ -0,0 +1,220 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package mfa
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 6238 (SHA1), truncated to six digits
+	secret := []byte("12345678901234567890")
+	testCases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range testCases {
+		assert.Equal(t, code, hotp(secret, timeStep(time.Unix(unix, 0))))
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1700000000, 0)
+	current := timeStep(now)
+	testCases := map[string]struct {
+		code       string
+		lastStep   int64
+		expectOk   bool
+		expectStep int64
+	}{
+		"current period": {
+			code:       hotp(secret, current),
+			expectOk:   true,
+			expectStep: current,
+		},
+		"previous period": {
+			code:       hotp(secret, current-1),
+			expectOk:   true,
+			expectStep: current - 1,
+		},
+		"next period": {
+			code:       hotp(secret, current+1),
+			expectOk:   true,
+			expectStep: current + 1,
+		},
+		"too old": {
+			code: hotp(secret, current-2),
+		},
+		"replayed": {
+			code:     hotp(secret, current),
+			lastStep: current,
+		},
+		"wrong code": {
+			code: "000000",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			step, ok := verifyTOTP(secret, tc.code, now, tc.lastStep)
+			assert.Equal(tc.expectOk, ok)
+			assert.Equal(tc.expectStep, step)
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	backingStore := store.NewStdStore()
+	verifier := newTestVerifier(t, backingStore, 0x01)
+	verifier.now = func() time.Time { return now }
+
+	// enrollment with one wrong code
+	var secret []byte
+	var recoveryCodes []string
+	attempts := 0
+	err := verifier.Authenticate("uuid", func(_, instruction string, questions []string, _ []bool) ([]string, error) {
+		if len(questions) == 0 {
+			recoveryCodes = regexp.MustCompile(`[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}`).FindAllString(instruction, -1)
+			return nil, nil
+		}
+		attempts++
+		if attempts == 1 {
+			match := regexp.MustCompile(`secret: ([A-Z2-7]+)`).FindStringSubmatch(instruction)
+			require.Len(match, 2)
+			var err error
+			secret, err = secretEncoding.DecodeString(match[1])
+			require.NoError(err)
+			assert.Contains(instruction, "otpauth://totp/")
+			return []string{"000000"}, nil
+		}
+		return []string{hotp(secret, timeStep(now))}, nil
+	})
+	require.NoError(err)
+	assert.Equal(2, attempts)
+	assert.Len(recoveryCodes, recoveryCodeCount)
+	// the secret is encrypted with the key ring
+	stored, err := backingStore.Get("mfa-uuid")
+	require.NoError(err)
+	assert.NotContains(string(stored), secretEncoding.EncodeToString(secret))
+
+	answer := func(code string) func(string, string, []string, []bool) ([]string, error) {
+		return func(string, string, []string, []bool) ([]string, error) {
+			return []string{code}, nil
+		}
+	}
+	// the code used for the enrollment cannot be used again
+	assert.ErrorIs(verifier.Authenticate("uuid", answer(hotp(secret, timeStep(now)))), ErrInvalidCode)
+	assert.NoError(verifier.Authenticate("uuid", answer(hotp(secret, timeStep(now)+1))))
+	// recovery codes are accepted once, independent of case and dashes
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	assert.NoError(verifier.Authenticate("uuid", answer(recoveryCode)))
+	assert.ErrorIs(verifier.Authenticate("uuid", answer(recoveryCode)), ErrInvalidCode)
+
+	// the secret cannot be decrypted with another key
+	otherVerifier := newTestVerifier(t, backingStore, 0x02)
+	otherVerifier.now = verifier.now
+	assert.Error(otherVerifier.Authenticate("uuid", answer(hotp(secret, timeStep(now)+1))))
+}
+
+func TestEnrollmentAttempts(t *testing.T) {
+	backingStore := store.NewStdStore()
+	verifier := newTestVerifier(t, backingStore, 0x01)
+	attempts := 0
+	err := verifier.Authenticate("uuid", func(string, string, []string, []bool) ([]string, error) {
+		attempts++
+		return []string{"000000"}, nil
+	})
+	assert.ErrorIs(t, err, ErrInvalidCode)
+	assert.Equal(t, enrollmentAttempts, attempts)
+	_, err = backingStore.Get("mfa-uuid")
+	assert.Error(t, err)
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	backingStore := store.NewStdStore()
+	secret := []byte("12345678901234567890")
+	// two servers share the store
+	verifiers := []*Verifier{newTestVerifier(t, backingStore, 0x01), newTestVerifier(t, backingStore, 0x01)}
+	for _, verifier := range verifiers {
+		verifier.now = func() time.Time { return now }
+	}
+	require.NoError(verifiers[0].data().PutMFAData("uuid", config.MFAData{Secret: secret, LastStep: timeStep(now) - 1}))
+
+	code := hotp(secret, timeStep(now))
+	var wg sync.WaitGroup
+	errs := make([]error, len(verifiers))
+	for i, verifier := range verifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = verifier.Authenticate("uuid", func(string, string, []string, []bool) ([]string, error) {
+				return []string{code}, nil
+			})
+		}()
+	}
+	wg.Wait()
+	accepted := 0
+	for _, err := range errs {
+		if err == nil {
+			accepted++
+			continue
+		}
+		assert.ErrorIs(err, ErrInvalidCode)
+	}
+	assert.Equal(1, accepted)
+}
+
+func TestRequired(t *testing.T) {
+	verifier := newTestVerifier(t, store.NewStdStore(), 0x01)
+	assert.True(t, verifier.Required("other", false))
+	assert.False(t, verifier.Required("other", true))
+	assert.True(t, verifier.Required("strict", true))
+	assert.False(t, verifier.Required("relaxed", false))
+}
+
+func newTestVerifier(t *testing.T, backingStore store.Store, keyByte byte) *Verifier {
+	keys, err := envelope.NewKeyRing("key", map[string][]byte{"key": bytes.Repeat([]byte{keyByte}, 32)})
+	require.NoError(t, err)
+	verifier, err := NewVerifier(zap.NewNop(), backingStore, keys, &serverconfig.MFAConfig{
+		Default: serverconfig.MFAPolicy{Password: true},
+		Courses: map[string]serverconfig.MFAPolicy{
+			"strict":  {Password: true, PublicKey: true},
+			"relaxed": {},
+		},
+	})
+	require.NoError(t, err)
+	return verifier
+}
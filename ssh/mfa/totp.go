@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// totpPeriod is the validity of a code, authenticator apps only support 30 seconds.
+	totpPeriod = 30
+	// totpDigits is the length of a code.
+	totpDigits = 6
+	// totpSkew is the number of periods accepted before and after the current period to tolerate clock drift.
+	totpSkew = 1
+	// secretSize is the size of the TOTP secret, RFC 4226 recommends 160 bits.
+	secretSize = 20
+)
+
+// secretEncoding is the base32 encoding used by authenticator apps.
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// timeStep returns the TOTP counter of t (RFC 6238).
+func timeStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp computes the code of the counter (RFC 4226).
+func hotp(secret []byte, counter int64) string {
+	mac := hmac.New(sha1.New, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// verifyTOTP checks the code against the periods around now. Only periods after lastStep are accepted,
+// so a code cannot be used twice. The matching period is returned.
+func verifyTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := timeStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// keyURI returns the otpauth URI of the secret, which is understood by authenticator apps.
+func keyURI(issuer, account string, secret []byte) string {
+	values := url.Values{}
+	values.Set("secret", secretEncoding.EncodeToString(secret))
+	values.Set("issuer", issuer)
+	values.Set("period", fmt.Sprint(totpPeriod))
+	values.Set("digits", fmt.Sprint(totpDigits))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: values.Encode(),
+	}).String()
+}
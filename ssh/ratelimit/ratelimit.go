@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package ratelimit protects the ssh server against brute-force attacks and resource exhaustion.
+// The state is kept in the store, so all replicas of the ssh server share the limits. Every update is a transaction,
+// concurrent attempts on different replicas are all counted. Expired states are removed by SweepLoop.
+// If the store is unavailable the limits are not enforced, so an etcd outage does not lock out all users.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+)
+
+// defaultLeaseTTL is the validity of a session lease, leases are renewed after a third of it.
+const defaultLeaseTTL = 3 * time.Minute
+
+// ErrLimited is returned if a limit is exceeded.
+var ErrLimited = errors.New("rate limit exceeded")
+
+// Limiter enforces the limits of the ssh server.
+type Limiter struct {
+	log          *zap.Logger
+	backingStore store.Store
+	conf         serverconfig.RateLimitConfig
+	now          func() time.Time
+	leaseTTL     time.Duration
+}
+
+// NewLimiter creates a new Limiter.
+func NewLimiter(logger *zap.Logger, backingStore store.Store, conf serverconfig.RateLimitConfig) *Limiter {
+	return &Limiter{
+		log:          logger,
+		backingStore: backingStore,
+		conf:         conf,
+		now:          time.Now,
+		leaseTTL:     defaultLeaseTTL,
+	}
+}
+
+// AllowConnection checks whether the replica may accept another connection.
+func (l *Limiter) AllowConnection(currentConnections int64) error {
+	if l.conf.MaxConnections >= 0 && currentConnections >= int64(l.conf.MaxConnections) {
+		return fmt.Errorf("%w: %d concurrent connections", ErrLimited, currentConnections)
+	}
+	return nil
+}
+
+// AllowHandshake counts the handshake of the source IP and checks whether the IP exceeded its handshakes in the current window.
+func (l *Limiter) AllowHandshake(ip string) error {
+	if l.conf.HandshakesPerIP < 0 {
+		return nil
+	}
+	count := 0
+	err := l.data().UpdateRateLimitState("handshake-"+ip, func(state *config.RateLimitState) error {
+		now := l.now()
+		if now.Sub(state.Start) >= l.conf.Window {
+			*state = config.RateLimitState{Start: now, Expires: now.Add(l.conf.Window)}
+		}
+		state.Count++
+		count = state.Count
+		return nil
+	})
+	if err != nil {
+		l.log.Error("storing rate limit state; likely due to etcd", zap.Error(err))
+		return nil
+	}
+	if count > l.conf.HandshakesPerIP {
+		return fmt.Errorf("%w: too many handshakes from %s", ErrLimited, ip)
+	}
+	return nil
+}
+
+// AllowAuth checks whether the source IP or the username is locked because of failed logins.
+func (l *Limiter) AllowAuth(ip, username string) error {
+	for _, key := range []string{"failure-ip-" + ip, "failure-user-" + username} {
+		state, err := l.data().GetRateLimitState(key)
+		if err != nil {
+			l.log.Error("getting rate limit state; likely due to etcd", zap.Error(err))
+			return nil
+		}
+		if l.now().Before(state.LockedUntil) {
+			return fmt.Errorf("%w: %s locked until %s", ErrLimited, key, state.LockedUntil.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// AuthFailed records a failed login of the username from the source IP.
+func (l *Limiter) AuthFailed(ip, username string) {
+	l.recordFailure("failure-ip-"+ip, l.conf.MaxFailuresPerIP)
+	l.recordFailure("failure-user-"+username, l.conf.MaxFailuresPerUser)
+}
+
+// AuthSucceeded resets the failed logins of the username. The failures of the IP are kept, as many users may share it.
+func (l *Limiter) AuthSucceeded(username string) {
+	if err := l.data().DeleteRateLimitState("failure-user-" + username); err != nil {
+		l.log.Error("storing rate limit state; likely due to etcd", zap.Error(err))
+	}
+}
+
+// recordFailure counts a failure and locks the key once maxFailures is reached.
+// The lockout doubles with every further failure up to MaxLockout.
+func (l *Limiter) recordFailure(key string, maxFailures int) {
+	if maxFailures < 0 {
+		return
+	}
+	var count int
+	var lockout time.Duration
+	err := l.data().UpdateRateLimitState(key, func(state *config.RateLimitState) error {
+		lockout = 0
+		now := l.now()
+		if now.Sub(state.LastFailure) > l.conf.MaxLockout {
+			*state = config.RateLimitState{}
+		}
+		state.Count++
+		state.LastFailure = now
+		// the lockout never exceeds MaxLockout, so the state expires after it
+		state.Expires = now.Add(l.conf.MaxLockout)
+		count = state.Count
+		if state.Count >= maxFailures {
+			lockout = l.conf.Lockout
+			for i := maxFailures; i < state.Count && lockout < l.conf.MaxLockout; i++ {
+				lockout *= 2
+			}
+			lockout = min(lockout, l.conf.MaxLockout)
+			state.LockedUntil = now.Add(lockout)
+		}
+		return nil
+	})
+	if err != nil {
+		l.log.Error("storing rate limit state; likely due to etcd", zap.Error(err))
+		return
+	}
+	if lockout > 0 {
+		l.log.Info("locked after failed logins", zap.String("key", key), zap.Int("failures", count), zap.Duration("lockout", lockout))
+	}
+}
+
+// SweepLoop removes the expired rate limit states periodically until ctx is done. The states of source IPs and
+// usernames which do not return would otherwise stay in the store forever.
+func (l *Limiter) SweepLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		l.sweep(ctx)
+	}
+}
+
+// sweep removes the expired rate limit states.
+func (l *Limiter) sweep(ctx context.Context) {
+	deleted, err := l.data().WithContext(ctx).DeleteExpiredRateLimitStates(l.now())
+	if err != nil {
+		l.log.Error("removing expired rate limit states; likely due to etcd", zap.Error(err))
+		return
+	}
+	l.log.Debug("removed expired rate limit states", zap.Int("count", deleted))
+}
+
+// AcquireSession registers a session of the user, if the user has less than MaxSessionsPerUser sessions.
+// The lease of the session is renewed until release is called or ctx is done, so sessions of crashed replicas expire.
+func (l *Limiter) AcquireSession(ctx context.Context, uuid string) (release func(), err error) {
+	if l.conf.MaxSessionsPerUser < 0 {
+		return func() {}, nil
+	}
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	sessionID := hex.EncodeToString(rawID)
+
+	err = l.data().UpdateSessionLeases(uuid, func(leases map[string]config.SessionLease) error {
+		now := l.now()
+		for id, lease := range leases {
+			if !now.Before(lease.Expires) {
+				delete(leases, id)
+			}
+		}
+		if len(leases) >= l.conf.MaxSessionsPerUser {
+			return fmt.Errorf("%w: user %s has %d active sessions", ErrLimited, uuid, len(leases))
+		}
+		leases[sessionID] = config.SessionLease{Expires: now.Add(l.leaseTTL)}
+		return nil
+	})
+	if errors.Is(err, ErrLimited) {
+		return nil, err
+	}
+	if err != nil {
+		l.log.Error("storing session lease; likely due to etcd", zap.Error(err))
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.renewLease(uuid, sessionID)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := l.data().DeleteSessionLease(uuid, sessionID); err != nil {
+			l.log.Error("deleting session lease; likely due to etcd", zap.Error(err))
+		}
+	}, nil
+}
+
+func (l *Limiter) renewLease(uuid, sessionID string) {
+	if err := l.data().PutSessionLease(uuid, sessionID, config.SessionLease{Expires: l.now().Add(l.leaseTTL)}); err != nil {
+		l.log.Error("storing session lease; likely due to etcd", zap.Error(err))
+	}
+}
+
+func (l *Limiter) data() storewrapper.StoreWrapper {
+	return storewrapper.StoreWrapper{Store: l.backingStore}
+}
@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func testConfig() serverconfig.RateLimitConfig {
+	return serverconfig.RateLimitConfig{
+		Window:             time.Minute,
+		HandshakesPerIP:    2,
+		MaxFailuresPerUser: 3,
+		MaxFailuresPerIP:   5,
+		Lockout:            time.Minute,
+		MaxLockout:         5 * time.Minute,
+		MaxConnections:     2,
+		MaxSessionsPerUser: 2,
+	}
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(backingStore store.Store, conf serverconfig.RateLimitConfig, clock *testClock) *Limiter {
+	limiter := NewLimiter(zap.NewNop(), backingStore, conf)
+	limiter.now = clock.Now
+	return limiter
+}
+
+func TestAllowConnection(t *testing.T) {
+	limiter := NewLimiter(zap.NewNop(), store.NewStdStore(), testConfig())
+	assert.NoError(t, limiter.AllowConnection(1))
+	assert.ErrorIs(t, limiter.AllowConnection(2), ErrLimited)
+
+	conf := testConfig()
+	conf.MaxConnections = -1
+	limiter = NewLimiter(zap.NewNop(), store.NewStdStore(), conf)
+	assert.NoError(t, limiter.AllowConnection(10000))
+}
+
+func TestAllowHandshake(t *testing.T) {
+	assert := assert.New(t)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	backingStore := store.NewStdStore()
+	limiter := newTestLimiter(backingStore, testConfig(), clock)
+
+	assert.NoError(limiter.AllowHandshake("10.0.0.1"))
+	assert.NoError(limiter.AllowHandshake("10.0.0.1"))
+	assert.ErrorIs(limiter.AllowHandshake("10.0.0.1"), ErrLimited)
+	assert.NoError(limiter.AllowHandshake("10.0.0.2"))
+
+	// the state is shared with other replicas through the store
+	replica := newTestLimiter(backingStore, testConfig(), clock)
+	assert.ErrorIs(replica.AllowHandshake("10.0.0.1"), ErrLimited)
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(limiter.AllowHandshake("10.0.0.1"))
+}
+
+func TestLockout(t *testing.T) {
+	testCases := map[string]struct {
+		failures      int
+		elapsed       time.Duration
+		succeeded     bool
+		otherIP       bool
+		expectLimited bool
+	}{
+		"below limit": {
+			failures: 2,
+		},
+		"locked": {
+			failures:      3,
+			expectLimited: true,
+		},
+		"lockout expired": {
+			failures: 3,
+			elapsed:  time.Minute,
+		},
+		"lockout doubles": {
+			failures:      4,
+			elapsed:       time.Minute,
+			expectLimited: true,
+		},
+		"lockout capped": {
+			failures: 20,
+			elapsed:  5 * time.Minute,
+		},
+		"user locked from other ip": {
+			failures:      3,
+			otherIP:       true,
+			expectLimited: true,
+		},
+		"success resets user": {
+			failures:  2,
+			succeeded: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			clock := &testClock{now: time.Unix(1700000000, 0)}
+			limiter := newTestLimiter(store.NewStdStore(), testConfig(), clock)
+
+			ip := "10.0.0.1"
+			for i := 0; i < tc.failures; i++ {
+				// use different ips, so only the user is locked
+				limiter.AuthFailed(ip+string(rune('a'+i)), "user")
+			}
+			if tc.succeeded {
+				limiter.AuthSucceeded("user")
+				limiter.AuthFailed(ip, "user")
+			}
+			if tc.otherIP {
+				ip = "10.0.0.2"
+			}
+			clock.now = clock.now.Add(tc.elapsed)
+			err := limiter.AllowAuth(ip, "user")
+			if tc.expectLimited {
+				assert.ErrorIs(err, ErrLimited)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	limiter := newTestLimiter(store.NewStdStore(), testConfig(), clock)
+	for i := 0; i < 5; i++ {
+		limiter.AuthFailed("10.0.0.1", string(rune('a'+i)))
+	}
+	assert.ErrorIs(t, limiter.AllowAuth("10.0.0.1", "other"), ErrLimited)
+	assert.NoError(t, limiter.AllowAuth("10.0.0.2", "other"))
+}
+
+func TestConcurrentFailures(t *testing.T) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	backingStore := store.NewStdStore()
+	conf := testConfig()
+	conf.MaxFailuresPerIP = 100
+	// two replicas share the store
+	limiters := []*Limiter{newTestLimiter(backingStore, conf, clock), newTestLimiter(backingStore, conf, clock)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiters[i%2].AuthFailed("10.0.0.1", fmt.Sprintf("user%d", i))
+		}()
+	}
+	wg.Wait()
+	state, err := storewrapper.StoreWrapper{Store: backingStore}.GetRateLimitState("failure-ip-10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 20, state.Count)
+}
+
+func TestSweep(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	backingStore := store.NewStdStore()
+	limiter := newTestLimiter(backingStore, testConfig(), clock)
+	data := storewrapper.StoreWrapper{Store: backingStore}
+
+	require.NoError(limiter.AllowHandshake("10.0.0.1"))
+	for i := 0; i < 3; i++ {
+		limiter.AuthFailed("10.0.0.1", "user")
+	}
+	// the handshake window expired, the failures are kept until the maximal lockout passed
+	clock.now = clock.now.Add(2 * time.Minute)
+	limiter.sweep(context.Background())
+	state, err := data.GetRateLimitState("handshake-10.0.0.1")
+	require.NoError(err)
+	assert.Zero(state.Count)
+	state, err = data.GetRateLimitState("failure-user-user")
+	require.NoError(err)
+	assert.Equal(3, state.Count)
+
+	clock.now = clock.now.Add(5 * time.Minute)
+	limiter.sweep(context.Background())
+	for _, key := range []string{"failure-user-user", "failure-ip-10.0.0.1"} {
+		state, err := data.GetRateLimitState(key)
+		require.NoError(err)
+		assert.Zero(state.Count, key)
+	}
+}
+
+func TestAcquireSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	backingStore := store.NewStdStore()
+	limiter := newTestLimiter(backingStore, testConfig(), clock)
+
+	releaseFirst, err := limiter.AcquireSession(context.Background(), "uuid")
+	require.NoError(err)
+	releaseSecond, err := limiter.AcquireSession(context.Background(), "uuid")
+	require.NoError(err)
+	_, err = limiter.AcquireSession(context.Background(), "uuid")
+	assert.ErrorIs(err, ErrLimited)
+	releaseOther, err := limiter.AcquireSession(context.Background(), "uuid-other")
+	require.NoError(err)
+	releaseOther()
+
+	releaseFirst()
+	releaseThird, err := limiter.AcquireSession(context.Background(), "uuid")
+	require.NoError(err)
+	releaseThird()
+	releaseSecond()
+
+	leases, err := storewrapper.StoreWrapper{Store: backingStore}.GetSessionLeases("uuid")
+	require.NoError(err)
+	assert.Empty(leases)
+}
+
+func TestExpiredSessionLease(t *testing.T) {
+	assert := assert.New(t)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	backingStore := store.NewStdStore()
+	data := storewrapper.StoreWrapper{Store: backingStore}
+	// leases of a crashed replica
+	assert.NoError(data.PutSessionLease("uuid", "a", config.SessionLease{Expires: clock.now.Add(-time.Second)}))
+	assert.NoError(data.PutSessionLease("uuid", "b", config.SessionLease{Expires: clock.now.Add(-time.Second)}))
+	limiter := newTestLimiter(backingStore, testConfig(), clock)
+
+	release, err := limiter.AcquireSession(context.Background(), "uuid")
+	assert.NoError(err)
+	release()
+	leases, err := data.GetSessionLeases("uuid")
+	assert.NoError(err)
+	assert.Empty(leases)
+}
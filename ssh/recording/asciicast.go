@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Event codes of asciicast v2.
+const (
+	eventOutput = "o"
+	eventInput  = "i"
+	eventResize = "r"
+)
+
+// Header is the first line of an asciicast v2 file.
+// See https://docs.asciinema.org/manual/asciicast/v2/.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is a single event of an asciicast v2 file.
+type Event struct {
+	// Time is the time since the start of the recording.
+	Time time.Duration
+	Code string
+	Data string
+}
+
+// MarshalJSON encodes the event as [time, code, data].
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time.Seconds(), e.Code, e.Data})
+}
+
+// UnmarshalJSON decodes an event encoded as [time, code, data].
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var raw []any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("expected 3 elements in event, got %d", len(raw))
+	}
+	seconds, ok := raw[0].(float64)
+	code, okCode := raw[1].(string)
+	eventData, okData := raw[2].(string)
+	if !ok || !okCode || !okData {
+		return errors.New("malformed event")
+	}
+	e.Time = time.Duration(seconds * float64(time.Second))
+	e.Code = code
+	e.Data = eventData
+	return nil
+}
+
+// ReadHeader reads the header of a recording and returns a function reading the next event.
+// The function returns io.EOF at the end of the recording.
+func ReadHeader(r io.Reader) (*Header, func() (*Event, error), error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("empty recording")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, fmt.Errorf("parsing header: %w", err)
+	}
+	if header.Version != 2 {
+		return nil, nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	next := func() (*Event, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("parsing event: %w", err)
+		}
+		return &event, nil
+	}
+	return &header, next, nil
+}
+
+// Replay writes the output of the recording to w with the recorded timing. The playback is accelerated by speed
+// and pauses are shortened to maxIdle, if it is positive.
+func Replay(ctx context.Context, r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	_, next, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	var last time.Duration
+	for {
+		event, err := next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Code != eventOutput {
+			continue
+		}
+		pause := event.Time - last
+		last = event.Time
+		if maxIdle > 0 && pause > maxIdle {
+			pause = maxIdle
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(float64(pause) / speed)):
+		}
+		if _, err := io.WriteString(w, event.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// splitUTF8 splits an incomplete UTF-8 sequence at the end of p, so multi-byte characters split
+// across two reads are recorded in one event.
+func splitUTF8(p []byte) (complete, rest []byte) {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(p); i++ {
+		if !utf8.RuneStart(p[len(p)-i]) {
+			continue
+		}
+		if !utf8.FullRune(p[len(p)-i:]) {
+			return p[:len(p)-i], p[len(p)-i:]
+		}
+		break
+	}
+	return p, nil
+}
@@ -0,0 +1,266 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package recording records interactive shells in the asciicast v2 format, which can be played with asciinema.
+// The recordings are stored per challenge and user, the retention is configured per challenge.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Suffix is the file extension of recordings.
+const Suffix = ".cast"
+
+// Recorder creates the recordings of shells according to the policy of the challenge.
+type Recorder struct {
+	log     *zap.Logger
+	storage Storage
+	conf    *serverconfig.RecordingConfig
+	now     func() time.Time
+}
+
+// NewRecorder creates a new Recorder.
+func NewRecorder(logger *zap.Logger, storage Storage, conf *serverconfig.RecordingConfig) *Recorder {
+	return &Recorder{
+		log:     logger,
+		storage: storage,
+		conf:    conf,
+		now:     time.Now,
+	}
+}
+
+// Key returns the key of a recording. Recordings are grouped by challenge and user and sorted by their start.
+func Key(challenge, uuid, sessionID string, start time.Time) string {
+	return fmt.Sprintf("%s/%s/%s-%s%s", challenge, uuid, start.UTC().Format("20060102T150405Z"), sessionID, Suffix)
+}
+
+// Start starts the recording of a shell. It returns nil if the policy of the challenge disables recordings.
+func (r *Recorder) Start(challenge, uuid, sessionID string, width, height uint32, term string) (*Recording, error) {
+	policy := r.conf.Policy(challenge)
+	if !policy.Enabled {
+		return nil, nil
+	}
+	// a connection may open multiple shells, the random suffix distinguishes their recordings
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	start := r.now()
+	key := Key(challenge, uuid, sessionID+"-"+hex.EncodeToString(suffix), start)
+	file, err := r.storage.Create(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording %s: %w", key, err)
+	}
+	header := Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%s %s", challenge, uuid),
+	}
+	if term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+	rec := &Recording{
+		log:         r.log.With(zap.String("recording", key)),
+		file:        file,
+		buffer:      bufio.NewWriter(file),
+		start:       start,
+		now:         r.now,
+		recordInput: policy.RecordInput,
+		pending:     make(map[string][]byte),
+	}
+	rec.encoder = json.NewEncoder(rec.buffer)
+	if err := rec.encoder.Encode(&header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.log.Info("recording started", zap.String("recording", key))
+	return rec, nil
+}
+
+// Prune removes the recordings which are older than the retention of their challenge.
+func (r *Recorder) Prune() error {
+	objects, err := r.storage.List("")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		challenge, _, _ := strings.Cut(object.Key, "/")
+		retention := r.conf.Policy(challenge).Retention
+		if retention <= 0 || r.now().Sub(object.ModTime) < retention {
+			continue
+		}
+		if err := r.storage.Remove(object.Key); err != nil {
+			r.log.Error("removing expired recording", zap.String("recording", object.Key), zap.Error(err))
+			continue
+		}
+		r.log.Info("removed expired recording", zap.String("recording", object.Key))
+	}
+	return nil
+}
+
+// PruneLoop prunes the recordings periodically until ctx is done.
+func (r *Recorder) PruneLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Prune(); err != nil {
+			r.log.Error("pruning recordings", zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Recording is a running recording. It is safe for concurrent use. Write errors are logged and stop the recording,
+// so a full volume does not terminate the shell.
+type Recording struct {
+	log         *zap.Logger
+	file        io.WriteCloser
+	buffer      *bufio.Writer
+	encoder     *json.Encoder
+	start       time.Time
+	now         func() time.Time
+	recordInput bool
+
+	mux    sync.Mutex
+	failed bool
+	// pending holds incomplete UTF-8 sequences per event code.
+	pending map[string][]byte
+}
+
+// Output records data written to the terminal.
+func (r *Recording) Output(p []byte) {
+	r.record(eventOutput, p)
+}
+
+// Input records data typed by the user, if the policy records the input.
+func (r *Recording) Input(p []byte) {
+	if r.recordInput {
+		r.record(eventInput, p)
+	}
+}
+
+// Resize records a change of the terminal size.
+func (r *Recording) Resize(width, height uint16) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.encode(Event{Time: r.now().Sub(r.start), Code: eventResize, Data: fmt.Sprintf("%dx%d", width, height)})
+}
+
+func (r *Recording) record(code string, p []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	data := append(r.pending[code], p...)
+	complete, rest := splitUTF8(data)
+	r.pending[code] = append([]byte(nil), rest...)
+	if len(complete) == 0 {
+		return
+	}
+	r.encode(Event{Time: r.now().Sub(r.start), Code: code, Data: string(complete)})
+}
+
+// encode writes the event, the caller must hold mux.
+func (r *Recording) encode(event Event) {
+	if r.failed {
+		return
+	}
+	if err := r.encoder.Encode(event); err != nil {
+		r.log.Error("writing recording failed, stopping the recording", zap.Error(err))
+		r.failed = true
+	}
+}
+
+// Close flushes and closes the recording.
+func (r *Recording) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	flushErr := r.buffer.Flush()
+	closeErr := r.file.Close()
+	r.log.Info("recording stopped")
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// Channel returns a channel which records the data read from and written to channel.
+func (r *Recording) Channel(channel ssh.Channel) ssh.Channel {
+	return &recordingChannel{Channel: channel, recording: r}
+}
+
+// SizeQueue returns a queue which records the sizes returned by queue.
+func (r *Recording) SizeQueue(queue remotecommand.TerminalSizeQueue) remotecommand.TerminalSizeQueue {
+	return &recordingSizeQueue{queue: queue, recording: r}
+}
+
+type recordingChannel struct {
+	ssh.Channel
+	recording *Recording
+}
+
+func (c *recordingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.recording.Input(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	if n > 0 {
+		c.recording.Output(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingChannel) Stderr() io.ReadWriter {
+	return &recordingStderr{ReadWriter: c.Channel.Stderr(), recording: c.recording}
+}
+
+type recordingStderr struct {
+	io.ReadWriter
+	recording *Recording
+}
+
+func (s *recordingStderr) Write(p []byte) (int, error) {
+	n, err := s.ReadWriter.Write(p)
+	if n > 0 {
+		s.recording.Output(p[:n])
+	}
+	return n, err
+}
+
+type recordingSizeQueue struct {
+	queue     remotecommand.TerminalSizeQueue
+	recording *Recording
+}
+
+func (q *recordingSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.queue.Next()
+	if size != nil {
+		q.recording.Resize(size.Width, size.Height)
+	}
+	return size
+}
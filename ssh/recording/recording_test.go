@@ -0,0 +1,257 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package recording
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func testConfig() *serverconfig.RecordingConfig {
+	return &serverconfig.RecordingConfig{
+		Directory: "/recordings",
+		Default:   serverconfig.RecordingPolicy{Enabled: true, Retention: time.Hour},
+		Challenges: map[string]serverconfig.RecordingPolicy{
+			"exam":    {Enabled: true, RecordInput: true},
+			"private": {},
+		},
+	}
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestRecording(t *testing.T) {
+	testCases := map[string]struct {
+		challenge     string
+		expectEnabled bool
+		expectInput   bool
+	}{
+		"default policy": {
+			challenge:     "lab",
+			expectEnabled: true,
+		},
+		"record input": {
+			challenge:     "exam",
+			expectEnabled: true,
+			expectInput:   true,
+		},
+		"disabled": {
+			challenge: "private",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			clock := &testClock{now: time.Unix(1700000000, 0)}
+			storage := NewDirectoryStorage(afero.NewMemMapFs(), "/recordings")
+			recorder := NewRecorder(zap.NewNop(), storage, testConfig())
+			recorder.now = clock.Now
+
+			rec, err := recorder.Start(tc.challenge, "uuid", "abcd", 80, 24, "xterm")
+			require.NoError(err)
+			if !tc.expectEnabled {
+				assert.Nil(rec)
+				return
+			}
+			require.NotNil(rec)
+
+			channel := rec.Channel(&stubChannel{input: strings.NewReader("ls\r")})
+			queue := rec.SizeQueue(&stubSizeQueue{size: &remotecommand.TerminalSize{Width: 100, Height: 30}})
+			buf := make([]byte, 16)
+			n, err := channel.Read(buf)
+			require.NoError(err)
+			assert.Equal("ls\r", string(buf[:n]))
+			clock.now = clock.now.Add(1500 * time.Millisecond)
+			// the euro sign is split across two writes, it is recorded with the second write
+			euro := []byte("€")
+			_, err = channel.Write(append([]byte("file "), euro[:1]...))
+			require.NoError(err)
+			_, err = channel.Write(euro[1:])
+			require.NoError(err)
+			_, err = channel.Stderr().Write([]byte("error\n"))
+			require.NoError(err)
+			assert.Equal(uint16(100), queue.Next().Width)
+			require.NoError(rec.Close())
+
+			objects, err := storage.List(tc.challenge + "/uuid/")
+			require.NoError(err)
+			require.Len(objects, 1)
+			assert.True(strings.HasPrefix(objects[0].Key, tc.challenge+"/uuid/20231114T221320Z-abcd-"))
+			reader, err := storage.Open(objects[0].Key)
+			require.NoError(err)
+			defer reader.Close()
+			header, next, err := ReadHeader(reader)
+			require.NoError(err)
+			assert.Equal(uint32(80), header.Width)
+			assert.Equal("xterm", header.Env["TERM"])
+
+			var events []Event
+			for {
+				event, err := next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(err)
+				events = append(events, *event)
+			}
+			expected := []Event{
+				{Time: 1500 * time.Millisecond, Code: eventOutput, Data: "file "},
+				{Time: 1500 * time.Millisecond, Code: eventOutput, Data: "€"},
+				{Time: 1500 * time.Millisecond, Code: eventOutput, Data: "error\n"},
+				{Time: 1500 * time.Millisecond, Code: eventResize, Data: "100x30"},
+			}
+			if tc.expectInput {
+				expected = append([]Event{{Time: 0, Code: eventInput, Data: "ls\r"}}, expected...)
+			}
+			assert.Equal(expected, events)
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recorded := `{"version":2,"width":80,"height":24,"timestamp":1700000000}
+[0.1,"o","hello "]
+[0.2,"i","x"]
+[0.3,"r","100x30"]
+[100.0,"o","world"]
+`
+	var out bytes.Buffer
+	start := time.Now()
+	require.NoError(t, Replay(context.Background(), strings.NewReader(recorded), &out, 10, 100*time.Millisecond))
+	assert.Equal(t, "hello world", out.String())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, Replay(ctx, strings.NewReader(recorded), &out, 1, 0), context.Canceled)
+	assert.Error(t, Replay(context.Background(), strings.NewReader(`{"version":1}`), &out, 1, 0))
+}
+
+func TestPrune(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fs := afero.NewMemMapFs()
+	storage := NewDirectoryStorage(fs, "/recordings")
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	recorder := NewRecorder(zap.NewNop(), storage, testConfig())
+	recorder.now = clock.Now
+
+	for _, key := range []string{"lab/uuid/old.cast", "lab/uuid/new.cast", "exam/uuid/old.cast"} {
+		writer, err := storage.Create(key)
+		require.NoError(err)
+		require.NoError(writer.Close())
+	}
+	old := clock.now.Add(-2 * time.Hour)
+	require.NoError(fs.Chtimes("/recordings/lab/uuid/old.cast", old, old))
+	require.NoError(fs.Chtimes("/recordings/exam/uuid/old.cast", old, old))
+	require.NoError(fs.Chtimes("/recordings/lab/uuid/new.cast", clock.now, clock.now))
+
+	require.NoError(recorder.Prune())
+	objects, err := storage.List("")
+	require.NoError(err)
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	// exam recordings are kept forever
+	assert.Equal([]string{"exam/uuid/old.cast", "lab/uuid/new.cast"}, keys)
+}
+
+func TestDirectoryStorage(t *testing.T) {
+	assert := assert.New(t)
+	storage := NewDirectoryStorage(afero.NewMemMapFs(), "/recordings")
+
+	objects, err := storage.List("")
+	assert.NoError(err)
+	assert.Empty(objects)
+
+	for _, key := range []string{"../escape.cast", "lab/../../escape.cast", "/absolute.cast", "", "lab//double.cast"} {
+		_, err := storage.Create(key)
+		assert.Error(err, key)
+		_, err = storage.Open(key)
+		assert.Error(err, key)
+	}
+
+	writer, err := storage.Create("lab/uuid/a.cast")
+	assert.NoError(err)
+	assert.NoError(writer.Close())
+	_, err = storage.Create("lab/uuid/a.cast")
+	assert.Error(err)
+	assert.NoError(storage.Remove("lab/uuid/a.cast"))
+}
+
+func TestSplitUTF8(t *testing.T) {
+	euro := []byte("€")
+	testCases := map[string]struct {
+		data           []byte
+		expectComplete string
+		expectRest     []byte
+	}{
+		"ascii":        {data: []byte("abc"), expectComplete: "abc"},
+		"complete":     {data: append([]byte("a"), euro...), expectComplete: "a€"},
+		"one byte":     {data: append([]byte("a"), euro[:1]...), expectComplete: "a", expectRest: euro[:1]},
+		"two bytes":    {data: append([]byte("a"), euro[:2]...), expectComplete: "a", expectRest: euro[:2]},
+		"invalid byte": {data: []byte{'a', 0xff}, expectComplete: "a\xff"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			complete, rest := splitUTF8(tc.data)
+			assert.Equal(t, tc.expectComplete, string(complete))
+			assert.Equal(t, tc.expectRest, rest)
+		})
+	}
+}
+
+type stubChannel struct {
+	input io.Reader
+	ssh.Channel
+}
+
+func (c *stubChannel) Read(p []byte) (int, error) {
+	return c.input.Read(p)
+}
+
+func (c *stubChannel) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *stubChannel) Stderr() io.ReadWriter {
+	return &bytes.Buffer{}
+}
+
+type stubSizeQueue struct {
+	size *remotecommand.TerminalSize
+}
+
+func (q *stubSizeQueue) Next() *remotecommand.TerminalSize {
+	return q.size
+}
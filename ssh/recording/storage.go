@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package recording
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Storage stores recordings as objects identified by a slash separated key.
+type Storage interface {
+	// Create creates a new object, existing objects are not overwritten.
+	Create(key string) (io.WriteCloser, error)
+	// Open opens an object for reading.
+	Open(key string) (io.ReadCloser, error)
+	// List returns the objects whose key starts with prefix, sorted by key.
+	List(prefix string) ([]Object, error)
+	// Remove deletes an object.
+	Remove(key string) error
+}
+
+// Object describes a stored recording.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// DirectoryStorage stores the objects as files in a directory, i.e. on a persistent volume.
+// It stands in for an object store, the key is the path of the file relative to the directory.
+type DirectoryStorage struct {
+	fs  afero.Fs
+	dir string
+}
+
+// NewDirectoryStorage creates a new DirectoryStorage.
+func NewDirectoryStorage(fs afero.Fs, dir string) *DirectoryStorage {
+	return &DirectoryStorage{fs: fs, dir: dir}
+}
+
+// Create creates the file of the object and its parent directories.
+func (d *DirectoryStorage) Create(key string) (io.WriteCloser, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.fs.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return nil, err
+	}
+	return d.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+// Open opens the file of the object.
+func (d *DirectoryStorage) Open(key string) (io.ReadCloser, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return d.fs.Open(name)
+}
+
+// List walks the directory and returns the matching files.
+func (d *DirectoryStorage) List(prefix string) ([]Object, error) {
+	var objects []Object
+	if _, err := d.fs.Stat(d.dir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	err := afero.Walk(d.fs, d.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Remove deletes the file of the object.
+func (d *DirectoryStorage) Remove(key string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return d.fs.Remove(name)
+}
+
+// path returns the file of the key, keys must not leave the directory.
+func (d *DirectoryStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || cleaned != "/"+key {
+		return "", errors.New("invalid recording key " + key)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(cleaned)), nil
+}
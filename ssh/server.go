@@ -12,17 +12,32 @@ import (
 	"log"
 	"net"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/benschlueter/delegatio/internal/hostkey"
 	"github.com/benschlueter/delegatio/internal/store"
 	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/internal/team"
+	"github.com/benschlueter/delegatio/ssh/audit"
+	"github.com/benschlueter/delegatio/ssh/auth"
+	"github.com/benschlueter/delegatio/ssh/certificate"
 	"github.com/benschlueter/delegatio/ssh/connection"
+	"github.com/benschlueter/delegatio/ssh/health"
+	"github.com/benschlueter/delegatio/ssh/keys"
 	"github.com/benschlueter/delegatio/ssh/kubernetes"
-	"github.com/benschlueter/delegatio/ssh/ldap"
+	"github.com/benschlueter/delegatio/ssh/mfa"
+	"github.com/benschlueter/delegatio/ssh/ratelimit"
+	"github.com/benschlueter/delegatio/ssh/recording"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
 	"github.com/benschlueter/delegatio/ssh/util"
+	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -36,141 +51,338 @@ type Server struct {
 	handleConnWG       *sync.WaitGroup
 	currentConnections int64
 	backingStore       store.Store
-	ldap               *ldap.Ldap
-	privateKey         []byte
+	// keys encrypt the secrets in the store, they are stored in plaintext if it is nil.
+	keys           *envelope.KeyRing
+	authenticators auth.Chain
+	// authority is nil if certificate authentication is disabled.
+	authority *certificate.Authority
+	// verifier is nil if the second factor is disabled.
+	verifier *mfa.Verifier
+	limiter  *ratelimit.Limiter
+	// recorder is nil if shells are not recorded.
+	recorder *recording.Recorder
+	// auditLogger is nil if the audit log is disabled.
+	auditLogger *audit.Logger
+	health      *health.Checker
+	// conf is the current configuration, serverConfig is created from it and used for new connections.
+	conf         atomic.Pointer[serverconfig.Config]
+	serverConfig atomic.Pointer[ssh.ServerConfig]
+	// hostKeys are the host keys of serverConfig and the next keys of ongoing rotations.
+	hostKeys atomic.Pointer[hostkey.Set]
+	// handlers are the handlers of the open connections, they are notified when the server drains.
+	handlers   map[*connection.Handler]struct{}
+	handlerMux sync.Mutex
 }
 
 // NewServer returns a sshServer.
-func NewServer(client kubernetes.K8sAPI, log *zap.Logger, storage store.Store, privKey []byte, ldap *ldap.Ldap) *Server {
-	return &Server{
+func NewServer(client kubernetes.K8sAPI, log *zap.Logger, storage store.Store, keys *envelope.KeyRing, authenticators auth.Chain, authority *certificate.Authority, verifier *mfa.Verifier, limiter *ratelimit.Limiter, recorder *recording.Recorder, auditLogger *audit.Logger, conf *serverconfig.Config, checker *health.Checker) *Server {
+	server := &Server{
 		k8sHelper:          client,
 		log:                log,
 		handleConnWG:       &sync.WaitGroup{},
 		currentConnections: 0,
 		backingStore:       storage,
-		privateKey:         privKey,
-		ldap:               ldap,
+		keys:               keys,
+		authenticators:     authenticators,
+		authority:          authority,
+		verifier:           verifier,
+		limiter:            limiter,
+		recorder:           recorder,
+		auditLogger:        auditLogger,
+		health:             checker,
+		handlers:           make(map[*connection.Handler]struct{}),
 	}
+	server.conf.Store(conf)
+	return server
 }
 
-// Start starts the ssh server.
+// config returns the current configuration.
+func (s *Server) config() *serverconfig.Config {
+	return s.conf.Load()
+}
+
+// Start starts the ssh server. When the context is cancelled the server drains: new connections are refused,
+// open sessions are notified and closed after the grace period.
 func (s *Server) Start(ctx context.Context) {
-	config := &ssh.ServerConfig{
+	if err := s.applyConfig(ctx, s.config()); err != nil {
+		log.Fatalf("Failed to apply configuration (%s)", err)
+	}
+	// routine currently leaks
+	periodicLogsDone := make(chan struct{})
+	go s.periodicLogs(ctx, periodicLogsDone)
+	if s.recorder != nil {
+		go s.recorder.PruneLoop(ctx, time.Hour)
+	}
+	go s.limiter.SweepLoop(ctx, 10*time.Minute)
+
+	var listeners []net.Listener
+	for _, address := range s.config().Listen {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s (%s)", address, err)
+		}
+		defer listener.Close()
+		s.log.Info("Listening", zap.String("address", address))
+		listeners = append(listeners, listener)
+	}
+
+	// connections outlive the context, they are closed by drainConnections.
+	connCtx, closeConnections := context.WithCancel(context.WithoutCancel(ctx))
+	defer closeConnections()
+
+	s.health.SetReady(true)
+	for _, listener := range listeners {
+		go s.acceptConnections(connCtx, listener)
+	}
+	<-ctx.Done()
+	s.health.SetReady(false)
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			s.log.Error("failed to close listener", zap.Error(err))
+		}
+	}
+	s.log.Info("waiting for periodicLogs to stop")
+	<-periodicLogsDone
+	s.log.Info("waiting for all connections to terminate gracefully", zap.Duration("gracePeriod", s.config().Drain.GracePeriod))
+	s.drainConnections(closeConnections)
+	s.log.Info("closing program")
+}
+
+// Reload applies the configuration to new connections. The listen addresses and the sections not handled by
+// the ssh protocol, i.e. authentication, mfa, rate limits, recording and the audit log, require a restart.
+func (s *Server) Reload(ctx context.Context, conf *serverconfig.Config) error {
+	if !slices.Equal(conf.Listen, s.config().Listen) {
+		s.log.Warn("listen addresses changed, restart the server to apply them", zap.Strings("listen", conf.Listen))
+	}
+	if err := s.applyConfig(ctx, conf); err != nil {
+		return err
+	}
+	s.log.Info("configuration reloaded")
+	return nil
+}
+
+// applyConfig creates the ssh server configuration and uses it for new connections.
+func (s *Server) applyConfig(ctx context.Context, conf *serverconfig.Config) error {
+	hostKeys, err := s.loadHostKeys(conf)
+	if err != nil {
+		return err
+	}
+	serverConfig := s.newServerConfig(ctx, conf)
+	for _, hostKey := range hostKeys.Current {
+		serverConfig.AddHostKey(hostKey)
+	}
+	s.conf.Store(conf)
+	s.hostKeys.Store(&hostKeys)
+	s.serverConfig.Store(serverConfig)
+	return nil
+}
+
+// newServerConfig creates the ssh server configuration without host keys.
+func (s *Server) newServerConfig(ctx context.Context, conf *serverconfig.Config) *ssh.ServerConfig {
+	serverConfig := &ssh.ServerConfig{
+		Config: conf.SSHConfig(),
 		// Function is called to determine if the user is allowed to connect with the ssh server
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			var userData config.UserInformation
 			encodeKey := base64.StdEncoding.EncodeToString(key.Marshal())
 			s.log.Debug("publickeycallback called", zap.String("user", conn.User()), zap.Binary("session", conn.SessionID()), zap.String("key", encodeKey))
+			// clients offer all of their keys, so rejected keys are not counted as failed logins. Keys can not be
+			// guessed and the handshakes per IP bound the attempts.
+			if cert, ok := key.(*ssh.Certificate); ok {
+				permissions, err := s.certificateCallback(cert)
+				if err != nil {
+					return nil, err
+				}
+				return s.secondFactor(conn, permissions, true)
+			}
 
-			err := s.data().GetPublicKeyData(string(key.Marshal()), &userData)
+			userData, err := s.data().WithContext(ctx).GetUserByPublicKey(string(key.Marshal()))
 			if err != nil {
 				s.log.Error("failed to obtain user data", zap.Error(err))
 				return nil, fmt.Errorf("failed to obtain user data: %w", err)
 			}
-			return &ssh.Permissions{
+			return s.secondFactor(conn, &ssh.Permissions{
 				Extensions: map[string]string{
 					config.AuthenticationType:  "pk",
 					config.AuthenticatedUserID: userData.UUID,
+					config.AuthenticatedPubKey: string(key.Marshal()),
 				},
-			}, nil
+			}, true)
 		},
 		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 			s.log.Debug("passwordcallback called", zap.String("user", conn.User()), zap.Binary("session", conn.SessionID()))
-			userData, err := s.ldap.Search(conn.User(), string(password))
-			if err != nil {
-				return nil, fmt.Errorf("ldap search for user %s failed: %w", conn.User(), err)
-			}
-			exists, err := s.data().UUIDExists(userData.UUID)
+			username, err := loginUser(conn.User())
 			if err != nil {
-				s.log.Error("error checking if uuid exists; likely due to etcd", zap.Error(err))
-				return nil, fmt.Errorf("error checking if uuid %s exists: %w", userData.UUID, err)
+				return nil, err
 			}
-			// We assume that when an entry exists in the store it ALWAYS has a public/private key pair
-			if !exists {
-				privKey, pubKey, err := util.CreateSSHKeypair()
-				if err != nil {
-					return nil, fmt.Errorf("failed to create ssh keypair: %w", err)
-				}
-				userData.PrivKey = privKey
-				userData.PubKey = pubKey
-				err = s.data().PutDataIdxByUUID(userData.UUID, userData)
+			return s.limitedAuth(conn, username, func() (*ssh.Permissions, error) {
+				userData, err := s.authenticators.Authenticate(ctx, auth.MethodPassword, auth.Credentials{Username: username, Password: string(password)})
 				if err != nil {
-					return nil, fmt.Errorf("failed to put data into store: %w", err)
+					return nil, fmt.Errorf("password authentication for user %s failed: %w", conn.User(), err)
 				}
-				err = s.data().PutDataIdxByPubKey(string(userData.PubKey), userData)
+				permissions, err := s.userPermissions(userData)
 				if err != nil {
-					return nil, fmt.Errorf("failed to put data into store: %w", err)
+					return nil, err
 				}
-				s.log.Debug("public key created and stored", zap.String("key", string(userData.PubKey)))
-			}
-			if err := s.data().GetUUIDData(userData.UUID, userData); err != nil {
-				return nil, fmt.Errorf("getting user data: %w", err)
-			}
-			s.log.Debug("private key", zap.String("key", string(userData.PrivKey)))
-			return &ssh.Permissions{
-				Extensions: map[string]string{
-					config.AuthenticationType:   "pw",
-					config.AuthenticatedPrivKey: string(userData.PrivKey),
-					config.AuthenticatedUserID:  userData.UUID,
-				},
-			}, nil
+				return s.secondFactor(conn, permissions, false)
+			})
 		},
+		AuthLogCallback: s.auditAuthAttempt,
 		BannerCallback: func(conn ssh.ConnMetadata) string {
-			return fmt.Sprintf("delegatio ssh server version %s\ncommit %s\nsession ID %s\n", config.Version, config.Commit, base64.StdEncoding.EncodeToString(conn.SessionID()))
+			banner, err := conf.RenderBanner(serverconfig.BannerData{
+				Version:   config.Version,
+				Commit:    config.Commit,
+				SessionID: base64.StdEncoding.EncodeToString(conn.SessionID()),
+				User:      conn.User(),
+			})
+			if err != nil {
+				s.log.Error("failed to render banner", zap.Error(err))
+			}
+			return banner
 		},
 	}
-	// routine currently leaks
-	periodicLogsDone := make(chan struct{})
-	go s.periodicLogs(ctx, periodicLogsDone)
-
-	private, err := ssh.ParsePrivateKey(s.privateKey)
-	if err != nil {
-		log.Fatal("Failed to parse private key")
+	if s.authenticators.Supports(auth.MethodKeyboardInteractive) {
+		serverConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			s.log.Debug("keyboardinteractivecallback called", zap.String("user", conn.User()), zap.Binary("session", conn.SessionID()))
+			username, err := loginUser(conn.User())
+			if err != nil {
+				return nil, err
+			}
+			return s.limitedAuth(conn, username, func() (*ssh.Permissions, error) {
+				userData, err := s.authenticators.Authenticate(ctx, auth.MethodKeyboardInteractive, auth.Credentials{Username: username, Challenge: challenge})
+				if err != nil {
+					return nil, fmt.Errorf("keyboard-interactive authentication for user %s failed: %w", conn.User(), err)
+				}
+				permissions, err := s.userPermissions(userData)
+				if err != nil {
+					return nil, err
+				}
+				return s.secondFactor(conn, permissions, false)
+			})
+		}
 	}
+	return serverConfig
+}
 
-	config.AddHostKey(private)
-	listener, err := net.Listen("tcp", "0.0.0.0:2200")
-	if err != nil {
-		log.Fatalf("Failed to listen on 2200 (%s)", err)
+// loadHostKeys reads the host keys of the configuration. The host keys from the store are used if none are configured,
+// they are read on every reload to pick up rotations.
+func (s *Server) loadHostKeys(conf *serverconfig.Config) (hostkey.Set, error) {
+	if len(conf.HostKeys) == 0 {
+		hostKeys, err := hostkey.Load(s.data())
+		if err != nil {
+			return hostkey.Set{}, fmt.Errorf("loading host keys from store: %w", err)
+		}
+		if len(hostKeys.Current) == 0 {
+			return hostkey.Set{}, errors.New("no host keys in store, they are generated by the installer")
+		}
+		return hostKeys, nil
+	}
+	fileHandler := file.NewHandler(afero.NewOsFs())
+	keyTypes := make(map[string]string)
+	var hostKeys hostkey.Set
+	for _, path := range conf.HostKeys {
+		data, err := fileHandler.Read(path)
+		if err != nil {
+			return hostkey.Set{}, fmt.Errorf("reading host key: %w", err)
+		}
+		private, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return hostkey.Set{}, fmt.Errorf("parsing host key %s: %w", path, err)
+		}
+		keyType := private.PublicKey().Type()
+		if other, ok := keyTypes[keyType]; ok {
+			return hostkey.Set{}, fmt.Errorf("host keys %s and %s are both of type %s", other, path, keyType)
+		}
+		keyTypes[keyType] = path
+		hostKeys.Current = append(hostKeys.Current, private)
 	}
-	defer listener.Close()
+	return hostKeys, nil
+}
 
-	s.log.Info("Listening on  \"0.0.0.0:2200\"")
-	go func(ctx context.Context) {
-		for {
-			tcpConn, err := listener.Accept()
-			if errors.Is(err, net.ErrClosed) {
-				// s.log.Error("failed to accept incoming connection", zap.Error(err))
-				return
-			}
-			if err != nil {
-				s.log.Error("failed to accept incoming connection", zap.Error(err))
-				continue
-			}
-			s.log.Info("received data on connection", zap.String("addr", tcpConn.RemoteAddr().String()))
-			s.handleConnWG.Add(1)
-			atomic.AddInt64(&s.currentConnections, 1)
-			go s.validateAndProcessConnection(ctx, tcpConn, config)
+// acceptConnections accepts connections until the listener is closed.
+func (s *Server) acceptConnections(ctx context.Context, listener net.Listener) {
+	for {
+		tcpConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
 		}
-	}(ctx)
-	<-ctx.Done()
-	if err := listener.Close(); err != nil {
-		s.log.Error("failed to close listener", zap.Error(err))
+		if err != nil {
+			s.log.Error("failed to accept incoming connection", zap.Error(err))
+			continue
+		}
+		s.log.Info("received data on connection", zap.String("addr", tcpConn.RemoteAddr().String()))
+		if err := s.allowConnection(tcpConn); err != nil {
+			s.log.Info("connection rejected", zap.String("addr", tcpConn.RemoteAddr().String()), zap.Error(err))
+			tcpConn.Close()
+			continue
+		}
+		s.handleConnWG.Add(1)
+		atomic.AddInt64(&s.currentConnections, 1)
+		go s.validateAndProcessConnection(ctx, tcpConn, s.serverConfig.Load())
+	}
+}
+
+// drainConnections notifies the open sessions and waits until all connections are closed by the users.
+// Connections still open after the grace period are closed.
+func (s *Server) drainConnections(closeConnections context.CancelFunc) {
+	drain := s.config().Drain
+	deadline := time.Now().Add(drain.GracePeriod)
+	s.broadcast(fmt.Sprintf("%s Open sessions are closed at %s.", drain.Message, deadline.UTC().Format("15:04:05 MST")))
+	done := make(chan struct{})
+	go func() {
+		s.handleConnWG.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(drain.GracePeriod)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+		s.log.Info("grace period is over, closing open connections", zap.Int64("conn", atomic.LoadInt64(&s.currentConnections)))
+		closeConnections()
+	}
+	<-done
+}
+
+// broadcast sends the message to all open sessions.
+func (s *Server) broadcast(message string) {
+	s.handlerMux.Lock()
+	defer s.handlerMux.Unlock()
+	for handler := range s.handlers {
+		handler.Broadcast(message)
 	}
-	s.log.Info("waiting for periodicLogs to stop")
-	<-periodicLogsDone
-	s.log.Info("waiting for all connections to terminate gracefully")
-	s.handleConnWG.Wait()
-	s.log.Info("closing program")
 }
 
-func (s *Server) validateAndProcessConnection(ctx context.Context, tcpConn net.Conn, config *ssh.ServerConfig) {
+func (s *Server) addHandler(handler *connection.Handler) {
+	s.handlerMux.Lock()
+	defer s.handlerMux.Unlock()
+	s.handlers[handler] = struct{}{}
+}
+
+func (s *Server) removeHandler(handler *connection.Handler) {
+	s.handlerMux.Lock()
+	defer s.handlerMux.Unlock()
+	delete(s.handlers, handler)
+}
+
+// allowConnection checks the connection limit of the replica and the handshake limit of the source IP.
+func (s *Server) allowConnection(tcpConn net.Conn) error {
+	if err := s.limiter.AllowConnection(atomic.LoadInt64(&s.currentConnections)); err != nil {
+		return err
+	}
+	return s.limiter.AllowHandshake(remoteIP(tcpConn.RemoteAddr()))
+}
+
+func (s *Server) validateAndProcessConnection(ctx context.Context, tcpConn net.Conn, serverConfig *ssh.ServerConfig) {
 	defer func() {
 		s.handleConnWG.Done()
 		atomic.AddInt64(&s.currentConnections, -1)
 	}()
+	// closing the tcp connection aborts the handshake or closes the ssh connection when the server is drained.
+	stop := context.AfterFunc(ctx, func() { tcpConn.Close() })
+	defer stop()
 
-	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, serverConfig)
 	if err != nil {
 		s.log.Info("failed to handshake", zap.Error(err))
 		return
@@ -180,20 +392,216 @@ func (s *Server) validateAndProcessConnection(ctx context.Context, tcpConn net.C
 		return
 	}
 	s.log.Info("authentication of connection successful", zap.Binary("session", sshConn.SessionID()))
+	s.auditLog(audit.EventAuthSuccess, sshConn, nil)
+	if publicKey := sshConn.Permissions.Extensions[config.AuthenticatedPubKey]; publicKey != "" {
+		if err := s.data().WithContext(ctx).TouchPublicKey([]byte(publicKey), time.Now()); err != nil {
+			s.log.Warn("failed to record the use of the public key", zap.Binary("session", sshConn.SessionID()), zap.Error(err))
+		}
+	}
+	release, err := s.limiter.AcquireSession(ctx, sshConn.Permissions.Extensions[config.AuthenticatedUserID])
+	if err != nil {
+		s.log.Info("session rejected", zap.Binary("session", sshConn.SessionID()), zap.Error(err))
+		s.auditLog(audit.EventSessionStart, sshConn, err)
+		sshConn.Close()
+		return
+	}
+	defer release()
+	s.auditLog(audit.EventSessionStart, sshConn, nil)
+	defer func(start time.Time) {
+		if s.auditLogger == nil {
+			return
+		}
+		event := audit.ConnectionEvent(audit.EventSessionEnd, sshConn)
+		event.UUID = sshConn.Permissions.Extensions[config.AuthenticatedUserID]
+		event.Duration = time.Since(start).Seconds()
+		s.auditLogger.Log(event)
+	}(time.Now())
+	if keysLogin(sshConn.User()) {
+		defer sshConn.Close()
+		keys.ServeConnection(ctx, s.log.Named("keys"), s.data(), sshConn, chans, reqs)
+		return
+	}
+	if sshConn.User() == config.SSHCertificateUser {
+		defer sshConn.Close()
+		if s.authority == nil {
+			s.log.Info("certificate requested, but certificate authentication is disabled")
+			return
+		}
+		s.authority.ServeSigningConnection(ctx, s.log.Named("certificate"), sshConn, chans, reqs)
+		return
+	}
+	workspace, err := team.ResolveWorkspace(s.data().WithContext(ctx), sshConn.User(), sshConn.Permissions.Extensions[config.AuthenticatedUserID])
+	if err != nil {
+		s.log.Error("failed to resolve workspace", zap.Binary("session", sshConn.SessionID()), zap.Error(err))
+		return
+	}
+	// the key of the user is only known after password logins, team workspaces are shared and get the key of the team
+	workspaceKey := []byte(sshConn.Permissions.Extensions[config.AuthenticatedPrivKey])
+	if name, ok := team.FromWorkspace(workspace); ok {
+		if workspaceKey, err = team.WorkspaceKey(s.data().WithContext(ctx), name); err != nil {
+			s.log.Error("failed to get the key of the team workspace", zap.Binary("session", sshConn.SessionID()), zap.Error(err))
+			return
+		}
+	}
 	builder := connection.NewBuilder()
 	builder.SetK8sHelper(s.k8sHelper)
+	builder.SetWorkspace(workspace)
+	builder.SetWorkspaceKey(workspaceKey)
+	builder.SetTeammates(s.teammates)
 	builder.SetChannel(chans)
 	builder.SetGlobalRequests(reqs)
 	builder.SetConnection(sshConn)
 	builder.SetLogger(s.log)
+	builder.SetRecorder(s.recorder)
+	builder.SetAuditLogger(s.auditLogger)
+	builder.SetConfig(s.config())
+	builder.SetHostKeys(s.hostKeys.Load().All())
 	sshConnHandler, err := builder.Build()
 	if err != nil {
 		s.log.Info("failed to build sshConnHandler", zap.Error(err))
 		return
 	}
+	s.addHandler(sshConnHandler)
+	defer s.removeHandler(sshConnHandler)
 	sshConnHandler.HandleGlobalConnection(ctx)
 }
 
+// userPermissions creates a key pair for users logging in for the first time and returns the permissions of the connection.
+// Password and keyboard-interactive logins share the "pw" authentication type, both get the private key of the user.
+func (s *Server) userPermissions(userData *config.UserInformation) (*ssh.Permissions, error) {
+	exists, err := s.data().UUIDExists(userData.UUID)
+	if err != nil {
+		s.log.Error("error checking if uuid exists; likely due to etcd", zap.Error(err))
+		return nil, fmt.Errorf("error checking if uuid %s exists: %w", userData.UUID, err)
+	}
+	// We assume that when an entry exists in the store it ALWAYS has a public/private key pair
+	if !exists {
+		privKey, pubKey, err := util.CreateSSHKeypair()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ssh keypair: %w", err)
+		}
+		userData.PrivKey = privKey
+		userData.PubKey = pubKey
+		if err := s.data().PutUser(*userData); err != nil {
+			return nil, fmt.Errorf("failed to put data into store: %w", err)
+		}
+		s.log.Debug("public key created and stored", zap.String("key", string(userData.PubKey)))
+	}
+	user, err := s.data().GetUser(userData.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("getting user data: %w", err)
+	}
+	*userData = user
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			config.AuthenticationType:   "pw",
+			config.AuthenticatedPrivKey: string(userData.PrivKey),
+			config.AuthenticatedUserID:  userData.UUID,
+		},
+	}, nil
+}
+
+// teammates returns the teammates of the user in the challenge. Users only reach their teammates in challenges with
+// teams enabled, otherwise they work in individual workspaces.
+func (s *Server) teammates(ctx context.Context, challenge, uuid string) ([]string, error) {
+	data := s.data().WithContext(ctx)
+	workspace, err := team.ResolveWorkspace(data, challenge, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if workspace == uuid {
+		return nil, nil
+	}
+	return team.Teammates(data, uuid)
+}
+
+// limitedAuth rejects the attempt if the source IP or the user is locked, otherwise it authenticates the user
+// and records the result for the brute-force protection. The user is the identity the secret belongs to, i.e.
+// the username of the backend for passwords and the uuid for second factors, not the challenge of the login.
+func (s *Server) limitedAuth(conn ssh.ConnMetadata, user string, authenticate func() (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	ip := remoteIP(conn.RemoteAddr())
+	if err := s.limiter.AllowAuth(ip, user); err != nil {
+		s.log.Info("authentication attempt rejected", zap.String("user", conn.User()), zap.String("ip", ip), zap.Error(err))
+		return nil, err
+	}
+	permissions, err := authenticate()
+	var partialSuccess *ssh.PartialSuccessError
+	switch {
+	case errors.As(err, &partialSuccess):
+	case err != nil:
+		s.limiter.AuthFailed(ip, user)
+	default:
+		s.limiter.AuthSucceeded(user)
+	}
+	return permissions, err
+}
+
+// secondFactor returns the permissions if the policy of the course requires no second factor for the authentication method.
+// Otherwise the client has to continue with a keyboard-interactive authentication asking for the verification code.
+func (s *Server) secondFactor(conn ssh.ConnMetadata, permissions *ssh.Permissions, publicKey bool) (*ssh.Permissions, error) {
+	if s.verifier == nil || !s.verifier.Required(conn.User(), publicKey) {
+		return permissions, nil
+	}
+	uuid := permissions.Extensions[config.AuthenticatedUserID]
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				s.log.Debug("second factor requested", zap.String("user", conn.User()), zap.Binary("session", conn.SessionID()))
+				return s.limitedAuth(conn, uuid, func() (*ssh.Permissions, error) {
+					if err := s.verifier.Authenticate(uuid, challenge); err != nil {
+						s.log.Info("second factor rejected", zap.String("uuid", uuid), zap.Error(err))
+						return nil, fmt.Errorf("second factor of user %s rejected: %w", uuid, err)
+					}
+					return permissions, nil
+				})
+			},
+		},
+	}
+}
+
+// certificateCallback authenticates a user with a certificate issued by the authority.
+// The user must still exist in the store, so deleting a user revokes all of its certificates.
+func (s *Server) certificateCallback(cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if s.authority == nil {
+		return nil, errors.New("certificate authentication is disabled")
+	}
+	uuid, err := s.authority.Authenticate(cert, func(cert *ssh.Certificate) bool {
+		revoked, err := s.data().CertificateRevoked(cert.Serial)
+		if err != nil {
+			s.log.Error("error checking if certificate is revoked; likely due to etcd", zap.Error(err))
+			return true
+		}
+		if revoked {
+			return true
+		}
+		// certificates of revoked public keys are rejected as well
+		revoked, err = s.data().PublicKeyRevoked(ssh.FingerprintSHA256(cert.Key))
+		if err != nil {
+			s.log.Error("error checking if public key is revoked; likely due to etcd", zap.Error(err))
+			return true
+		}
+		return revoked
+	})
+	if err != nil {
+		s.log.Info("certificate rejected", zap.Uint64("serial", cert.Serial), zap.Error(err))
+		return nil, fmt.Errorf("certificate rejected: %w", err)
+	}
+	exists, err := s.data().UUIDExists(uuid)
+	if err != nil {
+		s.log.Error("error checking if uuid exists; likely due to etcd", zap.Error(err))
+		return nil, fmt.Errorf("error checking if uuid %s exists: %w", uuid, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("user %s of certificate does not exist", uuid)
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			config.AuthenticationType:  "cert",
+			config.AuthenticatedUserID: uuid,
+		},
+	}, nil
+}
+
 func (s *Server) periodicLogs(ctx context.Context, done chan<- struct{}) {
 	t := time.NewTicker(10 * time.Second)
 	defer func() {
@@ -213,6 +621,65 @@ func (s *Server) periodicLogs(ctx context.Context, done chan<- struct{}) {
 	}
 }
 
+// auditAuthAttempt writes failed and partially successful authentication attempts to the audit log.
+// Successful authentications are written once the handshake is complete, so they contain the uuid of the user.
+// The "none" method is tried by clients to query the supported methods, its failures are not audited.
+func (s *Server) auditAuthAttempt(conn ssh.ConnMetadata, method string, err error) {
+	if s.auditLogger == nil || err == nil || method == "none" {
+		return
+	}
+	event := audit.ConnectionEvent(audit.EventAuthFailure, conn)
+	event.AuthMethod = method
+	var partialSuccess *ssh.PartialSuccessError
+	if errors.As(err, &partialSuccess) {
+		event.Type = audit.EventAuthPartial
+	} else {
+		event.Error = err.Error()
+	}
+	s.auditLogger.Log(event)
+}
+
+// auditLog writes an event of the authenticated connection to the audit log. A non-nil err marks the event as rejected.
+func (s *Server) auditLog(eventType string, sshConn *ssh.ServerConn, err error) {
+	if s.auditLogger == nil {
+		return
+	}
+	event := audit.ConnectionEvent(eventType, sshConn)
+	event.UUID = sshConn.Permissions.Extensions[config.AuthenticatedUserID]
+	event.AuthMethod = sshConn.Permissions.Extensions[config.AuthenticationType]
+	event.Accepted = audit.Bool(err == nil)
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.auditLogger.Log(event)
+}
+
+// loginUser returns the name of the user a password or keyboard-interactive login authenticates. The keys user is
+// followed by the name of the user, i.e. keys+<user>, so the plain keys user can only log in with a public key.
+func loginUser(user string) (string, error) {
+	if user == config.SSHKeysUser {
+		return "", fmt.Errorf("password logins to the %s user require %s+<user>", config.SSHKeysUser, config.SSHKeysUser)
+	}
+	if name, ok := strings.CutPrefix(user, config.SSHKeysUser+"+"); ok {
+		return name, nil
+	}
+	return user, nil
+}
+
+// keysLogin reports whether the login manages the public keys of the user.
+func keysLogin(user string) bool {
+	return user == config.SSHKeysUser || strings.HasPrefix(user, config.SSHKeysUser+"+")
+}
+
+// remoteIP returns the IP of the address without the port.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func (s *Server) data() storewrapper.StoreWrapper {
-	return storewrapper.StoreWrapper{Store: s.backingStore}
+	return storewrapper.StoreWrapper{Store: s.backingStore, Keys: s.keys}
 }
@@ -0,0 +1,189 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/benschlueter/delegatio/internal/storewrapper"
+	"github.com/benschlueter/delegatio/internal/team"
+	"github.com/benschlueter/delegatio/ssh/ratelimit"
+	"github.com/benschlueter/delegatio/ssh/serverconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	require.NoError(t, err)
+	return signer
+}
+
+// newTestServer returns a server without kubernetes whose rate limiter locks users and IPs after one failure.
+func newTestServer(t *testing.T, backingStore store.Store) (*Server, *ssh.ServerConfig) {
+	conf := serverconfig.Default()
+	conf.RateLimit = serverconfig.RateLimitConfig{
+		Window:             time.Minute,
+		HandshakesPerIP:    10,
+		MaxFailuresPerUser: 1,
+		MaxFailuresPerIP:   1,
+		Lockout:            time.Minute,
+		MaxLockout:         time.Minute,
+		MaxConnections:     10,
+		MaxSessionsPerUser: 10,
+	}
+	limiter := ratelimit.NewLimiter(zap.NewNop(), backingStore, conf.RateLimit)
+	server := NewServer(nil, zap.NewNop(), backingStore, nil, nil, nil, nil, limiter, nil, nil, conf, nil)
+	serverConfig := server.newServerConfig(context.Background(), conf)
+	serverConfig.AddHostKey(newTestSigner(t))
+	return server, serverConfig
+}
+
+// testLogin performs the ssh handshake of the user with the signers and returns the permissions of the server.
+func testLogin(t *testing.T, serverConfig *ssh.ServerConfig, user string, signers ...ssh.Signer) (*ssh.Permissions, error) {
+	// the handshake needs buffered connections, both sides send their version first
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	defer func() { <-clientDone }()
+	netConn, err := listener.Accept()
+	require.NoError(t, err)
+	defer netConn.Close()
+	conn, _, _, err := ssh.NewServerConn(netConn, serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Permissions, nil
+}
+
+func TestPublicKeyLoginAfterUnknownKeys(t *testing.T) {
+	testCases := map[string]struct {
+		unknownKeys int
+		rightKey    bool
+		wantErr     bool
+	}{
+		"right key": {
+			rightKey: true,
+		},
+		"unknown keys before the right key": {
+			unknownKeys: 3,
+			rightKey:    true,
+		},
+		"only unknown keys": {
+			unknownKeys: 3,
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backingStore := store.NewStdStore()
+			_, serverConfig := newTestServer(t, backingStore)
+			userKey := newTestSigner(t)
+			require.NoError(storewrapper.StoreWrapper{Store: backingStore}.PutUser(config.UserInformation{
+				UUID:   "uuid",
+				PubKey: userKey.PublicKey().Marshal(),
+			}))
+
+			var signers []ssh.Signer
+			for range tc.unknownKeys {
+				signers = append(signers, newTestSigner(t))
+			}
+			if tc.rightKey {
+				signers = append(signers, userKey)
+			}
+			permissions, err := testLogin(t, serverConfig, "challenge", signers...)
+			if tc.wantErr {
+				assert.Error(err)
+			} else {
+				require.NoError(err)
+				assert.Equal("uuid", permissions.Extensions[config.AuthenticatedUserID])
+			}
+			// the rejected keys lock neither the challenge nor the source IP
+			permissions, err = testLogin(t, serverConfig, "challenge", newTestSigner(t), userKey)
+			require.NoError(err)
+			assert.Equal("uuid", permissions.Extensions[config.AuthenticatedUserID])
+		})
+	}
+}
+
+func TestTeammates(t *testing.T) {
+	testCases := map[string]struct {
+		challenge       string
+		uuid            string
+		expectTeammates []string
+	}{
+		"team challenge": {
+			challenge:       "project",
+			uuid:            "alice",
+			expectTeammates: []string{"bob"},
+		},
+		"team challenge without team": {
+			challenge: "project",
+			uuid:      "carol",
+		},
+		"challenge without teams": {
+			challenge: "exam",
+			uuid:      "alice",
+		},
+		"unknown challenge": {
+			challenge: "lab",
+			uuid:      "alice",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			backingStore := store.NewStdStore()
+			server, _ := newTestServer(t, backingStore)
+			data := storewrapper.StoreWrapper{Store: backingStore}
+			for _, uuid := range []string{"alice", "bob", "carol"} {
+				require.NoError(data.PutUser(config.UserInformation{UUID: uuid}))
+			}
+			require.NoError(data.PutChallenge("project", config.ContainerInformation{Teams: true}))
+			require.NoError(data.PutChallenge("exam", config.ContainerInformation{}))
+			require.NoError(team.Create(data, "red", []string{"alice", "bob"}))
+
+			teammates, err := server.teammates(context.Background(), tc.challenge, tc.uuid)
+			require.NoError(err)
+			assert.Equal(tc.expectTeammates, teammates)
+		})
+	}
+}
@@ -0,0 +1,601 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package serverconfig contains the configuration of the ssh server.
+// The configuration is read from a YAML file or from the ssh-config ConfigMap.
+package serverconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"text/template"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/backup"
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/envelope"
+	"github.com/benschlueter/delegatio/internal/file"
+	"github.com/benschlueter/delegatio/internal/store"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Authentication backend types.
+const (
+	BackendLDAP     = "ldap"
+	BackendOIDC     = "oidc"
+	BackendHtpasswd = "htpasswd"
+)
+
+// reservedBackendName prefixes the workspaces of teams, it can not be the name of an authentication backend.
+const reservedBackendName = "team"
+
+// backendNameRegexp matches the names of authentication backends. They contain no dashes, so the uuid of a user
+// always starts with the name of its backend followed by a single dash.
+var backendNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// Config is the configuration of the ssh server.
+type Config struct {
+	// Listen are the addresses the ssh server listens on. Defaults to 0.0.0.0:2200.
+	Listen []string `yaml:"listen"`
+	// HostKeys are the paths of PEM encoded private host keys. The host keys from the store are used if it is empty.
+	HostKeys []string `yaml:"hostKeys"`
+	// Algorithms restricts the algorithms negotiated with the clients.
+	Algorithms AlgorithmsConfig `yaml:"algorithms"`
+	// KeepAlive configures the detection of dead connections. Zero values are replaced with the defaults.
+	KeepAlive KeepAliveConfig `yaml:"keepAlive"`
+	// Session limits the sessions of a connection. Zero values are replaced with the defaults.
+	Session SessionConfig `yaml:"session"`
+	// Banner is a text/template shown before the authentication, see BannerData.
+	Banner string `yaml:"banner"`
+	// MOTD is a text/template written to shells after the login, see MOTDData. Nothing is written if it is empty.
+	MOTD string `yaml:"motd"`
+	// ChannelTypes are the enabled channel types. Defaults to all supported types.
+	ChannelTypes []string `yaml:"channelTypes"`
+	// Subsystems maps the subsystem requested by the client to the built-in implementation. Defaults to {sftp: sftp}.
+	Subsystems map[string]string `yaml:"subsystems"`
+	// SFTP configures the built-in SFTP server. Zero values are replaced with the defaults.
+	SFTP SFTPConfig `yaml:"sftp"`
+	// Forwarding is the policy of the destinations of direct-tcpip channels.
+	Forwarding ForwardingConfig `yaml:"forwarding"`
+	// Authentication is the chain of backends used for password and keyboard-interactive logins.
+	// The backends are tried in order, the first successful backend authenticates the user.
+	Authentication []AuthenticationBackend `yaml:"authentication"`
+	// MFA configures the second factor, it is disabled if the section is missing.
+	MFA *MFAConfig `yaml:"mfa,omitempty"`
+	// RateLimit limits connections and authentication attempts. Zero values are replaced with the defaults.
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	// Recording configures the recording of shells, it is disabled if the section is missing.
+	Recording *RecordingConfig `yaml:"recording,omitempty"`
+	// Audit configures the audit log. Defaults to stdout.
+	Audit AuditConfig `yaml:"audit"`
+	// Drain configures the shutdown of the server. Zero values are replaced with the defaults.
+	Drain DrainConfig `yaml:"drain"`
+	// Store selects the store backend, it is read once at the start. Defaults to the etcd of the cluster.
+	Store store.Config `yaml:"store"`
+	// Encryption selects the key ring used to encrypt the secrets in the store, they are stored in plaintext if the
+	// section is missing. It is read once at the start.
+	Encryption *envelope.Config `yaml:"encryption,omitempty"`
+	// Backup configures the snapshots of the store, they are not scheduled if the section is missing. It is read once
+	// at the start.
+	Backup *backup.Config `yaml:"backup,omitempty"`
+}
+
+// Channel types supported by the server.
+const (
+	ChannelSession     = "session"
+	ChannelDirectTCPIP = "direct-tcpip"
+)
+
+// SubsystemSFTP is the built-in SFTP server.
+const SubsystemSFTP = "sftp"
+
+// DefaultBanner is the banner used if none is configured.
+const DefaultBanner = "delegatio ssh server version {{.Version}}\ncommit {{.Commit}}\nsession ID {{.SessionID}}\n"
+
+// supportedCiphers, supportedKeyExchanges and supportedMACs are the algorithms implemented by golang.org/x/crypto/ssh.
+var (
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com", "arcfour256", "arcfour128", "arcfour", "aes128-cbc", "3des-cbc",
+	}
+	supportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// AlgorithmsConfig restricts the negotiated algorithms, the defaults of golang.org/x/crypto/ssh are used for empty lists.
+type AlgorithmsConfig struct {
+	Ciphers      []string `yaml:"ciphers"`
+	KeyExchanges []string `yaml:"keyExchanges"`
+	MACs         []string `yaml:"macs"`
+}
+
+// KeepAliveConfig configures the keepalive requests sent to the clients.
+type KeepAliveConfig struct {
+	// Interval is the interval of the keepalive requests.
+	Interval time.Duration `yaml:"interval"`
+	// MaxRetries is the number of unanswered keepalive requests after which the connection is closed.
+	MaxRetries int `yaml:"maxRetries"`
+}
+
+// SessionConfig limits the sessions of a connection. Negative values disable a limit.
+type SessionConfig struct {
+	// IdleTimeout closes connections without channel data in either direction for the duration.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxDuration closes connections after the duration, regardless of their activity.
+	MaxDuration time.Duration `yaml:"maxDuration"`
+	// Warning is the time before a timeout at which the user is warned.
+	Warning time.Duration `yaml:"warning"`
+	// MaxSessions is the number of concurrent session channels of a connection.
+	MaxSessions int `yaml:"maxSessions"`
+	// Challenges maps the challenge (the ssh user name) to its timeouts, zero values are taken from the defaults above.
+	Challenges map[string]SessionTimeouts `yaml:"challenges"`
+}
+
+// SessionTimeouts are the timeouts of the connections to a challenge. Negative values disable a timeout.
+type SessionTimeouts struct {
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	MaxDuration time.Duration `yaml:"maxDuration"`
+}
+
+// Timeouts returns the timeouts of the challenge.
+func (s *SessionConfig) Timeouts(challenge string) SessionTimeouts {
+	timeouts := s.Challenges[challenge]
+	setDefault(&timeouts.IdleTimeout, s.IdleTimeout)
+	setDefault(&timeouts.MaxDuration, s.MaxDuration)
+	return timeouts
+}
+
+// SFTPConfig configures the built-in SFTP server.
+type SFTPConfig struct {
+	// Quota is the number of bytes a user may store in the home directory using SFTP, a negative value disables it.
+	// The usage is shared by all sessions of the workspace, it is read from the disk of the container.
+	Quota int64 `yaml:"quota"`
+}
+
+// ForwardingConfig is the policy of the destinations of direct-tcpip channels. The own container of the user is
+// always reachable, the containers of teammates are reachable if teams are configured.
+type ForwardingConfig struct {
+	// Services maps the challenge (the ssh user name) to the services shared by its users.
+	Services map[string][]ForwardService `yaml:"services"`
+}
+
+// ForwardService is a service shared by the users of a challenge, e.g. a vulnerable target server.
+type ForwardService struct {
+	// Name is the host requested by the client.
+	Name string `yaml:"name"`
+	// Address is the host dialed by the ssh server, e.g. target.exam.svc.cluster.local. Defaults to the name.
+	Address string `yaml:"address"`
+	// Ports are the reachable ports, all ports are reachable if it is empty.
+	Ports []uint32 `yaml:"ports"`
+}
+
+// BannerData is passed to the banner template.
+type BannerData struct {
+	Version   string
+	Commit    string
+	SessionID string
+	User      string
+}
+
+// MOTDData is passed to the MOTD template.
+type MOTDData struct {
+	Version   string
+	Challenge string
+	UUID      string
+}
+
+// AuthenticationBackend configures a single authentication backend. Only the section matching Type is used.
+type AuthenticationBackend struct {
+	Type string `yaml:"type"`
+	// Name is prepended to the uuids of the users of the backend, so users of different backends never share a uuid,
+	// workspace or keys. Lower case letters and digits, defaults to the type.
+	Name     string          `yaml:"name"`
+	LDAP     *LDAPConfig     `yaml:"ldap,omitempty"`
+	OIDC     *OIDCConfig     `yaml:"oidc,omitempty"`
+	Htpasswd *HtpasswdConfig `yaml:"htpasswd,omitempty"`
+}
+
+// LDAPConfig configures a LDAP server, users are authenticated by binding with their credentials.
+type LDAPConfig struct {
+	// URL of the server, i.e. ldaps://ldap.example.com or ldap://ldap.example.com:389.
+	URL string `yaml:"url"`
+	// StartTLS upgrades a ldap:// connection to TLS before binding.
+	StartTLS bool `yaml:"startTLS"`
+	// BindDN is the DN template of the users, %s is replaced with the username.
+	BindDN string `yaml:"bindDN"`
+	// Attributes maps the LDAP attributes to the user information.
+	Attributes LDAPAttributes `yaml:"attributes"`
+}
+
+// LDAPAttributes maps LDAP attributes to the user information. Empty attributes are not read.
+type LDAPAttributes struct {
+	// UUID is appended to the username to build the uuid of the user. The username is the uuid if it is empty.
+	UUID       string   `yaml:"uuid"`
+	LegiNumber string   `yaml:"legiNumber"`
+	Email      string   `yaml:"email"`
+	Gender     string   `yaml:"gender"`
+	RealName   []string `yaml:"realName"`
+}
+
+// OIDCConfig configures an OpenID Connect provider, users are authenticated with the device authorization flow.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, the endpoints are discovered from it.
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+	// UUIDClaim is the userinfo claim used as uuid of the user. Defaults to "sub".
+	UUIDClaim string `yaml:"uuidClaim"`
+	// UsernameClaim is the userinfo claim used as username. Defaults to "preferred_username".
+	UsernameClaim string `yaml:"usernameClaim"`
+}
+
+// HtpasswdConfig configures a local htpasswd file with bcrypt hashed passwords.
+type HtpasswdConfig struct {
+	Path string `yaml:"path"`
+}
+
+// MFAConfig configures time-based one-time passwords (TOTP) as second factor.
+type MFAConfig struct {
+	// Issuer is shown in the authenticator app of the user.
+	Issuer string `yaml:"issuer"`
+	// Default is the policy of courses without an entry in Courses.
+	Default MFAPolicy `yaml:"default"`
+	// Courses maps the course (the ssh user name) to its policy.
+	Courses map[string]MFAPolicy `yaml:"courses"`
+}
+
+// MFAPolicy decides for which authentication methods a second factor is required.
+type MFAPolicy struct {
+	// Password applies to password and keyboard-interactive logins of the authentication backends.
+	Password  bool `yaml:"password"`
+	PublicKey bool `yaml:"publicKey"`
+}
+
+// Policy returns the policy of the course.
+func (m *MFAConfig) Policy(course string) MFAPolicy {
+	if policy, ok := m.Courses[course]; ok {
+		return policy
+	}
+	return m.Default
+}
+
+// RateLimitConfig configures the limits of the ssh server. The state is shared by all replicas through the store.
+// Negative values disable a limit.
+type RateLimitConfig struct {
+	// Window is the interval in which HandshakesPerIP are allowed.
+	Window time.Duration `yaml:"window"`
+	// HandshakesPerIP is the number of ssh handshakes per source IP within Window.
+	HandshakesPerIP int `yaml:"handshakesPerIP"`
+	// MaxFailuresPerUser is the number of failed logins of a username before it is locked.
+	MaxFailuresPerUser int `yaml:"maxFailuresPerUser"`
+	// MaxFailuresPerIP is the number of failed logins from a source IP before it is locked.
+	MaxFailuresPerIP int `yaml:"maxFailuresPerIP"`
+	// Lockout is the duration of the first lockout, it doubles with every further failure.
+	Lockout time.Duration `yaml:"lockout"`
+	// MaxLockout caps the lockout duration. Failures are forgotten after MaxLockout without failures.
+	MaxLockout time.Duration `yaml:"maxLockout"`
+	// MaxConnections is the number of concurrent connections handled by a replica.
+	MaxConnections int `yaml:"maxConnections"`
+	// MaxSessionsPerUser is the number of concurrent connections of a user across all replicas.
+	MaxSessionsPerUser int `yaml:"maxSessionsPerUser"`
+}
+
+// RecordingConfig configures the recording of interactive shells in the asciicast v2 format.
+type RecordingConfig struct {
+	// Directory is the directory, usually on a persistent volume, in which the recordings are stored.
+	Directory string `yaml:"directory"`
+	// Default is the policy of challenges without an entry in Challenges.
+	Default RecordingPolicy `yaml:"default"`
+	// Challenges maps the challenge (the ssh user name) to its policy.
+	Challenges map[string]RecordingPolicy `yaml:"challenges"`
+}
+
+// RecordingPolicy decides whether and how long shells are recorded.
+type RecordingPolicy struct {
+	Enabled bool `yaml:"enabled"`
+	// RecordInput records the keystrokes of the user as well, this includes passwords typed without echo.
+	RecordInput bool `yaml:"recordInput"`
+	// Retention is the duration after which recordings are deleted, recordings are kept forever if it is zero.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Policy returns the policy of the challenge.
+func (r *RecordingConfig) Policy(challenge string) RecordingPolicy {
+	if policy, ok := r.Challenges[challenge]; ok {
+		return policy
+	}
+	return r.Default
+}
+
+// AuditSinkNone disables the audit log.
+const AuditSinkNone = "none"
+
+// AuditConfig configures the audit log of authentications, sessions and channels.
+type AuditConfig struct {
+	// Sink is "stdout", "stderr", the path of a file the events are appended to, or "none" to disable the audit log.
+	Sink string `yaml:"sink"`
+}
+
+// DrainConfig configures how open sessions are handled when the server is stopped, i.e. during a rolling update.
+// New connections are refused immediately, open sessions are notified and closed after GracePeriod.
+type DrainConfig struct {
+	// GracePeriod is the duration open sessions are kept. It must be shorter than the terminationGracePeriodSeconds of the pod.
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	// Message is sent to all open sessions, the time at which the sessions are closed is appended.
+	Message string `yaml:"message"`
+}
+
+// setDefaults replaces zero values with the defaults.
+func (d *DrainConfig) setDefaults() {
+	setDefault(&d.GracePeriod, config.SSHDrainGracePeriod)
+	setDefault(&d.Message, "The ssh server is restarting, please save your work and reconnect.")
+}
+
+// setDefaults replaces zero values with the defaults.
+func (a *AuditConfig) setDefaults() {
+	setDefault(&a.Sink, "stdout")
+}
+
+// setDefaults replaces zero values with the defaults.
+func (k *KeepAliveConfig) setDefaults() {
+	setDefault(&k.Interval, 10*time.Second)
+	setDefault(&k.MaxRetries, 3)
+}
+
+// setDefaults replaces zero values with the defaults.
+func (s *SessionConfig) setDefaults() {
+	setDefault(&s.IdleTimeout, -1)
+	setDefault(&s.MaxDuration, -1)
+	setDefault(&s.Warning, time.Minute)
+	setDefault(&s.MaxSessions, 10)
+}
+
+// setDefaults replaces zero values with the defaults.
+func (r *RateLimitConfig) setDefaults() {
+	setDefault(&r.Window, time.Minute)
+	setDefault(&r.HandshakesPerIP, 60)
+	setDefault(&r.MaxFailuresPerUser, 5)
+	setDefault(&r.MaxFailuresPerIP, 30)
+	setDefault(&r.Lockout, 30*time.Second)
+	setDefault(&r.MaxLockout, time.Hour)
+	setDefault(&r.MaxConnections, 1000)
+	setDefault(&r.MaxSessionsPerUser, 10)
+}
+
+func setDefault[T comparable](value *T, defaultValue T) {
+	var zero T
+	if *value == zero {
+		*value = defaultValue
+	}
+}
+
+// setDefaults replaces zero values with the defaults.
+func (c *Config) setDefaults() {
+	if len(c.Listen) == 0 {
+		c.Listen = []string{fmt.Sprintf("%s:%d", config.DefaultIP, config.SSHPort)}
+	}
+	setDefault(&c.Banner, DefaultBanner)
+	if len(c.ChannelTypes) == 0 {
+		c.ChannelTypes = []string{ChannelSession, ChannelDirectTCPIP}
+	}
+	if c.Subsystems == nil {
+		c.Subsystems = map[string]string{SubsystemSFTP: SubsystemSFTP}
+	}
+	setDefault(&c.SFTP.Quota, config.SFTPQuota)
+	for i := range c.Authentication {
+		setDefault(&c.Authentication[i].Name, c.Authentication[i].Type)
+	}
+	c.KeepAlive.setDefaults()
+	c.Session.setDefaults()
+	c.RateLimit.setDefaults()
+	c.Audit.setDefaults()
+	c.Drain.setDefaults()
+	setDefault(&c.Store.Backend, store.BackendEtcd)
+}
+
+// SSHConfig returns the algorithms of the configuration, the defaults of golang.org/x/crypto/ssh are used for empty lists.
+func (c *Config) SSHConfig() ssh.Config {
+	return ssh.Config{
+		Ciphers:      c.Algorithms.Ciphers,
+		KeyExchanges: c.Algorithms.KeyExchanges,
+		MACs:         c.Algorithms.MACs,
+	}
+}
+
+// RenderBanner renders the banner template.
+func (c *Config) RenderBanner(data BannerData) (string, error) {
+	return render("banner", c.Banner, data)
+}
+
+// RenderMOTD renders the MOTD template.
+func (c *Config) RenderMOTD(data MOTDData) (string, error) {
+	return render("motd", c.MOTD, data)
+}
+
+func render(name, text string, data any) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Default returns the configuration used if no configuration is provided.
+func Default() *Config {
+	conf := &Config{
+		Authentication: []AuthenticationBackend{
+			{
+				Type: BackendLDAP,
+				LDAP: &LDAPConfig{
+					URL:    "ldaps://ldaps-rz-1.ethz.ch",
+					BindDN: "cn=%s,ou=users,ou=nethz,ou=id,ou=auth,o=ethz,c=ch",
+					// https://help.switch.ch/aai/support/documents/attributes/
+					Attributes: LDAPAttributes{
+						UUID:       "swissEduPersonMatriculationNumber",
+						LegiNumber: "swissEduPersonMatriculationNumber",
+						Email:      "swissEduPersonOrganizationalMail",
+						Gender:     "swissEduPersonGender",
+						RealName:   []string{"givenName", "surname"},
+					},
+				},
+			},
+		},
+	}
+	conf.setDefaults()
+	return conf
+}
+
+// Load parses and validates a YAML configuration. Unknown fields are rejected.
+func Load(data []byte) (*Config, error) {
+	var conf Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing ssh server configuration: %w", err)
+	}
+	conf.setDefaults()
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// LoadFile reads, parses and validates a YAML configuration file.
+func LoadFile(fileHandler file.Handler, path string) (*Config, error) {
+	data, err := fileHandler.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return Load(data)
+}
+
+// Validate checks that the configuration is complete.
+func (c *Config) Validate() error {
+	var errs []error
+	backendNames := make(map[string]bool)
+	for i, backend := range c.Authentication {
+		if err := backend.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("authentication backend %d: %w", i, err))
+		}
+		if backendNames[backend.Name] {
+			errs = append(errs, fmt.Errorf("authentication backend %d: name %s is used twice", i, backend.Name))
+		}
+		backendNames[backend.Name] = true
+	}
+	if c.MFA != nil && c.Encryption == nil {
+		errs = append(errs, errors.New("mfa: the encryption section is required to encrypt the totp secrets"))
+	}
+	for _, address := range c.Listen {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Errorf("listen: %w", err))
+		}
+	}
+	errs = append(errs,
+		validateNames("algorithms: cipher", c.Algorithms.Ciphers, supportedCiphers),
+		validateNames("algorithms: key exchange", c.Algorithms.KeyExchanges, supportedKeyExchanges),
+		validateNames("algorithms: mac", c.Algorithms.MACs, supportedMACs),
+		validateNames("channel type", c.ChannelTypes, []string{ChannelSession, ChannelDirectTCPIP}),
+	)
+	for name, implementation := range c.Subsystems {
+		if implementation != SubsystemSFTP {
+			errs = append(errs, fmt.Errorf("subsystem %s: unknown implementation %q", name, implementation))
+		}
+	}
+	for challenge, services := range c.Forwarding.Services {
+		names := make(map[string]bool)
+		for _, service := range services {
+			if service.Name == "" {
+				errs = append(errs, fmt.Errorf("forwarding: service of challenge %s without name", challenge))
+			}
+			if names[service.Name] {
+				errs = append(errs, fmt.Errorf("forwarding: service %s of challenge %s is defined twice", service.Name, challenge))
+			}
+			names[service.Name] = true
+			for _, port := range service.Ports {
+				if port == 0 || port > 65535 {
+					errs = append(errs, fmt.Errorf("forwarding: service %s of challenge %s: invalid port %d", service.Name, challenge, port))
+				}
+			}
+		}
+	}
+	if c.KeepAlive.Interval < 0 {
+		errs = append(errs, errors.New("keepAlive: interval must not be negative"))
+	}
+	if _, err := template.New("banner").Parse(c.Banner); err != nil {
+		errs = append(errs, fmt.Errorf("banner: %w", err))
+	}
+	if _, err := template.New("motd").Parse(c.MOTD); err != nil {
+		errs = append(errs, fmt.Errorf("motd: %w", err))
+	}
+	if c.Drain.GracePeriod < 0 {
+		errs = append(errs, errors.New("drain: gracePeriod must not be negative"))
+	}
+	if c.Recording != nil && c.Recording.Directory == "" {
+		errs = append(errs, errors.New("recording: directory is required"))
+	}
+	errs = append(errs, c.Store.Validate())
+	if c.Encryption != nil {
+		errs = append(errs, c.Encryption.Validate())
+	}
+	if c.Backup != nil {
+		errs = append(errs, c.Backup.Validate())
+	}
+	return errors.Join(errs...)
+}
+
+// validateNames checks that all names are supported.
+func validateNames(kind string, names, supported []string) error {
+	var errs []error
+	for _, name := range names {
+		if !slices.Contains(supported, name) {
+			errs = append(errs, fmt.Errorf("%s %q is not supported", kind, name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *AuthenticationBackend) validate() error {
+	if !backendNameRegexp.MatchString(b.Name) || b.Name == reservedBackendName {
+		return fmt.Errorf("invalid name %q, use lower case letters and digits other than %s", b.Name, reservedBackendName)
+	}
+	switch b.Type {
+	case BackendLDAP:
+		if b.LDAP == nil {
+			return errors.New("ldap section missing")
+		}
+		if b.LDAP.URL == "" || b.LDAP.BindDN == "" {
+			return errors.New("ldap url and bindDN are required")
+		}
+	case BackendOIDC:
+		if b.OIDC == nil {
+			return errors.New("oidc section missing")
+		}
+		if b.OIDC.Issuer == "" || b.OIDC.ClientID == "" {
+			return errors.New("oidc issuer and clientID are required")
+		}
+	case BackendHtpasswd:
+		if b.Htpasswd == nil || b.Htpasswd.Path == "" {
+			return errors.New("htpasswd path is required")
+		}
+	default:
+		return fmt.Errorf("unknown backend type %q", b.Type)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package serverconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/internal/config"
+	"github.com/benschlueter/delegatio/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	testCases := map[string]struct {
+		data          string
+		expectErr     bool
+		expectBackend []string
+	}{
+		"all backends": {
+			data: `
+authentication:
+  - type: htpasswd
+    htpasswd:
+      path: /etc/delegatio/htpasswd
+  - type: ldap
+    ldap:
+      url: ldap://ldap.example.com
+      startTLS: true
+      bindDN: uid=%s,ou=people,dc=example,dc=com
+      attributes:
+        email: mail
+        realName: [cn]
+  - type: oidc
+    oidc:
+      issuer: https://id.example.com
+      clientID: delegatio
+`,
+			expectBackend: []string{BackendHtpasswd, BackendLDAP, BackendOIDC},
+		},
+		"mfa": {
+			data: `
+encryption:
+  file: /etc/delegatio/keyring.yaml
+mfa:
+  default:
+    password: true
+  courses:
+    exam:
+      password: true
+      publicKey: true
+`,
+		},
+		"backend names": {
+			data: `
+authentication:
+  - type: htpasswd
+    name: staff
+    htpasswd:
+      path: /etc/delegatio/staff
+  - type: htpasswd
+    htpasswd:
+      path: /etc/delegatio/students
+`,
+			expectBackend: []string{BackendHtpasswd, BackendHtpasswd},
+		},
+		"backend name used twice": {
+			data:      "authentication:\n  - type: htpasswd\n    htpasswd:\n      path: a\n  - type: htpasswd\n    htpasswd:\n      path: b\n",
+			expectErr: true,
+		},
+		"reserved backend name": {
+			data:      "authentication:\n  - type: htpasswd\n    name: team\n    htpasswd:\n      path: a\n",
+			expectErr: true,
+		},
+		"backend name with dash": {
+			data:      "authentication:\n  - type: htpasswd\n    name: tu-students\n    htpasswd:\n      path: a\n",
+			expectErr: true,
+		},
+		"mfa without encryption": {
+			data:      "mfa:\n  default:\n    password: true\n",
+			expectErr: true,
+		},
+		"empty configuration": {
+			data: "",
+		},
+		"unknown field": {
+			data:      "authentication:\n  - type: ldap\n    kerberos: {}\n",
+			expectErr: true,
+		},
+		"unknown type": {
+			data:      "authentication:\n  - type: kerberos\n",
+			expectErr: true,
+		},
+		"missing section": {
+			data:      "authentication:\n  - type: oidc\n",
+			expectErr: true,
+		},
+		"incomplete ldap": {
+			data:      "authentication:\n  - type: ldap\n    ldap:\n      url: ldaps://ldap.example.com\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			conf, err := Load([]byte(tc.data))
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(t, err)
+			var backends []string
+			for _, backend := range conf.Authentication {
+				backends = append(backends, backend.Type)
+			}
+			assert.Equal(tc.expectBackend, backends)
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+}
+
+func TestRateLimitDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := Load([]byte("rateLimit:\n  window: 30s\n  maxSessionsPerUser: -1\n"))
+	require.NoError(t, err)
+	assert.Equal(30*time.Second, conf.RateLimit.Window)
+	assert.Equal(-1, conf.RateLimit.MaxSessionsPerUser)
+	assert.Equal(5, conf.RateLimit.MaxFailuresPerUser)
+	assert.Equal(Default().RateLimit.MaxConnections, conf.RateLimit.MaxConnections)
+}
+
+func TestAuditDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := Load([]byte(""))
+	require.NoError(t, err)
+	assert.Equal("stdout", conf.Audit.Sink)
+	assert.Equal("stdout", Default().Audit.Sink)
+
+	conf, err = Load([]byte("audit:\n  sink: /var/log/delegatio/audit.log\n"))
+	require.NoError(t, err)
+	assert.Equal("/var/log/delegatio/audit.log", conf.Audit.Sink)
+}
+
+func TestDrainDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := Load([]byte("drain:\n  gracePeriod: 1m\n"))
+	require.NoError(t, err)
+	assert.Equal(time.Minute, conf.Drain.GracePeriod)
+	assert.Equal(Default().Drain.Message, conf.Drain.Message)
+	assert.NotEmpty(conf.Drain.Message)
+
+	_, err = Load([]byte("drain:\n  gracePeriod: -1m\n"))
+	assert.Error(err)
+}
+
+func TestServerSettings(t *testing.T) {
+	testCases := map[string]struct {
+		data      string
+		expectErr bool
+	}{
+		"defaults": {
+			data: "",
+		},
+		"all settings": {
+			data: `
+listen: ["0.0.0.0:2200", "[::]:2200"]
+hostKeys: [/etc/delegatio/ssh_host_ed25519_key, /etc/delegatio/ssh_host_rsa_key]
+algorithms:
+  ciphers: [chacha20-poly1305@openssh.com, aes256-gcm@openssh.com]
+  keyExchanges: [curve25519-sha256]
+  macs: [hmac-sha2-256-etm@openssh.com]
+keepAlive:
+  interval: 30s
+  maxRetries: 5
+session:
+  idleTimeout: 1h
+  maxSessions: 4
+banner: "welcome {{.User}}\n"
+motd: "challenge {{.Challenge}}\n"
+channelTypes: [session]
+subsystems:
+  sftp: sftp
+  sftp-server: sftp
+sftp:
+  quota: 536870912
+forwarding:
+  services:
+    exam:
+      - name: target
+        address: target.exam.svc.cluster.local
+        ports: [80, 443]
+      - name: db
+store:
+  backend: bolt
+  path: /var/lib/delegatio/store.db
+encryption:
+  secret: ssh-keyring
+backup:
+  interval: 6h
+  directory: /backups
+  retention:
+    keep: 28
+    maxAge: 720h
+`,
+		},
+		"unsupported cipher": {
+			data:      "algorithms:\n  ciphers: [rot13]\n",
+			expectErr: true,
+		},
+		"unsupported channel type": {
+			data:      "channelTypes: [x11]\n",
+			expectErr: true,
+		},
+		"unknown subsystem implementation": {
+			data:      "subsystems:\n  netconf: netconf\n",
+			expectErr: true,
+		},
+		"forwarding service without name": {
+			data:      "forwarding:\n  services:\n    exam:\n      - address: target\n",
+			expectErr: true,
+		},
+		"forwarding service defined twice": {
+			data:      "forwarding:\n  services:\n    exam:\n      - name: target\n      - name: target\n",
+			expectErr: true,
+		},
+		"invalid forwarding port": {
+			data:      "forwarding:\n  services:\n    exam:\n      - name: target\n        ports: [70000]\n",
+			expectErr: true,
+		},
+		"unknown store backend": {
+			data:      "store:\n  backend: redis\n",
+			expectErr: true,
+		},
+		"bolt store without path": {
+			data:      "store:\n  backend: bolt\n",
+			expectErr: true,
+		},
+		"encryption with file and secret": {
+			data:      "encryption:\n  file: /etc/delegatio/keyring.yaml\n  secret: ssh-keyring\n",
+			expectErr: true,
+		},
+		"encryption without source": {
+			data:      "encryption: {}\n",
+			expectErr: true,
+		},
+		"backup without destination": {
+			data:      "backup:\n  interval: 1h\n",
+			expectErr: true,
+		},
+		"backup with directory and s3": {
+			data:      "backup:\n  directory: /backups\n  s3:\n    endpoint: https://s3.example.com\n    bucket: backups\n    accessKeyID: id\n    secretAccessKeyFile: /secret\n",
+			expectErr: true,
+		},
+		"invalid listen address": {
+			data:      "listen: [localhost]\n",
+			expectErr: true,
+		},
+		"invalid banner": {
+			data:      "banner: \"{{.User\"\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load([]byte(tc.data))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestServerDefaults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conf, err := Load([]byte("keepAlive:\n  maxRetries: 5\n"))
+	require.NoError(err)
+	assert.Equal([]string{"0.0.0.0:2200"}, conf.Listen)
+	assert.Equal(10*time.Second, conf.KeepAlive.Interval)
+	assert.Equal(5, conf.KeepAlive.MaxRetries)
+	assert.Equal(10, conf.Session.MaxSessions)
+	assert.Negative(conf.Session.IdleTimeout)
+	assert.Equal([]string{ChannelSession, ChannelDirectTCPIP}, conf.ChannelTypes)
+	assert.Equal(map[string]string{SubsystemSFTP: SubsystemSFTP}, conf.Subsystems)
+	assert.Equal(int64(config.SFTPQuota), conf.SFTP.Quota)
+	assert.Equal(store.BackendEtcd, conf.Store.Backend)
+
+	banner, err := conf.RenderBanner(BannerData{Version: "0.0.1", Commit: "abc", SessionID: "c2Vzc2lvbg=="})
+	require.NoError(err)
+	assert.Equal("delegatio ssh server version 0.0.1\ncommit abc\nsession ID c2Vzc2lvbg==\n", banner)
+	motd, err := conf.RenderMOTD(MOTDData{Challenge: "exam"})
+	require.NoError(err)
+	assert.Empty(motd)
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conf, err := Load([]byte(`
+session:
+  idleTimeout: 1h
+  challenges:
+    exam:
+      maxDuration: 2h
+    lab:
+      idleTimeout: -1s
+`))
+	require.NoError(err)
+	assert.Equal(time.Minute, conf.Session.Warning)
+	assert.Equal(SessionTimeouts{IdleTimeout: time.Hour, MaxDuration: 2 * time.Hour}, conf.Session.Timeouts("exam"))
+	assert.Equal(SessionTimeouts{IdleTimeout: -time.Second, MaxDuration: -1}, conf.Session.Timeouts("lab"))
+	assert.Equal(SessionTimeouts{IdleTimeout: time.Hour, MaxDuration: -1}, conf.Session.Timeouts("other"))
+}